@@ -1,6 +1,7 @@
 
-import { useState } from "react";
+import { useState, useEffect } from "react";
 import { Music } from "lucide-react";
+import { signedURL } from "@/lib/api";
 
 interface AlbumArtProps {
   trackId: string;
@@ -10,6 +11,21 @@ interface AlbumArtProps {
 export const AlbumArt = ({ trackId, size = "md" }: AlbumArtProps) => {
   const [imageError, setImageError] = useState(false);
   const [imageLoading, setImageLoading] = useState(true);
+  const [src, setSrc] = useState<string | null>(null);
+
+  // The image element cannot send credentials, so it loads the cover from a signed URL
+  useEffect(() => {
+    let cancelled = false;
+    setSrc(null);
+    setImageError(false);
+    setImageLoading(true);
+    signedURL(`/cover/${trackId}`).then((url) => {
+      if (!cancelled) setSrc(url);
+    });
+    return () => {
+      cancelled = true;
+    };
+  }, [trackId]);
 
   const sizeClasses = {
     sm: "w-12 h-12",
@@ -32,20 +48,24 @@ export const AlbumArt = ({ trackId, size = "md" }: AlbumArtProps) => {
     setImageLoading(false);
   };
 
-  if (imageError || imageLoading) {
-    return (
-      <div className={`${sizeClasses[size]} bg-gradient-to-br from-purple-600 to-pink-600 rounded-lg flex items-center justify-center`}>
-        <Music className="text-white/80" size={iconSizes[size]} />
-      </div>
-    );
+  const placeholder = (
+    <div className={`${sizeClasses[size]} bg-gradient-to-br from-purple-600 to-pink-600 rounded-lg flex items-center justify-center`}>
+      <Music className="text-white/80" size={iconSizes[size]} />
+    </div>
+  );
+
+  if (imageError || !src) {
+    return placeholder;
   }
 
+  // The image stays hidden behind the placeholder until it has loaded
   return (
     <div className={`${sizeClasses[size]} rounded-lg overflow-hidden`}>
+      {imageLoading && placeholder}
       <img
-        src={`http://localhost:8080/cover/${trackId}`}
+        src={src}
         alt="Album artwork"
-        className="w-full h-full object-cover"
+        className={imageLoading ? "hidden" : "w-full h-full object-cover"}
         onLoad={handleImageLoad}
         onError={handleImageError}
       />
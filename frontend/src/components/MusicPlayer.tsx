@@ -6,6 +6,7 @@ import { Howl } from "howler";
 import { LyricsDisplay } from "./LyricsDisplay";
 import { AlbumArt } from "./AlbumArt";
 import { ProgressBar } from "./ProgressBar";
+import { signedURL } from "@/lib/api";
 
 interface MusicPlayerProps {
   track: Track;
@@ -26,37 +27,44 @@ export const MusicPlayer = ({ track, tracks, onTrackChange }: MusicPlayerProps)
 
   // Initialize audio when track changes
   useEffect(() => {
+    let cancelled = false;
     if (howlRef.current) {
       howlRef.current.unload();
+      howlRef.current = null;
     }
 
-    const sound = new Howl({
-      src: [`http://localhost:8080/stream/${track.id}`],
-      html5: true,
-      volume: isMuted ? 0 : volume,
-      onload: () => {
-        setDuration(sound.duration());
-      },
-      onplay: () => {
-        setIsPlaying(true);
-        startProgressUpdate();
-      },
-      onpause: () => {
-        setIsPlaying(false);
-        stopProgressUpdate();
-      },
-      onend: () => {
-        handleNext();
-      },
+    // The audio element cannot send credentials, so it streams from a signed URL
+    signedURL(`/stream/${track.id}`).then((src) => {
+      if (cancelled) return;
+      const sound = new Howl({
+        src: [src],
+        html5: true,
+        volume: isMuted ? 0 : volume,
+        onload: () => {
+          setDuration(sound.duration());
+        },
+        onplay: () => {
+          setIsPlaying(true);
+          startProgressUpdate();
+        },
+        onpause: () => {
+          setIsPlaying(false);
+          stopProgressUpdate();
+        },
+        onend: () => {
+          handleNext();
+        },
+      });
+      howlRef.current = sound;
     });
 
-    howlRef.current = sound;
     setCurrentTime(0);
     
     // Fetch lyrics
     fetchLyrics();
 
     return () => {
+      cancelled = true;
       if (howlRef.current) {
         howlRef.current.unload();
       }
@@ -68,7 +76,7 @@ export const MusicPlayer = ({ track, tracks, onTrackChange }: MusicPlayerProps)
     try {
       // Using LRCLib.net API for lyrics
       const response = await fetch(
-        `https://lrclib.net/api/search?artist_name=${encodeURIComponent(track.artist_id)}&track_name=${encodeURIComponent(track.title)}`
+        `https://lrclib.net/api/search?artist_name=${encodeURIComponent(track.artist_name)}&track_name=${encodeURIComponent(track.title)}`
       );
       
       if (response.ok) {
@@ -190,7 +198,7 @@ export const MusicPlayer = ({ track, tracks, onTrackChange }: MusicPlayerProps)
             <AlbumArt trackId={track.id} size="sm" />
             <div className="min-w-0">
               <h3 className="text-white font-medium truncate">{track.title}</h3>
-              <p className="text-gray-400 text-sm truncate">{track.artist_id}</p>
+              <p className="text-gray-400 text-sm truncate">{track.artist_name}</p>
             </div>
             {lyrics && (
               <button
@@ -42,7 +42,7 @@ export const Sidebar = ({ tracks, onTrackSelect }: SidebarProps) => {
           {albums.map((albumId) => (
             <div key={albumId} className="space-y-1">
               <h3 className="text-white font-medium text-sm px-2 py-1 bg-white/5 rounded">
-                {albumId}
+                {albumGroups[albumId][0].album_title}
               </h3>
               <div className="space-y-1 pl-2">
                 {albumGroups[albumId].map((track) => (
@@ -55,7 +55,7 @@ export const Sidebar = ({ tracks, onTrackSelect }: SidebarProps) => {
                       {track.title}
                     </div>
                     <div className="text-gray-500 text-xs truncate">
-                      {track.artist_id}
+                      {track.artist_name}
                     </div>
                   </button>
                 ))}
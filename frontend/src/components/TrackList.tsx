@@ -62,10 +62,10 @@ export const TrackList = ({ tracks, onTrackSelect, currentTrack, searchQuery }:
                   {highlightText(track.title, searchQuery)}
                 </h3>
                 <p className="text-gray-400 text-sm truncate">
-                  {highlightText(track.artist_id, searchQuery)}
+                  {highlightText(track.artist_name, searchQuery)}
                 </p>
                 <p className="text-gray-500 text-xs truncate">
-                  {track.album_id}
+                  {track.album_title}
                 </p>
               </div>
               
@@ -0,0 +1,26 @@
+// Base URL of the HeavyMetal hosting server
+export const API_URL = "http://localhost:8080";
+
+// The API key or session token saved in the browser, if any. Without one the server
+// must run with MUSIC_AUTH=off.
+export const authHeaders = (): Record<string, string> => {
+  const token = localStorage.getItem("heavymetal_token");
+  return token ? { Authorization: `Bearer ${token}` } : {};
+};
+
+// Audio and image elements cannot send credentials, so they load URLs signed by
+// /auth/sign. Falls back to the unsigned URL, which works when the server is open.
+export const signedURL = async (path: string): Promise<string> => {
+  try {
+    const response = await fetch(`${API_URL}/auth/sign?path=${encodeURIComponent(path)}`, {
+      headers: authHeaders(),
+    });
+    if (response.ok) {
+      const { url } = await response.json();
+      return `${API_URL}${url}`;
+    }
+  } catch (error) {
+    console.error(`Failed to sign ${path}:`, error);
+  }
+  return `${API_URL}${path}`;
+};
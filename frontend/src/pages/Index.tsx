@@ -17,12 +17,20 @@ const Index = () => {
   useEffect(() => {
     const fetchTracks = async () => {
       try {
-        const response = await fetch("http://localhost:8080/tracks/all");
-        if (response.ok) {
-          const data = await response.json();
-          setTracks(data);
-          setSearchResults(data);
+        // The listing is paginated; keep fetching pages until we have them all
+        const pageSize = 500;
+        const all: Track[] = [];
+        let total = Infinity;
+        while (all.length < total) {
+          const response = await fetch(`http://localhost:8080/tracks/all?limit=${pageSize}&offset=${all.length}`);
+          if (!response.ok) break;
+          const page: Track[] = await response.json();
+          total = Number(response.headers.get("X-Total-Count") ?? all.length + page.length);
+          all.push(...page);
+          if (page.length < pageSize) break;
         }
+        setTracks(all);
+        setSearchResults(all);
       } catch (error) {
         console.error("Failed to fetch tracks:", error);
       } finally {
@@ -45,10 +53,13 @@ const Index = () => {
     }
 
     try {
-      const response = await fetch(`http://localhost:8080/search/${encodeURIComponent(query)}`);
+      // Typo-tolerant search, ordered by score; 404 means nothing matched
+      const response = await fetch(`http://localhost:8080/search/track/${encodeURIComponent(query)}`);
       if (response.ok) {
         const data = await response.json();
         setSearchResults(data);
+      } else if (response.status === 404) {
+        setSearchResults([]);
       }
     } catch (error) {
       console.error("Search failed:", error);
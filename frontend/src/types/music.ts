@@ -4,7 +4,10 @@ export interface Track {
   title: string;
   artist_id: string;
   album_id: string;
+  artist_name: string;
+  album_title: string;
   file_path: string;
+  score?: number; // Set on fuzzy search results, 1 for an exact match
 }
 
 export interface LyricLine {
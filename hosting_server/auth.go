@@ -0,0 +1,219 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"unicode"
+
+	"heavymetal/library"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Users log in with a name and password kept, bcrypt-hashed, in the users table, or
+// with the tokens of tokens.go. Admins manage users through /admin; regular users only
+// listen. With MUSIC_AUTH=off the music endpoints are open to anyone, for local
+// development, but /admin still requires an admin.
+
+// userKey is the context key of the library.User a request is authenticated as.
+const userKey = "user"
+
+// Password length limits. bcrypt ignores anything past 72 bytes.
+const (
+	minPasswordLength = 8
+	maxPasswordLength = 72
+)
+
+// guestName is the name plays are recorded under for anonymous requests in open mode.
+// No user can take it, so that nobody is mistaken for anonymous listeners.
+const guestName = "guest"
+
+// validateUserName rejects names that cannot be sent with Basic auth, would be
+// confusing to show, or are reserved.
+func validateUserName(name string) error {
+	switch {
+	case name == "" || len(name) > 64:
+		return errors.New("name must be 1 to 64 characters")
+	case strings.EqualFold(name, guestName):
+		return errors.New("name " + guestName + " is reserved for anonymous listeners")
+	case strings.ContainsRune(name, ':'):
+		return errors.New("name must not contain ':'")
+	case strings.IndexFunc(name, func(r rune) bool { return unicode.IsSpace(r) || unicode.IsControl(r) }) >= 0:
+		return errors.New("name must not contain spaces")
+	}
+	return nil
+}
+
+// hashPassword checks the length of a new password and hashes it.
+func hashPassword(password string) (string, error) {
+	if len(password) < minPasswordLength || len(password) > maxPasswordLength {
+		return "", fmt.Errorf("password must be %d to %d bytes", minPasswordLength, maxPasswordLength)
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", fmt.Errorf("failed to hash password: %w", err)
+	}
+	return string(hash), nil
+}
+
+// verifiedPasswords remembers the SHA-256 of the password last verified for each user,
+// with the hash it matched, so that clients sending credentials with every request do
+// not pay for bcrypt each time. Changing the password changes the hash, which forgets
+// the entry.
+var verifiedPasswords = struct {
+	sync.Mutex
+	m map[int]verifiedPassword
+}{m: map[int]verifiedPassword{}}
+
+type verifiedPassword struct {
+	hash string
+	sum  [sha256.Size]byte
+}
+
+// dummyHash is compared against for unknown users, so that they take as long to refuse
+// as wrong passwords.
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("not a password"), bcrypt.DefaultCost)
+
+// checkLogin returns the user with a name and password, and false if there is no such
+// user, the password is wrong, or the user is disabled.
+func checkLogin(name, password string) (library.User, bool, error) {
+	user, err := repo.UserByName(name)
+	if errors.Is(err, library.ErrNotFound) {
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return user, false, nil
+	}
+	if err != nil {
+		return user, false, err
+	}
+
+	sum := sha256.Sum256([]byte(password))
+	verifiedPasswords.Lock()
+	v, cached := verifiedPasswords.m[user.ID]
+	verifiedPasswords.Unlock()
+	if !cached || v.hash != user.PasswordHash || subtle.ConstantTimeCompare(v.sum[:], sum[:]) != 1 {
+		if bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)) != nil {
+			return user, false, nil
+		}
+		verifiedPasswords.Lock()
+		verifiedPasswords.m[user.ID] = verifiedPassword{user.PasswordHash, sum}
+		verifiedPasswords.Unlock()
+	}
+	return user, !user.Disabled, nil
+}
+
+// authenticate authenticates requests with a bearer token or Basic auth against the
+// users table, or lets them through if they carry a valid signed URL, answering 401
+// otherwise. With optional set, as in open mode, requests without credentials go
+// through anonymously.
+func authenticate(optional bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var (
+			user  library.User
+			valid bool
+			err   error
+		)
+		header := c.GetHeader("Authorization")
+		if bearer, found := strings.CutPrefix(header, "Bearer "); found {
+			var token library.Token
+			if token, user, valid, err = checkToken(bearer); valid {
+				c.Set(tokenKey, token)
+			}
+		} else if name, password, ok := c.Request.BasicAuth(); ok {
+			user, valid, err = checkLogin(name, password)
+		} else if c.Query("sig") != "" && validSignature(c) || optional {
+			c.Next()
+			return
+		}
+		if err != nil {
+			log.Printf("Query error: %v", err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+			return
+		}
+		if !valid {
+			if header == "" {
+				c.Header("WWW-Authenticate", `Basic realm="heavymetal"`)
+			}
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "authentication required"})
+			return
+		}
+		c.Set(userKey, user)
+		c.Next()
+	}
+}
+
+// requireAdmin answers 403 unless authenticate authenticated an admin.
+func requireAdmin(c *gin.Context) {
+	if user, ok := currentUser(c); !ok || user.Role != library.UserRoleAdmin {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "admin role required"})
+		return
+	}
+	c.Next()
+}
+
+// currentUser returns the user a request is authenticated as, and false for anonymous
+// requests in open mode.
+func currentUser(c *gin.Context) (library.User, bool) {
+	v, ok := c.Get(userKey)
+	if !ok {
+		return library.User{}, false
+	}
+	user, ok := v.(library.User)
+	return user, ok
+}
+
+// currentToken returns the token a request is authenticated with, and false for
+// requests authenticated otherwise.
+func currentToken(c *gin.Context) (library.Token, bool) {
+	v, ok := c.Get(tokenKey)
+	if !ok {
+		return library.Token{}, false
+	}
+	token, ok := v.(library.Token)
+	return token, ok
+}
+
+// bootstrapAdmin creates the first admin when there are no users yet, named name and
+// with password password, or with a random password that is logged once.
+func bootstrapAdmin(name, password string) error {
+	n, err := repo.CountUsers()
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return nil
+	}
+	if err := validateUserName(name); err != nil {
+		return fmt.Errorf("invalid MUSIC_USER: %w", err)
+	}
+
+	generated := password == ""
+	if generated {
+		b := make([]byte, 12)
+		if _, err := rand.Read(b); err != nil {
+			return fmt.Errorf("failed to generate password: %w", err)
+		}
+		password = base64.RawURLEncoding.EncodeToString(b)
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return fmt.Errorf("invalid MUSIC_PASS: %w", err)
+	}
+	if _, err := repo.CreateUser(library.User{Name: name, PasswordHash: hash, Role: library.UserRoleAdmin}); err != nil {
+		return err
+	}
+	if generated {
+		log.Printf("Created admin user %q with password %q; change it with PUT /admin/users/{id}/password", name, password)
+	} else {
+		log.Printf("Created admin user %q with the password in MUSIC_PASS", name)
+	}
+	return nil
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"heavymetal/library"
+
+	"github.com/gin-gonic/gin"
+)
+
+// hlsBitrates are the AAC bitrates, in kbit/s, of the variants in an HLS master
+// playlist, lowest first.
+var hlsBitrates = []int{64, 128, 192}
+
+// hlsSegmentSeconds is the length of every HLS segment but the last, as Apple
+// recommends for on-demand audio.
+const hlsSegmentSeconds = 6
+
+// hlsTargetDuration is the EXT-X-TARGETDURATION of media playlists. Indexed lengths are
+// rounded to the nearest second and the last segment runs to the real end of the track,
+// so it can be up to half a second longer than its EXTINF says.
+const hlsTargetDuration = hlsSegmentSeconds + 1
+
+// hlsPlaylistType is the MIME type of HLS playlists.
+const hlsPlaylistType = "application/vnd.apple.mpegurl"
+
+// hlsSegmentCount returns how many segments a track of the given length is cut into.
+func hlsSegmentCount(durationSeconds int) int {
+	return (durationSeconds + hlsSegmentSeconds - 1) / hlsSegmentSeconds
+}
+
+// hlsTrack looks up the track named by the id path parameter for HLS, answering with
+// an error if it is missing, if the server cannot transcode, or if the length of the
+// track is unknown, which HLS playlists need.
+func hlsTrack(c *gin.Context) (library.Track, bool) {
+	if transcoder == nil {
+		c.JSON(http.StatusNotImplemented, gin.H{"error": "transcoding is not available on this server"})
+		return library.Track{}, false
+	}
+	track, err := repo.Track(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "track not found"})
+		return track, false
+	}
+	if track.DurationSeconds <= 0 {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "the length of this track is unknown, so it cannot be streamed with HLS"})
+		return track, false
+	}
+	return track, true
+}
+
+// hlsBitrateParam reads the variant bitrate path parameter, answering 404 if the
+// master playlist does not offer it.
+func hlsBitrateParam(c *gin.Context) (int, bool) {
+	bitrate, err := strconv.Atoi(c.Param("bitrate"))
+	if err == nil {
+		for _, b := range hlsBitrates {
+			if b == bitrate {
+				return bitrate, true
+			}
+		}
+	}
+	c.JSON(http.StatusNotFound, gin.H{"error": "no such variant"})
+	return 0, false
+}
+
+// hlsSignedQuery returns the query to append to the URIs in a playlist: the exp and sig
+// of a request made with a signed URL, which cover every playlist and segment of the
+// track, so that players can fetch them without credentials too, or "" otherwise.
+func hlsSignedQuery(c *gin.Context) string {
+	if c.Query("sig") == "" || !validSignature(c) {
+		return ""
+	}
+	return "?" + url.Values{"exp": {c.Query("exp")}, "sig": {c.Query("sig")}}.Encode()
+}
+
+// @Summary HLS master playlist
+// @Description Lists one variant per bitrate (64, 128 and 192 kbit/s AAC) so that players can adapt to the network. Segments are transcoded when first requested and then cached. Requested with a signed URL of /hls/{id}/, the variant URIs carry its signature.
+// @Produce application/vnd.apple.mpegurl
+// @Param id path string true "Track HumanHash ID"
+// @Success 200 {string} string "Master playlist"
+// @Failure 404 {object} map[string]string
+// @Failure 422 {object} map[string]string
+// @Failure 501 {object} map[string]string
+// @Router /hls/{id}/master.m3u8 [get]
+func hlsMasterPlaylistHandler(c *gin.Context) {
+	if _, ok := hlsTrack(c); !ok {
+		return
+	}
+	query := hlsSignedQuery(c)
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n#EXT-X-VERSION:3\n")
+	for _, bitrate := range hlsBitrates {
+		// BANDWIDTH is the peak bits per second, transport stream overhead included
+		fmt.Fprintf(&b, "#EXT-X-STREAM-INF:BANDWIDTH=%d,AVERAGE-BANDWIDTH=%d,CODECS=\"mp4a.40.2\"\n%d/index.m3u8%s\n",
+			bitrate*1200, bitrate*1100, bitrate, query)
+	}
+	c.Data(http.StatusOK, hlsPlaylistType, []byte(b.String()))
+}
+
+// @Summary HLS media playlist
+// @Description The segments of one variant of a track. The playlist is computed from the track's length; nothing is transcoded until a segment is requested. Requested with a signed URL, the segment URIs carry its signature.
+// @Produce application/vnd.apple.mpegurl
+// @Param id path string true "Track HumanHash ID"
+// @Param bitrate path int true "Variant bitrate in kbit/s, as listed in the master playlist"
+// @Success 200 {string} string "Media playlist"
+// @Failure 404 {object} map[string]string
+// @Failure 422 {object} map[string]string
+// @Failure 501 {object} map[string]string
+// @Router /hls/{id}/{bitrate}/index.m3u8 [get]
+func hlsMediaPlaylistHandler(c *gin.Context) {
+	track, ok := hlsTrack(c)
+	if !ok {
+		return
+	}
+	if _, ok := hlsBitrateParam(c); !ok {
+		return
+	}
+
+	query := hlsSignedQuery(c)
+	var b strings.Builder
+	fmt.Fprintf(&b, "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:%d\n#EXT-X-MEDIA-SEQUENCE:0\n#EXT-X-PLAYLIST-TYPE:VOD\n", hlsTargetDuration)
+	remaining := track.DurationSeconds
+	for n := 0; remaining > 0; n++ {
+		length := min(remaining, hlsSegmentSeconds)
+		fmt.Fprintf(&b, "#EXTINF:%d.000,\n%d.ts%s\n", length, n, query)
+		remaining -= length
+	}
+	b.WriteString("#EXT-X-ENDLIST\n")
+	c.Data(http.StatusOK, hlsPlaylistType, []byte(b.String()))
+}
+
+// @Summary HLS segment
+// @Description One segment of a variant as AAC in an MPEG transport stream, transcoded on first request and served from the transcode cache afterwards.
+// @Produce video/mp2t
+// @Param id path string true "Track HumanHash ID"
+// @Param bitrate path int true "Variant bitrate in kbit/s"
+// @Param segment path string true "Segment number followed by .ts"
+// @Success 200 {file} string
+// @Failure 404 {object} map[string]string
+// @Failure 422 {object} map[string]string
+// @Failure 501 {object} map[string]string
+// @Router /hls/{id}/{bitrate}/{segment} [get]
+func hlsSegmentHandler(c *gin.Context) {
+	if c.Param("segment") == "index.m3u8" {
+		hlsMediaPlaylistHandler(c)
+		return
+	}
+	track, ok := hlsTrack(c)
+	if !ok {
+		return
+	}
+	bitrate, ok := hlsBitrateParam(c)
+	if !ok {
+		return
+	}
+	n, err := strconv.Atoi(strings.TrimSuffix(c.Param("segment"), ".ts"))
+	if err != nil || !strings.HasSuffix(c.Param("segment"), ".ts") || n < 0 || n >= hlsSegmentCount(track.DurationSeconds) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "no such segment"})
+		return
+	}
+
+	fi, err := os.Stat(track.FilePath)
+	if err != nil {
+		log.Printf("Error reading audio file of track %s: %v", track.ID, err)
+		c.JSON(http.StatusNotFound, gin.H{"error": "audio file not found"})
+		return
+	}
+	opts := TranscodeOptions{
+		Format:         hlsSegmentFormat,
+		Bitrate:        bitrate,
+		Offset:         time.Duration(n*hlsSegmentSeconds) * time.Second,
+		Duration:       hlsSegmentSeconds * time.Second,
+		KeepTimestamps: true,
+	}
+	if n == hlsSegmentCount(track.DurationSeconds)-1 {
+		// The indexed length is rounded; let the last segment run to the real end
+		opts.Duration = 0
+	}
+	// The size and mtime make a changed source file miss the cache
+	key := fmt.Sprintf("%s-%x-%x-hls%d-%d.ts", track.ID, fi.Size(), fi.ModTime().UnixNano(), bitrate, n)
+
+	segment, err := hlsSegment(c, track, opts, key)
+	if err != nil {
+		if c.Request.Context().Err() == nil {
+			log.Printf("Error transcoding segment %d of track %s: %v", n, track.ID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "transcoding failed"})
+		}
+		return
+	}
+	defer segment.Close()
+	c.Header("Content-Type", "video/mp2t")
+	c.Header("ETag", `"`+key+`"`)
+	http.ServeContent(c.Writer, c.Request, "", fi.ModTime(), segment)
+}
+
+// hlsSegment returns the transcoded segment stored under key in the transcode cache,
+// producing it first if needed. Without a cache the segment is kept in memory.
+func hlsSegment(c *gin.Context, track library.Track, opts TranscodeOptions, key string) (io.ReadSeekCloser, error) {
+	ctx := c.Request.Context()
+	if transcodes == nil {
+		var buf bytes.Buffer
+		if err := transcoder.Transcode(ctx, track.FilePath, opts, &buf); err != nil {
+			return nil, err
+		}
+		return nopCloser{bytes.NewReader(buf.Bytes())}, nil
+	}
+
+	if cached := transcodes.open(key); cached != nil {
+		return cached, nil
+	}
+	part, err := transcodes.create(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := transcoder.Transcode(ctx, track.FilePath, opts, part); err != nil {
+		transcodes.discard(part)
+		return nil, err
+	}
+	if stored := transcodes.commit(part, key); stored != nil {
+		return stored, nil
+	}
+	return nil, fmt.Errorf("failed to store segment %s in the transcode cache", key)
+}
+
+// nopCloser adds a no-op Close to an io.ReadSeeker.
+type nopCloser struct {
+	io.ReadSeeker
+}
+
+func (nopCloser) Close() error { return nil }
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestHLSMediaPlaylist(t *testing.T) {
+	db := newTestLibrary(t)
+	addTestTrack(t, db, "listed", "song.flac", "flac", testAudio(100)) // 10 seconds long
+	useFakeTranscoder(t, 1<<20)
+
+	w := request(newRouter(true), http.MethodGet, "/hls/listed/128/index.m3u8")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d, want 200", w.Code)
+	}
+	playlist := w.Body.String()
+	// The last segment runs to the real end of the track, which can be almost a second
+	// past its rounded-down length
+	if !strings.Contains(playlist, "#EXT-X-TARGETDURATION:7\n") {
+		t.Errorf("playlist does not allow for the last segment running long:\n%s", playlist)
+	}
+	if !strings.Contains(playlist, "#EXTINF:6.000,\n0.ts\n#EXTINF:4.000,\n1.ts\n#EXT-X-ENDLIST\n") {
+		t.Errorf("playlist segments are wrong:\n%s", playlist)
+	}
+
+	if w = request(newRouter(true), http.MethodGet, "/hls/listed/100/index.m3u8"); w.Code != http.StatusNotFound {
+		t.Errorf("unknown variant: status %d, want 404", w.Code)
+	}
+}
+
+func TestHLSSegmentLargerThanCache(t *testing.T) {
+	db := newTestLibrary(t)
+	data := testAudio(1000) // 10 seconds at the fake transcoder's 100 bytes a second
+	addTestTrack(t, db, "segmented", "song.flac", "flac", data)
+	cache := useFakeTranscoder(t, 100) // Smaller than a 600-byte segment
+
+	r := newRouter(true)
+	for n, want := range [][]byte{data[:600], data[600:]} {
+		w := request(r, http.MethodGet, "/hls/segmented/64/"+strconv.Itoa(n)+".ts")
+		if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), want) {
+			t.Errorf("segment %d: status %d, %d bytes, want 200 with %d", n, w.Code, w.Body.Len(), len(want))
+		}
+	}
+	if names := cachedTranscodes(t, cache); len(names) != 0 {
+		t.Errorf("cache of 100 bytes kept %v", names)
+	}
+	if w := request(r, http.MethodGet, "/hls/segmented/64/2.ts"); w.Code != http.StatusNotFound {
+		t.Errorf("segment past the end: status %d, want 404", w.Code)
+	}
+}
+
+func TestHLSSignedPlaylists(t *testing.T) {
+	db := newTestLibrary(t)
+	useURLSecret(t)
+	newTestUser(t, db, "signer", "account password")
+	data := testAudio(1000)
+	addTestTrack(t, db, "signed", "song.flac", "flac", data)
+	useFakeTranscoder(t, 1<<20)
+	r := newRouter(false)
+
+	master := signURL(t, r, "/hls/signed/")
+	query := master[strings.Index(master, "?"):]
+	if !strings.HasPrefix(master, "/hls/signed/master.m3u8?") {
+		t.Fatalf("signed URL %s is not of the master playlist", master)
+	}
+	w := request(r, http.MethodGet, master)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "\n64/index.m3u8"+query+"\n") {
+		t.Fatalf("master playlist: status %d:\n%s", w.Code, w.Body)
+	}
+	w = request(r, http.MethodGet, "/hls/signed/64/index.m3u8"+query)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "\n1.ts"+query+"\n") {
+		t.Fatalf("media playlist: status %d:\n%s", w.Code, w.Body)
+	}
+	w = request(r, http.MethodGet, "/hls/signed/64/1.ts"+query)
+	if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), data[600:]) {
+		t.Errorf("segment: status %d, %d bytes", w.Code, w.Body.Len())
+	}
+
+	if w = request(r, http.MethodGet, "/hls/other/64/1.ts"+query); w.Code != http.StatusUnauthorized {
+		t.Errorf("signature of another track: status %d, want 401", w.Code)
+	}
+	// Requests authenticated otherwise get playlists without signatures
+	w = request(newRouter(true), http.MethodGet, "/hls/signed/master.m3u8")
+	if strings.Contains(w.Body.String(), "sig=") {
+		t.Errorf("unsigned master playlist has signatures:\n%s", w.Body)
+	}
+}
@@ -1,17 +1,17 @@
 package main
 
 import (
-	"database/sql"
 	"encoding/base64"
+	"errors"
 	"io/ioutil"
 	"log"
 	"time"
 	"net/http"
 	"os"
-	"path/filepath"
+	"strconv"
 	"strings"
 
-	_ "github.com/mattn/go-sqlite3"
+	"heavymetal/library"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gin-contrib/cors"
@@ -26,16 +26,11 @@ import (
 // @host localhost:8080
 // @BasePath /
 
-// Track represents audio file metadata.
-type Track struct {
-	ID       string `json:"id" example:"funky-lion-pencil-heart"`
-	Title    string `json:"title"`
-	ArtistID string `json:"artist_id"`
-	AlbumID  string `json:"album_id"`
-	FilePath string `json:"file_path"`
-}
+// repo is the music library the handlers read from.
+var repo library.Repository
 
-var db *sql.DB
+// fuzzyThreshold is the default minimum word similarity of the fuzzy search endpoints.
+var fuzzyThreshold = library.DefaultFuzzyThreshold
 
 func getEnv(key, fallback string) string {
 	val := os.Getenv(key)
@@ -45,34 +40,171 @@ func getEnv(key, fallback string) string {
 	return val
 }
 
-// @Summary Get racks by Fuzzy Search
+// idParam parses a numeric path parameter, answering 404 if it is not a number.
+func idParam(c *gin.Context, name string) (int, bool) {
+	id, err := strconv.Atoi(c.Param(name))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": name + " must be a number"})
+		return 0, false
+	}
+	return id, true
+}
+
+// respondTracks writes a page of tracks with the total in the X-Total-Count header, or
+// 404 with notFound if no track matches at all.
+func respondTracks(c *gin.Context, tracks []library.Track, total int, err error, notFound string) {
+	if err == nil && total == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": notFound})
+		return
+	}
+	respondPage(c, tracks, total, err)
+}
+
+// respondPage writes a page of a listing with the total in the X-Total-Count header. An
+// unknown sort key is the client's fault and answered with 400.
+func respondPage(c *gin.Context, page any, total int, err error) {
+	if errors.Is(err, library.ErrInvalidSort) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		log.Printf("Query error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		return
+	}
+	c.Header("X-Total-Count", strconv.Itoa(total))
+	c.JSON(http.StatusOK, page)
+}
+
+// pageParams reads the optional offset, limit and sort query parameters of paginated
+// list endpoints, answering 400 if they are invalid. Sort keys are checked by the
+// repository.
+func pageParams(c *gin.Context) (library.Page, bool) {
+	offset, err := strconv.Atoi(c.DefaultQuery("offset", "0"))
+	if err != nil || offset < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "offset must be a non-negative number"})
+		return library.Page{}, false
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if err != nil || limit <= 0 || limit > 500 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be between 1 and 500"})
+		return library.Page{}, false
+	}
+	return library.Page{Offset: offset, Limit: limit, Sort: c.Query("sort")}, true
+}
+
+// intQuery reads an optional numeric query parameter, 0 if it is absent, answering 400
+// if it is not a number.
+func intQuery(c *gin.Context, name string) (int, bool) {
+	v := c.Query(name)
+	if v == "" {
+		return 0, true
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": name + " must be a number"})
+		return 0, false
+	}
+	return n, true
+}
+
+// intQueries reads each named numeric query parameter into the matching field with
+// intQuery, stopping at the first invalid one.
+func intQueries(c *gin.Context, names []string, fields ...*int) bool {
+	for i, name := range names {
+		v, ok := intQuery(c, name)
+		if !ok {
+			return false
+		}
+		*fields[i] = v
+	}
+	return true
+}
+
+// trackFilterParams reads the artist, album, genre, year_from, year_to and lossless
+// query parameters that narrow track listings, answering 400 if they are invalid.
+func trackFilterParams(c *gin.Context) (library.TrackFilter, bool) {
+	var f library.TrackFilter
+	if !intQueries(c, []string{"artist", "album", "genre", "year_from", "year_to"},
+		&f.ArtistID, &f.AlbumID, &f.GenreID, &f.YearFrom, &f.YearTo) {
+		return f, false
+	}
+	if v := c.Query("lossless"); v != "" {
+		lossless, err := strconv.ParseBool(v)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "lossless must be true or false"})
+			return f, false
+		}
+		f.Lossless = &lossless
+	}
+	return f, true
+}
+
+// trackListParams reads the paging, sort and filter parameters of track listings.
+func trackListParams(c *gin.Context) (library.Page, library.TrackFilter, bool) {
+	page, ok := pageParams(c)
+	if !ok {
+		return page, library.TrackFilter{}, false
+	}
+	filter, ok := trackFilterParams(c)
+	return page, filter, ok
+}
+
+// albumFilterParams reads the artist, genre, year_from and year_to query parameters
+// that narrow album listings, answering 400 if they are invalid.
+func albumFilterParams(c *gin.Context) (library.AlbumFilter, bool) {
+	var f library.AlbumFilter
+	ok := intQueries(c, []string{"artist", "genre", "year_from", "year_to"},
+		&f.ArtistID, &f.GenreID, &f.YearFrom, &f.YearTo)
+	return f, ok
+}
+
+// fuzzyParams reads the optional threshold and limit query parameters of the fuzzy
+// search endpoints, answering 400 if they are invalid.
+func fuzzyParams(c *gin.Context) (float64, int, bool) {
+	threshold := fuzzyThreshold
+	if t := c.Query("threshold"); t != "" {
+		v, err := strconv.ParseFloat(t, 64)
+		if err != nil || v <= 0 || v > 1 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "threshold must be a number between 0 and 1"})
+			return 0, 0, false
+		}
+		threshold = v
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if err != nil || limit <= 0 || limit > 500 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be between 1 and 500"})
+		return 0, 0, false
+	}
+	return threshold, limit, true
+}
+
+// @Summary Get tracks by Fuzzy Search
+// @Description Typo-tolerant search over track titles, artists and albums, ordered by score. Every query word must be at least threshold similar to a word of the track.
 // @Produce json
 // @Param query path string true "Search Query"
-// @Success 200 {array} Track
+// @Param threshold query number false "Minimum similarity of each word, 0 to 1 (default MUSIC_FUZZY_THRESHOLD or 0.7)"
+// @Param limit query int false "Maximum number of results" default(50)
+// @Success 200 {array} library.FuzzyTrack
 // @Failure 404 {object} map[string]string
-// @Router /search/{query} [get]
+// @Router /search/track/{query} [get]
 func getTracksByFuzzySearchHandler(c *gin.Context) {
 	query := c.Param("query")
 	if query == "" {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "query cannot be empty"})
 		return
 	}
+	threshold, limit, ok := fuzzyParams(c)
+	if !ok {
+		return
+	}
 
-	rows, err := db.Query(`SELECT human_hash_id, title, artist_id, album_id, file_path FROM audio_files WHERE title LIKE ?`, "%"+query+"%")
+	tracks, err := repo.FuzzySearchTracks(query, threshold, limit)
 	if err != nil {
 		log.Printf("Query error: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
 		return
 	}
-	defer rows.Close()
-
-	var tracks []Track
-	for rows.Next() {
-		var t Track
-		if err := rows.Scan(&t.ID, &t.Title, &t.ArtistID, &t.AlbumID, &t.FilePath); err == nil {
-			tracks = append(tracks, t)
-		}
-	}
 
 	if len(tracks) == 0 {
 		c.JSON(http.StatusNotFound, gin.H{"error": "no tracks found"})
@@ -83,9 +215,12 @@ func getTracksByFuzzySearchHandler(c *gin.Context) {
 }
 
 // @Summary Get all Albums using Fuzzy Search
+// @Description Typo-tolerant search over album titles and album artists, ordered by score.
 // @Produce json
 // @Param query path string true "Search Query"
-// @Success 200 {array} Track
+// @Param threshold query number false "Minimum similarity of each word, 0 to 1 (default MUSIC_FUZZY_THRESHOLD or 0.7)"
+// @Param limit query int false "Maximum number of results" default(50)
+// @Success 200 {array} library.FuzzyAlbum
 // @Failure 404 {object} map[string]string
 // @Router /search/album/{query} [get]
 func getAlbumsByFuzzySearchHandler(c *gin.Context) {
@@ -94,210 +229,443 @@ func getAlbumsByFuzzySearchHandler(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "query cannot be empty"})
 		return
 	}
+	threshold, limit, ok := fuzzyParams(c)
+	if !ok {
+		return
+	}
 
-	// Use the `albums` table to search for albums
-	log.Printf("Searching for albums with query: %s", "'%"+query+"%'")
-	rows, err := db.Query(`SELECT * FROM albums WHERE title LIKE ?`, "'%"+query+"%'")
+	albums, err := repo.FuzzySearchAlbums(query, threshold, limit)
 	if err != nil {
 		log.Printf("Query error: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
 		return
 	}
-	defer rows.Close()
 
-	var tracks []Track
-	for rows.Next() {
-		var t Track
-		if err := rows.Scan(&t.ID, &t.Title, &t.ArtistID, &t.AlbumID, &t.FilePath); err == nil {
-			tracks = append(tracks, t)
-		}
-	}
-
-	if len(tracks) == 0 {
+	if len(albums) == 0 {
 		c.JSON(http.StatusNotFound, gin.H{"error": "no albums found"})
 		return
 	}
 
-	c.JSON(http.StatusOK, tracks)
+	c.JSON(http.StatusOK, albums)
 }
 
-// @Summary Get all tracks
+// @Summary Get artists using Fuzzy Search
+// @Description Typo-tolerant search over artist names, ordered by score.
 // @Produce json
-// @Success 200 {array} Track
-// @Router /tracks/all [get]
-func getAllTracksHandler(c *gin.Context) {
-	rows, err := db.Query(`SELECT human_hash_id, title, artist_id, album_id, file_path FROM audio_files`)
+// @Param query path string true "Search Query"
+// @Param threshold query number false "Minimum similarity of each word, 0 to 1 (default MUSIC_FUZZY_THRESHOLD or 0.7)"
+// @Param limit query int false "Maximum number of results" default(50)
+// @Success 200 {array} library.FuzzyArtist
+// @Failure 404 {object} map[string]string
+// @Router /search/artist/{query} [get]
+func getArtistsByFuzzySearchHandler(c *gin.Context) {
+	query := c.Param("query")
+	if query == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "query cannot be empty"})
+		return
+	}
+	threshold, limit, ok := fuzzyParams(c)
+	if !ok {
+		return
+	}
+
+	artists, err := repo.FuzzySearchArtists(query, threshold, limit)
 	if err != nil {
 		log.Printf("Query error: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
 		return
 	}
-	defer rows.Close()
 
-	var tracks []Track
-	for rows.Next() {
-		var t Track
-		if err := rows.Scan(&t.ID, &t.Title, &t.ArtistID, &t.AlbumID, &t.FilePath); err == nil {
-			tracks = append(tracks, t)
-		}
+	if len(artists) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "no artists found"})
+		return
 	}
-	c.JSON(http.StatusOK, tracks)
+
+	c.JSON(http.StatusOK, artists)
+}
+
+// @Summary Search tracks, albums and artists
+// @Description Ranked full-text search. Every word must match, as a word prefix, ignoring case and diacritics. Tracks match on title, artists, album and genres.
+// @Produce json
+// @Param q query string true "Search query"
+// @Param limit query int false "Maximum results of each kind" default(20)
+// @Success 200 {object} library.SearchResults
+// @Failure 400 {object} map[string]string
+// @Router /search [get]
+func searchHandler(c *gin.Context) {
+	query := strings.TrimSpace(c.Query("q"))
+	if query == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "q cannot be empty"})
+		return
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "20"))
+	if err != nil || limit <= 0 || limit > 100 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be between 1 and 100"})
+		return
+	}
+
+	results, err := repo.Search(query, limit)
+	if err != nil {
+		log.Printf("Search error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		return
+	}
+	c.JSON(http.StatusOK, results)
+}
+
+// @Summary List tracks
+// @Description A page of the tracks matching the filters, by default ordered by title. The number of matching tracks is in the X-Total-Count header.
+// @Produce json
+// @Param offset query int false "Number of tracks to skip" default(0)
+// @Param limit query int false "Maximum number of tracks" default(50)
+// @Param sort query string false "title, artist, album, year, added, duration or track (album, disc and track number); prefix with - to reverse"
+// @Param artist query int false "Only tracks crediting this artist ID"
+// @Param album query int false "Only tracks of this album ID"
+// @Param genre query int false "Only tracks with this genre ID"
+// @Param year_from query int false "Only tracks from this year on"
+// @Param year_to query int false "Only tracks up to this year"
+// @Param lossless query bool false "Only lossless, or only lossy, tracks"
+// @Success 200 {array} library.Track
+// @Failure 400 {object} map[string]string
+// @Router /tracks/all [get]
+func getAllTracksHandler(c *gin.Context) {
+	page, filter, ok := trackListParams(c)
+	if !ok {
+		return
+	}
+	tracks, total, err := repo.Tracks(filter, page)
+	respondPage(c, tracks, total, err)
 }
 
 // @Summary Get all tracks by artist ID
+// @Description Includes tracks where the artist is credited in any role (main, featured or composer). Takes the paging, sort and filter parameters of /tracks/all.
 // @Produce json
 // @Param artist_id path string true "Artist ID"
-// @Success 200 {array} Track
+// @Success 200 {array} library.Track
+// @Failure 400 {object} map[string]string
 // @Failure 404 {object} map[string]string
 // @Router /artist/{artist_id} [get]
 func getTracksByArtistHandler(c *gin.Context) {
-	artistID := c.Param("artist_id")
-	rows, err := db.Query(`SELECT human_hash_id, title, artist_id, album_id, file_path FROM audio_files WHERE artist_id = ?`, artistID)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+	artistID, ok := idParam(c, "artist_id")
+	if !ok {
 		return
 	}
-	defer rows.Close()
-
-	var tracks []Track
-	for rows.Next() {
-		var t Track
-		if err := rows.Scan(&t.ID, &t.Title, &t.ArtistID, &t.AlbumID, &t.FilePath); err == nil {
-			tracks = append(tracks, t)
-		}
+	page, filter, ok := trackListParams(c)
+	if !ok {
+		return
 	}
+	filter.ArtistID = artistID
+	tracks, total, err := repo.Tracks(filter, page)
+	respondTracks(c, tracks, total, err, "no tracks found")
+}
 
-	if len(tracks) == 0 {
-		c.JSON(http.StatusNotFound, gin.H{"error": "no tracks found"})
+// @Summary Get tracks by genre
+// @Description Matches every genre of a track, not only the primary one. Takes the paging, sort and filter parameters of /tracks/all.
+// @Produce json
+// @Param genre_id path string true "Genre ID"
+// @Success 200 {array} library.Track
+// @Failure 400 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Router /genre/{genre_id} [get]
+func getTracksByGenreHandler(c *gin.Context) {
+	genreID, ok := idParam(c, "genre_id")
+	if !ok {
 		return
 	}
-
-	c.JSON(http.StatusOK, tracks)
+	page, filter, ok := trackListParams(c)
+	if !ok {
+		return
+	}
+	filter.GenreID = genreID
+	tracks, total, err := repo.Tracks(filter, page)
+	respondTracks(c, tracks, total, err, "no tracks found for this genre")
 }
 
 // @Summary Get tracks of an album
+// @Description In disc and track number order by default. Takes the paging, sort and filter parameters of /tracks/all.
 // @Produce json
 // @Param id path string true "Album ID"
-// @Success 200 {array} Track
+// @Success 200 {array} library.Track
+// @Failure 400 {object} map[string]string
 // @Failure 404 {object} map[string]string
 // @Router /album/{id} [get]
 func getTracksByAlbumHandler(c *gin.Context) {
-	id := c.Param("id")
-	rows, err := db.Query(`SELECT human_hash_id, title, artist_id, album_id, file_path FROM audio_files WHERE album_id = ?`, id)
+	id, ok := idParam(c, "id")
+	if !ok {
+		return
+	}
+	page, filter, ok := trackListParams(c)
+	if !ok {
+		return
+	}
+	filter.AlbumID = id
+	tracks, total, err := repo.Tracks(filter, page)
+	respondTracks(c, tracks, total, err, "no tracks found for this album")
+}
+
+// albumDetail is an album with its tracklist, as served by /albums/{id}.
+type albumDetail struct {
+	library.AlbumInfo
+	CoverURL string          `json:"cover_url,omitempty" example:"/cover/funky-lion-pencil-heart"`
+	Tracks   []library.Track `json:"tracks"`
+}
+
+// @Summary List albums
+// @Description Albums matching the filters, with their track count and total duration, by default ordered by title. The number of matching albums is in the X-Total-Count header.
+// @Produce json
+// @Param offset query int false "Number of albums to skip" default(0)
+// @Param limit query int false "Maximum number of albums" default(50)
+// @Param sort query string false "title, artist, year, duration, tracks, added (latest track), plays or played (last played); prefix with - to reverse"
+// @Param artist query int false "Only albums filed under this artist ID"
+// @Param genre query int false "Only albums with a track of this genre ID"
+// @Param year_from query int false "Only albums released from this year on"
+// @Param year_to query int false "Only albums released up to this year"
+// @Success 200 {array} library.AlbumInfo
+// @Failure 400 {object} map[string]string
+// @Router /albums [get]
+func getAlbumsHandler(c *gin.Context) {
+	page, ok := pageParams(c)
+	if !ok {
+		return
+	}
+	filter, ok := albumFilterParams(c)
+	if !ok {
+		return
+	}
+	albums, total, err := repo.Albums(filter, page)
+	respondPage(c, albums, total, err)
+}
+
+// @Summary Get an album
+// @Description Album metadata with its tracklist in disc and track number order. cover_url points at the cover of the first track, which falls back to the album's art.
+// @Produce json
+// @Param id path string true "Album ID"
+// @Success 200 {object} albumDetail
+// @Failure 404 {object} map[string]string
+// @Router /albums/{id} [get]
+func getAlbumHandler(c *gin.Context) {
+	id, ok := idParam(c, "id")
+	if !ok {
+		return
+	}
+	album, err := repo.AlbumInfo(id)
+	if errors.Is(err, library.ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "album not found"})
+		return
+	}
 	if err != nil {
+		log.Printf("Query error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		return
+	}
+	tracks, err := repo.TracksByAlbum(id)
+	if err != nil {
+		log.Printf("Query error: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
 		return
 	}
-	defer rows.Close()
 
-	var tracks []Track
-	for rows.Next() {
-		var t Track
-		if err := rows.Scan(&t.ID, &t.Title, &t.ArtistID, &t.AlbumID, &t.FilePath); err == nil {
-			tracks = append(tracks, t)
-		}
+	detail := albumDetail{AlbumInfo: album, Tracks: tracks}
+	if detail.Tracks == nil {
+		detail.Tracks = []library.Track{}
+	}
+	if len(tracks) > 0 {
+		detail.CoverURL = "/cover/" + tracks[0].ID
 	}
+	c.JSON(http.StatusOK, detail)
+}
 
-	if len(tracks) == 0 {
-		c.JSON(http.StatusNotFound, gin.H{"error": "no tracks found for this album"})
+// artistDetail is an artist with their albums, as served by /artists/{id}.
+type artistDetail struct {
+	library.ArtistInfo
+	Albums []library.AlbumInfo `json:"albums"`
+}
+
+// @Summary List artists
+// @Description Artists with their album and track counts, by default ordered by name. The total number of artists is in the X-Total-Count header.
+// @Produce json
+// @Param offset query int false "Number of artists to skip" default(0)
+// @Param limit query int false "Maximum number of artists" default(50)
+// @Param sort query string false "name, albums or tracks; prefix with - to reverse"
+// @Success 200 {array} library.ArtistInfo
+// @Failure 400 {object} map[string]string
+// @Router /artists [get]
+func getArtistsHandler(c *gin.Context) {
+	page, ok := pageParams(c)
+	if !ok {
 		return
 	}
+	artists, total, err := repo.Artists(page)
+	respondPage(c, artists, total, err)
+}
 
-	c.JSON(http.StatusOK, tracks)
+// @Summary Get an artist
+// @Description Artist name, album and track counts, and the albums filed under the artist, oldest first. Use /artist/{artist_id} for every track crediting them.
+// @Produce json
+// @Param id path string true "Artist ID"
+// @Success 200 {object} artistDetail
+// @Failure 404 {object} map[string]string
+// @Router /artists/{id} [get]
+func getArtistHandler(c *gin.Context) {
+	id, ok := idParam(c, "id")
+	if !ok {
+		return
+	}
+	artist, err := repo.ArtistInfo(id)
+	if errors.Is(err, library.ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "artist not found"})
+		return
+	}
+	if err != nil {
+		log.Printf("Query error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		return
+	}
+	albums, err := repo.AlbumsByArtist(id)
+	if err != nil {
+		log.Printf("Query error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		return
+	}
+	c.JSON(http.StatusOK, artistDetail{ArtistInfo: artist, Albums: albums})
+}
+
+// @Summary List genres
+// @Description Genres with their track counts, by default ordered by name. The total number of genres is in the X-Total-Count header.
+// @Produce json
+// @Param offset query int false "Number of genres to skip" default(0)
+// @Param limit query int false "Maximum number of genres" default(50)
+// @Param sort query string false "name or tracks; prefix with - to reverse"
+// @Success 200 {array} library.GenreInfo
+// @Failure 400 {object} map[string]string
+// @Router /genres [get]
+func getGenresHandler(c *gin.Context) {
+	page, ok := pageParams(c)
+	if !ok {
+		return
+	}
+	genres, total, err := repo.Genres(page)
+	respondPage(c, genres, total, err)
 }
 
-// @Summary Get album cover as base64
+// @Summary Get the tracks of a genre
+// @Description Matches every genre of a track, not only the primary one. Unlike /genre/{genre_id}, a known genre without tracks gives an empty list. Takes the paging, sort and filter parameters of /tracks/all.
 // @Produce json
+// @Param id path string true "Genre ID"
+// @Success 200 {array} library.Track
+// @Failure 400 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Router /genres/{id}/tracks [get]
+func getGenreTracksHandler(c *gin.Context) {
+	id, ok := idParam(c, "id")
+	if !ok {
+		return
+	}
+	page, filter, ok := trackListParams(c)
+	if !ok {
+		return
+	}
+	if _, err := repo.Genre(id); err != nil {
+		if errors.Is(err, library.ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "genre not found"})
+		} else {
+			log.Printf("Query error: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		}
+		return
+	}
+	filter.GenreID = id
+	tracks, total, err := repo.Tracks(filter, page)
+	respondPage(c, tracks, total, err)
+}
+
+// coverFiles are the images next to a track that are taken for its album's cover, in
+// order of preference.
+var coverFiles = []string{"cover.jpg", "cover.png", "folder.jpg", "folder.png"}
+
+// @Summary Get album cover
+// @Description Uses a cover/folder image next to the file if present, otherwise the embedded cover art extracted by the indexer. Returns it as a base64 data URL in JSON, or as the image itself to clients that accept images but not JSON, such as image elements.
+// @Produce json,image/jpeg,image/png
 // @Param id path string true "Track HumanHash ID"
 // @Success 200 {object} map[string]string
 // @Failure 404 {object} map[string]string
 // @Router /cover/{id} [get]
 func getAlbumCoverHandler(c *gin.Context) {
 	id := c.Param("id")
-	var path string
-	err := db.QueryRow("SELECT file_path FROM audio_files WHERE human_hash_id = ?", id).Scan(&path)
+	track, err := repo.Track(id)
 	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "track not found"})
 		return
 	}
-	dir := filepath.Dir(path)
-	candidates := []string{"cover.jpg", "cover.png", "folder.jpg", "folder.png"}
+	path, mimeType, err := trackCover(track)
+	if err != nil {
+		log.Printf("Error fetching artwork of track %s: %v", id, err)
+	}
+	if path == "" {
+		c.JSON(http.StatusNotFound, gin.H{"error": "cover image not found"})
+		return
+	}
 
-	for _, name := range candidates {
-		candidatePath := filepath.Join(dir, name)
-		if data, err := ioutil.ReadFile(candidatePath); err == nil {
-			encoded := base64.StdEncoding.EncodeToString(data)
-			c.JSON(http.StatusOK, gin.H{"image_base64": "data:image/png;base64," + encoded})
+	accept := c.GetHeader("Accept")
+	if strings.Contains(accept, "image/") && !strings.Contains(accept, "application/json") {
+		f, err := os.Open(path)
+		if err != nil {
+			log.Printf("Cover image missing for track %s: %s", id, path)
+			c.JSON(http.StatusNotFound, gin.H{"error": "cover image not found"})
+			return
+		}
+		defer f.Close()
+		fi, err := f.Stat()
+		if err != nil {
+			log.Printf("Error reading cover image of track %s: %v", id, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
 			return
 		}
+		c.Header("Content-Type", mimeType)
+		http.ServeContent(c.Writer, c.Request, "", fi.ModTime(), f)
+		return
 	}
-
-	c.JSON(http.StatusNotFound, gin.H{"error": "cover image not found"})
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Printf("Cover image missing for track %s: %s", id, path)
+		c.JSON(http.StatusNotFound, gin.H{"error": "cover image not found"})
+		return
+	}
+	encoded := base64.StdEncoding.EncodeToString(data)
+	c.JSON(http.StatusOK, gin.H{"image_base64": "data:" + mimeType + ";base64," + encoded})
 }
 
 // @Summary Get track metadata
 // @Produce json
 // @Param id path string true "Track HumanHash ID"
-// @Success 200 {object} Track
+// @Success 200 {object} library.Track
 // @Failure 404 {object} map[string]string
 // @Router /track/{id} [get]
 func getTrackHandler(c *gin.Context) {
 	id := c.Param("id")
-	var t Track
-	err := db.QueryRow(`SELECT human_hash_id, title, artist_id, album_id, file_path FROM audio_files WHERE human_hash_id = ?`, id).
-		Scan(&t.ID, &t.Title, &t.ArtistID, &t.AlbumID, &t.FilePath)
+	t, err := repo.Track(id)
 	if err != nil {
-		log.Printf("Error fetching track: %v", err);
+		log.Printf("Error fetching track: %v", err)
 		c.JSON(http.StatusNotFound, gin.H{"error": "track not found"})
 		return
 	}
 	c.JSON(http.StatusOK, t)
 }
 
-// @Summary Stream audio file
-// @Produce audio/flac
-// @Param id path string true "Track HumanHash ID"
-// @Success 200 {file} string
-// @Failure 404 {object} map[string]string
-// @Router /stream/{id} [get]
-func streamTrackHandler(c *gin.Context) {
-	id := c.Param("id")
-	var path string
-	err := db.QueryRow("SELECT file_path FROM audio_files WHERE human_hash_id = ?", id).Scan(&path)
-	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "track not found"})
-		return
-	}
-
-	c.Header("Content-Type", "audio/flac") // Assuming FLAC; adapt if needed
-	c.File(path)
-}
-
 func indexHandler(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"message": "Welcome to the Music Server API"})
 }
 
-func main() {
-	dbPath := getEnv("MUSIC_DB_PATH", "music_library.sqlite")
-	user := getEnv("MUSIC_USER", "admin")
-	pass := getEnv("MUSIC_PASS", "admin123")
-	port := getEnv("PORT", "8080")
-
-	var err error
-	db, err = sql.Open("sqlite3", dbPath)
-	if err != nil {
-		log.Fatalf("Failed to open DB: %v", err)
-	}
-	defer db.Close()
-
+// newRouter sets up the routes of the server.
+func newRouter(authOpen bool) *gin.Engine {
 	r := gin.Default()
 
 	// CORS configuration
 	r.Use(cors.New(cors.Config{
     AllowOrigins:     []string{"*"},
-    AllowMethods:     []string{"PUT", "PATCH", "POST", "GET", "DELETE"},
-    AllowHeaders:     []string{"Origin"},
-    ExposeHeaders:    []string{"Content-Length"},
+    AllowMethods:     []string{"PUT", "PATCH", "POST", "GET", "HEAD", "DELETE"},
+    AllowHeaders:     []string{"Origin", "Authorization", "Content-Type", "Range", "If-None-Match", "If-Modified-Since", "If-Range"},
+    ExposeHeaders:    []string{"Content-Length", "X-Total-Count", "Content-Range", "Accept-Ranges", "ETag", "Last-Modified"},
     AllowCredentials: true,
     AllowOriginFunc: func(origin string) bool {
       return true
@@ -305,29 +673,60 @@ func main() {
     MaxAge: 12 * time.Hour,
   }));
 
-	// Conditionally apply BasicAuth
-	if strings.ToLower(user) != "0null" {
-		auth := r.Group("/", gin.BasicAuth(gin.Accounts{user: pass}))
-		auth.GET("", indexHandler)
-		auth.GET("/track/:id", getTrackHandler)
-		auth.GET("/stream/:id", streamTrackHandler)
-		auth.GET("/tracks/all", getAllTracksHandler)
-		auth.GET("/artist/:artist_id", getTracksByArtistHandler)
-		auth.GET("/cover/:id", getAlbumCoverHandler)
-		auth.GET("/album/:id", getTracksByAlbumHandler)
-		auth.GET("/search/track/:query", getTracksByFuzzySearchHandler)
-		auth.GET("/search/album/:query", getAlbumsByFuzzySearchHandler)
-	} else {
-		r.GET("", indexHandler)
-		r.GET("/track/:id", getTrackHandler)
-		r.GET("/stream/:id", streamTrackHandler)
-		r.GET("/tracks/all", getAllTracksHandler)
-		r.GET("/artist/:artist_id", getTracksByArtistHandler)
-		r.GET("/cover/:id", getAlbumCoverHandler)
-		r.GET("/album/:id", getTracksByAlbumHandler)
-		r.GET("/search/track/:query", getTracksByFuzzySearchHandler)
-		r.GET("/search/album/:query", getAlbumsByFuzzySearchHandler)
-	}
+	// In open mode requests without credentials go through anonymously
+	api := r.Group("/", authenticate(authOpen))
+	api.GET("", indexHandler)
+	api.GET("/track/:id", getTrackHandler)
+	api.GET("/stream/:id", streamTrackHandler)
+	api.HEAD("/stream/:id", streamTrackHandler)
+	api.GET("/hls/:id/master.m3u8", hlsMasterPlaylistHandler)
+	api.GET("/hls/:id/:bitrate/:segment", hlsSegmentHandler)
+	api.GET("/tracks/all", getAllTracksHandler)
+	api.GET("/artist/:artist_id", getTracksByArtistHandler)
+	api.GET("/genre/:genre_id", getTracksByGenreHandler)
+	api.GET("/cover/:id", getAlbumCoverHandler)
+	api.GET("/album/:id", getTracksByAlbumHandler)
+	api.GET("/albums", getAlbumsHandler)
+	api.GET("/albums/:id", getAlbumHandler)
+	api.GET("/artists", getArtistsHandler)
+	api.GET("/artists/:id", getArtistHandler)
+	api.GET("/genres", getGenresHandler)
+	api.GET("/genres/:id/tracks", getGenreTracksHandler)
+	api.GET("/search", searchHandler)
+	api.GET("/search/track/:query", getTracksByFuzzySearchHandler)
+	api.GET("/search/album/:query", getAlbumsByFuzzySearchHandler)
+	api.GET("/search/artist/:query", getArtistsByFuzzySearchHandler)
+	api.GET("/playlists", getPlaylistsHandler)
+	api.POST("/playlists", createPlaylistHandler)
+	api.GET("/playlists/:id", getPlaylistHandler)
+	api.PATCH("/playlists/:id", updatePlaylistHandler)
+	api.DELETE("/playlists/:id", deletePlaylistHandler)
+	api.GET("/playlists/:id/cover", getPlaylistCoverHandler)
+	api.PUT("/playlists/:id/tracks", setPlaylistTracksHandler)
+	api.POST("/playlists/:id/tracks", addPlaylistTracksHandler)
+	api.PATCH("/playlists/:id/tracks/:position", movePlaylistEntryHandler)
+	api.DELETE("/playlists/:id/tracks/:position", removePlaylistEntryHandler)
+
+	r.POST("/auth/login", loginHandler)
+	auth := r.Group("/auth", authenticate(false))
+	auth.POST("/logout", logoutHandler)
+	auth.GET("/tokens", getTokensHandler)
+	auth.DELETE("/tokens/:id", deleteTokenHandler)
+	auth.POST("/keys", createAPIKeyHandler)
+	auth.GET("/sign", signURLHandler)
+	auth.PUT("/subsonic-password", setSubsonicPasswordHandler)
+	auth.DELETE("/subsonic-password", deleteSubsonicPasswordHandler)
+
+	admin := r.Group("/admin", authenticate(false), requireAdmin)
+	admin.GET("/users", getUsersHandler)
+	admin.POST("/users", createUserHandler)
+	admin.PATCH("/users/:id", updateUserHandler)
+	admin.PUT("/users/:id/password", resetPasswordHandler)
+
+	// Subsonic clients send their credentials as parameters rather than with BasicAuth
+	rest := r.Group("/rest", subsonicAuth(authOpen))
+	rest.GET("/:method", subsonicHandler)
+	rest.POST("/:method", subsonicHandler)
 
 	// Swagger docs
 	swag.SwaggerInfo.Title = "Music Server API"
@@ -335,5 +734,54 @@ func main() {
 	swag.SwaggerInfo.BasePath = "/"
 	r.GET("/docs/*any", ginSwagger.WrapHandler(swaggerFiles.Handler))
 
+	return r
+}
+
+func main() {
+	dbPath := getEnv("MUSIC_DB_PATH", "music_library.sqlite")
+	adminName := getEnv("MUSIC_USER", "admin") // Only used to create the first admin
+	authMode := strings.ToLower(getEnv("MUSIC_AUTH", "basic"))
+	if strings.ToLower(adminName) == "0null" {
+		log.Printf("MUSIC_USER=0null is deprecated, use MUSIC_AUTH=off")
+		adminName, authMode = "admin", "off"
+	}
+	if authMode != "basic" && authMode != "off" {
+		log.Fatalf("MUSIC_AUTH must be basic or off, got %q", authMode)
+	}
+	authOpen := authMode == "off"
+	port := getEnv("PORT", "8080")
+	if t := os.Getenv("MUSIC_FUZZY_THRESHOLD"); t != "" {
+		v, err := strconv.ParseFloat(t, 64)
+		if err != nil || v <= 0 || v > 1 {
+			log.Fatalf("MUSIC_FUZZY_THRESHOLD must be a number between 0 and 1, got %q", t)
+		}
+		fuzzyThreshold = v
+	}
+
+	db, err := library.Open(dbPath)
+	if err != nil {
+		log.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+	// The server never migrates; refuse a schema its queries were not written for
+	if err := db.CheckSchema(); err != nil {
+		log.Fatalf("Incompatible database schema: %v", err)
+	}
+	repo = db
+	if err := bootstrapAdmin(adminName, os.Getenv("MUSIC_PASS")); err != nil {
+		log.Fatalf("Failed to create the first admin: %v", err)
+	}
+	if err := setupURLSigning(); err != nil {
+		log.Fatalf("Failed to set up signed URLs: %v", err)
+	}
+	if err := setupSubsonicKey(dbPath); err != nil {
+		log.Fatalf("Failed to set up Subsonic passwords: %v", err)
+	}
+	if authOpen {
+		log.Printf("MUSIC_AUTH=off: anyone can use the music endpoints, /admin still requires an admin")
+	}
+	setupTranscoding()
+
+	r := newRouter(authOpen)
 	r.Run(":" + port)
 }
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"heavymetal/library"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestMain(m *testing.M) {
+	gin.SetMode(gin.TestMode)
+	os.Exit(m.Run())
+}
+
+// newTestLibrary points repo at an empty in-memory library for the length of a test.
+func newTestLibrary(t *testing.T) *library.DB {
+	t.Helper()
+	db, err := library.OpenMemory()
+	if err != nil {
+		t.Fatalf("OpenMemory: %v", err)
+	}
+	old := repo
+	repo = db
+	t.Cleanup(func() {
+		repo = old
+		db.Close()
+	})
+	return db
+}
+
+// request sends a request to r with headers given as name, value pairs.
+func request(r http.Handler, method, url string, headers ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, url, nil)
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+// addLibraryTrack indexes af under its artist and album, with its genres and its
+// artist credited as the indexer does, and returns it with its IDs set.
+func addLibraryTrack(t *testing.T, db *library.DB, af library.AudioFile) library.AudioFile {
+	t.Helper()
+	af.FilePath = "/music/" + af.HumanHashID + ".flac"
+	var err error
+	if af.ArtistID, err = db.GetOrInsertArtist(af.ArtistName); err != nil {
+		t.Fatal(err)
+	}
+	if af.AlbumID, err = db.GetOrInsertAlbum(af.AlbumTitle, af.ArtistID, af.Year, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.UpsertAudioFile(&af); err != nil {
+		t.Fatal(err)
+	}
+	af.GenreIDs = nil
+	for _, name := range af.Genres {
+		id, err := db.GetOrInsertGenre(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		af.GenreIDs = append(af.GenreIDs, id)
+	}
+	if err := db.SetTrackGenres(af.HumanHashID, af.GenreIDs); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetTrackArtists(af.HumanHashID, []library.ArtistCredit{{Name: af.ArtistName, Role: library.RoleMain, ArtistID: af.ArtistID}}); err != nil {
+		t.Fatal(err)
+	}
+	return af
+}
+
+// newBrowsingLibrary fills the test library with two albums, the first one's tracks
+// added out of order, and returns it with its tracks by ID.
+func newBrowsingLibrary(t *testing.T) (*library.DB, map[string]library.AudioFile) {
+	t.Helper()
+	db := newTestLibrary(t)
+	tracks := make(map[string]library.AudioFile)
+	for _, af := range []library.AudioFile{
+		{HumanHashID: "orion", Title: "Orion", DiscNumber: 1, TrackNumber: 8, DurationSeconds: 507, Lossless: true},
+		{HumanHashID: "damage", Title: "Damage Inc. (Live)", DiscNumber: 2, TrackNumber: 1, DurationSeconds: 300, Lossless: true},
+		{HumanHashID: "thing", Title: "The Thing That Should Not Be", DiscNumber: 1, DurationSeconds: 396, Lossless: true},
+		{HumanHashID: "battery", Title: "Battery", TrackNumber: 1, DurationSeconds: 312, Lossless: true},
+		{HumanHashID: "paranoid", Title: "Paranoid", TrackNumber: 2, DurationSeconds: 168, Genres: []string{"Heavy Metal"}},
+		{HumanHashID: "iron", Title: "Iron Man", TrackNumber: 4, DurationSeconds: 356, Genres: []string{"Heavy Metal", "Doom Metal"}},
+	} {
+		if af.Genres == nil {
+			af.ArtistName, af.AlbumTitle, af.Year, af.Genres = "Metallica", "Master of Puppets", 1986, []string{"Thrash Metal"}
+		} else {
+			af.ArtistName, af.AlbumTitle, af.Year = "Black Sabbath", "Paranoid", 1970
+		}
+		tracks[af.HumanHashID] = addLibraryTrack(t, db, af)
+	}
+	return db, tracks
+}
+
+// getJSON requests url from r and decodes the 200 response into v.
+func getJSON(t *testing.T, r http.Handler, url string, v any) *httptest.ResponseRecorder {
+	t.Helper()
+	w := request(r, http.MethodGet, url)
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET %s: status %d: %s", url, w.Code, w.Body)
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+		t.Fatalf("GET %s: %v", url, err)
+	}
+	return w
+}
+
+// trackIDs joins the IDs of tracks with spaces.
+func trackIDs(tracks []library.Track) string {
+	ids := make([]string, len(tracks))
+	for i, track := range tracks {
+		ids[i] = track.ID
+	}
+	return strings.Join(ids, " ")
+}
+
+func TestAlbumTracklist(t *testing.T) {
+	_, tracks := newBrowsingLibrary(t)
+	r := newRouter(true)
+
+	var album albumDetail
+	getJSON(t, r, "/albums/"+strconv.Itoa(tracks["battery"].AlbumID), &album)
+	if album.Title != "Master of Puppets" || album.ArtistName != "Metallica" || album.Year != 1986 {
+		t.Errorf("album = %+v", album.Album)
+	}
+	if album.TrackCount != 4 || album.DurationSeconds != 507+300+396+312 {
+		t.Errorf("%d tracks lasting %ds, want 4 lasting 1515s", album.TrackCount, album.DurationSeconds)
+	}
+	// Disc 1 before disc 2, a missing disc number counting as disc 1, and a missing
+	// track number last on its disc
+	if got := trackIDs(album.Tracks); got != "battery orion thing damage" {
+		t.Errorf("tracklist %s, want battery orion thing damage", got)
+	}
+	if album.CoverURL != "/cover/battery" {
+		t.Errorf("cover_url = %q, want the cover of the first track", album.CoverURL)
+	}
+
+	var albums []library.AlbumInfo
+	getJSON(t, r, "/albums", &albums)
+	if len(albums) != 2 || albums[0].Title != "Master of Puppets" || albums[1].Title != "Paranoid" || albums[1].TrackCount != 2 {
+		t.Errorf("albums = %+v, want Master of Puppets then Paranoid", albums)
+	}
+
+	for _, url := range []string{"/albums/999", "/albums/puppets"} {
+		if w := request(r, http.MethodGet, url); w.Code != http.StatusNotFound {
+			t.Errorf("GET %s: status %d, want 404", url, w.Code)
+		}
+	}
+}
+
+func TestArtistsAndGenres(t *testing.T) {
+	db, tracks := newBrowsingLibrary(t)
+	jazz, err := db.GetOrInsertGenre("Jazz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := newRouter(true)
+
+	var artists []library.ArtistInfo
+	getJSON(t, r, "/artists", &artists)
+	if len(artists) != 2 || artists[0].Name != "Black Sabbath" || artists[0].AlbumCount != 1 || artists[0].TrackCount != 2 ||
+		artists[1].Name != "Metallica" || artists[1].TrackCount != 4 {
+		t.Errorf("artists = %+v", artists)
+	}
+
+	var artist artistDetail
+	getJSON(t, r, "/artists/"+strconv.Itoa(tracks["iron"].ArtistID), &artist)
+	if artist.Name != "Black Sabbath" || len(artist.Albums) != 1 || artist.Albums[0].Title != "Paranoid" {
+		t.Errorf("artist = %+v", artist)
+	}
+
+	var genres []library.GenreInfo
+	getJSON(t, r, "/genres", &genres)
+	var got []string
+	for _, g := range genres {
+		got = append(got, g.Name+":"+strconv.Itoa(g.TrackCount))
+	}
+	if strings.Join(got, " ") != "Doom Metal:1 Heavy Metal:2 Jazz:0 Thrash Metal:4" {
+		t.Errorf("genres %v, want Doom Metal:1 Heavy Metal:2 Jazz:0 Thrash Metal:4", got)
+	}
+
+	// Secondary genres count, and a genre without tracks has an empty list
+	var genreTracks []library.Track
+	getJSON(t, r, "/genres/"+strconv.Itoa(tracks["iron"].GenreIDs[1])+"/tracks", &genreTracks)
+	if trackIDs(genreTracks) != "iron" {
+		t.Errorf("Doom Metal tracks %s, want iron", trackIDs(genreTracks))
+	}
+	getJSON(t, r, "/genres/"+strconv.Itoa(jazz)+"/tracks", &genreTracks)
+	if len(genreTracks) != 0 {
+		t.Errorf("Jazz tracks %s, want none", trackIDs(genreTracks))
+	}
+
+	// Tracks carry the names of their artist and album
+	var track library.Track
+	getJSON(t, r, "/track/paranoid", &track)
+	if track.ArtistName != "Black Sabbath" || track.AlbumTitle != "Paranoid" {
+		t.Errorf("track names %q, %q; want Black Sabbath, Paranoid", track.ArtistName, track.AlbumTitle)
+	}
+
+	for _, url := range []string{"/artists/999", "/artists/sabbath", "/genres/999/tracks"} {
+		if w := request(r, http.MethodGet, url); w.Code != http.StatusNotFound {
+			t.Errorf("GET %s: status %d, want 404", url, w.Code)
+		}
+	}
+}
+
+func TestListParams(t *testing.T) {
+	_, tracks := newBrowsingLibrary(t)
+	r := newRouter(true)
+	sabbath, doom := strconv.Itoa(tracks["iron"].ArtistID), strconv.Itoa(tracks["iron"].GenreIDs[1])
+
+	for _, tc := range []struct {
+		url   string
+		want  string // IDs in order
+		total string
+	}{
+		{"/tracks/all", "battery damage iron orion paranoid thing", "6"},
+		{"/tracks/all?limit=2&offset=2", "iron orion", "6"},
+		{"/tracks/all?offset=10", "", "6"},
+		{"/tracks/all?sort=-duration", "orion thing iron battery damage paranoid", "6"},
+		{"/tracks/all?sort=year", "paranoid iron battery orion thing damage", "6"},
+		{"/tracks/all?sort=-title&limit=1", "thing", "6"},
+		{"/tracks/all?lossless=true&sort=duration", "damage battery thing orion", "4"},
+		{"/tracks/all?lossless=false", "iron paranoid", "2"},
+		{"/tracks/all?year_from=1980&year_to=1990&limit=1", "battery", "4"},
+		{"/tracks/all?year_to=1975", "iron paranoid", "2"},
+		{"/tracks/all?genre=" + doom, "iron", "1"},
+		{"/tracks/all?artist=" + sabbath + "&sort=track", "paranoid iron", "2"},
+		{"/artist/" + sabbath + "?sort=-duration", "iron paranoid", "2"},
+		{"/genre/" + doom, "iron", "1"},
+		{"/genres/" + doom + "/tracks?lossless=true", "", "0"},
+		{"/album/" + strconv.Itoa(tracks["battery"].AlbumID) + "?limit=3", "battery orion thing", "4"},
+	} {
+		var page []library.Track
+		w := getJSON(t, r, tc.url, &page)
+		if got := trackIDs(page); got != tc.want {
+			t.Errorf("GET %s: %s, want %s", tc.url, got, tc.want)
+		}
+		if got := w.Header().Get("X-Total-Count"); got != tc.total {
+			t.Errorf("GET %s: X-Total-Count %q, want %s", tc.url, got, tc.total)
+		}
+	}
+
+	var albums []library.AlbumInfo
+	w := getJSON(t, r, "/albums?sort=-year&limit=1", &albums)
+	if len(albums) != 1 || albums[0].Title != "Master of Puppets" || w.Header().Get("X-Total-Count") != "2" {
+		t.Errorf("latest album = %+v, total %s", albums, w.Header().Get("X-Total-Count"))
+	}
+	getJSON(t, r, "/albums?year_to=1975", &albums)
+	if len(albums) != 1 || albums[0].Title != "Paranoid" {
+		t.Errorf("albums up to 1975 = %+v", albums)
+	}
+	var artists []library.ArtistInfo
+	w = getJSON(t, r, "/artists?sort=-tracks&limit=1", &artists)
+	if len(artists) != 1 || artists[0].Name != "Metallica" || w.Header().Get("X-Total-Count") != "2" {
+		t.Errorf("artist with most tracks = %+v, total %s", artists, w.Header().Get("X-Total-Count"))
+	}
+	var genres []library.GenreInfo
+	w = getJSON(t, r, "/genres?sort=-tracks&limit=1", &genres)
+	if len(genres) != 1 || genres[0].Name != "Thrash Metal" || w.Header().Get("X-Total-Count") != "3" {
+		t.Errorf("genre with most tracks = %+v, total %s", genres, w.Header().Get("X-Total-Count"))
+	}
+
+	// A filter leaving a by-artist listing empty is a 404, as an unknown artist is
+	if w := request(r, http.MethodGet, "/artist/"+sabbath+"?lossless=true"); w.Code != http.StatusNotFound {
+		t.Errorf("no matching tracks of an artist: status %d, want 404", w.Code)
+	}
+	for _, url := range []string{
+		"/tracks/all?sort=bogus", "/tracks/all?limit=0", "/tracks/all?limit=501", "/tracks/all?offset=-1",
+		"/tracks/all?lossless=maybe", "/tracks/all?year_from=eighties", "/albums?sort=bogus", "/artists?sort=title", "/genres?limit=x",
+	} {
+		if w := request(r, http.MethodGet, url); w.Code != http.StatusBadRequest {
+			t.Errorf("GET %s: status %d, want 400", url, w.Code)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"image"
+	"image/color"
+	_ "image/gif" // Decoders of embedded cover art
+	"image/jpeg"
+	_ "image/png"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"heavymetal/library"
+
+	"github.com/gin-gonic/gin"
+)
+
+// A playlist's cover is a mosaic of the covers of its first four albums, or the cover
+// of its first album if it has fewer, rendered as a JPEG.
+
+// mosaicSize is the width and height of playlist covers, in pixels.
+const mosaicSize = 600
+
+// mosaicCacheEntries is how many rendered covers are kept in memory.
+const mosaicCacheEntries = 64
+
+// mosaicCache holds rendered covers by the cover files they were made from, so that a
+// playlist's cover is rendered again only when the albums it shows change.
+var mosaicCache = struct {
+	sync.Mutex
+	m map[string][]byte
+}{m: map[string][]byte{}}
+
+// mosaicCovers returns the cover files of up to four albums of tracks, in order of
+// first appearance.
+func mosaicCovers(tracks []library.Track) ([]string, error) {
+	albums := map[int]bool{}
+	paths := map[string]bool{}
+	var covers []string
+	for _, t := range tracks {
+		if t.AlbumID != 0 {
+			if albums[t.AlbumID] {
+				continue
+			}
+			albums[t.AlbumID] = true
+		}
+		path, _, err := trackCover(t)
+		if err != nil {
+			return nil, err
+		}
+		if path == "" || paths[path] {
+			continue
+		}
+		paths[path] = true
+		if covers = append(covers, path); len(covers) == 4 {
+			break
+		}
+	}
+	return covers, nil
+}
+
+// playlistMosaic returns the cover of a playlist as a JPEG with an ETag for it, or nil
+// if none of its tracks has a cover.
+func playlistMosaic(id int) ([]byte, string, error) {
+	tracks, err := repo.PlaylistTracks(id)
+	if err != nil {
+		return nil, "", err
+	}
+	covers, err := mosaicCovers(tracks)
+	if err != nil || len(covers) == 0 {
+		return nil, "", err
+	}
+	key := strings.Join(covers, "\n")
+	sum := sha256.Sum256([]byte(key))
+	etag := `"` + hex.EncodeToString(sum[:8]) + `"`
+
+	mosaicCache.Lock()
+	data, ok := mosaicCache.m[key]
+	mosaicCache.Unlock()
+	if ok {
+		return data, etag, nil
+	}
+
+	var images []image.Image
+	for _, path := range covers {
+		if img, err := decodeCover(path); err != nil {
+			log.Printf("Skipping cover %s: %v", path, err)
+		} else {
+			images = append(images, img)
+		}
+	}
+	if len(images) == 0 {
+		return nil, "", nil
+	}
+	if data, err = renderMosaic(images); err != nil {
+		return nil, "", err
+	}
+
+	mosaicCache.Lock()
+	if len(mosaicCache.m) >= mosaicCacheEntries {
+		for k := range mosaicCache.m { // Evict any entry
+			delete(mosaicCache.m, k)
+			break
+		}
+	}
+	mosaicCache.m[key] = data
+	mosaicCache.Unlock()
+	return data, etag, nil
+}
+
+func decodeCover(path string) (image.Image, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	img, _, err := image.Decode(f)
+	return img, err
+}
+
+// renderMosaic draws four images in a 2x2 grid, or the first one alone if there are
+// fewer, and encodes the result as a JPEG.
+func renderMosaic(images []image.Image) ([]byte, error) {
+	dst := image.NewRGBA(image.Rect(0, 0, mosaicSize, mosaicSize))
+	if len(images) < 4 {
+		drawScaled(dst, dst.Bounds(), images[0])
+	} else {
+		half := mosaicSize / 2
+		for i, img := range images[:4] {
+			x, y := i%2*half, i/2*half
+			drawScaled(dst, image.Rect(x, y, x+half, y+half), img)
+		}
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, dst, &jpeg.Options{Quality: 85}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// drawScaled draws the largest centered square of src scaled to fill r of dst,
+// averaging a few samples per pixel so that large covers do not alias.
+func drawScaled(dst *image.RGBA, r image.Rectangle, src image.Image) {
+	const samples = 3 // Per axis
+	b := src.Bounds()
+	side := min(b.Dx(), b.Dy())
+	x0, y0 := b.Min.X+(b.Dx()-side)/2, b.Min.Y+(b.Dy()-side)/2
+	w, h := r.Dx()*samples, r.Dy()*samples
+	for y := 0; y < r.Dy(); y++ {
+		for x := 0; x < r.Dx(); x++ {
+			var rs, gs, bs uint32
+			for sy := 0; sy < samples; sy++ {
+				py := y0 + (y*samples+sy)*side/h
+				for sx := 0; sx < samples; sx++ {
+					cr, cg, cb, _ := src.At(x0+(x*samples+sx)*side/w, py).RGBA()
+					rs, gs, bs = rs+cr, gs+cg, bs+cb
+				}
+			}
+			const n = samples * samples
+			dst.SetRGBA(r.Min.X+x, r.Min.Y+y, color.RGBA{uint8(rs / n >> 8), uint8(gs / n >> 8), uint8(bs / n >> 8), 255})
+		}
+	}
+}
+
+// @Summary Get the cover of a playlist
+// @Description A JPEG mosaic of the covers of the playlist's first four albums, or the cover of its first album if it has fewer. Private playlists of others are not found.
+// @Produce jpeg
+// @Param id path int true "Playlist ID"
+// @Success 200 {file} string
+// @Failure 404 {object} map[string]string
+// @Router /playlists/{id}/cover [get]
+func getPlaylistCoverHandler(c *gin.Context) {
+	p, ok := findPlaylist(c, false)
+	if !ok {
+		return
+	}
+	data, etag, err := playlistMosaic(p.ID)
+	if err != nil {
+		log.Printf("Query error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		return
+	}
+	if data == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "cover image not found"})
+		return
+	}
+	c.Header("ETag", etag)
+	http.ServeContent(c.Writer, c.Request, "cover.jpg", time.Time{}, bytes.NewReader(data))
+}
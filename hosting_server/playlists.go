@@ -0,0 +1,491 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"heavymetal/library"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Playlists belong to the user who creates them, and others see them only once they
+// are public. Their entries are numbered from 0 in order; the same track can appear
+// more than once, unless a request asks to skip or reject duplicates.
+
+// Duplicate policies of requests adding tracks to a playlist.
+const (
+	duplicatesAllow  = "allow"  // Add tracks that are already there again
+	duplicatesSkip   = "skip"   // Leave out tracks that are already there
+	duplicatesReject = "reject" // Fail with 409 if a track is already there
+)
+
+// maxPlaylistName is the longest playlist name accepted, in bytes.
+const maxPlaylistName = 200
+
+// playlistDetail is a playlist with its entries, as served by /playlists/{id}.
+type playlistDetail struct {
+	library.Playlist
+	Tracks   []library.Track `json:"tracks"`              // In order, repeats included
+	CoverURL string          `json:"cover_url,omitempty"` // Absent for empty playlists
+}
+
+// createPlaylistRequest is the body of POST /playlists.
+type createPlaylistRequest struct {
+	Name       string   `json:"name" example:"Road trip"`
+	Comment    string   `json:"comment" example:"Loud, then louder"`
+	Public     bool     `json:"public"`
+	TrackIDs   []string `json:"track_ids" example:"eleven-beryllium-bravo-indigo"`
+	Duplicates string   `json:"duplicates" example:"skip"` // allow (default), skip or reject
+}
+
+// updatePlaylistRequest is the body of PATCH /playlists/{id}; omitted fields are kept.
+type updatePlaylistRequest struct {
+	Name    *string `json:"name" example:"Road trip"`
+	Comment *string `json:"comment" example:"Loud, then louder"`
+	Public  *bool   `json:"public" example:"true"`
+}
+
+// playlistTracksRequest is the body of PUT and POST /playlists/{id}/tracks.
+type playlistTracksRequest struct {
+	TrackIDs   []string `json:"track_ids" example:"eleven-beryllium-bravo-indigo"`
+	Position   *int     `json:"position"`                  // POST only: where to insert, by default at the end
+	Duplicates string   `json:"duplicates" example:"skip"` // allow (default), skip or reject
+}
+
+// moveEntryRequest is the body of PATCH /playlists/{id}/tracks/{position}.
+type moveEntryRequest struct {
+	Position *int `json:"position" example:"0"`
+}
+
+// playlistError is a client error found while editing the entries of a playlist.
+type playlistError struct {
+	Status  int
+	Message string
+}
+
+func (e *playlistError) Error() string { return e.Message }
+
+// ownsPlaylist reports whether the user making a request owns a playlist. Anonymous
+// requests in open mode own none, not even those made anonymously before playlists
+// needed an owner.
+func ownsPlaylist(c *gin.Context, p library.Playlist) bool {
+	user, ok := currentUser(c)
+	return ok && p.OwnerID == user.ID
+}
+
+// playlistOwner returns the user making a request that creates a playlist, answering
+// 401 for anonymous requests in open mode, which cannot own one.
+func playlistOwner(c *gin.Context) (library.User, bool) {
+	user, ok := currentUser(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "log in to change playlists"})
+	}
+	return user, ok
+}
+
+// findPlaylist loads the playlist in the id path parameter if the user can see it,
+// answering 404 otherwise. When mine is set the user must also own it, which changing
+// a playlist requires, or it answers 403, or 401 for anonymous requests.
+func findPlaylist(c *gin.Context, mine bool) (library.Playlist, bool) {
+	id, ok := idParam(c, "id")
+	if !ok {
+		return library.Playlist{}, false
+	}
+	p, err := repo.Playlist(id)
+	if err != nil && !errors.Is(err, library.ErrNotFound) {
+		log.Printf("Query error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		return p, false
+	}
+	owned := err == nil && ownsPlaylist(c, p)
+	if err != nil || !owned && !p.Public {
+		c.JSON(http.StatusNotFound, gin.H{"error": "playlist not found"})
+		return p, false
+	}
+	if mine && !owned {
+		if _, ok := playlistOwner(c); ok {
+			c.JSON(http.StatusForbidden, gin.H{"error": "only the owner can change a playlist"})
+		}
+		return p, false
+	}
+	return p, true
+}
+
+// validDuplicates reports whether a duplicate policy is known, answering 400 if not.
+// The empty policy allows duplicates.
+func validDuplicates(c *gin.Context, policy string) bool {
+	switch policy {
+	case "", duplicatesAllow, duplicatesSkip, duplicatesReject:
+		return true
+	}
+	c.JSON(http.StatusBadRequest, gin.H{"error": "duplicates must be allow, skip or reject"})
+	return false
+}
+
+// insertTracks inserts trackIDs into a playlist's current tracks at position, applying
+// a duplicate policy to tracks that are already there or repeated in trackIDs.
+func insertTracks(current, trackIDs []string, position int, policy string) ([]string, error) {
+	if position < 0 || position > len(current) {
+		return nil, &playlistError{http.StatusBadRequest, fmt.Sprintf("position must be between 0 and %d", len(current))}
+	}
+	seen := make(map[string]bool, len(current)+len(trackIDs))
+	for _, id := range current {
+		seen[id] = true
+	}
+	added := make([]string, 0, len(trackIDs))
+	for _, id := range trackIDs {
+		if seen[id] {
+			switch policy {
+			case duplicatesSkip:
+				continue
+			case duplicatesReject:
+				return nil, &playlistError{http.StatusConflict, "track already in playlist: " + id}
+			}
+		}
+		seen[id] = true
+		added = append(added, id)
+	}
+
+	out := make([]string, 0, len(current)+len(added))
+	out = append(out, current[:position]...)
+	out = append(out, added...)
+	return append(out, current[position:]...), nil
+}
+
+// editPlaylistTracks applies edit to the tracks of a playlist, then answers with the
+// playlist, or with the error edit or the repository reported.
+func editPlaylistTracks(c *gin.Context, p library.Playlist, edit func(trackIDs []string) ([]string, error)) {
+	err := repo.EditPlaylistTracks(p.ID, edit)
+	var perr *playlistError
+	switch {
+	case errors.As(err, &perr):
+		c.JSON(perr.Status, gin.H{"error": perr.Message})
+	case errors.Is(err, library.ErrNotFound):
+		// The playlist was found just before, so it is a new track that is missing
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case err != nil:
+		log.Printf("Query error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+	default:
+		respondPlaylist(c, p.ID, http.StatusOK)
+	}
+}
+
+// respondPlaylist answers with a playlist and its entries.
+func respondPlaylist(c *gin.Context, id, status int) {
+	p, err := repo.Playlist(id)
+	if errors.Is(err, library.ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "playlist not found"})
+		return
+	}
+	if err != nil {
+		log.Printf("Query error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		return
+	}
+	tracks, err := repo.PlaylistTracks(id)
+	if err != nil {
+		log.Printf("Query error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		return
+	}
+
+	detail := playlistDetail{Playlist: p, Tracks: tracks}
+	if len(tracks) > 0 {
+		detail.CoverURL = "/playlists/" + strconv.Itoa(id) + "/cover"
+	}
+	c.JSON(status, detail)
+}
+
+// @Summary List playlists
+// @Description Your playlists and the public playlists of others, with their track count and total duration, by default ordered by name. The number of matching playlists is in the X-Total-Count header.
+// @Produce json
+// @Param owner query string false "Only the playlists of this user"
+// @Param offset query int false "Number of playlists to skip" default(0)
+// @Param limit query int false "Maximum number of playlists, at most 500" default(50)
+// @Param sort query string false "name, created, updated, tracks or duration, with a leading - to reverse" default(name)
+// @Success 200 {array} library.Playlist
+// @Failure 400 {object} map[string]string
+// @Router /playlists [get]
+func getPlaylistsHandler(c *gin.Context) {
+	page, ok := pageParams(c)
+	if !ok {
+		return
+	}
+	user, _ := currentUser(c)
+	playlists, total, err := repo.Playlists(user.ID, library.PlaylistFilter{Owner: c.Query("owner")}, page)
+	respondPage(c, playlists, total, err)
+}
+
+// @Summary Get a playlist
+// @Description A playlist with its tracks in order. Private playlists of others are not found.
+// @Produce json
+// @Param id path int true "Playlist ID"
+// @Success 200 {object} playlistDetail
+// @Failure 404 {object} map[string]string
+// @Router /playlists/{id} [get]
+func getPlaylistHandler(c *gin.Context) {
+	p, ok := findPlaylist(c, false)
+	if !ok {
+		return
+	}
+	respondPlaylist(c, p.ID, http.StatusOK)
+}
+
+// @Summary Create a playlist
+// @Description Creates a playlist owned by you, private unless public is set, holding track_ids in order. Anonymous requests in open mode cannot create playlists.
+// @Accept json
+// @Produce json
+// @Param playlist body createPlaylistRequest true "New playlist"
+// @Success 201 {object} playlistDetail
+// @Failure 400 {object} map[string]string
+// @Failure 401 {object} map[string]string
+// @Failure 409 {object} map[string]string
+// @Router /playlists [post]
+func createPlaylistHandler(c *gin.Context) {
+	owner, ok := playlistOwner(c)
+	if !ok {
+		return
+	}
+	var req createPlaylistRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid body: " + err.Error()})
+		return
+	}
+	if req.Name == "" || len(req.Name) > maxPlaylistName {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("name must be 1 to %d characters", maxPlaylistName)})
+		return
+	}
+	if !validDuplicates(c, req.Duplicates) {
+		return
+	}
+	trackIDs, err := insertTracks(nil, req.TrackIDs, 0, req.Duplicates)
+	var perr *playlistError
+	if errors.As(err, &perr) {
+		c.JSON(perr.Status, gin.H{"error": perr.Message})
+		return
+	}
+
+	p, err := repo.CreatePlaylist(library.Playlist{Name: req.Name, Comment: req.Comment, OwnerID: owner.ID, Public: req.Public}, trackIDs)
+	if errors.Is(err, library.ErrNotFound) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		log.Printf("Query error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		return
+	}
+	respondPlaylist(c, p.ID, http.StatusCreated)
+}
+
+// @Summary Rename a playlist, or change its comment or visibility
+// @Description Only the owner can change a playlist.
+// @Accept json
+// @Produce json
+// @Param id path int true "Playlist ID"
+// @Param changes body updatePlaylistRequest true "Fields to change"
+// @Success 200 {object} playlistDetail
+// @Failure 400 {object} map[string]string
+// @Failure 401 {object} map[string]string
+// @Failure 403 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Router /playlists/{id} [patch]
+func updatePlaylistHandler(c *gin.Context) {
+	p, ok := findPlaylist(c, true)
+	if !ok {
+		return
+	}
+	var req updatePlaylistRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid body: " + err.Error()})
+		return
+	}
+	if req.Name != nil {
+		if *req.Name == "" || len(*req.Name) > maxPlaylistName {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("name must be 1 to %d characters", maxPlaylistName)})
+			return
+		}
+		p.Name = *req.Name
+	}
+	if req.Comment != nil {
+		p.Comment = *req.Comment
+	}
+	if req.Public != nil {
+		p.Public = *req.Public
+	}
+
+	if err := repo.UpdatePlaylist(p); err != nil {
+		log.Printf("Query error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		return
+	}
+	respondPlaylist(c, p.ID, http.StatusOK)
+}
+
+// @Summary Delete a playlist
+// @Description Only the owner can delete a playlist.
+// @Param id path int true "Playlist ID"
+// @Success 204
+// @Failure 401 {object} map[string]string
+// @Failure 403 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Router /playlists/{id} [delete]
+func deletePlaylistHandler(c *gin.Context) {
+	p, ok := findPlaylist(c, true)
+	if !ok {
+		return
+	}
+	if err := repo.DeletePlaylist(p.ID); err != nil && !errors.Is(err, library.ErrNotFound) {
+		log.Printf("Query error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// @Summary Replace the tracks of a playlist
+// @Description Only the owner can change a playlist. With duplicates=skip, repeated tracks are kept once; with reject, they fail with 409.
+// @Accept json
+// @Produce json
+// @Param id path int true "Playlist ID"
+// @Param tracks body playlistTracksRequest true "Tracks in order"
+// @Success 200 {object} playlistDetail
+// @Failure 400 {object} map[string]string
+// @Failure 401 {object} map[string]string
+// @Failure 403 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Failure 409 {object} map[string]string
+// @Router /playlists/{id}/tracks [put]
+func setPlaylistTracksHandler(c *gin.Context) {
+	p, ok := findPlaylist(c, true)
+	if !ok {
+		return
+	}
+	var req playlistTracksRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid body: " + err.Error()})
+		return
+	}
+	if !validDuplicates(c, req.Duplicates) {
+		return
+	}
+	editPlaylistTracks(c, p, func([]string) ([]string, error) {
+		return insertTracks(nil, req.TrackIDs, 0, req.Duplicates)
+	})
+}
+
+// @Summary Add tracks to a playlist
+// @Description Inserts tracks before the entry at position, or at the end. Only the owner can change a playlist. With duplicates=skip, tracks already in the playlist are left out; with reject, they fail with 409.
+// @Accept json
+// @Produce json
+// @Param id path int true "Playlist ID"
+// @Param tracks body playlistTracksRequest true "Tracks to add"
+// @Success 200 {object} playlistDetail
+// @Failure 400 {object} map[string]string
+// @Failure 401 {object} map[string]string
+// @Failure 403 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Failure 409 {object} map[string]string
+// @Router /playlists/{id}/tracks [post]
+func addPlaylistTracksHandler(c *gin.Context) {
+	p, ok := findPlaylist(c, true)
+	if !ok {
+		return
+	}
+	var req playlistTracksRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid body: " + err.Error()})
+		return
+	}
+	if !validDuplicates(c, req.Duplicates) {
+		return
+	}
+	editPlaylistTracks(c, p, func(trackIDs []string) ([]string, error) {
+		position := len(trackIDs)
+		if req.Position != nil {
+			position = *req.Position
+		}
+		return insertTracks(trackIDs, req.TrackIDs, position, req.Duplicates)
+	})
+}
+
+// checkEntry returns an error unless position is that of an entry among trackIDs.
+func checkEntry(trackIDs []string, position int) error {
+	if position < 0 || position >= len(trackIDs) {
+		return &playlistError{http.StatusNotFound, "no entry at position " + strconv.Itoa(position)}
+	}
+	return nil
+}
+
+// @Summary Move a playlist entry
+// @Description Moves the entry at a position to another, shifting the entries in between. Only the owner can change a playlist.
+// @Accept json
+// @Produce json
+// @Param id path int true "Playlist ID"
+// @Param position path int true "Current position of the entry, from 0"
+// @Param move body moveEntryRequest true "New position of the entry"
+// @Success 200 {object} playlistDetail
+// @Failure 400 {object} map[string]string
+// @Failure 401 {object} map[string]string
+// @Failure 403 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Router /playlists/{id}/tracks/{position} [patch]
+func movePlaylistEntryHandler(c *gin.Context) {
+	p, ok := findPlaylist(c, true)
+	if !ok {
+		return
+	}
+	from, ok := idParam(c, "position")
+	if !ok {
+		return
+	}
+	var req moveEntryRequest
+	if err := c.ShouldBindJSON(&req); err != nil || req.Position == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "body must hold the new position"})
+		return
+	}
+	to := *req.Position
+	editPlaylistTracks(c, p, func(trackIDs []string) ([]string, error) {
+		if err := checkEntry(trackIDs, from); err != nil {
+			return nil, err
+		}
+		if to < 0 || to >= len(trackIDs) {
+			return nil, &playlistError{http.StatusBadRequest, fmt.Sprintf("position must be between 0 and %d", len(trackIDs)-1)}
+		}
+		id := trackIDs[from]
+		trackIDs = append(trackIDs[:from], trackIDs[from+1:]...)
+		return append(trackIDs[:to], append([]string{id}, trackIDs[to:]...)...), nil
+	})
+}
+
+// @Summary Remove a playlist entry
+// @Description Removes the entry at a position; later entries move up. Only the owner can change a playlist.
+// @Produce json
+// @Param id path int true "Playlist ID"
+// @Param position path int true "Position of the entry, from 0"
+// @Success 200 {object} playlistDetail
+// @Failure 401 {object} map[string]string
+// @Failure 403 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Router /playlists/{id}/tracks/{position} [delete]
+func removePlaylistEntryHandler(c *gin.Context) {
+	p, ok := findPlaylist(c, true)
+	if !ok {
+		return
+	}
+	position, ok := idParam(c, "position")
+	if !ok {
+		return
+	}
+	editPlaylistTracks(c, p, func(trackIDs []string) ([]string, error) {
+		if err := checkEntry(trackIDs, position); err != nil {
+			return nil, err
+		}
+		return append(trackIDs[:position], trackIDs[position+1:]...), nil
+	})
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"heavymetal/library"
+)
+
+// playlistRequest sends a JSON body to r, as the named user with their password
+// "account password", or anonymously if name is empty.
+func playlistRequest(r http.Handler, method, url, name, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, url, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if name != "" {
+		req.SetBasicAuth(name, "account password")
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestPlaylistsNeedAnOwner(t *testing.T) {
+	db := newTestLibrary(t)
+	alice := newTestUser(t, db, "alice", "account password")
+	newTestUser(t, db, "bob", "account password")
+	r := newRouter(true)
+
+	if w := playlistRequest(r, http.MethodPost, "/playlists", "", `{"name": "Anonymous"}`); w.Code != http.StatusUnauthorized {
+		t.Errorf("anonymous create: status %d, want 401", w.Code)
+	}
+	w := playlistRequest(r, http.MethodPost, "/playlists", "alice", `{"name": "Mine", "public": true}`)
+	var p library.Playlist
+	if w.Code != http.StatusCreated || json.Unmarshal(w.Body.Bytes(), &p) != nil {
+		t.Fatalf("create: status %d: %s", w.Code, w.Body)
+	}
+	if p.OwnerID != alice.ID || p.Owner != "alice" {
+		t.Errorf("owner = %d %q, want %d alice", p.OwnerID, p.Owner, alice.ID)
+	}
+
+	path := "/playlists/" + strconv.Itoa(p.ID)
+	for name, want := range map[string]int{"": http.StatusUnauthorized, "bob": http.StatusForbidden, "alice": http.StatusOK} {
+		if w := playlistRequest(r, http.MethodPatch, path, name, `{"comment": "changed"}`); w.Code != want {
+			t.Errorf("change by %q: status %d, want %d", name, w.Code, want)
+		}
+	}
+	if w := playlistRequest(r, http.MethodGet, "/playlists", "", ""); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"Mine"`) {
+		t.Errorf("anonymous listing: status %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestSubsonicPlaylistsNeedAnOwner(t *testing.T) {
+	db := newTestLibrary(t)
+	useSubsonicKey(t)
+	alice := newTestUser(t, db, "alice", "account password")
+	p, err := db.CreatePlaylist(library.Playlist{Name: "Mine", OwnerID: alice.ID}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := newRouter(true)
+
+	// In open mode a wrong password goes through anonymously, not as the user it names
+	for _, tc := range []struct {
+		name   string
+		params url.Values
+		want   int
+	}{
+		{"create", url.Values{"name": {"Anonymous"}}, subsonicErrBadCredentials},
+		// The private playlist of alice is not even there for anonymous requests
+		{"change of alice", url.Values{"playlistId": {strconv.Itoa(p.ID)}, "u": {"alice"}, "p": {"wrong password"}}, subsonicErrNotFound},
+	} {
+		tc.params.Set("f", "json")
+		w := request(r, http.MethodGet, "/rest/createPlaylist?"+tc.params.Encode())
+		var body struct {
+			Response subsonicResponse `json:"subsonic-response"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+		if body.Response.Error == nil || body.Response.Error.Code != tc.want {
+			t.Errorf("anonymous %s: %+v, want error %d", tc.name, body.Response.Error, tc.want)
+		}
+	}
+	playlists, _, err := db.Playlists(0, library.PlaylistFilter{}, library.Page{Limit: -1})
+	if err != nil || len(playlists) != 0 {
+		t.Errorf("anonymous requests created %v, %v", playlists, err)
+	}
+}
+
+func TestGuestNameReserved(t *testing.T) {
+	for _, name := range []string{"guest", "Guest"} {
+		if err := validateUserName(name); err == nil {
+			t.Errorf("validateUserName(%q) accepted a reserved name", name)
+		}
+	}
+	if err := validateUserName("guests"); err != nil {
+		t.Errorf("validateUserName(guests): %v", err)
+	}
+}
+
+func TestInsertTracks(t *testing.T) {
+	current := []string{"a", "b"}
+	for _, tc := range []struct {
+		name     string
+		trackIDs []string
+		position int
+		policy   string
+		want     []string
+		status   int // Of the playlistError expected instead
+	}{
+		{"at the end", []string{"c"}, 2, "", []string{"a", "b", "c"}, 0},
+		{"at the start", []string{"c", "d"}, 0, duplicatesAllow, []string{"c", "d", "a", "b"}, 0},
+		{"in between", []string{"c"}, 1, "", []string{"a", "c", "b"}, 0},
+		{"before the start", []string{"c"}, -1, "", nil, http.StatusBadRequest},
+		{"past the end", []string{"c"}, 3, "", nil, http.StatusBadRequest},
+		{"allowed duplicates", []string{"a", "c", "c"}, 2, duplicatesAllow, []string{"a", "b", "a", "c", "c"}, 0},
+		{"skipped duplicates", []string{"a", "c", "c"}, 2, duplicatesSkip, []string{"a", "b", "c"}, 0},
+		{"rejected duplicate of an entry", []string{"c", "b"}, 2, duplicatesReject, nil, http.StatusConflict},
+		{"rejected repeat", []string{"c", "c"}, 2, duplicatesReject, nil, http.StatusConflict},
+		{"nothing", nil, 1, duplicatesReject, []string{"a", "b"}, 0},
+	} {
+		got, err := insertTracks(current, tc.trackIDs, tc.position, tc.policy)
+		var perr *playlistError
+		switch {
+		case tc.status != 0:
+			if !errors.As(err, &perr) || perr.Status != tc.status {
+				t.Errorf("%s: %v, %v; want status %d", tc.name, got, err, tc.status)
+			}
+		case err != nil || strings.Join(got, " ") != strings.Join(tc.want, " "):
+			t.Errorf("%s: %v, %v; want %v", tc.name, got, err, tc.want)
+		}
+	}
+	if strings.Join(current, " ") != "a b" {
+		t.Errorf("insertTracks changed the current tracks to %v", current)
+	}
+}
+
+func TestEditPlaylistEntries(t *testing.T) {
+	db := newTestLibrary(t)
+	alice := newTestUser(t, db, "alice", "account password")
+	newTestUser(t, db, "bob", "account password")
+	for _, id := range []string{"a", "b", "c"} {
+		addTestTrack(t, db, id, id+".mp3", "mpeg", testAudio(10))
+	}
+	p, err := db.CreatePlaylist(library.Playlist{Name: "Mine", OwnerID: alice.ID}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := newRouter(true)
+	path := "/playlists/" + strconv.Itoa(p.ID) + "/tracks/"
+
+	for _, tc := range []struct {
+		name   string
+		method string
+		url    string
+		user   string
+		body   string
+		status int
+		want   string // Tracks after the request, from a b c
+	}{
+		{"move down", http.MethodPatch, path + "0", "alice", `{"position": 2}`, http.StatusOK, "b c a"},
+		{"move up", http.MethodPatch, path + "2", "alice", `{"position": 0}`, http.StatusOK, "c a b"},
+		{"move in place", http.MethodPatch, path + "1", "alice", `{"position": 1}`, http.StatusOK, "a b c"},
+		{"move a missing entry", http.MethodPatch, path + "3", "alice", `{"position": 0}`, http.StatusNotFound, "a b c"},
+		{"move past the end", http.MethodPatch, path + "0", "alice", `{"position": 3}`, http.StatusBadRequest, "a b c"},
+		{"move before the start", http.MethodPatch, path + "0", "alice", `{"position": -1}`, http.StatusBadRequest, "a b c"},
+		{"move nowhere", http.MethodPatch, path + "0", "alice", `{}`, http.StatusBadRequest, "a b c"},
+		{"move by position name", http.MethodPatch, path + "first", "alice", `{"position": 1}`, http.StatusNotFound, "a b c"},
+		{"move by another user", http.MethodPatch, path + "0", "bob", `{"position": 2}`, http.StatusNotFound, "a b c"},
+		{"remove", http.MethodDelete, path + "1", "alice", "", http.StatusOK, "a c"},
+		{"remove the last", http.MethodDelete, path + "2", "alice", "", http.StatusOK, "a b"},
+		{"remove a missing entry", http.MethodDelete, path + "3", "alice", "", http.StatusNotFound, "a b c"},
+		{"remove anonymously", http.MethodDelete, path + "0", "", "", http.StatusNotFound, "a b c"},
+	} {
+		if err := db.SetPlaylistTracks(p.ID, []string{"a", "b", "c"}); err != nil {
+			t.Fatal(err)
+		}
+		w := playlistRequest(r, tc.method, tc.url, tc.user, tc.body)
+		if w.Code != tc.status {
+			t.Errorf("%s: status %d, want %d: %s", tc.name, w.Code, tc.status, w.Body)
+		}
+		if w.Code == http.StatusOK {
+			var detail playlistDetail
+			if err := json.Unmarshal(w.Body.Bytes(), &detail); err != nil || len(detail.Tracks) != len(strings.Fields(tc.want)) {
+				t.Errorf("%s: response %s", tc.name, w.Body)
+			}
+		}
+		tracks, err := db.PlaylistTracks(p.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, track := range tracks {
+			got = append(got, track.ID)
+		}
+		if strings.Join(got, " ") != tc.want {
+			t.Errorf("%s: tracks %v, want %s", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestSubsonicUpdatePlaylistAllOrNothing(t *testing.T) {
+	db := newTestLibrary(t)
+	useSubsonicKey(t)
+	alice := newTestUser(t, db, "alice", "account password")
+	for _, id := range []string{"a", "b"} {
+		addTestTrack(t, db, id, id+".mp3", "mpeg", testAudio(10))
+	}
+	p, err := db.CreatePlaylist(library.Playlist{Name: "Old", OwnerID: alice.ID}, []string{"a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := newRouter(false)
+	setSubsonicPassword(t, r, "alice", "account password", "subsonic password")
+
+	for _, tc := range []struct {
+		name   string
+		params url.Values
+		want   int // Error code, or -1 for success
+		tracks string
+	}{
+		{"bad index", url.Values{"songIndexToRemove": {"1"}}, subsonicErrGeneric, "a"},
+		{"unknown song", url.Values{"songIdToAdd": {"nope"}}, subsonicErrNotFound, "a"},
+		{"bad public", url.Values{"public": {"maybe"}, "songIdToAdd": {"b"}}, subsonicErrGeneric, "a"},
+		{"valid", url.Values{"songIndexToRemove": {"0"}, "songIdToAdd": {"b"}}, -1, "b"},
+	} {
+		params := tc.params
+		params.Set("name", "New "+tc.name)
+		params.Set("playlistId", strconv.Itoa(p.ID))
+		params.Set("u", "alice")
+		params.Set("p", "subsonic password")
+		params.Set("f", "json")
+		w := request(r, http.MethodGet, "/rest/updatePlaylist?"+params.Encode())
+		var body struct {
+			Response subsonicResponse `json:"subsonic-response"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatalf("%s: %v: %s", tc.name, err, w.Body)
+		}
+		code := -1
+		if body.Response.Error != nil {
+			code = body.Response.Error.Code
+		}
+		if code != tc.want {
+			t.Errorf("%s: code %d, want %d", tc.name, code, tc.want)
+		}
+
+		got, err := db.Playlist(p.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wantName := "Old"
+		if tc.want == -1 {
+			wantName = "New " + tc.name
+		}
+		if got.Name != wantName {
+			t.Errorf("%s: name %q, want %q", tc.name, got.Name, wantName)
+		}
+		tracks, err := db.PlaylistTracks(p.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for _, track := range tracks {
+			ids = append(ids, track.ID)
+		}
+		if strings.Join(ids, " ") != tc.tracks {
+			t.Errorf("%s: tracks %v, want %s", tc.name, ids, tc.tracks)
+		}
+	}
+}
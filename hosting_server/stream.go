@@ -0,0 +1,234 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"heavymetal/library"
+
+	"github.com/gin-gonic/gin"
+)
+
+// containerTypes maps the containers recorded by the indexer to MIME types.
+var containerTypes = map[string]string{
+	"mpeg": "audio/mpeg",
+	"flac": "audio/flac",
+	"mp4":  "audio/mp4",
+	"ogg":  "audio/ogg",
+	"wav":  "audio/wav",
+	"aiff": "audio/aiff",
+}
+
+// extensionTypes maps file extensions to MIME types, for files whose container the
+// indexer could not read.
+var extensionTypes = map[string]string{
+	".mp3":  "audio/mpeg",
+	".flac": "audio/flac",
+	".m4a":  "audio/mp4",
+	".ogg":  "audio/ogg",
+	".opus": "audio/ogg",
+	".aac":  "audio/aac",
+	".wma":  "audio/x-ms-wma",
+	".wav":  "audio/wav",
+	".aiff": "audio/aiff",
+	".aif":  "audio/aiff",
+}
+
+// audioContentType returns the MIME type of a track's file, from the container the
+// indexer found in it or else from its extension.
+func audioContentType(t library.Track) string {
+	if ct, ok := containerTypes[t.Container]; ok {
+		return ct
+	}
+	if ct, ok := extensionTypes[strings.ToLower(filepath.Ext(t.FilePath))]; ok {
+		return ct
+	}
+	return "application/octet-stream"
+}
+
+// fileETag returns a strong entity tag that changes whenever the file is replaced or
+// modified.
+func fileETag(fi os.FileInfo) string {
+	return fmt.Sprintf(`"%x-%x"`, fi.Size(), fi.ModTime().UnixNano())
+}
+
+// openTrackFile looks up the track named by the id path parameter and opens its audio
+// file, answering 404 if either is missing. The caller must close the file.
+func openTrackFile(c *gin.Context) (library.Track, *os.File, os.FileInfo, bool) {
+	id := c.Param("id")
+	track, err := repo.Track(id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "track not found"})
+		return track, nil, nil, false
+	}
+
+	f, err := os.Open(track.FilePath)
+	if err != nil {
+		log.Printf("Error opening audio file of track %s: %v", id, err)
+		c.JSON(http.StatusNotFound, gin.H{"error": "audio file not found"})
+		return track, nil, nil, false
+	}
+	fi, err := f.Stat()
+	if err != nil || fi.IsDir() {
+		f.Close()
+		log.Printf("Error reading audio file of track %s: %v", id, err)
+		c.JSON(http.StatusNotFound, gin.H{"error": "audio file not found"})
+		return track, nil, nil, false
+	}
+	return track, f, fi, true
+}
+
+// @Summary Stream audio file
+// @Description Without format, serves the file as is with its real MIME type. It supports byte ranges (206 Partial Content) for seeking, and conditional requests with If-None-Match, If-Modified-Since and If-Range against the ETag and Last-Modified headers.
+// @Description With format, transcodes the file on the fly, optionally starting at time_offset. Finished transcodes from the start are cached on disk, and once cached they are served with ranges and validators too.
+// @Produce audio/mpeg,audio/flac,audio/mp4,audio/ogg,audio/aac,audio/wav,audio/aiff
+// @Param id path string true "Track HumanHash ID"
+// @Param format query string false "Transcode to opus, ogg (Vorbis), mp3 or aac"
+// @Param bitrate query int false "Transcode bitrate in kbit/s, 32 to 320 (default 128 for opus, 192 for mp3, 160 otherwise)"
+// @Param time_offset query number false "Seconds into the track to start the transcode at"
+// @Param Range header string false "Byte range, e.g. bytes=1000-"
+// @Success 200 {file} string
+// @Success 206 {file} string
+// @Success 304 {string} string "Not modified"
+// @Failure 400 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Failure 416 {string} string "Range not satisfiable"
+// @Failure 501 {object} map[string]string
+// @Router /stream/{id} [get]
+func streamTrackHandler(c *gin.Context) {
+	track, f, fi, ok := openTrackFile(c)
+	if !ok {
+		return
+	}
+	defer f.Close()
+
+	if c.Query("format") != "" {
+		opts, ok := transcodeParams(c)
+		if !ok {
+			return
+		}
+		streamTranscode(c, track, fi, opts)
+		return
+	}
+	if c.Query("bitrate") != "" || c.Query("time_offset") != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "bitrate and time_offset need a format"})
+		return
+	}
+
+	serveTrackFile(c, track, f, fi)
+}
+
+// serveTrackFile sends the audio file of a track as is.
+func serveTrackFile(c *gin.Context, track library.Track, f *os.File, fi os.FileInfo) {
+	c.Header("Content-Type", audioContentType(track))
+	c.Header("ETag", fileETag(fi))
+	// ServeContent answers ranges, conditional requests and HEAD from these headers
+	http.ServeContent(c.Writer, c.Request, "", fi.ModTime(), f)
+}
+
+// transcodeParams reads the format, bitrate and time_offset query parameters of a
+// transcoded stream, answering 400 if they are invalid.
+func transcodeParams(c *gin.Context) (TranscodeOptions, bool) {
+	opts := TranscodeOptions{Format: c.Query("format")}
+	format, ok := transcodeFormats[opts.Format]
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be one of opus, ogg, mp3 or aac"})
+		return opts, false
+	}
+
+	opts.Bitrate = format.defaultBitrate
+	if b := c.Query("bitrate"); b != "" {
+		v, err := strconv.Atoi(b)
+		if err != nil || v < minTranscodeBitrate || v > maxTranscodeBitrate {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("bitrate must be between %d and %d", minTranscodeBitrate, maxTranscodeBitrate)})
+			return opts, false
+		}
+		opts.Bitrate = v
+	}
+
+	if t := c.Query("time_offset"); t != "" {
+		v, err := strconv.ParseFloat(t, 64)
+		if err != nil || v < 0 || math.IsInf(v, 0) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "time_offset must be a non-negative number of seconds"})
+			return opts, false
+		}
+		opts.Offset = time.Duration(v * float64(time.Second))
+	}
+	return opts, true
+}
+
+// streamTranscode sends a track transcoded as opts asks, from the cache if it is there.
+// Otherwise the transcode is streamed as it is produced, and kept in the cache if it
+// started at the beginning and ran to the end.
+func streamTranscode(c *gin.Context, track library.Track, fi os.FileInfo, opts TranscodeOptions) {
+	if transcoder == nil {
+		c.JSON(http.StatusNotImplemented, gin.H{"error": "transcoding is not available on this server"})
+		return
+	}
+	format := transcodeFormats[opts.Format]
+	// The size and mtime make a changed source file miss the cache
+	key := fmt.Sprintf("%s-%x-%x-%d%s", track.ID, fi.Size(), fi.ModTime().UnixNano(), opts.Bitrate, format.extension)
+	cacheable := transcodes != nil && opts.Offset == 0
+
+	if cacheable {
+		if cached := transcodes.open(key); cached != nil {
+			defer cached.Close()
+			c.Header("Content-Type", format.contentType)
+			// The cache file's own mtime tracks its use, so validators come from the source
+			c.Header("ETag", `"`+key+`"`)
+			http.ServeContent(c.Writer, c.Request, "", fi.ModTime(), cached)
+			return
+		}
+	}
+
+	c.Header("Content-Type", format.contentType)
+	// The length is unknown until the encoder is done, so there is nothing to seek in
+	c.Header("Accept-Ranges", "none")
+	if c.Request.Method == http.MethodHead {
+		c.Status(http.StatusOK)
+		return
+	}
+
+	var (
+		w    io.Writer = c.Writer
+		part *os.File
+	)
+	if cacheable {
+		var err error
+		if part, err = transcodes.create(key); err != nil {
+			log.Printf("Transcode of track %s will not be cached: %v", track.ID, err)
+		} else {
+			w = io.MultiWriter(c.Writer, part)
+		}
+	}
+
+	err := transcoder.Transcode(c.Request.Context(), track.FilePath, opts, w)
+	if err != nil {
+		if part != nil {
+			transcodes.discard(part)
+		}
+		if c.Request.Context().Err() != nil {
+			return // The client went away
+		}
+		log.Printf("Error transcoding track %s: %v", track.ID, err)
+		if !c.Writer.Written() {
+			c.Writer.Header().Del("Content-Type")
+			c.Writer.Header().Del("Accept-Ranges")
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "transcoding failed"})
+		}
+		return
+	}
+	if part != nil {
+		if stored := transcodes.commit(part, key); stored != nil {
+			stored.Close()
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"heavymetal/library"
+)
+
+// addTestTrack writes data to a file named name in a temporary directory and indexes
+// it as track id, recorded with the given container.
+func addTestTrack(t *testing.T, db *library.DB, id, name, container string, data []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	af := library.AudioFile{HumanHashID: id, FilePath: path, Title: id, Container: container, DurationSeconds: 10}
+	var err error
+	if af.ArtistID, err = db.GetOrInsertArtist("Artist"); err != nil {
+		t.Fatal(err)
+	}
+	if af.AlbumID, err = db.GetOrInsertAlbum("Album", af.ArtistID, 0, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.UpsertAudioFile(&af); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// testAudio returns n bytes that differ from one offset to the next, so that ranges
+// can be told apart.
+func testAudio(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i * 7)
+	}
+	return b
+}
+
+func TestStreamRanges(t *testing.T) {
+	db := newTestLibrary(t)
+	data := testAudio(1000)
+	addTestTrack(t, db, "ranged", "song.mp3", "mpeg", data)
+	r := newRouter(true)
+
+	w := request(r, http.MethodGet, "/stream/ranged")
+	if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), data) {
+		t.Fatalf("full stream: status %d, %d bytes", w.Code, w.Body.Len())
+	}
+	if got := w.Header().Get("Accept-Ranges"); got != "bytes" {
+		t.Errorf("Accept-Ranges = %q, want bytes", got)
+	}
+	etag := w.Header().Get("ETag")
+	if etag == "" || w.Header().Get("Last-Modified") == "" {
+		t.Fatalf("missing validators: %v", w.Header())
+	}
+
+	w = request(r, http.MethodGet, "/stream/ranged", "Range", "bytes=600-")
+	if w.Code != http.StatusPartialContent {
+		t.Fatalf("open range: status %d, want 206", w.Code)
+	}
+	if got := w.Header().Get("Content-Range"); got != "bytes 600-999/1000" {
+		t.Errorf("Content-Range = %q, want bytes 600-999/1000", got)
+	}
+	if !bytes.Equal(w.Body.Bytes(), data[600:]) {
+		t.Errorf("open range body has %d bytes, want the last 400", w.Body.Len())
+	}
+
+	w = request(r, http.MethodGet, "/stream/ranged", "Range", "bytes=10-19")
+	if w.Code != http.StatusPartialContent || w.Header().Get("Content-Range") != "bytes 10-19/1000" || !bytes.Equal(w.Body.Bytes(), data[10:20]) {
+		t.Errorf("closed range: status %d, Content-Range %q, %d bytes", w.Code, w.Header().Get("Content-Range"), w.Body.Len())
+	}
+
+	w = request(r, http.MethodGet, "/stream/ranged", "Range", "bytes=2000-")
+	if w.Code != http.StatusRequestedRangeNotSatisfiable {
+		t.Errorf("range past the end: status %d, want 416", w.Code)
+	}
+	if got := w.Header().Get("Content-Range"); got != "bytes */1000" {
+		t.Errorf("416 Content-Range = %q, want bytes */1000", got)
+	}
+
+	w = request(r, http.MethodGet, "/stream/ranged", "If-None-Match", etag)
+	if w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Errorf("If-None-Match: status %d with %d bytes, want 304", w.Code, w.Body.Len())
+	}
+
+	// A range only applies while the file is the one the client has part of
+	w = request(r, http.MethodGet, "/stream/ranged", "Range", "bytes=600-", "If-Range", etag)
+	if w.Code != http.StatusPartialContent {
+		t.Errorf("current If-Range: status %d, want 206", w.Code)
+	}
+	w = request(r, http.MethodGet, "/stream/ranged", "Range", "bytes=600-", "If-Range", `"stale"`)
+	if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), data) {
+		t.Errorf("stale If-Range: status %d with %d bytes, want 200 with the whole file", w.Code, w.Body.Len())
+	}
+}
+
+func TestStreamETagChangesWithFile(t *testing.T) {
+	db := newTestLibrary(t)
+	path := addTestTrack(t, db, "edited", "song.flac", "flac", testAudio(100))
+	r := newRouter(true)
+	etag := request(r, http.MethodGet, "/stream/edited").Header().Get("ETag")
+
+	if err := os.WriteFile(path, testAudio(120), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	w := request(r, http.MethodGet, "/stream/edited", "If-None-Match", etag)
+	if w.Code != http.StatusOK || w.Body.Len() != 120 {
+		t.Errorf("If-None-Match after an edit: status %d with %d bytes, want 200 with 120", w.Code, w.Body.Len())
+	}
+}
+
+func TestStreamHead(t *testing.T) {
+	db := newTestLibrary(t)
+	addTestTrack(t, db, "headed", "song.ogg", "ogg", testAudio(500))
+	w := request(newRouter(true), http.MethodHead, "/stream/headed")
+	if w.Code != http.StatusOK {
+		t.Fatalf("HEAD: status %d, want 200", w.Code)
+	}
+	if w.Body.Len() != 0 {
+		t.Errorf("HEAD sent %d bytes of body", w.Body.Len())
+	}
+	for name, want := range map[string]string{"Content-Length": "500", "Content-Type": "audio/ogg", "Accept-Ranges": "bytes"} {
+		if got := w.Header().Get(name); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestStreamContentType(t *testing.T) {
+	db := newTestLibrary(t)
+	for _, tc := range []struct {
+		name, container, want string
+	}{
+		{"misnamed.mp3", "flac", "audio/flac"}, // The container wins over the extension
+		{"song.m4a", "mp4", "audio/mp4"},
+		{"unread.M4A", "", "audio/mp4"}, // Not read by the indexer: the extension decides
+		{"unread.opus", "", "audio/ogg"},
+		{"unread.aif", "", "audio/aiff"},
+		{"unknown.xyz", "", "application/octet-stream"},
+	} {
+		addTestTrack(t, db, tc.name, tc.name, tc.container, testAudio(10))
+		w := request(newRouter(true), http.MethodGet, "/stream/"+tc.name)
+		if got := w.Header().Get("Content-Type"); got != tc.want {
+			t.Errorf("%s with container %q: Content-Type = %q, want %q", tc.name, tc.container, got, tc.want)
+		}
+	}
+}
+
+func TestStreamNotFound(t *testing.T) {
+	db := newTestLibrary(t)
+	path := addTestTrack(t, db, "gone", "gone.mp3", "mpeg", testAudio(10))
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	r := newRouter(true)
+	for _, url := range []string{"/stream/nonexistent", "/stream/gone"} {
+		if w := request(r, http.MethodGet, url); w.Code != http.StatusNotFound {
+			t.Errorf("%s: status %d, want 404", url, w.Code)
+		}
+	}
+}
+
+func TestStreamOptionsNeedFormat(t *testing.T) {
+	db := newTestLibrary(t)
+	addTestTrack(t, db, "plain", "plain.mp3", "mpeg", testAudio(10))
+	r := newRouter(true)
+	for _, url := range []string{"/stream/plain?bitrate=128", "/stream/plain?time_offset=5", "/stream/plain?format=wav"} {
+		if w := request(r, http.MethodGet, url); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", url, w.Code)
+		}
+	}
+}
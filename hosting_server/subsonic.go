@@ -0,0 +1,322 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The Subsonic API lets existing Subsonic and OpenSubsonic apps (DSub, Symfonium,
+// Feishin, Sonixd...) use the library. Every method is served at /rest/{method} and
+// /rest/{method}.view, takes its parameters from the query string or a POSTed form, and
+// answers in XML or, with f=json, in JSON. Errors are reported in the body with HTTP
+// status 200, as clients expect.
+
+const (
+	subsonicAPIVersion = "1.16.1"
+	subsonicNamespace  = "http://subsonic.org/restapi"
+	subsonicServerType = "heavymetal"
+)
+
+// Error codes defined by the Subsonic API.
+const (
+	subsonicErrGeneric        = 0
+	subsonicErrMissingParam   = 10
+	subsonicErrBadCredentials = 40
+	subsonicErrTokenAuth      = 41
+	subsonicErrConflictAuth   = 43
+	subsonicErrInvalidAPIKey  = 44
+	subsonicErrUnauthorized   = 50
+	subsonicErrNotFound       = 70
+)
+
+// subsonicError is an error reported to a Subsonic client.
+type subsonicError struct {
+	Code    int    `xml:"code,attr" json:"code"`
+	Message string `xml:"message,attr" json:"message"`
+}
+
+func (e *subsonicError) Error() string { return e.Message }
+
+// subsonicMissing reports a missing required parameter.
+func subsonicMissing(name string) *subsonicError {
+	return &subsonicError{subsonicErrMissingParam, "required parameter is missing: " + name}
+}
+
+// subsonicNotFound reports that the thing a client asked for does not exist.
+func subsonicNotFound(what string) *subsonicError {
+	return &subsonicError{subsonicErrNotFound, what + " not found"}
+}
+
+// subsonicResponse is the subsonic-response envelope. A method sets the one payload
+// field it returns; the rest are left nil and omitted.
+type subsonicResponse struct {
+	XMLName       xml.Name `xml:"subsonic-response" json:"-"`
+	Xmlns         string   `xml:"xmlns,attr" json:"-"`
+	Status        string   `xml:"status,attr" json:"status"`
+	Version       string   `xml:"version,attr" json:"version"`
+	Type          string   `xml:"type,attr" json:"type"`
+	ServerVersion string   `xml:"serverVersion,attr" json:"serverVersion"`
+	OpenSubsonic  bool     `xml:"openSubsonic,attr" json:"openSubsonic"`
+
+	Error                  *subsonicError         `xml:"error,omitempty" json:"error,omitempty"`
+	License                *subsonicLicense       `xml:"license,omitempty" json:"license,omitempty"`
+	OpenSubsonicExtensions *[]subsonicExtension   `xml:"openSubsonicExtensions,omitempty" json:"openSubsonicExtensions,omitempty"`
+	MusicFolders           *subsonicMusicFolders  `xml:"musicFolders,omitempty" json:"musicFolders,omitempty"`
+	Genres                 *subsonicGenres        `xml:"genres,omitempty" json:"genres,omitempty"`
+	Indexes                *subsonicIndexes       `xml:"indexes,omitempty" json:"indexes,omitempty"`
+	Artists                *subsonicArtists       `xml:"artists,omitempty" json:"artists,omitempty"`
+	Directory              *subsonicDirectory     `xml:"directory,omitempty" json:"directory,omitempty"`
+	Artist                 *subsonicArtist        `xml:"artist,omitempty" json:"artist,omitempty"`
+	Album                  *subsonicAlbum         `xml:"album,omitempty" json:"album,omitempty"`
+	Song                   *subsonicChild         `xml:"song,omitempty" json:"song,omitempty"`
+	SearchResult3          *subsonicSearchResult3 `xml:"searchResult3,omitempty" json:"searchResult3,omitempty"`
+	AlbumList              *subsonicAlbumList     `xml:"albumList,omitempty" json:"albumList,omitempty"`
+	AlbumList2             *subsonicAlbumList2    `xml:"albumList2,omitempty" json:"albumList2,omitempty"`
+	RandomSongs            *subsonicSongs         `xml:"randomSongs,omitempty" json:"randomSongs,omitempty"`
+	Playlists              *subsonicPlaylists     `xml:"playlists,omitempty" json:"playlists,omitempty"`
+	Playlist               *subsonicPlaylist      `xml:"playlist,omitempty" json:"playlist,omitempty"`
+}
+
+type subsonicLicense struct {
+	Valid bool `xml:"valid,attr" json:"valid"`
+}
+
+type subsonicExtension struct {
+	Name     string `xml:"name,attr" json:"name"`
+	Versions []int  `xml:"versions" json:"versions"`
+}
+
+type subsonicMusicFolders struct {
+	MusicFolder []subsonicMusicFolder `xml:"musicFolder" json:"musicFolder"`
+}
+
+type subsonicMusicFolder struct {
+	ID   int    `xml:"id,attr" json:"id"`
+	Name string `xml:"name,attr" json:"name"`
+}
+
+// subsonicMethod serves one method of the Subsonic API. It returns the response to
+// send, or nil if it has written the response itself, as the media methods do.
+type subsonicMethod func(c *gin.Context) (*subsonicResponse, error)
+
+// subsonicMethods maps the name of every supported method to its handler.
+var subsonicMethods = map[string]subsonicMethod{
+	"ping":                      subsonicPing,
+	"getLicense":                subsonicGetLicense,
+	"getOpenSubsonicExtensions": subsonicGetOpenSubsonicExtensions,
+	"getMusicFolders":           subsonicGetMusicFolders,
+	"getGenres":                 subsonicGetGenres,
+	"getIndexes":                subsonicGetIndexes,
+	"getMusicDirectory":         subsonicGetMusicDirectory,
+	"getArtists":                subsonicGetArtists,
+	"getArtist":                 subsonicGetArtist,
+	"getAlbum":                  subsonicGetAlbum,
+	"getSong":                   subsonicGetSong,
+	"stream":                    subsonicStream,
+	"download":                  subsonicDownload,
+	"getCoverArt":               subsonicGetCoverArt,
+	"search3":                   subsonicSearch3,
+	"getAlbumList":              subsonicGetAlbumList,
+	"getAlbumList2":             subsonicGetAlbumList2,
+	"getRandomSongs":            subsonicGetRandomSongs,
+	"scrobble":                  subsonicScrobble,
+	"getPlaylists":              subsonicGetPlaylists,
+	"getPlaylist":               subsonicGetPlaylist,
+	"createPlaylist":            subsonicCreatePlaylist,
+	"updatePlaylist":            subsonicUpdatePlaylist,
+	"deletePlaylist":            subsonicDeletePlaylist,
+}
+
+// subsonicHandler dispatches /rest/{method} to the method's handler.
+func subsonicHandler(c *gin.Context) {
+	name := strings.TrimSuffix(c.Param("method"), ".view")
+	method, ok := subsonicMethods[name]
+	if !ok {
+		writeSubsonicError(c, &subsonicError{subsonicErrNotFound, "unknown method " + name})
+		return
+	}
+
+	resp, err := method(c)
+	var serr *subsonicError
+	switch {
+	case errors.As(err, &serr):
+		writeSubsonicError(c, serr)
+	case err != nil:
+		log.Printf("Query error: %v", err)
+		writeSubsonicError(c, &subsonicError{subsonicErrGeneric, "internal error"})
+	case resp != nil:
+		writeSubsonic(c, resp)
+	}
+}
+
+// writeSubsonic sends a response in the format the client asked for with f.
+func writeSubsonic(c *gin.Context, resp *subsonicResponse) {
+	resp.Xmlns = subsonicNamespace
+	resp.Version = subsonicAPIVersion
+	resp.Type = subsonicServerType
+	resp.ServerVersion = "1.0"
+	resp.OpenSubsonic = true
+	if resp.Status == "" {
+		resp.Status = "ok"
+	}
+
+	switch subsonicParam(c, "f") {
+	case "json":
+		c.JSON(http.StatusOK, gin.H{"subsonic-response": resp})
+	case "jsonp":
+		c.JSONP(http.StatusOK, gin.H{"subsonic-response": resp})
+	default:
+		body, err := xml.Marshal(resp)
+		if err != nil {
+			log.Printf("Error encoding Subsonic response: %v", err)
+			c.Status(http.StatusInternalServerError)
+			return
+		}
+		c.Data(http.StatusOK, "application/xml; charset=utf-8", append([]byte(xml.Header), body...))
+	}
+}
+
+// writeSubsonicError sends a failed response.
+func writeSubsonicError(c *gin.Context, err *subsonicError) {
+	writeSubsonic(c, &subsonicResponse{Status: "failed", Error: err})
+}
+
+// subsonicValues returns every value of a parameter, from the query string and from a
+// POSTed form.
+func subsonicValues(c *gin.Context, name string) []string {
+	c.Request.ParseForm()
+	return c.Request.Form[name]
+}
+
+// subsonicParam returns the first value of a parameter, or "" if it is absent.
+func subsonicParam(c *gin.Context, name string) string {
+	if v := subsonicValues(c, name); len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+// subsonicRequired returns the value of a required parameter.
+func subsonicRequired(c *gin.Context, name string) (string, error) {
+	v := subsonicParam(c, name)
+	if v == "" {
+		return "", subsonicMissing(name)
+	}
+	return v, nil
+}
+
+// subsonicInt returns a numeric parameter, or def if it is absent.
+func subsonicInt(c *gin.Context, name string, def int) (int, error) {
+	v := subsonicParam(c, name)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, &subsonicError{subsonicErrGeneric, name + " must be a number"}
+	}
+	return n, nil
+}
+
+// subsonicSize returns the size and offset parameters of a list method, with size
+// defaulting to def and capped at 500.
+func subsonicSize(c *gin.Context, def int) (size, offset int, err error) {
+	if size, err = subsonicInt(c, "size", def); err != nil {
+		return 0, 0, err
+	}
+	if offset, err = subsonicInt(c, "offset", 0); err != nil {
+		return 0, 0, err
+	}
+	return min(max(size, 0), 500), max(offset, 0), nil
+}
+
+// subsonicAuth checks the credentials Subsonic clients send with every request: either
+// an API key apiKey, alone, or a user name with a token and salt or a password, as
+// subsonicLogin checks them. With optional set, as in open mode, requests without
+// valid credentials go through anonymously instead of failing.
+func subsonicAuth(optional bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if key := subsonicParam(c, "apiKey"); key != "" {
+			subsonicAPIKeyAuth(c, key)
+			return
+		}
+		user, err := subsonicLogin(c)
+		if err != nil {
+			if optional && err.Code != subsonicErrGeneric {
+				c.Next()
+				return
+			}
+			writeSubsonicError(c, err)
+			c.Abort()
+			return
+		}
+		c.Set(userKey, user)
+		c.Next()
+	}
+}
+
+// subsonicAPIKeyAuth authenticates a Subsonic request with an API key, or with a
+// session token, which works the same.
+func subsonicAPIKeyAuth(c *gin.Context, key string) {
+	if subsonicParam(c, "u") != "" || subsonicParam(c, "p") != "" || subsonicParam(c, "t") != "" {
+		writeSubsonicError(c, &subsonicError{subsonicErrConflictAuth, "send either apiKey or u, not both"})
+		c.Abort()
+		return
+	}
+	token, user, ok, err := checkToken(key)
+	if err != nil {
+		log.Printf("Query error: %v", err)
+		writeSubsonicError(c, &subsonicError{subsonicErrGeneric, "internal error"})
+		c.Abort()
+		return
+	}
+	if !ok {
+		writeSubsonicError(c, &subsonicError{subsonicErrInvalidAPIKey, "invalid API key"})
+		c.Abort()
+		return
+	}
+	c.Set(userKey, user)
+	c.Set(tokenKey, token)
+	c.Next()
+}
+
+// subsonicUser returns the name of the user making a Subsonic request, or guestName
+// for anonymous requests in open mode, whatever the client sends as u.
+func subsonicUser(c *gin.Context) string {
+	if user, ok := currentUser(c); ok {
+		return user.Name
+	}
+	return guestName
+}
+
+func subsonicPing(c *gin.Context) (*subsonicResponse, error) {
+	return &subsonicResponse{}, nil
+}
+
+func subsonicGetLicense(c *gin.Context) (*subsonicResponse, error) {
+	return &subsonicResponse{License: &subsonicLicense{Valid: true}}, nil
+}
+
+// subsonicGetOpenSubsonicExtensions lists the OpenSubsonic extensions the server
+// implements: formPost, taking parameters from a POSTed form, and apiKeyAuthentication,
+// logging in with the API keys of /auth/keys.
+func subsonicGetOpenSubsonicExtensions(c *gin.Context) (*subsonicResponse, error) {
+	return &subsonicResponse{OpenSubsonicExtensions: &[]subsonicExtension{
+		{Name: "formPost", Versions: []int{1}},
+		{Name: "apiKeyAuthentication", Versions: []int{1}},
+	}}, nil
+}
+
+// subsonicGetMusicFolders lists the whole library as a single folder, since the
+// database does not record which music directory a file was indexed from.
+func subsonicGetMusicFolders(c *gin.Context) (*subsonicResponse, error) {
+	return &subsonicResponse{MusicFolders: &subsonicMusicFolders{
+		MusicFolder: []subsonicMusicFolder{{ID: 1, Name: "Music"}},
+	}}, nil
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"heavymetal/library"
+)
+
+// newSubsonicLibrary fills the test library with two albums and returns a router with
+// the credentials of a Subsonic user.
+func newSubsonicLibrary(t *testing.T) (*library.DB, http.Handler, url.Values) {
+	t.Helper()
+	db := newTestLibrary(t)
+	useSubsonicKey(t)
+	newTestUser(t, db, "alice", "account password")
+	r := newRouter(false)
+	setSubsonicPassword(t, r, "alice", "account password", "subsonic password")
+
+	for _, af := range []library.AudioFile{
+		{HumanHashID: "battery", Title: "Battery", TrackNumber: 1, ArtistName: "Metallica", AlbumTitle: "Master of Puppets", Year: 1986, Genres: []string{"Thrash Metal"}},
+		{HumanHashID: "orion", Title: "Orion", TrackNumber: 8, ArtistName: "Metallica", AlbumTitle: "Master of Puppets", Year: 1986, Genres: []string{"Thrash Metal"}},
+		{HumanHashID: "paranoid", Title: "Paranoid", TrackNumber: 2, ArtistName: "Black Sabbath", AlbumTitle: "Paranoid", Year: 1970, Genres: []string{"Heavy Metal"}},
+	} {
+		af.Container, af.DurationSeconds = "flac", 300
+		addLibraryTrack(t, db, af)
+	}
+	return db, r, url.Values{"u": {"alice"}, "p": {"subsonic password"}}
+}
+
+// callSubsonic calls a Subsonic method with auth and params in the format f, and
+// returns the body.
+func callSubsonic(t *testing.T, r http.Handler, method, f string, auth, params url.Values) []byte {
+	t.Helper()
+	q := url.Values{"c": {"test"}, "v": {"1.16.1"}, "f": {f}}
+	for _, values := range []url.Values{auth, params} {
+		for k, v := range values {
+			q[k] = v
+		}
+	}
+	w := request(r, http.MethodGet, "/rest/"+method+"?"+q.Encode())
+	if w.Code != http.StatusOK {
+		t.Fatalf("%s as %s: status %d: %s", method, f, w.Code, w.Body)
+	}
+	return w.Body.Bytes()
+}
+
+// xmlNode is an XML element, decoded generically to be walked like decoded JSON.
+type xmlNode struct {
+	XMLName  xml.Name
+	Attrs    []xml.Attr `xml:",any,attr"`
+	Text     string     `xml:",chardata"`
+	Children []xmlNode  `xml:",any"`
+}
+
+// subsonicPath looks up a dotted path in a response decoded from JSON or XML. Each
+// step names a key, or an element then an attribute; the JSON key "value" is the text
+// of an element. A step ending in [] must be a JSON array, whose first item is taken,
+// as is the first of repeated elements. It returns the value found, and false if the
+// path is missing or a step that should be an array is not.
+func subsonicPath(body []byte, format, path string) (string, bool) {
+	steps := strings.Split(path, ".")
+	if format == "json" {
+		var v any
+		if json.Unmarshal(body, &v) != nil {
+			return "", false
+		}
+		v = v.(map[string]any)["subsonic-response"]
+		for _, step := range steps {
+			key, isList := strings.CutSuffix(step, "[]")
+			m, ok := v.(map[string]any)
+			if !ok {
+				return "", false
+			}
+			if v, ok = m[key]; !ok {
+				return "", false
+			}
+			if isList {
+				list, ok := v.([]any)
+				if !ok || len(list) == 0 {
+					return "", false
+				}
+				v = list[0]
+			}
+		}
+		if _, ok := v.(map[string]any); ok {
+			return "", true
+		}
+		return fmt.Sprint(v), true
+	}
+
+	var node xmlNode
+	if xml.Unmarshal(body, &node) != nil {
+		return "", false
+	}
+	for i, step := range steps {
+		name := strings.TrimSuffix(step, "[]")
+		found := false
+		for _, child := range node.Children {
+			if child.XMLName.Local == name {
+				node, found = child, true
+				break
+			}
+		}
+		if found {
+			continue
+		}
+		if i < len(steps)-1 {
+			return "", false
+		}
+		if name == "value" {
+			return node.Text, true
+		}
+		for _, attr := range node.Attrs {
+			if attr.Name.Local == name {
+				return attr.Value, true
+			}
+		}
+		return "", false
+	}
+	return "", true
+}
+
+// subsonicCheck is a value expected at a path of a response, or only the path if want
+// is empty.
+type subsonicCheck struct {
+	path string
+	want string
+}
+
+func checkSubsonicResponse(t *testing.T, name string, body []byte, format string, checks []subsonicCheck) {
+	t.Helper()
+	for _, check := range checks {
+		got, ok := subsonicPath(body, format, check.path)
+		if !ok {
+			t.Errorf("%s as %s: no %s in %s", name, format, check.path, body)
+		} else if check.want != "" && got != check.want {
+			t.Errorf("%s as %s: %s = %q, want %q", name, format, check.path, got, check.want)
+		}
+	}
+}
+
+func TestSubsonicEnvelope(t *testing.T) {
+	_, r, auth := newSubsonicLibrary(t)
+
+	for _, f := range []string{"xml", "json"} {
+		body := callSubsonic(t, r, "ping", f, auth, nil)
+		checkSubsonicResponse(t, "ping", body, f, []subsonicCheck{
+			{"status", "ok"},
+			{"version", subsonicAPIVersion},
+			{"type", subsonicServerType},
+			{"openSubsonic", "true"},
+		})
+		if _, ok := subsonicPath(body, f, "error"); ok {
+			t.Errorf("ping as %s has an error: %s", f, body)
+		}
+
+		body = callSubsonic(t, r, "getAlbum", f, auth, nil)
+		checkSubsonicResponse(t, "getAlbum without id", body, f, []subsonicCheck{
+			{"status", "failed"},
+			{"version", subsonicAPIVersion},
+			{"error.code", fmt.Sprint(subsonicErrMissingParam)},
+			{"error.message", ""},
+		})
+		body = callSubsonic(t, r, "noSuchMethod", f, auth, nil)
+		checkSubsonicResponse(t, "unknown method", body, f, []subsonicCheck{{"status", "failed"}, {"error.code", fmt.Sprint(subsonicErrNotFound)}})
+	}
+
+	// XML responses are in the Subsonic namespace, and .view suffixes are accepted
+	body := callSubsonic(t, r, "ping.view", "xml", auth, nil)
+	var root xmlNode
+	if err := xml.Unmarshal(body, &root); err != nil || root.XMLName.Local != "subsonic-response" || root.XMLName.Space != subsonicNamespace {
+		t.Errorf("XML root %v, %v: %s", root.XMLName, err, body)
+	}
+	if !strings.HasPrefix(string(body), "<?xml") {
+		t.Errorf("XML response without a declaration: %s", body)
+	}
+}
+
+func TestSubsonicBrowsingShapes(t *testing.T) {
+	db, r, auth := newSubsonicLibrary(t)
+	artist, err := db.GetOrInsertArtist("Metallica")
+	if err != nil {
+		t.Fatal(err)
+	}
+	album, err := db.GetOrInsertAlbum("Master of Puppets", artist, 1986, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	albumID, artistID := subsonicAlbumID(album), subsonicArtistID(artist)
+
+	for _, tc := range []struct {
+		method string
+		params url.Values
+		checks []subsonicCheck
+	}{
+		{"getMusicFolders", nil, []subsonicCheck{{"musicFolders.musicFolder[].id", ""}, {"musicFolders.musicFolder[].name", ""}}},
+		{"getGenres", nil, []subsonicCheck{{"genres.genre[].value", "Heavy Metal"}, {"genres.genre[].songCount", "1"}}},
+		{"getArtists", nil, []subsonicCheck{
+			{"artists.ignoredArticles", subsonicIgnoredArticles},
+			{"artists.index[].name", "B"},
+			{"artists.index[].artist[].name", "Black Sabbath"},
+			{"artists.index[].artist[].albumCount", "1"},
+		}},
+		{"getIndexes", nil, []subsonicCheck{{"indexes.lastModified", ""}, {"indexes.index[].artist[].name", "Black Sabbath"}}},
+		{"getArtist", url.Values{"id": {artistID}}, []subsonicCheck{
+			{"artist.id", artistID},
+			{"artist.name", "Metallica"},
+			{"artist.album[].name", "Master of Puppets"},
+			{"artist.album[].songCount", "2"},
+		}},
+		{"getAlbum", url.Values{"id": {albumID}}, []subsonicCheck{
+			{"album.id", albumID},
+			{"album.name", "Master of Puppets"},
+			{"album.artist", "Metallica"},
+			{"album.year", "1986"},
+			{"album.songCount", "2"},
+			{"album.duration", "600"},
+			{"album.song[].id", "battery"},
+			{"album.song[].title", "Battery"},
+			{"album.song[].track", "1"},
+			{"album.song[].albumId", albumID},
+		}},
+		{"getSong", url.Values{"id": {"orion"}}, []subsonicCheck{
+			{"song.id", "orion"},
+			{"song.parent", albumID},
+			{"song.isDir", "false"},
+			{"song.title", "Orion"},
+			{"song.album", "Master of Puppets"},
+			{"song.artist", "Metallica"},
+			{"song.track", "8"},
+			{"song.genre", "Thrash Metal"},
+			{"song.suffix", "flac"},
+			{"song.contentType", "audio/flac"},
+			{"song.duration", "300"},
+			{"song.type", "music"},
+		}},
+		{"getMusicDirectory", url.Values{"id": {albumID}}, []subsonicCheck{
+			{"directory.id", albumID},
+			{"directory.name", "Master of Puppets"},
+			{"directory.child[].id", "battery"},
+			{"directory.child[].isDir", "false"},
+		}},
+		{"search3", url.Values{"query": {"orion"}}, []subsonicCheck{{"searchResult3.song[].id", "orion"}}},
+		{"search3", url.Values{"query": {"metallica"}}, []subsonicCheck{
+			{"searchResult3.artist[].name", "Metallica"},
+			{"searchResult3.album[].name", "Master of Puppets"},
+			{"searchResult3.song[].artist", "Metallica"},
+		}},
+		{"getAlbumList2", url.Values{"type": {"alphabeticalByName"}}, []subsonicCheck{
+			{"albumList2.album[].name", "Master of Puppets"},
+			{"albumList2.album[].artist", "Metallica"},
+			{"albumList2.album[].songCount", "2"},
+		}},
+		{"getAlbumList2", url.Values{"type": {"byYear"}, "fromYear": {"1960"}, "toYear": {"1979"}}, []subsonicCheck{{"albumList2.album[].name", "Paranoid"}}},
+		{"getAlbumList", url.Values{"type": {"alphabeticalByName"}}, []subsonicCheck{{"albumList.album[].title", "Master of Puppets"}, {"albumList.album[].isDir", "true"}}},
+		{"getRandomSongs", url.Values{"size": {"1"}, "genre": {"Heavy Metal"}}, []subsonicCheck{{"randomSongs.song[].id", "paranoid"}}},
+	} {
+		for _, f := range []string{"xml", "json"} {
+			body := callSubsonic(t, r, tc.method, f, auth, tc.params)
+			checkSubsonicResponse(t, strings.TrimSpace(tc.method+" "+tc.params.Encode()), body, f, append([]subsonicCheck{{"status", "ok"}}, tc.checks...))
+		}
+	}
+}
+
+func TestSubsonicScrobble(t *testing.T) {
+	_, r, auth := newSubsonicLibrary(t)
+
+	for _, f := range []string{"xml", "json"} {
+		body := callSubsonic(t, r, "scrobble", f, auth, url.Values{"id": {"paranoid"}, "time": {"1700000000000"}})
+		checkSubsonicResponse(t, "scrobble", body, f, []subsonicCheck{{"status", "ok"}})
+		body = callSubsonic(t, r, "scrobble", f, auth, url.Values{"id": {"nope"}})
+		checkSubsonicResponse(t, "scrobble of a missing song", body, f, []subsonicCheck{{"status", "failed"}, {"error.code", fmt.Sprint(subsonicErrNotFound)}})
+	}
+	// Only submissions count as plays, so Paranoid was played twice and nothing else
+	callSubsonic(t, r, "scrobble", "json", auth, url.Values{"id": {"battery"}, "submission": {"false"}})
+	for _, f := range []string{"xml", "json"} {
+		body := callSubsonic(t, r, "getAlbumList2", f, auth, url.Values{"type": {"frequent"}})
+		checkSubsonicResponse(t, "frequent albums", body, f, []subsonicCheck{{"albumList2.album[].name", "Paranoid"}})
+		body = callSubsonic(t, r, "getAlbumList2", f, auth, url.Values{"type": {"recent"}})
+		checkSubsonicResponse(t, "recent albums", body, f, []subsonicCheck{{"albumList2.album[].name", "Paranoid"}})
+	}
+}
+
+func TestSubsonicPlaylistShapes(t *testing.T) {
+	_, r, auth := newSubsonicLibrary(t)
+
+	var id string
+	for _, f := range []string{"xml", "json"} {
+		body := callSubsonic(t, r, "createPlaylist", f, auth, url.Values{"name": {"Loud " + f}, "songId": {"battery", "paranoid"}})
+		checkSubsonicResponse(t, "createPlaylist", body, f, []subsonicCheck{
+			{"status", "ok"},
+			{"playlist.name", "Loud " + f},
+			{"playlist.owner", "alice"},
+			{"playlist.public", "false"},
+			{"playlist.songCount", "2"},
+			{"playlist.duration", "600"},
+			{"playlist.created", ""},
+			{"playlist.changed", ""},
+			{"playlist.entry[].id", "battery"},
+		})
+		id, _ = subsonicPath(body, f, "playlist.id")
+	}
+
+	for _, f := range []string{"xml", "json"} {
+		body := callSubsonic(t, r, "getPlaylists", f, auth, nil)
+		checkSubsonicResponse(t, "getPlaylists", body, f, []subsonicCheck{
+			{"playlists.playlist[].name", "Loud json"},
+			{"playlists.playlist[].songCount", "2"},
+		})
+		if _, ok := subsonicPath(body, f, "playlists.playlist[].entry[]"); ok {
+			t.Errorf("getPlaylists as %s lists songs: %s", f, body)
+		}
+
+		body = callSubsonic(t, r, "updatePlaylist", f, auth, url.Values{"playlistId": {id}, "songIndexToRemove": {"0"}, "comment": {"Just one " + f}})
+		checkSubsonicResponse(t, "updatePlaylist", body, f, []subsonicCheck{{"status", "ok"}})
+		body = callSubsonic(t, r, "getPlaylist", f, auth, url.Values{"id": {id}})
+		checkSubsonicResponse(t, "getPlaylist", body, f, []subsonicCheck{
+			{"playlist.id", id},
+			{"playlist.comment", "Just one " + f},
+			{"playlist.songCount", "1"},
+			{"playlist.entry[].id", "paranoid"},
+			{"playlist.entry[].title", "Paranoid"},
+		})
+		// Put the removed song back for the other format
+		callSubsonic(t, r, "createPlaylist", f, auth, url.Values{"playlistId": {id}, "songId": {"battery", "paranoid"}})
+	}
+
+	for _, f := range []string{"xml", "json"} {
+		body := callSubsonic(t, r, "deletePlaylist", f, auth, url.Values{"id": {id}})
+		want := []subsonicCheck{{"status", "ok"}}
+		if f == "json" {
+			want = []subsonicCheck{{"status", "failed"}, {"error.code", fmt.Sprint(subsonicErrNotFound)}}
+		}
+		checkSubsonicResponse(t, "deletePlaylist", body, f, want)
+	}
+}
@@ -0,0 +1,798 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"math"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"heavymetal/library"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Subsonic IDs are opaque strings. Tracks keep their human hash IDs, while artist and
+// album IDs are prefixed so that getMusicDirectory and getCoverArt can tell them apart.
+const (
+	subsonicArtistPrefix = "ar-"
+	subsonicAlbumPrefix  = "al-"
+	// Only used for the cover art of playlists, whose IDs are plain numbers otherwise
+	subsonicPlaylistPrefix = "pl-"
+)
+
+func subsonicArtistID(id int) string { return subsonicArtistPrefix + strconv.Itoa(id) }
+func subsonicAlbumID(id int) string  { return subsonicAlbumPrefix + strconv.Itoa(id) }
+
+// parseSubsonicID returns the number of an artist or album ID with the given prefix.
+func parseSubsonicID(id, prefix string) (int, bool) {
+	rest, ok := strings.CutPrefix(id, prefix)
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.Atoi(rest)
+	return n, err == nil
+}
+
+// subsonicTime formats Unix seconds as Subsonic dates, or "" if unknown.
+func subsonicTime(unix int64) string {
+	if unix <= 0 {
+		return ""
+	}
+	return time.Unix(unix, 0).UTC().Format(time.RFC3339)
+}
+
+// subsonicIgnoredArticles are skipped when artists are sorted into indexes.
+const subsonicIgnoredArticles = "The El La Los Las Le Les"
+
+// Subsonic payloads. The XML attributes and JSON keys are the ones clients expect.
+type (
+	subsonicGenres struct {
+		Genre []subsonicGenre `xml:"genre" json:"genre"`
+	}
+	subsonicGenre struct {
+		Name      string `xml:",chardata" json:"value"`
+		SongCount int    `xml:"songCount,attr" json:"songCount"`
+	}
+
+	subsonicIndexes struct {
+		LastModified    int64           `xml:"lastModified,attr" json:"lastModified"`
+		IgnoredArticles string          `xml:"ignoredArticles,attr" json:"ignoredArticles"`
+		Index           []subsonicIndex `xml:"index" json:"index"`
+	}
+	subsonicArtists struct {
+		IgnoredArticles string          `xml:"ignoredArticles,attr" json:"ignoredArticles"`
+		Index           []subsonicIndex `xml:"index" json:"index"`
+	}
+	subsonicIndex struct {
+		Name   string           `xml:"name,attr" json:"name"`
+		Artist []subsonicArtist `xml:"artist" json:"artist"`
+	}
+	subsonicArtist struct {
+		ID         string          `xml:"id,attr" json:"id"`
+		Name       string          `xml:"name,attr" json:"name"`
+		AlbumCount int             `xml:"albumCount,attr,omitempty" json:"albumCount,omitempty"`
+		Album      []subsonicAlbum `xml:"album,omitempty" json:"album,omitempty"` // Only in getArtist
+	}
+
+	// subsonicAlbum is an AlbumID3.
+	subsonicAlbum struct {
+		ID        string          `xml:"id,attr" json:"id"`
+		Name      string          `xml:"name,attr" json:"name"`
+		Artist    string          `xml:"artist,attr,omitempty" json:"artist,omitempty"`
+		ArtistID  string          `xml:"artistId,attr,omitempty" json:"artistId,omitempty"`
+		CoverArt  string          `xml:"coverArt,attr,omitempty" json:"coverArt,omitempty"`
+		SongCount int             `xml:"songCount,attr" json:"songCount"`
+		Duration  int             `xml:"duration,attr" json:"duration"`
+		Created   string          `xml:"created,attr,omitempty" json:"created,omitempty"`
+		Year      int             `xml:"year,attr,omitempty" json:"year,omitempty"`
+		Song      []subsonicChild `xml:"song,omitempty" json:"song,omitempty"` // Only in getAlbum
+	}
+
+	// subsonicChild is a song, or a directory in the folder based methods.
+	subsonicChild struct {
+		ID           string `xml:"id,attr" json:"id"`
+		Parent       string `xml:"parent,attr,omitempty" json:"parent,omitempty"`
+		IsDir        bool   `xml:"isDir,attr" json:"isDir"`
+		Title        string `xml:"title,attr" json:"title"`
+		Album        string `xml:"album,attr,omitempty" json:"album,omitempty"`
+		Artist       string `xml:"artist,attr,omitempty" json:"artist,omitempty"`
+		Track        int    `xml:"track,attr,omitempty" json:"track,omitempty"`
+		Year         int    `xml:"year,attr,omitempty" json:"year,omitempty"`
+		Genre        string `xml:"genre,attr,omitempty" json:"genre,omitempty"`
+		CoverArt     string `xml:"coverArt,attr,omitempty" json:"coverArt,omitempty"`
+		ContentType  string `xml:"contentType,attr,omitempty" json:"contentType,omitempty"`
+		Suffix       string `xml:"suffix,attr,omitempty" json:"suffix,omitempty"`
+		Duration     int    `xml:"duration,attr,omitempty" json:"duration,omitempty"`
+		BitRate      int    `xml:"bitRate,attr,omitempty" json:"bitRate,omitempty"` // Kilobits per second
+		Path         string `xml:"path,attr,omitempty" json:"path,omitempty"`
+		DiscNumber   int    `xml:"discNumber,attr,omitempty" json:"discNumber,omitempty"`
+		Created      string `xml:"created,attr,omitempty" json:"created,omitempty"`
+		AlbumID      string `xml:"albumId,attr,omitempty" json:"albumId,omitempty"`
+		ArtistID     string `xml:"artistId,attr,omitempty" json:"artistId,omitempty"`
+		Type         string `xml:"type,attr,omitempty" json:"type,omitempty"`
+		MediaType    string `xml:"mediaType,attr,omitempty" json:"mediaType,omitempty"` // OpenSubsonic
+		SamplingRate int    `xml:"samplingRate,attr,omitempty" json:"samplingRate,omitempty"`
+		ChannelCount int    `xml:"channelCount,attr,omitempty" json:"channelCount,omitempty"`
+		BitDepth     int    `xml:"bitDepth,attr,omitempty" json:"bitDepth,omitempty"`
+	}
+
+	subsonicDirectory struct {
+		ID     string          `xml:"id,attr" json:"id"`
+		Parent string          `xml:"parent,attr,omitempty" json:"parent,omitempty"`
+		Name   string          `xml:"name,attr" json:"name"`
+		Child  []subsonicChild `xml:"child" json:"child"`
+	}
+
+	subsonicSearchResult3 struct {
+		Artist []subsonicArtist `xml:"artist" json:"artist"`
+		Album  []subsonicAlbum  `xml:"album" json:"album"`
+		Song   []subsonicChild  `xml:"song" json:"song"`
+	}
+	subsonicAlbumList struct {
+		Album []subsonicChild `xml:"album" json:"album"`
+	}
+	subsonicAlbumList2 struct {
+		Album []subsonicAlbum `xml:"album" json:"album"`
+	}
+	subsonicSongs struct {
+		Song []subsonicChild `xml:"song" json:"song"`
+	}
+)
+
+// newSubsonicSong describes a track as a Subsonic song.
+func newSubsonicSong(t library.Track) subsonicChild {
+	song := subsonicChild{
+		ID:           t.ID,
+		Parent:       subsonicAlbumID(t.AlbumID),
+		Title:        t.Title,
+		Album:        t.AlbumTitle,
+		Artist:       t.ArtistName,
+		Track:        t.TrackNumber,
+		Year:         t.Year,
+		CoverArt:     t.ID,
+		ContentType:  audioContentType(t),
+		Suffix:       strings.TrimPrefix(strings.ToLower(filepath.Ext(t.FilePath)), "."),
+		Duration:     t.DurationSeconds,
+		BitRate:      t.Bitrate / 1000,
+		Path:         t.FilePath,
+		DiscNumber:   t.DiscNumber,
+		Created:      subsonicTime(t.AddedAt),
+		AlbumID:      subsonicAlbumID(t.AlbumID),
+		ArtistID:     subsonicArtistID(t.ArtistID),
+		Type:         "music",
+		MediaType:    "song",
+		SamplingRate: t.SampleRate,
+		ChannelCount: t.Channels,
+		BitDepth:     t.BitDepth,
+	}
+	if len(t.Genres) > 0 {
+		song.Genre = t.Genres[0]
+	}
+	return song
+}
+
+// newSubsonicSongs describes tracks as Subsonic songs.
+func newSubsonicSongs(tracks []library.Track) []subsonicChild {
+	songs := make([]subsonicChild, len(tracks))
+	for i, t := range tracks {
+		songs[i] = newSubsonicSong(t)
+	}
+	return songs
+}
+
+// newSubsonicAlbum describes an album as a Subsonic AlbumID3.
+func newSubsonicAlbum(a library.AlbumInfo) subsonicAlbum {
+	return subsonicAlbum{
+		ID:        subsonicAlbumID(a.ID),
+		Name:      a.Title,
+		Artist:    a.ArtistName,
+		ArtistID:  subsonicArtistID(a.ArtistID),
+		CoverArt:  subsonicAlbumID(a.ID),
+		SongCount: a.TrackCount,
+		Duration:  a.DurationSeconds,
+		Created:   subsonicTime(a.AddedAt),
+		Year:      a.Year,
+	}
+}
+
+// newSubsonicAlbums describes albums as Subsonic AlbumID3s.
+func newSubsonicAlbums(albums []library.AlbumInfo) []subsonicAlbum {
+	out := make([]subsonicAlbum, len(albums))
+	for i, a := range albums {
+		out[i] = newSubsonicAlbum(a)
+	}
+	return out
+}
+
+// newSubsonicAlbumDir describes an album as a directory of the folder based methods.
+func newSubsonicAlbumDir(a library.AlbumInfo) subsonicChild {
+	return subsonicChild{
+		ID:        subsonicAlbumID(a.ID),
+		Parent:    subsonicArtistID(a.ArtistID),
+		IsDir:     true,
+		Title:     a.Title,
+		Album:     a.Title,
+		Artist:    a.ArtistName,
+		Year:      a.Year,
+		CoverArt:  subsonicAlbumID(a.ID),
+		Duration:  a.DurationSeconds,
+		Created:   subsonicTime(a.AddedAt),
+		MediaType: "album",
+	}
+}
+
+// subsonicArtistIndex sorts the artists that have albums into indexes by the first
+// letter of their name, skipping the articles in subsonicIgnoredArticles.
+func subsonicArtistIndex() ([]subsonicIndex, error) {
+	artists, _, err := repo.Artists(library.Page{Limit: math.MaxInt32, Sort: "name"})
+	if err != nil {
+		return nil, err
+	}
+
+	type entry struct {
+		key    string // Name without its article, lower case
+		artist subsonicArtist
+	}
+	var entries []entry
+	for _, a := range artists {
+		if a.AlbumCount == 0 {
+			continue // Only credited on tracks; there is nothing to browse
+		}
+		key := strings.ToLower(a.Name)
+		for _, article := range strings.Fields(subsonicIgnoredArticles) {
+			if rest, ok := strings.CutPrefix(key, strings.ToLower(article)+" "); ok && rest != "" {
+				key = rest
+				break
+			}
+		}
+		entries = append(entries, entry{key, subsonicArtist{ID: subsonicArtistID(a.ID), Name: a.Name, AlbumCount: a.AlbumCount}})
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].key < entries[j].key })
+
+	indexes := []subsonicIndex{}
+	for _, e := range entries {
+		name := "#"
+		if r, _ := utf8.DecodeRuneInString(e.key); unicode.IsLetter(r) {
+			name = strings.ToUpper(string(r))
+		}
+		if len(indexes) == 0 || indexes[len(indexes)-1].Name != name {
+			indexes = append(indexes, subsonicIndex{Name: name})
+		}
+		last := &indexes[len(indexes)-1]
+		last.Artist = append(last.Artist, e.artist)
+	}
+	return indexes, nil
+}
+
+func subsonicGetGenres(c *gin.Context) (*subsonicResponse, error) {
+	genres, _, err := repo.Genres(library.Page{Limit: math.MaxInt32, Sort: "name"})
+	if err != nil {
+		return nil, err
+	}
+	out := &subsonicGenres{Genre: make([]subsonicGenre, len(genres))}
+	for i, g := range genres {
+		out.Genre[i] = subsonicGenre{Name: g.Name, SongCount: g.TrackCount}
+	}
+	return &subsonicResponse{Genres: out}, nil
+}
+
+func subsonicGetIndexes(c *gin.Context) (*subsonicResponse, error) {
+	indexes, err := subsonicArtistIndex()
+	if err != nil {
+		return nil, err
+	}
+	// Folder based clients browse artists without the ID3 album counts
+	for i := range indexes {
+		for j := range indexes[i].Artist {
+			indexes[i].Artist[j].AlbumCount = 0
+		}
+	}
+	return &subsonicResponse{Indexes: &subsonicIndexes{
+		LastModified:    time.Now().UnixMilli(),
+		IgnoredArticles: subsonicIgnoredArticles,
+		Index:           indexes,
+	}}, nil
+}
+
+func subsonicGetArtists(c *gin.Context) (*subsonicResponse, error) {
+	indexes, err := subsonicArtistIndex()
+	if err != nil {
+		return nil, err
+	}
+	return &subsonicResponse{Artists: &subsonicArtists{IgnoredArticles: subsonicIgnoredArticles, Index: indexes}}, nil
+}
+
+// subsonicGetMusicDirectory lists an artist's albums, or an album's songs, for clients
+// that browse by folder. The folders are those of the tags, not of the file system.
+func subsonicGetMusicDirectory(c *gin.Context) (*subsonicResponse, error) {
+	id, err := subsonicRequired(c, "id")
+	if err != nil {
+		return nil, err
+	}
+
+	if artistID, ok := parseSubsonicID(id, subsonicArtistPrefix); ok {
+		artist, err := repo.Artist(artistID)
+		if errors.Is(err, library.ErrNotFound) {
+			return nil, subsonicNotFound("directory")
+		}
+		if err != nil {
+			return nil, err
+		}
+		albums, err := repo.AlbumsByArtist(artistID)
+		if err != nil {
+			return nil, err
+		}
+		dir := &subsonicDirectory{ID: id, Name: artist.Name, Child: make([]subsonicChild, len(albums))}
+		for i, a := range albums {
+			dir.Child[i] = newSubsonicAlbumDir(a)
+		}
+		return &subsonicResponse{Directory: dir}, nil
+	}
+
+	albumID, ok := parseSubsonicID(id, subsonicAlbumPrefix)
+	if !ok {
+		return nil, subsonicNotFound("directory")
+	}
+	album, err := repo.Album(albumID)
+	if errors.Is(err, library.ErrNotFound) {
+		return nil, subsonicNotFound("directory")
+	}
+	if err != nil {
+		return nil, err
+	}
+	tracks, err := repo.TracksByAlbum(albumID)
+	if err != nil {
+		return nil, err
+	}
+	return &subsonicResponse{Directory: &subsonicDirectory{
+		ID:     id,
+		Parent: subsonicArtistID(album.ArtistID),
+		Name:   album.Title,
+		Child:  newSubsonicSongs(tracks),
+	}}, nil
+}
+
+func subsonicGetArtist(c *gin.Context) (*subsonicResponse, error) {
+	id, err := subsonicRequired(c, "id")
+	if err != nil {
+		return nil, err
+	}
+	artistID, ok := parseSubsonicID(id, subsonicArtistPrefix)
+	if !ok {
+		return nil, subsonicNotFound("artist")
+	}
+	artist, err := repo.ArtistInfo(artistID)
+	if errors.Is(err, library.ErrNotFound) {
+		return nil, subsonicNotFound("artist")
+	}
+	if err != nil {
+		return nil, err
+	}
+	albums, err := repo.AlbumsByArtist(artistID)
+	if err != nil {
+		return nil, err
+	}
+	return &subsonicResponse{Artist: &subsonicArtist{
+		ID:         id,
+		Name:       artist.Name,
+		AlbumCount: artist.AlbumCount,
+		Album:      newSubsonicAlbums(albums),
+	}}, nil
+}
+
+func subsonicGetAlbum(c *gin.Context) (*subsonicResponse, error) {
+	id, err := subsonicRequired(c, "id")
+	if err != nil {
+		return nil, err
+	}
+	albumID, ok := parseSubsonicID(id, subsonicAlbumPrefix)
+	if !ok {
+		return nil, subsonicNotFound("album")
+	}
+	info, err := repo.AlbumInfo(albumID)
+	if errors.Is(err, library.ErrNotFound) {
+		return nil, subsonicNotFound("album")
+	}
+	if err != nil {
+		return nil, err
+	}
+	tracks, err := repo.TracksByAlbum(albumID)
+	if err != nil {
+		return nil, err
+	}
+	album := newSubsonicAlbum(info)
+	album.Song = newSubsonicSongs(tracks)
+	return &subsonicResponse{Album: &album}, nil
+}
+
+func subsonicGetSong(c *gin.Context) (*subsonicResponse, error) {
+	id, err := subsonicRequired(c, "id")
+	if err != nil {
+		return nil, err
+	}
+	track, err := repo.Track(id)
+	if errors.Is(err, library.ErrNotFound) {
+		return nil, subsonicNotFound("song")
+	}
+	if err != nil {
+		return nil, err
+	}
+	song := newSubsonicSong(track)
+	return &subsonicResponse{Song: &song}, nil
+}
+
+// subsonicOpenTrack looks up the track named by the id parameter and opens its audio
+// file. The caller must close the file.
+func subsonicOpenTrack(c *gin.Context) (library.Track, *os.File, os.FileInfo, error) {
+	id, err := subsonicRequired(c, "id")
+	if err != nil {
+		return library.Track{}, nil, nil, err
+	}
+	track, err := repo.Track(id)
+	if errors.Is(err, library.ErrNotFound) {
+		return track, nil, nil, subsonicNotFound("song")
+	}
+	if err != nil {
+		return track, nil, nil, err
+	}
+	f, err := os.Open(track.FilePath)
+	if err != nil {
+		log.Printf("Error opening audio file of track %s: %v", id, err)
+		return track, nil, nil, subsonicNotFound("audio file")
+	}
+	fi, err := f.Stat()
+	if err != nil || fi.IsDir() {
+		f.Close()
+		log.Printf("Error reading audio file of track %s: %v", id, err)
+		return track, nil, nil, subsonicNotFound("audio file")
+	}
+	return track, f, fi, nil
+}
+
+// subsonicDefaultFormat is what stream transcodes to when a client only limits the
+// bitrate, since every Subsonic client plays MP3.
+const subsonicDefaultFormat = "mp3"
+
+// subsonicStream sends a song, transcoded if the client asks for a format other than
+// "raw" or for a maxBitRate (kbit/s) below the file's. timeOffset (seconds) starts a
+// transcode part-way in. When the server cannot transcode, the file is sent as is.
+func subsonicStream(c *gin.Context) (*subsonicResponse, error) {
+	maxBitRate, err := subsonicInt(c, "maxBitRate", 0)
+	if err != nil {
+		return nil, err
+	}
+	timeOffset, err := subsonicInt(c, "timeOffset", 0)
+	if err != nil {
+		return nil, err
+	}
+	track, f, fi, err := subsonicOpenTrack(c)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	name := subsonicParam(c, "format")
+	if name == "" && maxBitRate > 0 && (track.Bitrate == 0 || track.Bitrate/1000 > maxBitRate) {
+		name = subsonicDefaultFormat
+	}
+	if name == "" || name == "raw" || transcoder == nil {
+		serveTrackFile(c, track, f, fi)
+		return nil, nil
+	}
+	format, ok := transcodeFormats[name]
+	if !ok {
+		return nil, &subsonicError{subsonicErrGeneric, "format must be raw, opus, ogg, mp3 or aac"}
+	}
+
+	opts := TranscodeOptions{Format: name, Bitrate: format.defaultBitrate, Offset: time.Duration(max(timeOffset, 0)) * time.Second}
+	if maxBitRate > 0 {
+		opts.Bitrate = max(min(opts.Bitrate, maxBitRate), minTranscodeBitrate)
+	}
+	streamTranscode(c, track, fi, opts)
+	return nil, nil
+}
+
+// subsonicDownload sends a song's file as is.
+func subsonicDownload(c *gin.Context) (*subsonicResponse, error) {
+	track, f, fi, err := subsonicOpenTrack(c)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	serveTrackFile(c, track, f, fi)
+	return nil, nil
+}
+
+// trackCover returns the path and MIME type of the cover image of a track, picked the
+// way /cover/{id} picks it, or "" if there is none.
+func trackCover(track library.Track) (string, string, error) {
+	dir := filepath.Dir(track.FilePath)
+	for _, name := range coverFiles {
+		path := filepath.Join(dir, name)
+		if fi, err := os.Stat(path); err == nil && !fi.IsDir() {
+			return path, mime.TypeByExtension(filepath.Ext(name)), nil
+		}
+	}
+	artwork, err := repo.TrackArtwork(track.ID)
+	if err != nil || artwork == nil {
+		return "", "", err
+	}
+	return artwork.FilePath, artwork.MimeType, nil
+}
+
+// subsonicGetCoverArt sends the cover of a song or, for album IDs, of the album's first
+// track, or the mosaic of a playlist. Images are sent at their original size whatever size asks for.
+func subsonicGetCoverArt(c *gin.Context) (*subsonicResponse, error) {
+	id, err := subsonicRequired(c, "id")
+	if err != nil {
+		return nil, err
+	}
+
+	if playlistID, ok := parseSubsonicID(id, subsonicPlaylistPrefix); ok {
+		return subsonicPlaylistCover(c, playlistID)
+	}
+
+	var track library.Track
+	if albumID, ok := parseSubsonicID(id, subsonicAlbumPrefix); ok {
+		tracks, _, err := repo.Tracks(library.TrackFilter{AlbumID: albumID}, library.Page{Limit: 1})
+		if err != nil {
+			return nil, err
+		}
+		if len(tracks) == 0 {
+			return nil, subsonicNotFound("cover art")
+		}
+		track = tracks[0]
+	} else {
+		track, err = repo.Track(id)
+		if errors.Is(err, library.ErrNotFound) {
+			return nil, subsonicNotFound("cover art")
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	path, mimeType, err := trackCover(track)
+	if err != nil {
+		return nil, err
+	}
+	if path == "" {
+		return nil, subsonicNotFound("cover art")
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		log.Printf("Cover art missing for track %s: %s", track.ID, path)
+		return nil, subsonicNotFound("cover art")
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	c.Header("Content-Type", mimeType)
+	http.ServeContent(c.Writer, c.Request, "", fi.ModTime(), f)
+	return nil, nil
+}
+
+// subsonicSearchParams reads the count and offset parameters of one kind of search3
+// result, such as songCount and songOffset.
+func subsonicSearchParams(c *gin.Context, kind string) (count, offset int, err error) {
+	if count, err = subsonicInt(c, kind+"Count", 20); err != nil {
+		return 0, 0, err
+	}
+	if offset, err = subsonicInt(c, kind+"Offset", 0); err != nil {
+		return 0, 0, err
+	}
+	return min(max(count, 0), 500), max(offset, 0), nil
+}
+
+// window returns the items of a list from offset on, up to count of them.
+func window[T any](items []T, offset, count int) []T {
+	if offset >= len(items) {
+		return items[:0]
+	}
+	return items[offset:min(offset+count, len(items))]
+}
+
+// subsonicSearch3 searches artists, albums and songs. An empty query, which clients
+// send to download the whole library, lists everything instead.
+func subsonicSearch3(c *gin.Context) (*subsonicResponse, error) {
+	query := strings.Trim(subsonicParam(c, "query"), `" `)
+	artistCount, artistOffset, err := subsonicSearchParams(c, "artist")
+	if err != nil {
+		return nil, err
+	}
+	albumCount, albumOffset, err := subsonicSearchParams(c, "album")
+	if err != nil {
+		return nil, err
+	}
+	songCount, songOffset, err := subsonicSearchParams(c, "song")
+	if err != nil {
+		return nil, err
+	}
+
+	result := &subsonicSearchResult3{Artist: []subsonicArtist{}, Album: []subsonicAlbum{}, Song: []subsonicChild{}}
+	if query == "" {
+		if artistCount > 0 {
+			artists, _, err := repo.Artists(library.Page{Offset: artistOffset, Limit: artistCount, Sort: "name"})
+			if err != nil {
+				return nil, err
+			}
+			for _, a := range artists {
+				result.Artist = append(result.Artist, subsonicArtist{ID: subsonicArtistID(a.ID), Name: a.Name, AlbumCount: a.AlbumCount})
+			}
+		}
+		if albumCount > 0 {
+			albums, _, err := repo.Albums(library.AlbumFilter{}, library.Page{Offset: albumOffset, Limit: albumCount, Sort: "title"})
+			if err != nil {
+				return nil, err
+			}
+			result.Album = newSubsonicAlbums(albums)
+		}
+		if songCount > 0 {
+			tracks, _, err := repo.Tracks(library.TrackFilter{}, library.Page{Offset: songOffset, Limit: songCount, Sort: "title"})
+			if err != nil {
+				return nil, err
+			}
+			result.Song = newSubsonicSongs(tracks)
+		}
+		return &subsonicResponse{SearchResult3: result}, nil
+	}
+
+	// The ranked search has no offsets, so fetch every page up to the furthest asked for
+	limit := max(artistOffset+artistCount, albumOffset+albumCount, songOffset+songCount)
+	if limit == 0 {
+		return &subsonicResponse{SearchResult3: result}, nil
+	}
+	found, err := repo.Search(query, limit)
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range window(found.Artists, artistOffset, artistCount) {
+		info, err := repo.ArtistInfo(a.ID)
+		if err != nil {
+			return nil, err
+		}
+		result.Artist = append(result.Artist, subsonicArtist{ID: subsonicArtistID(a.ID), Name: a.Name, AlbumCount: info.AlbumCount})
+	}
+	for _, a := range window(found.Albums, albumOffset, albumCount) {
+		info, err := repo.AlbumInfo(a.ID)
+		if err != nil {
+			return nil, err
+		}
+		result.Album = append(result.Album, newSubsonicAlbum(info))
+	}
+	result.Song = newSubsonicSongs(window(found.Tracks, songOffset, songCount))
+	return &subsonicResponse{SearchResult3: result}, nil
+}
+
+// subsonicListAlbums returns the albums of getAlbumList and getAlbumList2, as selected
+// by the type, size, offset, fromYear, toYear and genre parameters. There are no
+// ratings or favourites, so "highest" and "starred" are always empty.
+func subsonicListAlbums(c *gin.Context) ([]library.AlbumInfo, error) {
+	listType, err := subsonicRequired(c, "type")
+	if err != nil {
+		return nil, err
+	}
+	size, offset, err := subsonicSize(c, 10)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		filter library.AlbumFilter
+		page   = library.Page{Offset: offset, Limit: size}
+	)
+	switch listType {
+	case "random":
+		return repo.RandomAlbums(filter, size)
+	case "newest":
+		page.Sort = "-added"
+	case "frequent":
+		filter.Played, page.Sort = true, "-plays"
+	case "recent":
+		filter.Played, page.Sort = true, "-played"
+	case "alphabeticalByName":
+		page.Sort = "title"
+	case "alphabeticalByArtist":
+		page.Sort = "artist"
+	case "byYear":
+		from, err := subsonicInt(c, "fromYear", 0)
+		if err != nil {
+			return nil, err
+		}
+		to, err := subsonicInt(c, "toYear", 0)
+		if err != nil {
+			return nil, err
+		}
+		if from == 0 || to == 0 {
+			return nil, subsonicMissing("fromYear and toYear")
+		}
+		// A reversed range lists the newest first
+		page.Sort = "year"
+		if from > to {
+			from, to, page.Sort = to, from, "-year"
+		}
+		filter.YearFrom, filter.YearTo = from, to
+	case "byGenre":
+		name, err := subsonicRequired(c, "genre")
+		if err != nil {
+			return nil, err
+		}
+		genre, err := repo.GenreByName(name)
+		if errors.Is(err, library.ErrNotFound) {
+			return []library.AlbumInfo{}, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		filter.GenreID, page.Sort = genre.ID, "title"
+	case "highest", "starred":
+		return []library.AlbumInfo{}, nil
+	default:
+		return nil, &subsonicError{subsonicErrGeneric, "unknown album list type " + listType}
+	}
+	if size == 0 {
+		return []library.AlbumInfo{}, nil
+	}
+	albums, _, err := repo.Albums(filter, page)
+	return albums, err
+}
+
+func subsonicGetAlbumList(c *gin.Context) (*subsonicResponse, error) {
+	albums, err := subsonicListAlbums(c)
+	if err != nil {
+		return nil, err
+	}
+	list := &subsonicAlbumList{Album: make([]subsonicChild, len(albums))}
+	for i, a := range albums {
+		list.Album[i] = newSubsonicAlbumDir(a)
+	}
+	return &subsonicResponse{AlbumList: list}, nil
+}
+
+func subsonicGetAlbumList2(c *gin.Context) (*subsonicResponse, error) {
+	albums, err := subsonicListAlbums(c)
+	if err != nil {
+		return nil, err
+	}
+	return &subsonicResponse{AlbumList2: &subsonicAlbumList2{Album: newSubsonicAlbums(albums)}}, nil
+}
+
+func subsonicGetRandomSongs(c *gin.Context) (*subsonicResponse, error) {
+	size, _, err := subsonicSize(c, 10)
+	if err != nil {
+		return nil, err
+	}
+	var filter library.TrackFilter
+	if filter.YearFrom, err = subsonicInt(c, "fromYear", 0); err != nil {
+		return nil, err
+	}
+	if filter.YearTo, err = subsonicInt(c, "toYear", 0); err != nil {
+		return nil, err
+	}
+	if name := subsonicParam(c, "genre"); name != "" {
+		genre, err := repo.GenreByName(name)
+		if errors.Is(err, library.ErrNotFound) {
+			return &subsonicResponse{RandomSongs: &subsonicSongs{Song: []subsonicChild{}}}, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		filter.GenreID = genre.ID
+	}
+	tracks, err := repo.RandomTracks(filter, size)
+	if err != nil {
+		return nil, err
+	}
+	return &subsonicResponse{RandomSongs: &subsonicSongs{Song: newSubsonicSongs(tracks)}}, nil
+}
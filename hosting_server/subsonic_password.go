@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"heavymetal/library"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Subsonic token logins send t = md5(password + s) for a random salt s, which the
+// server can only check if it can read the password. Account passwords are hashed, so
+// users who want token logins set a separate Subsonic password, which is kept
+// encrypted with the server's key.
+
+// maxSubsonicPasswordLength bounds Subsonic passwords, which are not hashed with bcrypt
+// and so have no limit of their own.
+const maxSubsonicPasswordLength = 128
+
+// subsonicKey encrypts Subsonic passwords, set by setupSubsonicKey.
+var subsonicKey cipher.AEAD
+
+// setupSubsonicKey derives the key of Subsonic passwords from MUSIC_SUBSONIC_KEY, or
+// from the key file MUSIC_SUBSONIC_KEY_FILE (default: the database path followed by
+// ".subsonic-key"), which is created with a random key if it does not exist. Unlike
+// the key of signed URLs, this one must survive restarts.
+func setupSubsonicKey(dbPath string) error {
+	secret := []byte(os.Getenv("MUSIC_SUBSONIC_KEY"))
+	if len(secret) == 0 {
+		path := getEnv("MUSIC_SUBSONIC_KEY_FILE", dbPath+".subsonic-key")
+		var err error
+		secret, err = os.ReadFile(path)
+		if errors.Is(err, os.ErrNotExist) {
+			b := make([]byte, 32)
+			if _, err := rand.Read(b); err != nil {
+				return fmt.Errorf("failed to generate Subsonic password key: %w", err)
+			}
+			secret = []byte(hex.EncodeToString(b))
+			if err := os.WriteFile(path, append(secret, '\n'), 0o600); err != nil {
+				return fmt.Errorf("failed to write Subsonic password key: %w", err)
+			}
+			log.Printf("Created Subsonic password key %s; back it up with the database", path)
+		} else if err != nil {
+			return fmt.Errorf("failed to read Subsonic password key: %w", err)
+		}
+	}
+	key := sha256.Sum256(bytes.TrimSpace(secret))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return fmt.Errorf("failed to set up Subsonic password key: %w", err)
+	}
+	subsonicKey, err = cipher.NewGCM(block)
+	return err
+}
+
+// encryptSubsonicPassword encrypts the Subsonic password of a user. The user ID is
+// authenticated with it, so that it cannot be copied to another user's row.
+func encryptSubsonicPassword(userID int, password string) (string, error) {
+	nonce := make([]byte, subsonicKey.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	sealed := subsonicKey.Seal(nonce, nonce, []byte(password), []byte(strconv.Itoa(userID)))
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// subsonicPassword returns the decrypted Subsonic password of a user, or "" if they
+// have none.
+func subsonicPassword(user library.User) (string, error) {
+	if user.SubsonicPassword == "" {
+		return "", nil
+	}
+	sealed, err := base64.StdEncoding.DecodeString(user.SubsonicPassword)
+	if err != nil || len(sealed) < subsonicKey.NonceSize() {
+		return "", fmt.Errorf("malformed Subsonic password of user %d", user.ID)
+	}
+	n := subsonicKey.NonceSize()
+	password, err := subsonicKey.Open(nil, sealed[:n], sealed[n:], []byte(strconv.Itoa(user.ID)))
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt Subsonic password of user %d, was the key changed? %w", user.ID, err)
+	}
+	return string(password), nil
+}
+
+// subsonicLogin checks the credentials of a Subsonic request other than an API key:
+// the user name u with either the token t and salt s, or the password p, in clear or
+// hex-encoded as "enc:<hex>". p may be the account password or the Subsonic password.
+func subsonicLogin(c *gin.Context) (library.User, *subsonicError) {
+	wrong := &subsonicError{subsonicErrBadCredentials, "wrong username or password"}
+	internal := &subsonicError{subsonicErrGeneric, "internal error"}
+	u := subsonicParam(c, "u")
+	if u == "" {
+		return library.User{}, subsonicMissing("u")
+	}
+
+	if t := subsonicParam(c, "t"); t != "" {
+		s := subsonicParam(c, "s")
+		if s == "" {
+			return library.User{}, subsonicMissing("s")
+		}
+		user, err := repo.UserByName(u)
+		if errors.Is(err, library.ErrNotFound) {
+			return user, wrong
+		}
+		if err != nil {
+			log.Printf("Query error: %v", err)
+			return user, internal
+		}
+		secret, err := subsonicPassword(user)
+		if err != nil {
+			log.Printf("Subsonic password error: %v", err)
+			return user, internal
+		}
+		if secret == "" {
+			return user, &subsonicError{subsonicErrTokenAuth, "set a Subsonic password with PUT /auth/subsonic-password to log in with a token, or send the password"}
+		}
+		sum := md5.Sum([]byte(secret + s))
+		if subtle.ConstantTimeCompare([]byte(hex.EncodeToString(sum[:])), []byte(strings.ToLower(t))) != 1 || user.Disabled {
+			return user, wrong
+		}
+		return user, nil
+	}
+
+	p := subsonicParam(c, "p")
+	if p == "" {
+		return library.User{}, subsonicMissing("p")
+	}
+	if enc, found := strings.CutPrefix(p, "enc:"); found {
+		decoded, err := hex.DecodeString(enc)
+		if err != nil {
+			return library.User{}, wrong
+		}
+		p = string(decoded)
+	}
+	user, ok, err := checkLogin(u, p)
+	if err != nil {
+		log.Printf("Query error: %v", err)
+		return user, internal
+	}
+	if ok {
+		return user, nil
+	}
+	if user.ID == 0 || user.Disabled {
+		return user, wrong
+	}
+	// Apps set up with the Subsonic password send it as p when token logins are off
+	secret, err := subsonicPassword(user)
+	if err != nil {
+		log.Printf("Subsonic password error: %v", err)
+		return user, internal
+	}
+	if secret == "" || subtle.ConstantTimeCompare([]byte(secret), []byte(p)) != 1 {
+		return user, wrong
+	}
+	return user, nil
+}
+
+// subsonicPasswordRequest is the body of PUT /auth/subsonic-password.
+type subsonicPasswordRequest struct {
+	Password string `json:"password" example:"another horse battery"`
+}
+
+// @Summary Set your Subsonic password
+// @Description Sets the password Subsonic apps log in with using a token and salt, which the account password cannot be used for because it is only kept hashed. The Subsonic password is kept encrypted; use one you use nowhere else. It is 8 to 128 bytes, and also works as p.
+// @Accept json
+// @Param password body subsonicPasswordRequest true "New Subsonic password"
+// @Success 204
+// @Failure 400 {object} map[string]string
+// @Failure 401 {object} map[string]string
+// @Router /auth/subsonic-password [put]
+func setSubsonicPasswordHandler(c *gin.Context) {
+	var req subsonicPasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid body: " + err.Error()})
+		return
+	}
+	if len(req.Password) < minPasswordLength || len(req.Password) > maxSubsonicPasswordLength {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("password must be %d to %d bytes", minPasswordLength, maxSubsonicPasswordLength)})
+		return
+	}
+	me, _ := currentUser(c)
+	encrypted, err := encryptSubsonicPassword(me.ID, req.Password)
+	if err != nil {
+		log.Printf("Encryption error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		return
+	}
+	saveSubsonicPassword(c, me.ID, encrypted)
+}
+
+// @Summary Remove your Subsonic password
+// @Description Subsonic token logins stop working until a new one is set.
+// @Success 204
+// @Failure 401 {object} map[string]string
+// @Router /auth/subsonic-password [delete]
+func deleteSubsonicPasswordHandler(c *gin.Context) {
+	me, _ := currentUser(c)
+	saveSubsonicPassword(c, me.ID, "")
+}
+
+// saveSubsonicPassword stores the encrypted Subsonic password of a user and answers 204.
+func saveSubsonicPassword(c *gin.Context, userID int, encrypted string) {
+	user, err := repo.User(userID)
+	if err == nil {
+		user.SubsonicPassword = encrypted
+		err = repo.UpdateUser(user)
+	}
+	if err != nil {
+		log.Printf("Query error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
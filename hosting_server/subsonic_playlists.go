@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"heavymetal/library"
+
+	"github.com/gin-gonic/gin"
+)
+
+type (
+	subsonicPlaylists struct {
+		Playlist []subsonicPlaylist `xml:"playlist" json:"playlist"`
+	}
+	subsonicPlaylist struct {
+		ID        string          `xml:"id,attr" json:"id"`
+		Name      string          `xml:"name,attr" json:"name"`
+		Comment   string          `xml:"comment,attr,omitempty" json:"comment,omitempty"`
+		Owner     string          `xml:"owner,attr" json:"owner"`
+		Public    bool            `xml:"public,attr" json:"public"`
+		SongCount int             `xml:"songCount,attr" json:"songCount"`
+		Duration  int             `xml:"duration,attr" json:"duration"`
+		Created   string          `xml:"created,attr" json:"created"`
+		Changed   string          `xml:"changed,attr" json:"changed"`
+		CoverArt  string          `xml:"coverArt,attr,omitempty" json:"coverArt,omitempty"`
+		Entry     []subsonicChild `xml:"entry,omitempty" json:"entry,omitempty"` // Only in getPlaylist
+	}
+)
+
+// newSubsonicPlaylist describes a playlist, without its songs.
+func newSubsonicPlaylist(p library.Playlist) subsonicPlaylist {
+	return subsonicPlaylist{
+		ID:        strconv.Itoa(p.ID),
+		Name:      p.Name,
+		Comment:   p.Comment,
+		Owner:     p.Owner,
+		Public:    p.Public,
+		SongCount: p.TrackCount,
+		Duration:  p.DurationSeconds,
+		Created:   subsonicTime(p.CreatedAt),
+		Changed:   subsonicTime(p.UpdatedAt),
+		CoverArt:  subsonicPlaylistPrefix + strconv.Itoa(p.ID),
+	}
+}
+
+// subsonicPlaylistCover sends the mosaic of a playlist the user can see.
+func subsonicPlaylistCover(c *gin.Context, id int) (*subsonicResponse, error) {
+	p, err := repo.Playlist(id)
+	if errors.Is(err, library.ErrNotFound) || err == nil && !ownsPlaylist(c, p) && !p.Public {
+		return nil, subsonicNotFound("cover art")
+	}
+	if err != nil {
+		return nil, err
+	}
+	data, etag, err := playlistMosaic(p.ID)
+	if err != nil {
+		return nil, err
+	}
+	if data == nil {
+		return nil, subsonicNotFound("cover art")
+	}
+	c.Header("ETag", etag)
+	http.ServeContent(c.Writer, c.Request, "cover.jpg", time.Time{}, bytes.NewReader(data))
+	return nil, nil
+}
+
+// subsonicPlaylistWithSongs describes a playlist with its songs.
+func subsonicPlaylistWithSongs(p library.Playlist) (*subsonicResponse, error) {
+	tracks, err := repo.PlaylistTracks(p.ID)
+	if err != nil {
+		return nil, err
+	}
+	playlist := newSubsonicPlaylist(p)
+	playlist.Entry = newSubsonicSongs(tracks)
+	return &subsonicResponse{Playlist: &playlist}, nil
+}
+
+// subsonicAnonymousWrite is the error of anonymous requests in open mode that change
+// playlists, which need an owner.
+var subsonicAnonymousWrite = &subsonicError{subsonicErrBadCredentials, "log in to change playlists"}
+
+// subsonicFindPlaylist returns the playlist whose ID is in the named parameter, if
+// the user can see it. When mine is set the user must also own it, which changing
+// a playlist requires and anonymous requests never do.
+func subsonicFindPlaylist(c *gin.Context, param string, mine bool) (library.Playlist, error) {
+	v, err := subsonicRequired(c, param)
+	if err != nil {
+		return library.Playlist{}, err
+	}
+	id, err := strconv.Atoi(v)
+	if err != nil {
+		return library.Playlist{}, subsonicNotFound("playlist")
+	}
+	p, err := repo.Playlist(id)
+	if errors.Is(err, library.ErrNotFound) {
+		return p, subsonicNotFound("playlist")
+	}
+	if err != nil {
+		return p, err
+	}
+
+	owned := ownsPlaylist(c, p)
+	switch {
+	case !owned && !p.Public:
+		return p, subsonicNotFound("playlist") // Private playlists of others are not there
+	case !owned && mine:
+		if _, ok := currentUser(c); !ok {
+			return p, subsonicAnonymousWrite
+		}
+		return p, &subsonicError{subsonicErrUnauthorized, "only the owner can change a playlist"}
+	}
+	return p, nil
+}
+
+// subsonicSetPlaylistTracks saves the tracks of a playlist, reporting unknown songs.
+func subsonicSetPlaylistTracks(id int, trackIDs []string) error {
+	err := repo.SetPlaylistTracks(id, trackIDs)
+	if errors.Is(err, library.ErrNotFound) {
+		return subsonicNotFound("song")
+	}
+	return err
+}
+
+func subsonicGetPlaylists(c *gin.Context) (*subsonicResponse, error) {
+	user, _ := currentUser(c)
+	playlists, _, err := repo.Playlists(user.ID, library.PlaylistFilter{}, library.Page{Limit: -1})
+	if err != nil {
+		return nil, err
+	}
+	out := &subsonicPlaylists{Playlist: make([]subsonicPlaylist, len(playlists))}
+	for i, p := range playlists {
+		out.Playlist[i] = newSubsonicPlaylist(p)
+	}
+	return &subsonicResponse{Playlists: out}, nil
+}
+
+func subsonicGetPlaylist(c *gin.Context) (*subsonicResponse, error) {
+	p, err := subsonicFindPlaylist(c, "id", false)
+	if err != nil {
+		return nil, err
+	}
+	return subsonicPlaylistWithSongs(p)
+}
+
+// subsonicCreatePlaylist creates a playlist named name holding the songs songId, or,
+// given a playlistId, replaces the songs of that playlist.
+func subsonicCreatePlaylist(c *gin.Context) (*subsonicResponse, error) {
+	songIDs := subsonicValues(c, "songId")
+
+	if subsonicParam(c, "playlistId") != "" {
+		p, err := subsonicFindPlaylist(c, "playlistId", true)
+		if err != nil {
+			return nil, err
+		}
+		if err := subsonicSetPlaylistTracks(p.ID, songIDs); err != nil {
+			return nil, err
+		}
+		if p, err = repo.Playlist(p.ID); err != nil {
+			return nil, err
+		}
+		return subsonicPlaylistWithSongs(p)
+	}
+
+	name, err := subsonicRequired(c, "name")
+	if err != nil {
+		return nil, err
+	}
+	owner, ok := currentUser(c)
+	if !ok {
+		return nil, subsonicAnonymousWrite
+	}
+	p, err := repo.CreatePlaylist(library.Playlist{Name: name, OwnerID: owner.ID}, songIDs)
+	if errors.Is(err, library.ErrNotFound) {
+		return nil, subsonicNotFound("song")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return subsonicPlaylistWithSongs(p)
+}
+
+// subsonicUpdatePlaylist changes the name, comment or visibility of a playlist, and
+// edits its songs: songIndexToRemove removes the songs at those positions, counted
+// before any change, and songIdToAdd appends songs.
+func subsonicUpdatePlaylist(c *gin.Context) (*subsonicResponse, error) {
+	p, err := subsonicFindPlaylist(c, "playlistId", true)
+	if err != nil {
+		return nil, err
+	}
+
+	changed := false
+	if v := subsonicValues(c, "name"); len(v) > 0 && v[0] != "" {
+		p.Name, changed = v[0], true
+	}
+	if v := subsonicValues(c, "comment"); len(v) > 0 {
+		p.Comment, changed = v[0], true
+	}
+	if v := subsonicParam(c, "public"); v != "" {
+		public, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, &subsonicError{subsonicErrGeneric, "public must be true or false"}
+		}
+		p.Public, changed = public, true
+	}
+
+	// Edit the songs first: the edit checks every index and song before it saves, so a
+	// bad one fails the request before the playlist is renamed or changed otherwise
+	add, remove := subsonicValues(c, "songIdToAdd"), subsonicValues(c, "songIndexToRemove")
+	if len(add) > 0 || len(remove) > 0 {
+		err := repo.EditPlaylistTracks(p.ID, func(trackIDs []string) ([]string, error) {
+			removed := make(map[int]bool, len(remove))
+			for _, v := range remove {
+				i, err := strconv.Atoi(v)
+				if err != nil || i < 0 || i >= len(trackIDs) {
+					return nil, &subsonicError{subsonicErrGeneric, "songIndexToRemove out of range: " + v}
+				}
+				removed[i] = true
+			}
+			var kept []string
+			for i, id := range trackIDs {
+				if !removed[i] {
+					kept = append(kept, id)
+				}
+			}
+			return append(kept, add...), nil
+		})
+		if errors.Is(err, library.ErrNotFound) {
+			return nil, subsonicNotFound("song")
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if changed {
+		if err := repo.UpdatePlaylist(p); err != nil {
+			return nil, err
+		}
+	}
+	return &subsonicResponse{}, nil
+}
+
+func subsonicDeletePlaylist(c *gin.Context) (*subsonicResponse, error) {
+	p, err := subsonicFindPlaylist(c, "id", true)
+	if err != nil {
+		return nil, err
+	}
+	if err := repo.DeletePlaylist(p.ID); err != nil {
+		return nil, err
+	}
+	return &subsonicResponse{}, nil
+}
+
+// subsonicScrobble records plays of the songs id at the times time, in milliseconds
+// since the epoch, defaulting to now. With submission=false the client only reports
+// what is playing now, which is not tracked.
+func subsonicScrobble(c *gin.Context) (*subsonicResponse, error) {
+	ids := subsonicValues(c, "id")
+	if len(ids) == 0 {
+		return nil, subsonicMissing("id")
+	}
+	if subsonicParam(c, "submission") == "false" {
+		return &subsonicResponse{}, nil
+	}
+
+	times := subsonicValues(c, "time")
+	for i, id := range ids {
+		at := time.Now()
+		if i < len(times) {
+			ms, err := strconv.ParseInt(times[i], 10, 64)
+			if err != nil {
+				return nil, &subsonicError{subsonicErrGeneric, "time must be a number"}
+			}
+			at = time.UnixMilli(ms)
+		}
+		err := repo.RecordPlay(id, subsonicUser(c), at)
+		if errors.Is(err, library.ErrNotFound) {
+			return nil, subsonicNotFound("song")
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &subsonicResponse{}, nil
+}
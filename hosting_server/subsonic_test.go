@@ -0,0 +1,215 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"heavymetal/library"
+)
+
+// newTestUser creates a regular user with the given account password.
+func newTestUser(t *testing.T, db *library.DB, name, password string) library.User {
+	t.Helper()
+	hash, err := hashPassword(password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := db.CreateUser(library.User{Name: name, PasswordHash: hash, Role: library.UserRoleRegular})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+// useSubsonicKey sets up a Subsonic password key for the length of a test.
+func useSubsonicKey(t *testing.T) {
+	t.Helper()
+	t.Setenv("MUSIC_SUBSONIC_KEY", "test key")
+	old := subsonicKey
+	t.Cleanup(func() { subsonicKey = old })
+	if err := setupSubsonicKey(t.TempDir() + "/music.sqlite"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// setSubsonicPassword sets the Subsonic password of user, logging in with their
+// account password.
+func setSubsonicPassword(t *testing.T, r http.Handler, name, password, subsonic string) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPut, "/auth/subsonic-password", strings.NewReader(`{"password": "`+subsonic+`"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.SetBasicAuth(name, password)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("PUT /auth/subsonic-password: status %d: %s", w.Code, w.Body)
+	}
+}
+
+// subsonicToken returns the t parameter of a token login with the salt s.
+func subsonicToken(password, s string) string {
+	sum := md5.Sum([]byte(password + s))
+	return hex.EncodeToString(sum[:])
+}
+
+// pingSubsonic calls ping with the given parameters and returns the error code, or -1
+// if it succeeded.
+func pingSubsonic(t *testing.T, r http.Handler, params url.Values) int {
+	t.Helper()
+	params.Set("f", "json")
+	w := request(r, http.MethodGet, "/rest/ping?"+params.Encode())
+	var body struct {
+		Response subsonicResponse `json:"subsonic-response"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("ping: %v: %s", err, w.Body)
+	}
+	if body.Response.Error != nil {
+		return body.Response.Error.Code
+	}
+	return -1
+}
+
+func TestSubsonicTokenLogin(t *testing.T) {
+	db := newTestLibrary(t)
+	useSubsonicKey(t)
+	newTestUser(t, db, "alice", "account password")
+	r := newRouter(false)
+
+	token := url.Values{"u": {"alice"}, "s": {"c0ffee"}, "t": {subsonicToken("subsonic password", "c0ffee")}}
+	if code := pingSubsonic(t, r, token); code != subsonicErrTokenAuth {
+		t.Errorf("token login without a Subsonic password: code %d, want %d", code, subsonicErrTokenAuth)
+	}
+
+	setSubsonicPassword(t, r, "alice", "account password", "subsonic password")
+	stored, err := db.UserByName("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.SubsonicPassword == "" || strings.Contains(stored.SubsonicPassword, "subsonic password") {
+		t.Errorf("stored Subsonic password %q, want it encrypted", stored.SubsonicPassword)
+	}
+
+	if code := pingSubsonic(t, r, token); code != -1 {
+		t.Errorf("token login: code %d, want success", code)
+	}
+	upper := url.Values{"u": {"alice"}, "s": {"c0ffee"}, "t": {strings.ToUpper(token.Get("t"))}}
+	if code := pingSubsonic(t, r, upper); code != -1 {
+		t.Errorf("token login in upper case: code %d, want success", code)
+	}
+	for name, params := range map[string]url.Values{
+		"another salt":      {"u": {"alice"}, "s": {"bad"}, "t": {token.Get("t")}},
+		"account password":  {"u": {"alice"}, "s": {"c0ffee"}, "t": {subsonicToken("account password", "c0ffee")}},
+		"unknown user":      {"u": {"bob"}, "s": {"c0ffee"}, "t": {token.Get("t")}},
+		"wrong password":    {"u": {"alice"}, "p": {"nope nope nope"}},
+		"malformed enc hex": {"u": {"alice"}, "p": {"enc:zz"}},
+	} {
+		if code := pingSubsonic(t, r, params); code != subsonicErrBadCredentials {
+			t.Errorf("%s: code %d, want %d", name, code, subsonicErrBadCredentials)
+		}
+	}
+	if code := pingSubsonic(t, r, url.Values{"u": {"alice"}, "t": {token.Get("t")}}); code != subsonicErrMissingParam {
+		t.Errorf("token without salt: code %d, want %d", code, subsonicErrMissingParam)
+	}
+
+	// Either password works as p, in clear or hex-encoded
+	for _, p := range []string{"account password", "subsonic password", "enc:" + hex.EncodeToString([]byte("subsonic password"))} {
+		if code := pingSubsonic(t, r, url.Values{"u": {"alice"}, "p": {p}}); code != -1 {
+			t.Errorf("p=%q: code %d, want success", p, code)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodDelete, "/auth/subsonic-password", nil)
+	req.SetBasicAuth("alice", "account password")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("DELETE /auth/subsonic-password: status %d", w.Code)
+	}
+	if code := pingSubsonic(t, r, token); code != subsonicErrTokenAuth {
+		t.Errorf("token login after removing the Subsonic password: code %d, want %d", code, subsonicErrTokenAuth)
+	}
+}
+
+func TestSubsonicTokenLoginDisabledUser(t *testing.T) {
+	db := newTestLibrary(t)
+	useSubsonicKey(t)
+	newTestUser(t, db, "carol", "account password")
+	r := newRouter(false)
+	setSubsonicPassword(t, r, "carol", "account password", "subsonic password")
+
+	user, err := db.UserByName("carol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	user.Disabled = true
+	if err := db.UpdateUser(user); err != nil {
+		t.Fatal(err)
+	}
+	token := url.Values{"u": {"carol"}, "s": {"salt"}, "t": {subsonicToken("subsonic password", "salt")}}
+	if code := pingSubsonic(t, r, token); code != subsonicErrBadCredentials {
+		t.Errorf("disabled user: code %d, want %d", code, subsonicErrBadCredentials)
+	}
+}
+
+func TestSubsonicPasswordBoundToUser(t *testing.T) {
+	db := newTestLibrary(t)
+	useSubsonicKey(t)
+	newTestUser(t, db, "dave", "account password")
+	newTestUser(t, db, "erin", "account password")
+	r := newRouter(false)
+	setSubsonicPassword(t, r, "dave", "account password", "subsonic password")
+
+	// A Subsonic password copied to another user's row does not decrypt
+	dave, _ := db.UserByName("dave")
+	erin, _ := db.UserByName("erin")
+	erin.SubsonicPassword = dave.SubsonicPassword
+	if err := db.UpdateUser(erin); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := subsonicPassword(erin); err == nil {
+		t.Error("decrypted a Subsonic password stored for another user")
+	}
+}
+
+func TestSubsonicOpenMode(t *testing.T) {
+	db := newTestLibrary(t)
+	useSubsonicKey(t)
+	newTestUser(t, db, "frank", "account password")
+	r := newRouter(true)
+
+	for name, params := range map[string]url.Values{
+		"no credentials":           {},
+		"token without a password": {"u": {"frank"}, "s": {"salt"}, "t": {subsonicToken("whatever", "salt")}},
+		"token of an unknown user": {"u": {"nobody"}, "s": {"salt"}, "t": {"00"}},
+		"wrong password":           {"u": {"frank"}, "p": {"wrong password"}},
+		"right password":           {"u": {"frank"}, "p": {"account password"}},
+	} {
+		if code := pingSubsonic(t, r, params); code != -1 {
+			t.Errorf("open mode, %s: code %d, want success", name, code)
+		}
+	}
+}
+
+func TestSetSubsonicPasswordLength(t *testing.T) {
+	db := newTestLibrary(t)
+	useSubsonicKey(t)
+	newTestUser(t, db, "gina", "account password")
+	r := newRouter(false)
+	for _, password := range []string{"short", strings.Repeat("x", maxSubsonicPasswordLength+1)} {
+		req := httptest.NewRequest(http.MethodPut, "/auth/subsonic-password", strings.NewReader(`{"password": "`+password+`"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.SetBasicAuth("gina", "account password")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%d byte password: status %d, want 400", len(password), w.Code)
+		}
+	}
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"time"
+
+	"heavymetal/library"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Besides Basic auth, clients authenticate with tokens sent as "Authorization: Bearer
+// <token>": session tokens, returned by POST /auth/login and expiring after
+// sessionTTL, and API keys, created per device or script and lasting until revoked.
+// Audio and image elements cannot send headers, so /stream, /cover and /hls also accept
+// short-lived signed URLs, whose exp and sig parameters prove that a logged-in user
+// asked for them. An HLS signature covers every playlist and segment of a track.
+
+// Prefixes of the two kinds of tokens, which make them easy to tell apart and to find
+// in leaked text.
+const (
+	sessionTokenPrefix = "hms_"
+	apiKeyPrefix       = "hmk_"
+)
+
+// sessionTTL is how long a session token lasts.
+const sessionTTL = 30 * 24 * time.Hour
+
+// Lifetimes of signed URLs: the default, and the longest that can be asked for.
+const (
+	signedURLTTL    = time.Hour
+	maxSignedURLTTL = 24 * time.Hour
+)
+
+// tokenKey is the context key of the library.Token a request is authenticated with.
+const tokenKey = "token"
+
+// urlSecret is the HMAC key of signed URLs, set by setupURLSigning.
+var urlSecret []byte
+
+// signablePath matches the paths signed URLs can be made for.
+var signablePath = regexp.MustCompile(`^/(stream|cover)/[^/]+$`)
+
+// hlsSignablePath matches the HLS paths signed URLs can be made for: the /hls/{id}/
+// prefix of a track, alone or followed by master.m3u8. The prefix is what is signed.
+var hlsSignablePath = regexp.MustCompile(`^(/hls/[^/]+/)(master\.m3u8)?$`)
+
+// hlsSignedPrefix matches the /hls/{id}/ prefix of the paths an HLS signature covers.
+var hlsSignedPrefix = regexp.MustCompile(`^/hls/[^/]+/`)
+
+// setupURLSigning takes the key of signed URLs from MUSIC_URL_SECRET, or makes up one
+// that lasts until the server restarts.
+func setupURLSigning() error {
+	if secret := os.Getenv("MUSIC_URL_SECRET"); secret != "" {
+		urlSecret = []byte(secret)
+		return nil
+	}
+	urlSecret = make([]byte, 32)
+	if _, err := rand.Read(urlSecret); err != nil {
+		return fmt.Errorf("failed to generate URL secret: %w", err)
+	}
+	return nil
+}
+
+// newToken returns a random token with a prefix, and the hash to store for it.
+func newToken(prefix string) (token, hash string, err error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", fmt.Errorf("failed to generate token: %w", err)
+	}
+	token = prefix + base64.RawURLEncoding.EncodeToString(b)
+	return token, hashToken(token), nil
+}
+
+// hashToken returns the hash tokens are stored and looked up by. Tokens are random
+// enough that a fast hash is as good as a slow one.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// checkToken returns the token with a value and its user, and false if there is no
+// such token, it expired or the user is disabled.
+func checkToken(value string) (library.Token, library.User, bool, error) {
+	token, user, err := repo.TokenByHash(hashToken(value))
+	if errors.Is(err, library.ErrNotFound) {
+		return token, user, false, nil
+	}
+	if err != nil {
+		return token, user, false, err
+	}
+	if now := time.Now(); now.Unix()-token.LastUsedAt >= 60 {
+		if err := repo.TouchToken(token.ID, now); err != nil {
+			log.Printf("Query error: %v", err)
+		}
+	}
+	return token, user, !user.Disabled, nil
+}
+
+// signPath returns the signature of a path valid until exp, in Unix seconds.
+func signPath(path string, exp int64) string {
+	mac := hmac.New(sha256.New, urlSecret)
+	mac.Write([]byte(path + "\n" + strconv.FormatInt(exp, 10)))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// validSignature reports whether a request carries an unexpired signature of its path,
+// or for HLS, of the /hls/{id}/ prefix of its path.
+func validSignature(c *gin.Context) bool {
+	exp, err := strconv.ParseInt(c.Query("exp"), 10, 64)
+	if err != nil || exp <= time.Now().Unix() {
+		return false
+	}
+	path := c.Request.URL.Path
+	if prefix := hlsSignedPrefix.FindString(path); prefix != "" {
+		// Signed paths never end in a slash, so a prefix signature is no other path's
+		path = prefix
+	}
+	return hmac.Equal([]byte(c.Query("sig")), []byte(signPath(path, exp)))
+}
+
+// loginRequest is the body of POST /auth/login.
+type loginRequest struct {
+	Name     string `json:"name" example:"alice"`
+	Password string `json:"password" example:"correct horse battery"`
+}
+
+// loginResponse is a new session.
+type loginResponse struct {
+	Token     string       `json:"token" example:"hms_..."`
+	ExpiresAt int64        `json:"expires_at" example:"1720592000"` // Unix seconds
+	User      library.User `json:"user"`
+}
+
+// apiKeyRequest is the body of POST /auth/keys.
+type apiKeyRequest struct {
+	Name string `json:"name" example:"laptop mpv"`
+}
+
+// apiKeyResponse is a new API key, with the only copy of its value.
+type apiKeyResponse struct {
+	Key string `json:"key" example:"hmk_..."`
+	library.Token
+}
+
+// signedURLResponse is a URL that works without credentials until it expires.
+type signedURLResponse struct {
+	URL       string `json:"url" example:"/stream/eleven-beryllium-bravo-indigo?exp=1718003600&sig=..."`
+	ExpiresAt int64  `json:"expires_at" example:"1718003600"` // Unix seconds
+}
+
+// @Summary Log in
+// @Description Returns a session token to send as "Authorization: Bearer <token>". Sessions last 30 days, or until logged out or the password is reset.
+// @Accept json
+// @Produce json
+// @Param credentials body loginRequest true "User name and password"
+// @Success 200 {object} loginResponse
+// @Failure 400 {object} map[string]string
+// @Failure 401 {object} map[string]string
+// @Router /auth/login [post]
+func loginHandler(c *gin.Context) {
+	var req loginRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid body: " + err.Error()})
+		return
+	}
+	user, ok, err := checkLogin(req.Name, req.Password)
+	if err != nil {
+		log.Printf("Query error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		return
+	}
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "wrong name or password"})
+		return
+	}
+
+	value, hash, err := newToken(sessionTokenPrefix)
+	if err != nil {
+		log.Printf("Token error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		return
+	}
+	token, err := repo.CreateToken(library.Token{UserID: user.ID, Kind: library.TokenKindSession, Hash: hash,
+		ExpiresAt: time.Now().Add(sessionTTL).Unix()})
+	if err != nil {
+		log.Printf("Query error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		return
+	}
+	c.JSON(http.StatusOK, loginResponse{Token: value, ExpiresAt: token.ExpiresAt, User: user})
+}
+
+// @Summary Log out
+// @Description Revokes the session token the request is made with.
+// @Success 204
+// @Failure 400 {object} map[string]string
+// @Failure 401 {object} map[string]string
+// @Router /auth/logout [post]
+func logoutHandler(c *gin.Context) {
+	token, ok := currentToken(c)
+	if !ok || token.Kind != library.TokenKindSession {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "not logged in with a session token"})
+		return
+	}
+	if err := repo.DeleteToken(token.ID); err != nil && !errors.Is(err, library.ErrNotFound) {
+		log.Printf("Query error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// @Summary List your sessions and API keys
+// @Description Token values are only shown when they are created.
+// @Produce json
+// @Success 200 {array} library.Token
+// @Failure 401 {object} map[string]string
+// @Router /auth/tokens [get]
+func getTokensHandler(c *gin.Context) {
+	user, _ := currentUser(c)
+	tokens, err := repo.Tokens(user.ID)
+	if err != nil {
+		log.Printf("Query error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		return
+	}
+	c.JSON(http.StatusOK, tokens)
+}
+
+// @Summary Revoke one of your sessions or API keys
+// @Param id path int true "Token ID"
+// @Success 204
+// @Failure 401 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Router /auth/tokens/{id} [delete]
+func deleteTokenHandler(c *gin.Context) {
+	id, ok := idParam(c, "id")
+	if !ok {
+		return
+	}
+	user, _ := currentUser(c)
+	token, err := repo.Token(id)
+	if errors.Is(err, library.ErrNotFound) || err == nil && token.UserID != user.ID {
+		c.JSON(http.StatusNotFound, gin.H{"error": "token not found"})
+		return
+	}
+	if err == nil {
+		err = repo.DeleteToken(id)
+	}
+	if err != nil && !errors.Is(err, library.ErrNotFound) {
+		log.Printf("Query error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// @Summary Create an API key
+// @Description Creates a key for a device or script, to send as "Authorization: Bearer <key>", or as apiKey to the Subsonic API. It lasts until revoked; its value is only shown now.
+// @Accept json
+// @Produce json
+// @Param key body apiKeyRequest true "Name of the device or script"
+// @Success 201 {object} apiKeyResponse
+// @Failure 400 {object} map[string]string
+// @Failure 401 {object} map[string]string
+// @Router /auth/keys [post]
+func createAPIKeyHandler(c *gin.Context) {
+	var req apiKeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid body: " + err.Error()})
+		return
+	}
+	if req.Name == "" || len(req.Name) > 100 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "name must be 1 to 100 characters"})
+		return
+	}
+
+	user, _ := currentUser(c)
+	value, hash, err := newToken(apiKeyPrefix)
+	if err != nil {
+		log.Printf("Token error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		return
+	}
+	token, err := repo.CreateToken(library.Token{UserID: user.ID, Kind: library.TokenKindAPIKey, Name: req.Name, Hash: hash})
+	if err != nil {
+		log.Printf("Query error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		return
+	}
+	c.JSON(http.StatusCreated, apiKeyResponse{Key: value, Token: token})
+}
+
+// @Summary Sign a stream, cover or HLS URL
+// @Description Returns a URL for /stream/{id}, /cover/{id} or /hls/{id}/ that works without credentials until it expires, for audio and image elements, which cannot send an Authorization header. Other query parameters, such as format, can be added to it. A signed /cover URL serves the image itself to clients that accept images, as image elements do. Signing /hls/{id}/ returns the URL of the master playlist, whose variant and segment URIs are signed the same way.
+// @Produce json
+// @Param path query string true "Path to sign, e.g. /stream/eleven-beryllium-bravo-indigo or /hls/eleven-beryllium-bravo-indigo/"
+// @Param ttl query int false "Seconds the URL lasts, at most 86400" default(3600)
+// @Success 200 {object} signedURLResponse
+// @Failure 400 {object} map[string]string
+// @Failure 401 {object} map[string]string
+// @Router /auth/sign [get]
+func signURLHandler(c *gin.Context) {
+	path, signed := c.Query("path"), ""
+	if m := hlsSignablePath.FindStringSubmatch(path); m != nil {
+		path, signed = m[1]+"master.m3u8", m[1]
+	} else if signablePath.MatchString(path) {
+		signed = path
+	} else {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "path must be /stream/{id}, /cover/{id} or /hls/{id}/"})
+		return
+	}
+	ttl := signedURLTTL
+	if v := c.Query("ttl"); v != "" {
+		seconds, err := strconv.Atoi(v)
+		if err != nil || seconds <= 0 || time.Duration(seconds)*time.Second > maxSignedURLTTL {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "ttl must be 1 to 86400 seconds"})
+			return
+		}
+		ttl = time.Duration(seconds) * time.Second
+	}
+
+	exp := time.Now().Add(ttl).Unix()
+	c.JSON(http.StatusOK, signedURLResponse{
+		URL:       path + "?exp=" + strconv.FormatInt(exp, 10) + "&sig=" + signPath(signed, exp),
+		ExpiresAt: exp,
+	})
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// useURLSecret sets up the key of signed URLs for the length of a test.
+func useURLSecret(t *testing.T) {
+	t.Helper()
+	t.Setenv("MUSIC_URL_SECRET", "test secret")
+	old := urlSecret
+	t.Cleanup(func() { urlSecret = old })
+	if err := setupURLSigning(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// signerAuth is the Authorization header of a user named signer with the password
+// "account password", who asks for signed URLs in tests that create them.
+var signerAuth = "Basic " + base64.StdEncoding.EncodeToString([]byte("signer:account password"))
+
+// signURL asks /auth/sign for a signed URL of path, as signer.
+func signURL(t *testing.T, r http.Handler, path string) string {
+	t.Helper()
+	w := request(r, http.MethodGet, "/auth/sign?path="+url.QueryEscape(path), "Authorization", signerAuth)
+	var resp signedURLResponse
+	if w.Code != http.StatusOK || json.Unmarshal(w.Body.Bytes(), &resp) != nil {
+		t.Fatalf("signing %s: status %d: %s", path, w.Code, w.Body)
+	}
+	return resp.URL
+}
+
+func TestSignedStreamURL(t *testing.T) {
+	db := newTestLibrary(t)
+	useURLSecret(t)
+	newTestUser(t, db, "signer", "account password")
+	data := testAudio(100)
+	addTestTrack(t, db, "signed", "song.mp3", "mpeg", data)
+	r := newRouter(false)
+
+	if w := request(r, http.MethodGet, "/stream/signed"); w.Code != http.StatusUnauthorized {
+		t.Fatalf("unsigned: status %d, want 401", w.Code)
+	}
+	signed := signURL(t, r, "/stream/signed")
+	if w := request(r, http.MethodGet, signed); w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), data) {
+		t.Errorf("signed: status %d, %d bytes", w.Code, w.Body.Len())
+	}
+	if w := request(r, http.MethodGet, strings.Replace(signed, "/stream/signed", "/stream/other", 1)); w.Code != http.StatusUnauthorized {
+		t.Errorf("signature of another track: status %d, want 401", w.Code)
+	}
+	for _, path := range []string{"/tracks/all", "/stream/a/b", "/hls/a/128/0.ts", "/hls/"} {
+		if w := request(r, http.MethodGet, "/auth/sign?path="+url.QueryEscape(path), "Authorization", signerAuth); w.Code != http.StatusBadRequest {
+			t.Errorf("signing %s: status %d, want 400", path, w.Code)
+		}
+	}
+}
+
+func TestSignedCoverURL(t *testing.T) {
+	db := newTestLibrary(t)
+	useURLSecret(t)
+	newTestUser(t, db, "signer", "account password")
+	path := addTestTrack(t, db, "covered", "song.mp3", "mpeg", testAudio(10))
+	image := []byte("\x89PNG not really")
+	if err := os.WriteFile(filepath.Join(filepath.Dir(path), "cover.png"), image, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	r := newRouter(false)
+	signed := signURL(t, r, "/cover/covered")
+
+	// As an image element asks for it
+	w := request(r, http.MethodGet, signed, "Accept", "image/avif,image/webp,image/*,*/*;q=0.8")
+	if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), image) {
+		t.Errorf("image: status %d, %d bytes", w.Code, w.Body.Len())
+	}
+	if got := w.Header().Get("Content-Type"); got != "image/png" {
+		t.Errorf("image Content-Type = %q, want image/png", got)
+	}
+
+	w = request(r, http.MethodGet, signed)
+	var body struct {
+		Image string `json:"image_base64"`
+	}
+	if w.Code != http.StatusOK || json.Unmarshal(w.Body.Bytes(), &body) != nil || !strings.HasPrefix(body.Image, "data:image/png;base64,") {
+		t.Errorf("JSON: status %d: %s", w.Code, w.Body)
+	}
+}
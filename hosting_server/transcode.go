@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// transcoder converts streams requested with ?format=, or is nil if the server cannot
+// transcode. transcodes caches its output, or is nil if caching is off.
+var (
+	transcoder Transcoder
+	transcodes *transcodeCache
+)
+
+// setupTranscoding picks the transcoder and cache from the environment:
+// MUSIC_TRANSCODER is "ffmpeg" (the default), "fake" or "none";
+// MUSIC_TRANSCODE_CACHE is the cache directory; and MUSIC_TRANSCODE_CACHE_MB caps its
+// size, with 0 turning the cache off.
+func setupTranscoding() {
+	switch name := getEnv("MUSIC_TRANSCODER", "ffmpeg"); name {
+	case "ffmpeg":
+		t, err := newFFmpegTranscoder()
+		if err != nil {
+			log.Printf("Transcoding disabled: %v", err)
+			return
+		}
+		transcoder = t
+	case "fake":
+		log.Printf("Using the fake transcoder: ?format= streams are the original files")
+		transcoder = fakeTranscoder{bytesPerSecond: 16000}
+	case "none":
+		return
+	default:
+		log.Fatalf("MUSIC_TRANSCODER must be ffmpeg, fake or none, got %q", name)
+	}
+
+	sizeMB, err := strconv.ParseInt(getEnv("MUSIC_TRANSCODE_CACHE_MB", "1024"), 10, 64)
+	if err != nil || sizeMB < 0 {
+		log.Fatalf("MUSIC_TRANSCODE_CACHE_MB must be a non-negative number, got %q", os.Getenv("MUSIC_TRANSCODE_CACHE_MB"))
+	}
+	if sizeMB == 0 {
+		return
+	}
+	dir := getEnv("MUSIC_TRANSCODE_CACHE", filepath.Join(os.TempDir(), "heavymetal-transcodes"))
+	if transcodes, err = newTranscodeCache(dir, sizeMB<<20); err != nil {
+		log.Printf("Transcodes will not be cached: %v", err)
+	}
+}
+
+// TranscodeOptions describe the stream a Transcoder produces.
+type TranscodeOptions struct {
+	Format   string        // One of the keys of transcodeFormats, or hlsSegmentFormat
+	Bitrate  int           // Kilobits per second
+	Offset   time.Duration // Position in the source to start from
+	Duration time.Duration // How much to transcode; 0 for the rest of the source
+	// KeepTimestamps makes output timestamps count from Offset rather than from 0, so
+	// that separately transcoded segments of a track play back to back.
+	KeepTimestamps bool
+}
+
+// Transcoder converts audio files to another format for streaming.
+type Transcoder interface {
+	// Transcode writes the audio of the file at path, converted as opts asks, to w. It
+	// stops early, returning the context's error, if ctx is cancelled.
+	Transcode(ctx context.Context, path string, opts TranscodeOptions, w io.Writer) error
+}
+
+// transcodeFormat is an output format clients can ask for with ?format=.
+type transcodeFormat struct {
+	contentType    string
+	extension      string // Of cached files
+	defaultBitrate int    // Kilobits per second
+	codec          string // ffmpeg encoder
+	muxer          string // ffmpeg output format
+}
+
+// transcodeFormats lists the formats /stream/{id} can transcode to.
+var transcodeFormats = map[string]transcodeFormat{
+	"opus": {"audio/ogg", ".opus", 128, "libopus", "ogg"},
+	"ogg":  {"audio/ogg", ".ogg", 160, "libvorbis", "ogg"},
+	"mp3":  {"audio/mpeg", ".mp3", 192, "libmp3lame", "mp3"},
+	"aac":  {"audio/aac", ".aac", 160, "aac", "adts"},
+}
+
+// hlsSegmentFormat is the format of HLS segments: AAC in MPEG transport streams, which
+// every HLS player accepts. Clients cannot ask /stream/{id} for it.
+const hlsSegmentFormat = "hls"
+
+// lookupTranscodeFormat returns the format a Transcoder should produce for name.
+func lookupTranscodeFormat(name string) (transcodeFormat, bool) {
+	if name == hlsSegmentFormat {
+		return transcodeFormat{"video/mp2t", ".ts", 128, "aac", "mpegts"}, true
+	}
+	format, ok := transcodeFormats[name]
+	return format, ok
+}
+
+// Bounds of ?bitrate=, in kilobits per second.
+const (
+	minTranscodeBitrate = 32
+	maxTranscodeBitrate = 320
+)
+
+// ffmpegTranscoder transcodes with the ffmpeg command line tool.
+type ffmpegTranscoder struct {
+	path string // Of the ffmpeg binary
+}
+
+// newFFmpegTranscoder finds ffmpeg on the PATH, or returns an error if it is missing.
+func newFFmpegTranscoder() (*ffmpegTranscoder, error) {
+	path, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		return nil, fmt.Errorf("ffmpeg not found: %w", err)
+	}
+	return &ffmpegTranscoder{path: path}, nil
+}
+
+func (t *ffmpegTranscoder) Transcode(ctx context.Context, path string, opts TranscodeOptions, w io.Writer) error {
+	format, ok := lookupTranscodeFormat(opts.Format)
+	if !ok {
+		return fmt.Errorf("unsupported transcode format %q", opts.Format)
+	}
+	seconds := func(d time.Duration) string { return strconv.FormatFloat(d.Seconds(), 'f', 3, 64) }
+
+	args := []string{"-nostdin", "-hide_banner", "-loglevel", "error"}
+	if opts.Offset > 0 {
+		// Seeking before -i jumps straight to the offset instead of decoding up to it
+		args = append(args, "-ss", seconds(opts.Offset))
+	}
+	if opts.Duration > 0 {
+		args = append(args, "-t", seconds(opts.Duration))
+	}
+	// Only the first audio stream; embedded cover art and tags are left out
+	args = append(args, "-i", path, "-map", "0:a:0", "-map_metadata", "-1",
+		"-c:a", format.codec, "-b:a", strconv.Itoa(opts.Bitrate)+"k")
+	if opts.KeepTimestamps && opts.Offset > 0 {
+		args = append(args, "-output_ts_offset", seconds(opts.Offset))
+	}
+	args = append(args, "-f", format.muxer, "pipe:1")
+
+	cmd := exec.CommandContext(ctx, t.path, args...)
+	cmd.Stdout = w
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return fmt.Errorf("ffmpeg failed on %s: %w: %s", path, err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// fakeTranscoder stands in for ffmpeg in tests and on machines without it: it copies
+// the source file unchanged, cutting out the share of it that the offset and duration
+// select. It does not change the format, so players may refuse what it produces.
+type fakeTranscoder struct {
+	// bytesPerSecond is how much of the source one second of offset or duration spans.
+	bytesPerSecond int64
+}
+
+func (t fakeTranscoder) Transcode(ctx context.Context, path string, opts TranscodeOptions, w io.Writer) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer f.Close()
+	if skip := int64(opts.Offset.Seconds() * float64(t.bytesPerSecond)); skip > 0 {
+		if _, err := f.Seek(skip, io.SeekStart); err != nil {
+			return fmt.Errorf("failed to seek in %s: %w", path, err)
+		}
+	}
+	var r io.Reader = f
+	if opts.Duration > 0 {
+		r = io.LimitReader(f, int64(opts.Duration.Seconds()*float64(t.bytesPerSecond)))
+	}
+	if _, err := io.Copy(w, contextReader{ctx, r}); err != nil {
+		return err
+	}
+	return nil
+}
+
+// contextReader fails reads once its context is done.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// transcodeCache keeps finished transcodes on disk so that replaying a track costs no
+// encoding. When the files outgrow maxBytes the least recently used are deleted.
+type transcodeCache struct {
+	dir      string
+	maxBytes int64
+	mu       sync.Mutex // Serialises eviction
+}
+
+// newTranscodeCache creates the cache directory if needed and clears out transcodes
+// left unfinished by a previous run.
+func newTranscodeCache(dir string, maxBytes int64) (*transcodeCache, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create transcode cache %s: %w", dir, err)
+	}
+	partials, _ := filepath.Glob(filepath.Join(dir, "*.partial"))
+	for _, p := range partials {
+		os.Remove(p)
+	}
+	c := &transcodeCache{dir: dir, maxBytes: maxBytes}
+	c.evict()
+	return c, nil
+}
+
+// open returns the cached transcode stored under key, or nil if there is none, and
+// marks it as recently used.
+func (c *transcodeCache) open(key string) *os.File {
+	path := filepath.Join(c.dir, key)
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	now := time.Now()
+	os.Chtimes(path, now, now)
+	return f
+}
+
+// create starts a new transcode for key. Write to the returned file, then pass it to
+// commit if the transcode finished or to discard if it did not.
+func (c *transcodeCache) create(key string) (*os.File, error) {
+	f, err := os.CreateTemp(c.dir, key+".*.partial")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create transcode cache file: %w", err)
+	}
+	return f, nil
+}
+
+// commit stores a finished transcode under key and makes room for it. It returns the
+// stored transcode opened for reading, or nil if it could not be stored. The file is
+// opened before making room, so it can be read even if it was too big to keep.
+func (c *transcodeCache) commit(f *os.File, key string) *os.File {
+	if err := f.Close(); err != nil {
+		log.Printf("Failed to write transcode %s: %v", key, err)
+		os.Remove(f.Name())
+		return nil
+	}
+	stored, err := os.Open(f.Name())
+	if err == nil {
+		if err = os.Rename(f.Name(), filepath.Join(c.dir, key)); err != nil {
+			stored.Close()
+		}
+	}
+	if err != nil {
+		log.Printf("Failed to store transcode %s: %v", key, err)
+		os.Remove(f.Name())
+		return nil
+	}
+	c.evict()
+	return stored
+}
+
+// discard deletes an unfinished transcode.
+func (c *transcodeCache) discard(f *os.File) {
+	f.Close()
+	os.Remove(f.Name())
+}
+
+// evict deletes the least recently used transcodes until the rest fit in maxBytes.
+func (c *transcodeCache) evict() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		log.Printf("Failed to read transcode cache %s: %v", c.dir, err)
+		return
+	}
+	var (
+		files []os.FileInfo
+		total int64
+	)
+	for _, e := range entries {
+		if e.IsDir() || strings.HasSuffix(e.Name(), ".partial") {
+			continue
+		}
+		fi, err := e.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, fi)
+		total += fi.Size()
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].ModTime().Before(files[j].ModTime()) })
+	for _, fi := range files {
+		if total <= c.maxBytes {
+			break
+		}
+		if err := os.Remove(filepath.Join(c.dir, fi.Name())); err != nil {
+			log.Printf("Failed to evict transcode %s: %v", fi.Name(), err)
+			continue
+		}
+		total -= fi.Size()
+	}
+}
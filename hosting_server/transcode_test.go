@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useFakeTranscoder makes ?format= streams copies of the source, cached in a temporary
+// directory of up to maxBytes, for the length of a test.
+func useFakeTranscoder(t *testing.T, maxBytes int64) *transcodeCache {
+	t.Helper()
+	cache, err := newTranscodeCache(t.TempDir(), maxBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldTranscoder, oldCache := transcoder, transcodes
+	transcoder, transcodes = fakeTranscoder{bytesPerSecond: 100}, cache
+	t.Cleanup(func() { transcoder, transcodes = oldTranscoder, oldCache })
+	return cache
+}
+
+// cachedTranscodes returns the names of the finished transcodes in a cache.
+func cachedTranscodes(t *testing.T, cache *transcodeCache) []string {
+	t.Helper()
+	entries, err := os.ReadDir(cache.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		if !strings.HasSuffix(e.Name(), ".partial") {
+			names = append(names, e.Name())
+		}
+	}
+	return names
+}
+
+func TestTranscodeCachedReplay(t *testing.T) {
+	db := newTestLibrary(t)
+	data := testAudio(1000)
+	addTestTrack(t, db, "replayed", "song.flac", "flac", data)
+	cache := useFakeTranscoder(t, 1<<20)
+	r := newRouter(true)
+
+	// The first play is streamed as it is encoded, without ranges
+	w := request(r, http.MethodGet, "/stream/replayed?format=mp3")
+	if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), data) {
+		t.Fatalf("first play: status %d, %d bytes", w.Code, w.Body.Len())
+	}
+	if got := w.Header().Get("Content-Type"); got != "audio/mpeg" {
+		t.Errorf("Content-Type = %q, want audio/mpeg", got)
+	}
+	if got := w.Header().Get("Accept-Ranges"); got != "none" {
+		t.Errorf("first play: Accept-Ranges = %q, want none", got)
+	}
+	if names := cachedTranscodes(t, cache); len(names) != 1 || !strings.HasPrefix(names[0], "replayed-") || !strings.HasSuffix(names[0], "-192.mp3") {
+		t.Fatalf("cache holds %v, want one 192 kbit/s mp3 of the track", names)
+	}
+
+	// Replays come from the cache, with ranges and validators
+	w = request(r, http.MethodGet, "/stream/replayed?format=mp3", "Range", "bytes=900-")
+	if w.Code != http.StatusPartialContent || !bytes.Equal(w.Body.Bytes(), data[900:]) {
+		t.Fatalf("cached range: status %d, %d bytes", w.Code, w.Body.Len())
+	}
+	if got := w.Header().Get("Content-Range"); got != "bytes 900-999/1000" {
+		t.Errorf("Content-Range = %q, want bytes 900-999/1000", got)
+	}
+	etag := w.Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("cached replay has no ETag")
+	}
+	if w = request(r, http.MethodGet, "/stream/replayed?format=mp3", "If-None-Match", etag); w.Code != http.StatusNotModified {
+		t.Errorf("If-None-Match on a cached transcode: status %d, want 304", w.Code)
+	}
+
+	// Another bitrate or format is another transcode
+	if w = request(r, http.MethodGet, "/stream/replayed?format=mp3&bitrate=96", "If-None-Match", etag); w.Code != http.StatusOK {
+		t.Errorf("other bitrate with the same ETag: status %d, want 200", w.Code)
+	}
+	if w = request(r, http.MethodGet, "/stream/replayed?format=opus"); w.Header().Get("Content-Type") != "audio/ogg" {
+		t.Errorf("opus Content-Type = %q, want audio/ogg", w.Header().Get("Content-Type"))
+	}
+	if names := cachedTranscodes(t, cache); len(names) != 3 {
+		t.Errorf("cache holds %v, want three transcodes", names)
+	}
+}
+
+func TestTranscodeOffsetNotCached(t *testing.T) {
+	db := newTestLibrary(t)
+	data := testAudio(1000)
+	addTestTrack(t, db, "seeked", "song.flac", "flac", data)
+	cache := useFakeTranscoder(t, 1<<20)
+	r := newRouter(true)
+
+	w := request(r, http.MethodGet, "/stream/seeked?format=ogg&time_offset=2.5")
+	if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), data[250:]) {
+		t.Fatalf("offset transcode: status %d, %d bytes, want the last 750", w.Code, w.Body.Len())
+	}
+	if w = request(r, http.MethodHead, "/stream/seeked?format=ogg"); w.Code != http.StatusOK || w.Body.Len() != 0 {
+		t.Errorf("HEAD: status %d with %d bytes, want 200 without a body", w.Code, w.Body.Len())
+	}
+	if names := cachedTranscodes(t, cache); len(names) != 0 {
+		t.Errorf("cache holds %v, want nothing", names)
+	}
+
+	// Nor is a range asked of a transcode that is not cached yet
+	w = request(r, http.MethodGet, "/stream/seeked?format=ogg", "Range", "bytes=900-")
+	if w.Code != http.StatusOK || w.Body.Len() != 1000 {
+		t.Errorf("uncached range: status %d, %d bytes, want 200 with the whole transcode", w.Code, w.Body.Len())
+	}
+}
+
+func TestTranscodeUnavailable(t *testing.T) {
+	db := newTestLibrary(t)
+	addTestTrack(t, db, "plain", "song.flac", "flac", testAudio(10))
+	oldTranscoder := transcoder
+	transcoder = nil
+	t.Cleanup(func() { transcoder = oldTranscoder })
+
+	if w := request(newRouter(true), http.MethodGet, "/stream/plain?format=mp3"); w.Code != http.StatusNotImplemented {
+		t.Errorf("status %d, want 501", w.Code)
+	}
+}
+
+// storeTranscode commits data to the cache under key, last used at used.
+func storeTranscode(t *testing.T, cache *transcodeCache, key string, data []byte, used time.Time) {
+	t.Helper()
+	f, err := cache.create(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if stored := cache.commit(f, key); stored != nil {
+		stored.Close()
+	}
+	os.Chtimes(filepath.Join(cache.dir, key), used, used)
+}
+
+func TestTranscodeCacheEviction(t *testing.T) {
+	cache, err := newTranscodeCache(t.TempDir(), 250)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := time.Now().Add(-time.Hour)
+	storeTranscode(t, cache, "a", testAudio(100), base)
+	storeTranscode(t, cache, "b", testAudio(100), base.Add(time.Minute))
+
+	// Opening a transcode makes it the most recently used
+	f := cache.open("a")
+	if f == nil {
+		t.Fatal("transcode a is not cached")
+	}
+	f.Close()
+
+	storeTranscode(t, cache, "c", testAudio(100), time.Now())
+	var total int64
+	for _, name := range cachedTranscodes(t, cache) {
+		fi, err := os.Stat(filepath.Join(cache.dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		total += fi.Size()
+	}
+	if total > cache.maxBytes {
+		t.Errorf("cache holds %d bytes, more than %d", total, cache.maxBytes)
+	}
+	if f := cache.open("b"); f != nil {
+		f.Close()
+		t.Error("least recently used transcode b was kept")
+	}
+	for _, key := range []string{"a", "c"} {
+		if f := cache.open(key); f == nil {
+			t.Errorf("transcode %s was evicted", key)
+		} else {
+			f.Close()
+		}
+	}
+}
+
+func TestTranscodeCacheDropsPartials(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "key.123.partial"), testAudio(10), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cache, err := newTranscodeCache(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := cache.create("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.discard(f)
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("cache directory holds %d files, want none", len(entries))
+	}
+}
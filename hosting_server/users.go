@@ -0,0 +1,200 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"heavymetal/library"
+
+	"github.com/gin-gonic/gin"
+)
+
+// createUserRequest is the body of POST /admin/users.
+type createUserRequest struct {
+	Name     string `json:"name" example:"alice"`
+	Password string `json:"password" example:"correct horse battery"`
+	Role     string `json:"role" example:"regular"` // Defaults to regular
+}
+
+// updateUserRequest is the body of PATCH /admin/users/{id}; omitted fields are kept.
+type updateUserRequest struct {
+	Role     *string `json:"role" example:"admin"`
+	Disabled *bool   `json:"disabled" example:"true"`
+}
+
+// passwordRequest is the body of PUT /admin/users/{id}/password.
+type passwordRequest struct {
+	Password string `json:"password" example:"correct horse battery"`
+}
+
+// validRole reports whether role is one users can have.
+func validRole(role string) bool {
+	return role == library.UserRoleAdmin || role == library.UserRoleRegular
+}
+
+// findUser loads the user in the id path parameter, answering 404 if there is none.
+func findUser(c *gin.Context) (library.User, bool) {
+	id, ok := idParam(c, "id")
+	if !ok {
+		return library.User{}, false
+	}
+	user, err := repo.User(id)
+	if errors.Is(err, library.ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+		return user, false
+	}
+	if err != nil {
+		log.Printf("Query error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		return user, false
+	}
+	return user, true
+}
+
+// @Summary List users
+// @Description Admins only.
+// @Produce json
+// @Success 200 {array} library.User
+// @Failure 403 {object} map[string]string
+// @Router /admin/users [get]
+func getUsersHandler(c *gin.Context) {
+	users, err := repo.Users()
+	if err != nil {
+		log.Printf("Query error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		return
+	}
+	c.JSON(http.StatusOK, users)
+}
+
+// @Summary Create a user
+// @Description Admins only. Names are unique ignoring case and cannot change later. Passwords are 8 to 72 bytes.
+// @Accept json
+// @Produce json
+// @Param user body createUserRequest true "New user"
+// @Success 201 {object} library.User
+// @Failure 400 {object} map[string]string
+// @Failure 403 {object} map[string]string
+// @Failure 409 {object} map[string]string
+// @Router /admin/users [post]
+func createUserHandler(c *gin.Context) {
+	var req createUserRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid body: " + err.Error()})
+		return
+	}
+	if req.Role == "" {
+		req.Role = library.UserRoleRegular
+	}
+	if !validRole(req.Role) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "role must be admin or regular"})
+		return
+	}
+	if err := validateUserName(req.Name); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	hash, err := hashPassword(req.Password)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	user, err := repo.CreateUser(library.User{Name: req.Name, PasswordHash: hash, Role: req.Role})
+	if errors.Is(err, library.ErrExists) {
+		c.JSON(http.StatusConflict, gin.H{"error": "user already exists"})
+		return
+	}
+	if err != nil {
+		log.Printf("Query error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		return
+	}
+	c.JSON(http.StatusCreated, user)
+}
+
+// @Summary Change the role of a user, or disable or enable them
+// @Description Admins only. Disabled users cannot log in. Admins cannot disable or demote themselves, so there is always an admin left.
+// @Accept json
+// @Produce json
+// @Param id path int true "User ID"
+// @Param changes body updateUserRequest true "Fields to change"
+// @Success 200 {object} library.User
+// @Failure 400 {object} map[string]string
+// @Failure 403 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Router /admin/users/{id} [patch]
+func updateUserHandler(c *gin.Context) {
+	user, ok := findUser(c)
+	if !ok {
+		return
+	}
+	var req updateUserRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid body: " + err.Error()})
+		return
+	}
+	if req.Role != nil {
+		if !validRole(*req.Role) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "role must be admin or regular"})
+			return
+		}
+		user.Role = *req.Role
+	}
+	if req.Disabled != nil {
+		user.Disabled = *req.Disabled
+	}
+	if me, _ := currentUser(c); me.ID == user.ID && (user.Disabled || user.Role != library.UserRoleAdmin) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "you cannot disable or demote yourself"})
+		return
+	}
+
+	if err := repo.UpdateUser(user); err != nil {
+		log.Printf("Query error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		return
+	}
+	if user, ok = findUser(c); ok {
+		c.JSON(http.StatusOK, user)
+	}
+}
+
+// @Summary Reset the password of a user
+// @Description Admins only. Passwords are 8 to 72 bytes. The user's sessions are logged out; their API keys keep working.
+// @Accept json
+// @Param id path int true "User ID"
+// @Param password body passwordRequest true "New password"
+// @Success 204
+// @Failure 400 {object} map[string]string
+// @Failure 403 {object} map[string]string
+// @Failure 404 {object} map[string]string
+// @Router /admin/users/{id}/password [put]
+func resetPasswordHandler(c *gin.Context) {
+	user, ok := findUser(c)
+	if !ok {
+		return
+	}
+	var req passwordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid body: " + err.Error()})
+		return
+	}
+	hash, err := hashPassword(req.Password)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	user.PasswordHash = hash
+	err = repo.UpdateUser(user)
+	if err == nil {
+		err = repo.DeleteUserTokens(user.ID, library.TokenKindSession)
+	}
+	if err != nil {
+		log.Printf("Query error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
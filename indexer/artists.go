@@ -0,0 +1,109 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"heavymetal/library"
+)
+
+// ArtistParser splits artist tag values such as "A & B feat. C" into individual credits.
+type ArtistParser struct {
+	separators []string // Split co-credited artists, e.g. ";"
+	featuring  []string // Introduce featured artists, e.g. "feat."
+}
+
+// NewArtistParser creates a parser from "|"-separated lists of separators and
+// featuring markers, as given on the command line.
+func NewArtistParser(separators, featuring string) *ArtistParser {
+	return &ArtistParser{separators: splitList(separators), featuring: splitList(featuring)}
+}
+
+// splitList splits a "|"-separated command line list, dropping empty entries.
+func splitList(list string) []string {
+	var out []string
+	for _, s := range strings.Split(list, "|") {
+		if s != "" {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// Parse turns raw tag values into credits with the given role. Artists introduced by a
+// featuring marker get library.RoleFeatured instead. Duplicate names are dropped.
+func (p *ArtistParser) Parse(values []string, role string) []library.ArtistCredit {
+	var credits []library.ArtistCredit
+	seen := make(map[string]bool)
+	add := func(names []string, role string) {
+		for _, name := range names {
+			key := strings.ToLower(name)
+			if name == "" || seen[key] {
+				continue
+			}
+			seen[key] = true
+			credits = append(credits, library.ArtistCredit{Name: name, Role: role})
+		}
+	}
+	for _, value := range values {
+		main, featured := p.splitFeaturing(value)
+		add(p.splitArtists(main), role)
+		if featured != "" {
+			add(p.splitArtists(featured), library.RoleFeatured)
+		}
+	}
+	return credits
+}
+
+// splitFeaturing splits "A feat. B" and "A (feat. B)" into "A" and "B". Markers only
+// count as whole words, so an artist named "Daft" is not split on "ft".
+func (p *ArtistParser) splitFeaturing(value string) (string, string) {
+	for _, marker := range p.featuring {
+		for idx := 1; idx+len(marker) <= len(value); idx++ {
+			end := idx + len(marker)
+			if !strings.EqualFold(value[idx:end], marker) {
+				continue
+			}
+			prev, _ := utf8.DecodeLastRuneInString(value[:idx])
+			next, _ := utf8.DecodeRuneInString(value[end:])
+			before := isMarkerBoundary(prev)
+			after := end == len(value) || isMarkerBoundary(next)
+			if before && after {
+				main := strings.TrimRight(value[:idx], " ([")
+				featured := strings.TrimRight(strings.TrimSpace(value[end:]), ")]")
+				return strings.TrimSpace(main), strings.TrimSpace(featured)
+			}
+		}
+	}
+	return value, ""
+}
+
+// isMarkerBoundary reports whether r may surround a featuring marker.
+func isMarkerBoundary(r rune) bool {
+	return unicode.IsSpace(r) || r == '(' || r == '[' || r == ')' || r == ']'
+}
+
+// splitArtists splits a list of co-credited artists on the configured separators.
+func (p *ArtistParser) splitArtists(value string) []string {
+	return splitOn(value, p.separators)
+}
+
+// splitOn splits value on every separator and returns the trimmed, non-empty parts.
+func splitOn(value string, separators []string) []string {
+	parts := []string{value}
+	for _, sep := range separators {
+		var next []string
+		for _, part := range parts {
+			next = append(next, strings.Split(part, sep)...)
+		}
+		parts = next
+	}
+	names := parts[:0]
+	for _, part := range parts {
+		if part = strings.TrimSpace(part); part != "" {
+			names = append(names, part)
+		}
+	}
+	return names
+}
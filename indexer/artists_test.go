@@ -0,0 +1,57 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"heavymetal/library"
+)
+
+func TestSplitFeaturing(t *testing.T) {
+	p := NewArtistParser(";", "feat.|ft.|featuring")
+	for _, tc := range []struct{ value, main, featured string }{
+		{"Daft Punk", "Daft Punk", ""},
+		{"Eminem feat. Rihanna", "Eminem", "Rihanna"},
+		{"Eminem (Feat. Rihanna)", "Eminem", "Rihanna"},
+		{"Beyoncé\u00a0ft. Jay-Z", "Beyoncé", "Jay-Z"}, // A real no-break space
+		{"Beyoncé ft. Jay-Z", "Beyoncé", "Jay-Z"},
+		// The last byte of "à" is 0xA0, a no-break space when read as a rune on its own
+		{"Voilàft. Someone", "Voilàft. Someone", ""},
+		{"Someone ft.à", "Someone ft.à", ""},
+	} {
+		main, featured := p.splitFeaturing(tc.value)
+		if main != tc.main || featured != tc.featured {
+			t.Errorf("splitFeaturing(%q) = %q, %q; want %q, %q", tc.value, main, featured, tc.main, tc.featured)
+		}
+	}
+}
+
+func TestParseArtists(t *testing.T) {
+	p := NewArtistParser(";", "feat.|ft.|featuring")
+	for _, tc := range []struct {
+		values []string
+		want   []library.ArtistCredit
+	}{
+		// Band names with "&" are one artist
+		{[]string{"Simon & Garfunkel"}, []library.ArtistCredit{{Name: "Simon & Garfunkel", Role: library.RoleMain}}},
+		{[]string{"Earth, Wind & Fire"}, []library.ArtistCredit{{Name: "Earth, Wind & Fire", Role: library.RoleMain}}},
+		{[]string{"Crosby, Stills, Nash & Young feat. Neil Young"}, []library.ArtistCredit{
+			{Name: "Crosby, Stills, Nash & Young", Role: library.RoleMain},
+			{Name: "Neil Young", Role: library.RoleFeatured},
+		}},
+		{[]string{"Simon & Garfunkel; Paul Simon"}, []library.ArtistCredit{
+			{Name: "Simon & Garfunkel", Role: library.RoleMain},
+			{Name: "Paul Simon", Role: library.RoleMain},
+		}},
+		// Multi-valued frames give one value per artist; repeats are dropped
+		{[]string{"Hall & Oates", "Daryl Hall", "hall & oates"}, []library.ArtistCredit{
+			{Name: "Hall & Oates", Role: library.RoleMain},
+			{Name: "Daryl Hall", Role: library.RoleMain},
+		}},
+	} {
+		got := p.Parse(tc.values, library.RoleMain)
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("Parse(%q) = %+v, want %+v", tc.values, got, tc.want)
+		}
+	}
+}
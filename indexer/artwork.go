@@ -0,0 +1,95 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"heavymetal/library"
+
+	"github.com/dhowden/tag"
+)
+
+// artworkExtensions maps the image types found in tags to cache file extensions.
+var artworkExtensions = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+	"image/bmp":  ".bmp",
+	"image/webp": ".webp",
+}
+
+// saveArtwork stores an embedded picture in the art cache, named after the hash of its
+// contents so identical images across an album are written and recorded only once, and
+// returns the artwork for the writer to record.
+func (i *Indexer) saveArtwork(pic *tag.Picture) (*library.Artwork, error) {
+	sum := sha1.Sum(pic.Data)
+	hash := hex.EncodeToString(sum[:])
+
+	// Tags often carry a missing or generic MIME type, so trust the data over the tag
+	mimeType := strings.ToLower(pic.MIMEType)
+	if _, ok := artworkExtensions[mimeType]; !ok {
+		mimeType = http.DetectContentType(pic.Data)
+	}
+	ext, ok := artworkExtensions[mimeType]
+	if !ok {
+		return nil, fmt.Errorf("unsupported image type %q", mimeType)
+	}
+
+	path := filepath.Join(i.artCacheDir, hash+ext)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		if err := i.writeArtworkFile(path, pic.Data); err != nil {
+			return nil, err
+		}
+	}
+
+	return &library.Artwork{Hash: hash, MimeType: mimeType, FilePath: path, Data: pic.Data}, nil
+}
+
+// writeArtworkFile writes an image to the art cache.
+func (i *Indexer) writeArtworkFile(path string, data []byte) error {
+	// Write to a temporary file first so concurrent workers never see a partial image
+	tmp, err := os.CreateTemp(i.artCacheDir, strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))+"-*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create artwork file: %w", err)
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to write artwork file %s: %w", path, err)
+	}
+	return nil
+}
+
+// restoreArtworkFile writes the cached image of a saved file again if it is gone. A
+// worker skips writing images it finds in the cache, but the writer may prune the
+// last track using one, and delete it, before saving the worker's file; the row
+// saved then would point at nothing.
+func (i *Indexer) restoreArtworkFile(art *library.Artwork) {
+	if _, err := os.Stat(art.FilePath); !os.IsNotExist(err) {
+		return
+	}
+	if err := i.writeArtworkFile(art.FilePath, art.Data); err != nil {
+		log.Printf("Could not restore cached artwork: %v", err)
+	}
+}
+
+// removeArtworkFiles deletes cached images whose artwork rows were pruned.
+func (i *Indexer) removeArtworkFiles(paths []string) {
+	for _, path := range paths {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			log.Printf("Could not remove cached artwork %s: %v", path, err)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+)
+
+// fingerprintChunk is the amount of audio data hashed from each sampled region.
+const fingerprintChunk = 64 * 1024
+
+// Fingerprint identifies the audio payload of a file independently of its tags, so a
+// file keeps the same fingerprint when it is moved or re-tagged. To keep indexing fast
+// only the payload size and its first, middle and last fingerprintChunk bytes are hashed.
+func Fingerprint(r io.ReaderAt, size int64, ext string) (string, error) {
+	h := sha1.New()
+	switch strings.ToLower(ext) {
+	case ".ogg", ".opus":
+		if err := hashOggAudio(h, r, size); err != nil {
+			return "", err
+		}
+	default:
+		off, n, err := audioPayload(r, size, ext)
+		if err != nil {
+			return "", err
+		}
+		if err := hashSampled(h, r, off, n); err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// audioPayload returns the offset and length of the part of a file holding audio data,
+// leaving out tag blocks. Unknown formats are hashed whole.
+func audioPayload(r io.ReaderAt, size int64, ext string) (int64, int64, error) {
+	switch strings.ToLower(ext) {
+	case ".mp3":
+		start := id3v2Size(r)
+		end := trailingTagsStart(r, size)
+		if end < start {
+			return 0, 0, errors.New("mp3 tags overlap")
+		}
+		return start, end - start, nil
+	case ".flac":
+		start, err := flacFramesStart(r, size)
+		if err != nil {
+			return 0, 0, err
+		}
+		return start, trailingTagsStart(r, size) - start, nil
+	case ".m4a":
+		var off, n int64 = -1, 0
+		err := walkMP4(r, 0, size, func(b mp4Box) error {
+			if b.typ == "mdat" && off < 0 {
+				off, n = b.dataStart, b.end-b.dataStart
+			}
+			return nil
+		})
+		if err != nil {
+			return 0, 0, fmt.Errorf("failed to parse mp4 boxes: %w", err)
+		}
+		if off < 0 {
+			return 0, 0, errors.New("no mdat box found")
+		}
+		return off, n, nil
+	case ".wav":
+		return findChunk(r, size, binary.LittleEndian, "data", "WAVE")
+	case ".aiff", ".aif":
+		return findChunk(r, size, binary.BigEndian, "SSND", "AIFF", "AIFC")
+	default:
+		return 0, size, nil
+	}
+}
+
+// trailingTagsStart returns the offset where ID3v1 and APEv2 tags at the end of the
+// file begin, or size if there are none.
+func trailingTagsStart(r io.ReaderAt, size int64) int64 {
+	end := size
+	var buf [32]byte
+	if end >= 128 {
+		if _, err := r.ReadAt(buf[:3], end-128); err == nil && string(buf[:3]) == "TAG" {
+			end -= 128
+		}
+	}
+	if end >= 32 {
+		if _, err := r.ReadAt(buf[:], end-32); err == nil && string(buf[:8]) == "APETAGEX" {
+			tagSize := int64(binary.LittleEndian.Uint32(buf[12:16])) // Items plus footer
+			if binary.LittleEndian.Uint32(buf[20:24])&(1<<31) != 0 {
+				tagSize += 32 // Header present
+			}
+			if tagSize <= end {
+				end -= tagSize
+			}
+		}
+	}
+	return end
+}
+
+// flacFramesStart returns the offset of the first audio frame after the metadata blocks.
+func flacFramesStart(r io.ReaderAt, size int64) (int64, error) {
+	off := id3v2Size(r)
+	var hdr [4]byte
+	if _, err := r.ReadAt(hdr[:], off); err != nil || string(hdr[:]) != "fLaC" {
+		return 0, errors.New("missing fLaC marker")
+	}
+	off += 4
+	for {
+		if _, err := r.ReadAt(hdr[:], off); err != nil {
+			return 0, fmt.Errorf("failed to read flac metadata block: %w", err)
+		}
+		off += 4 + (int64(hdr[1])<<16 | int64(hdr[2])<<8 | int64(hdr[3]))
+		if off > size {
+			return 0, errors.New("flac metadata block runs past end of file")
+		}
+		if hdr[0]&0x80 != 0 { // Last metadata block
+			return off, nil
+		}
+	}
+}
+
+// hashSampled hashes the length of [off, off+n) and up to three chunks taken from its
+// start, middle and end.
+func hashSampled(h hash.Hash, r io.ReaderAt, off, n int64) error {
+	fmt.Fprintf(h, "%d:", n)
+	starts := []int64{off}
+	length := n
+	if n > 3*fingerprintChunk {
+		starts = []int64{off, off + n/2 - fingerprintChunk/2, off + n - fingerprintChunk}
+		length = fingerprintChunk
+	}
+	for _, start := range starts {
+		if _, err := io.Copy(h, io.NewSectionReader(r, start, length)); err != nil {
+			return fmt.Errorf("failed to read audio data: %w", err)
+		}
+	}
+	return nil
+}
+
+// hashOggAudio hashes the bodies of the first audio pages of an Ogg stream and its final
+// granule position. Page headers are skipped because their sequence numbers shift when a
+// larger comment header is written.
+func hashOggAudio(h hash.Hash, r io.ReaderAt, size int64) error {
+	var page [27 + 255]byte
+	var serial uint32
+	hashed := int64(0)
+	for off := int64(0); off+27 <= size && hashed < fingerprintChunk; {
+		if _, err := r.ReadAt(page[:27], off); err != nil {
+			return fmt.Errorf("failed to read ogg page: %w", err)
+		}
+		if string(page[:4]) != "OggS" {
+			return fmt.Errorf("lost ogg sync at offset %d", off)
+		}
+		if off == 0 {
+			serial = binary.LittleEndian.Uint32(page[14:18])
+		}
+		segments := int(page[26])
+		if _, err := r.ReadAt(page[27:27+segments], off+27); err != nil {
+			return fmt.Errorf("failed to read ogg segment table: %w", err)
+		}
+		body := int64(0)
+		for _, l := range page[27 : 27+segments] {
+			body += int64(l)
+		}
+		bodyOff := off + 27 + int64(segments)
+		// Header packets are on pages with granule position 0; audio pages never are
+		if binary.LittleEndian.Uint64(page[6:14]) != 0 {
+			if _, err := io.Copy(h, io.NewSectionReader(r, bodyOff, body)); err != nil {
+				return fmt.Errorf("failed to read ogg page body: %w", err)
+			}
+			hashed += body
+		}
+		off = bodyOff + body
+	}
+
+	granule, err := lastOggGranule(r, size, serial)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(h, ":%d", granule)
+	return nil
+}
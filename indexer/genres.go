@@ -0,0 +1,128 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// id3v1Genres are the genre names behind the numeric codes of ID3v1 tags, including the
+// Winamp extensions (80 onwards). ID3v2 TCON frames may refer to them as "(17)" or "17".
+var id3v1Genres = [...]string{
+	"Blues", "Classic Rock", "Country", "Dance", "Disco", "Funk", "Grunge",
+	"Hip-Hop", "Jazz", "Metal", "New Age", "Oldies", "Other", "Pop", "R&B",
+	"Rap", "Reggae", "Rock", "Techno", "Industrial", "Alternative", "Ska",
+	"Death Metal", "Pranks", "Soundtrack", "Euro-Techno", "Ambient",
+	"Trip-Hop", "Vocal", "Jazz+Funk", "Fusion", "Trance", "Classical",
+	"Instrumental", "Acid", "House", "Game", "Sound Clip", "Gospel",
+	"Noise", "Alternative Rock", "Bass", "Soul", "Punk", "Space", "Meditative",
+	"Instrumental Pop", "Instrumental Rock", "Ethnic", "Gothic",
+	"Darkwave", "Techno-Industrial", "Electronic", "Pop-Folk",
+	"Eurodance", "Dream", "Southern Rock", "Comedy", "Cult", "Gangsta",
+	"Top 40", "Christian Rap", "Pop/Funk", "Jungle", "Native American",
+	"Cabaret", "New Wave", "Psychedelic", "Rave", "Showtunes", "Trailer",
+	"Lo-Fi", "Tribal", "Acid Punk", "Acid Jazz", "Polka", "Retro",
+	"Musical", "Rock & Roll", "Hard Rock", "Folk", "Folk-Rock",
+	"National Folk", "Swing", "Fast Fusion", "Bebop", "Latin", "Revival",
+	"Celtic", "Bluegrass", "Avantgarde", "Gothic Rock", "Progressive Rock",
+	"Psychedelic Rock", "Symphonic Rock", "Slow Rock", "Big Band",
+	"Chorus", "Easy Listening", "Acoustic", "Humour", "Speech", "Chanson",
+	"Opera", "Chamber Music", "Sonata", "Symphony", "Booty Bass", "Primus",
+	"Porn Groove", "Satire", "Slow Jam", "Club", "Tango", "Samba",
+	"Folklore", "Ballad", "Power Ballad", "Rhythmic Soul", "Freestyle",
+	"Duet", "Punk Rock", "Drum Solo", "A Cappella", "Euro-House", "Dance Hall",
+	"Goa", "Drum & Bass", "Club-House", "Hardcore", "Terror", "Indie",
+	"Britpop", "Afro-Punk", "Polsk Punk", "Beat", "Christian Gangsta Rap",
+	"Heavy Metal", "Black Metal", "Crossover", "Contemporary Christian",
+	"Christian Rock", "Merengue", "Salsa", "Thrash Metal", "Anime", "JPop",
+	"Synthpop", "Christmas", "Art Rock", "Baroque", "Bhangra", "Big Beat",
+	"Breakbeat", "Chillout", "Downtempo", "Dub", "EBM", "Eclectic", "Electro",
+	"Electroclash", "Emo", "Experimental", "Garage", "Global", "IDM",
+	"Illbient", "Industro-Goth", "Jam Band", "Krautrock", "Leftfield", "Lounge",
+	"Math Rock", "New Romantic", "Nu-Breakz", "Post-Punk", "Post-Rock", "Psytrance",
+	"Shoegaze", "Space Rock", "Trop Rock", "World Music", "Neoclassical", "Audiobook",
+	"Audio Theatre", "Neue Deutsche Welle", "Podcast", "Indie Rock", "G-Funk", "Dubstep",
+	"Garage Rock", "Psybient",
+}
+
+// GenreParser splits genre tag values such as "Rock; Alternative" into individual genres.
+type GenreParser struct {
+	separators []string // Split multiple genres in one value, e.g. ";" or "/"
+}
+
+// NewGenreParser creates a parser from a "|"-separated list of separators, as given on
+// the command line.
+func NewGenreParser(separators string) *GenreParser {
+	return &GenreParser{separators: splitList(separators)}
+}
+
+// Parse turns raw tag values into genre names. Numeric ID3 references are replaced by
+// their names and duplicate genres are dropped.
+func (p *GenreParser) Parse(values []string) []string {
+	var genres []string
+	seen := make(map[string]bool)
+	for _, value := range values {
+		for _, part := range splitOn(value, p.separators) {
+			for _, name := range normaliseGenre(part) {
+				key := strings.ToLower(name)
+				if seen[key] {
+					continue
+				}
+				seen[key] = true
+				genres = append(genres, name)
+			}
+		}
+	}
+	return genres
+}
+
+// normaliseGenre expands ID3 genre references. A bare number or a sequence of "(n)"
+// references becomes the matching names; text after the references refines the last one
+// and replaces it, so "(17)Indie Rock" yields "Indie Rock". "(RX)" and "(CR)" stand for
+// remix and cover, and "((" escapes a literal parenthesis.
+func normaliseGenre(value string) []string {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return nil
+	}
+	if name, ok := genreByNumber(value); ok {
+		return []string{name}
+	}
+
+	var names []string
+	rest := value
+	for strings.HasPrefix(rest, "(") && !strings.HasPrefix(rest, "((") {
+		end := strings.IndexByte(rest, ')')
+		if end < 0 {
+			break
+		}
+		ref := rest[1:end]
+		switch name, ok := genreByNumber(ref); {
+		case ok:
+			names = append(names, name)
+		case ref == "RX":
+			names = append(names, "Remix")
+		case ref == "CR":
+			names = append(names, "Cover")
+		default: // Not a reference, e.g. "(Post) Punk"
+			return []string{value}
+		}
+		rest = rest[end+1:]
+	}
+	if rest = strings.TrimSpace(rest); rest != "" {
+		rest = strings.Replace(rest, "((", "(", 1)
+		if len(names) > 0 {
+			names = names[:len(names)-1]
+		}
+		names = append(names, rest)
+	}
+	return names
+}
+
+// genreByNumber returns the ID3v1 genre name for a numeric code such as "17".
+func genreByNumber(s string) (string, bool) {
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 || n >= len(id3v1Genres) {
+		return "", false
+	}
+	return id3v1Genres[n], true
+}
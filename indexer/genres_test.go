@@ -0,0 +1,64 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNormaliseGenre(t *testing.T) {
+	for _, tc := range []struct {
+		value string
+		want  []string
+	}{
+		{"Heavy Metal", []string{"Heavy Metal"}},
+		{" Heavy Metal ", []string{"Heavy Metal"}},
+		{"", nil},
+		{"   ", nil},
+		{"17", []string{"Rock"}},
+		{"(17)", []string{"Rock"}},
+		{"(17)(9)", []string{"Rock", "Metal"}},
+		// Text after the references refines the last one
+		{"(17)Indie Rock", []string{"Indie Rock"}},
+		{"(17)(9)Thrash", []string{"Rock", "Thrash"}},
+		{"(RX)(CR)", []string{"Remix", "Cover"}},
+		{"(9)(RX)", []string{"Metal", "Remix"}},
+		// "((" escapes a parenthesis
+		{"((foo)", []string{"(foo)"}},
+		{"(9)((Live)", []string{"(Live)"}},
+		// Not references
+		{"(Post) Punk", []string{"(Post) Punk"}},
+		{"(17", []string{"(17"}},
+		{"(192)", []string{"(192)"}},
+		{"191", []string{"Psybient"}},
+		{"192", []string{"192"}},
+		{"-1", []string{"-1"}},
+	} {
+		if got := normaliseGenre(tc.value); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("normaliseGenre(%q) = %q, want %q", tc.value, got, tc.want)
+		}
+	}
+}
+
+func TestParseGenres(t *testing.T) {
+	p := NewGenreParser(";|/")
+	for _, tc := range []struct {
+		values []string
+		want   []string
+	}{
+		{[]string{"Rock; Alternative"}, []string{"Rock", "Alternative"}},
+		{[]string{"Rock/Pop", "rock", "Jazz"}, []string{"Rock", "Pop", "Jazz"}}, // Duplicates ignore case
+		{[]string{"(17)Indie Rock;(9)"}, []string{"Indie Rock", "Metal"}},
+		{[]string{"17", "Rock"}, []string{"Rock"}},
+		{[]string{" ; /"}, nil},
+		{nil, nil},
+	} {
+		if got := p.Parse(tc.values); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("Parse(%q) = %q, want %q", tc.values, got, tc.want)
+		}
+	}
+
+	// Without separators a value is one genre
+	if got := NewGenreParser("").Parse([]string{"Rock/Pop"}); !reflect.DeepEqual(got, []string{"Rock/Pop"}) {
+		t.Errorf("Parse without separators = %q, want [Rock/Pop]", got)
+	}
+}
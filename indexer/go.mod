@@ -4,6 +4,15 @@ go 1.24.3
 
 require (
 	github.com/dhowden/tag v0.0.0-20240417053706-3d75831295e8
-	github.com/mattn/go-sqlite3 v1.14.28
+	github.com/fsnotify/fsnotify v1.8.0
 	github.com/wolfeidau/humanhash v1.1.0
+	heavymetal/library v0.0.0
 )
+
+require (
+	github.com/mattn/go-sqlite3 v1.14.28 // indirect
+	golang.org/x/sys v0.13.0 // indirect
+	golang.org/x/text v0.23.0 // indirect
+)
+
+replace heavymetal/library => ../library
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"database/sql"
 	"flag"
 	"fmt"
 	"log"
@@ -12,257 +11,36 @@ import (
 	"time"
 
 	"github.com/dhowden/tag"
-	"github.com/mattn/go-sqlite3"
 	"github.com/wolfeidau/humanhash"
-)
-
-// AudioFile represents the metadata for an audio track.
-type AudioFile struct {
-	HumanHashID     string
-	FilePath        string
-	Title           string
-	DurationSeconds int // Note: dhowden/tag does not directly provide duration. This will be 0 unless another library is integrated.
-	Lossless        bool
-	TrackNumber     int
-	DiscNumber      int
-	Year            int
-	ArtistName      string
-	AlbumTitle      string
-	GenreName       string
-	ArtistID        int // Foreign key after insertion
-	AlbumID         int // Foreign key after insertion
-	GenreID         int // Foreign key after insertion
-}
-
-// DBManager handles all database operations.
-type DBManager struct {
-	db *sql.DB
-	mu sync.Mutex // Mutex to protect database writes from concurrent access
-}
-
-// NewDBManager creates a new DBManager and initializes the database connection.
-func NewDBManager(dbPath string) (*DBManager, error) {
-	db, err := sql.Open("sqlite3", dbPath)
-	if err != nil {
-		return nil, fmt.Errorf("failed to open database: %w", err)
-	}
-	// Set a timeout for database operations (e.g., 5 seconds)
-	// For SQLite, it's generally best to keep MaxOpenConns low for writes.
-	// We'll manage concurrent writes using a mutex.
-	db.SetMaxOpenConns(1) // Only one active connection to prevent SQLite locking issues with concurrent writes
-	db.SetConnMaxLifetime(5 * time.Minute)
-
-	mgr := &DBManager{db: db}
-	if err := mgr.InitDB(); err != nil {
-		db.Close() // Close on initialization failure
-		return nil, fmt.Errorf("failed to initialize database schema: %w", err)
-	}
-	return mgr, nil
-}
 
-// Close closes the database connection.
-func (m *DBManager) Close() error {
-	return m.db.Close()
-}
-
-// InitDB creates the necessary tables if they don't exist.
-func (m *DBManager) InitDB() error {
-	schema := `
-	PRAGMA foreign_keys = ON;
-
-	CREATE TABLE IF NOT EXISTS artists (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		name TEXT UNIQUE NOT NULL COLLATE NOCASE
-	);
-
-	CREATE TABLE IF NOT EXISTS albums (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		title TEXT NOT NULL COLLATE NOCASE,
-		artist_id INTEGER NOT NULL,
-		release_year INTEGER,
-		FOREIGN KEY (artist_id) REFERENCES artists(id) ON DELETE CASCADE,
-		UNIQUE(title, artist_id)
-	);
-
-	CREATE TABLE IF NOT EXISTS genres (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		name TEXT UNIQUE NOT NULL COLLATE NOCASE
-	);
-
-	CREATE TABLE IF NOT EXISTS audio_files (
-		human_hash_id TEXT PRIMARY KEY NOT NULL,
-		file_path TEXT UNIQUE NOT NULL,
-		title TEXT NOT NULL,
-		duration_seconds INTEGER,
-		lossless BOOLEAN NOT NULL,
-		track_number INTEGER,
-		disc_number INTEGER,
-		year INTEGER,
-		artist_id INTEGER NOT NULL,
-		album_id INTEGER NOT NULL,
-		genre_id INTEGER,
-		FOREIGN KEY (artist_id) REFERENCES artists(id) ON DELETE CASCADE,
-		FOREIGN KEY (album_id) REFERENCES albums(id) ON DELETE CASCADE,
-		FOREIGN KEY (genre_id) REFERENCES genres(id) ON DELETE SET NULL
-	);
-	`
-	// Acquire mutex for schema creation to ensure it's not run concurrently
-	m.mu.Lock()
-	defer m.mu.Unlock()
-	_, err := m.db.Exec(schema)
-	if err != nil {
-		return fmt.Errorf("error creating database schema: %w", err)
-	}
-	return nil
-}
-
-// GetOrInsertArtist retrieves an artist's ID or inserts a new artist if not found.
-func (m *DBManager) GetOrInsertArtist(name string) (int, error) {
-	// Acquire mutex for database write operations
-	m.mu.Lock()
-	defer m.mu.Unlock()
-
-	var id int
-	// Try to get existing artist
-	err := m.db.QueryRow("SELECT id FROM artists WHERE name = ? COLLATE NOCASE", name).Scan(&id)
-	if err == nil {
-		return id, nil // Artist found
-	}
-	if err != sql.ErrNoRows {
-		return 0, fmt.Errorf("failed to query artist: %w", err)
-	}
+	"heavymetal/library"
+)
 
-	// Artist not found, insert new one
-	res, err := m.db.Exec("INSERT INTO artists (name) VALUES (?)", name)
-	if err != nil {
-		// Handle potential race condition if another goroutine inserted it between check and insert
-		if sqliteErr, ok := err.(sqlite3.Error); ok && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique {
-			// Try to get again if it was a unique constraint error
-			err = m.db.QueryRow("SELECT id FROM artists WHERE name = ? COLLATE NOCASE", name).Scan(&id)
-			if err == nil {
-				return id, nil
+// isCompilation reports whether a file's tags mark it as part of a compilation
+// (ID3 TCMP/TCP, MP4 cpil or a Vorbis COMPILATION comment).
+func isCompilation(m tag.Metadata) bool {
+	raw := m.Raw()
+	for _, key := range []string{"TCMP", "TCP", "cpil", "compilation"} {
+		switch v := raw[key].(type) {
+		case int:
+			if v != 0 {
+				return true
 			}
-		}
-		return 0, fmt.Errorf("failed to insert artist: %w", err)
-	}
-	lastID, err := res.LastInsertId()
-	if err != nil {
-		return 0, fmt.Errorf("failed to get last inserted artist ID: %w", err)
-	}
-	return int(lastID), nil
-}
-
-// GetOrInsertAlbum retrieves an album's ID or inserts a new album if not found.
-func (m *DBManager) GetOrInsertAlbum(title string, artistID int, releaseYear int) (int, error) {
-	// Acquire mutex for database write operations
-	m.mu.Lock()
-	defer m.mu.Unlock()
-
-	var id int
-	err := m.db.QueryRow("SELECT id FROM albums WHERE title = ? COLLATE NOCASE AND artist_id = ?", title, artistID).Scan(&id)
-	if err == nil {
-		return id, nil
-	}
-	if err != sql.ErrNoRows {
-		return 0, fmt.Errorf("failed to query album: %w", err)
-	}
-
-	// Album not found, insert new one
-	res, err := m.db.Exec("INSERT INTO albums (title, artist_id, release_year) VALUES (?, ?, ?)", title, artistID, releaseYear)
-	if err != nil {
-		if sqliteErr, ok := err.(sqlite3.Error); ok && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique {
-			err = m.db.QueryRow("SELECT id FROM albums WHERE title = ? COLLATE NOCASE AND artist_id = ?", title, artistID).Scan(&id)
-			if err == nil {
-				return id, nil
+		case string:
+			switch strings.ToLower(strings.TrimSpace(strings.Trim(v, "\x00"))) {
+			case "1", "true", "yes":
+				return true
 			}
 		}
-		return 0, fmt.Errorf("failed to insert album: %w", err)
-	}
-	lastID, err := res.LastInsertId()
-	if err != nil {
-		return 0, fmt.Errorf("failed to get last inserted album ID: %w", err)
-	}
-	return int(lastID), nil
-}
-
-// GetOrInsertGenre retrieves a genre's ID or inserts a new genre if not found.
-func (m *DBManager) GetOrInsertGenre(name string) (int, error) {
-	if name == "" { // Handle empty genre gracefully
-		return 0, nil
-	}
-	// Acquire mutex for database write operations
-	m.mu.Lock()
-	defer m.mu.Unlock()
-
-	var id int
-	err := m.db.QueryRow("SELECT id FROM genres WHERE name = ? COLLATE NOCASE", name).Scan(&id)
-	if err == nil {
-		return id, nil
-	}
-	if err != sql.ErrNoRows {
-		return 0, fmt.Errorf("failed to query genre: %w", err)
-	}
-
-	// Genre not found, insert new one
-	res, err := m.db.Exec("INSERT INTO genres (name) VALUES (?)", name)
-	if err != nil {
-		if sqliteErr, ok := err.(sqlite3.Error); ok && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique {
-			err = m.db.QueryRow("SELECT id FROM genres WHERE name = ? COLLATE NOCASE", name).Scan(&id)
-			if err == nil {
-				return id, nil
-			}
-		}
-		return 0, fmt.Errorf("failed to insert genre: %w", err)
-	}
-	lastID, err := res.LastInsertId()
-	if err != nil {
-		return 0, fmt.Errorf("failed to get last inserted genre ID: %w", err)
-	}
-	return int(lastID), nil
-}
-
-// InsertAudioFile inserts an audio file record into the database.
-func (m *DBManager) InsertAudioFile(af *AudioFile) error {
-	// Acquire mutex for database write operations
-	m.mu.Lock()
-	defer m.mu.Unlock()
-
-	// Check if the audio file already exists by its human hash ID or file path
-	var existingHumanHashID string
-	err := m.db.QueryRow("SELECT human_hash_id FROM audio_files WHERE human_hash_id = ? OR file_path = ?", af.HumanHashID, af.FilePath).Scan(&existingHumanHashID)
-	if err == nil {
-		log.Printf("Skipping existing audio file: %s (Human Hash: %s)", af.FilePath, existingHumanHashID)
-		return nil // File already exists, skip
-	}
-	if err != sql.ErrNoRows {
-		return fmt.Errorf("failed to check for existing audio file: %w", err)
-	}
-
-	_, err = m.db.Exec(`
-		INSERT INTO audio_files (human_hash_id, file_path, title, duration_seconds, lossless, track_number, disc_number, year, artist_id, album_id, genre_id)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
-	`, af.HumanHashID, af.FilePath, af.Title, af.DurationSeconds, af.Lossless, af.TrackNumber, af.DiscNumber, af.Year, af.ArtistID, af.AlbumID, sql.NullInt64{Int64: int64(af.GenreID), Valid: af.GenreID != 0})
-	if err != nil {
-		return fmt.Errorf("failed to insert audio file %s: %w", af.FilePath, err)
-	}
-	return nil
-}
-
-// IsLossless checks if a file extension typically denotes a lossless audio format.
-func IsLossless(ext string) bool {
-	switch strings.ToLower(ext) {
-	case ".flac", ".wav", ".aiff", ".aif":
-		return true
-	default:
-		return false
 	}
+	return false
 }
 
 // isAudioFile checks if a file has a common audio extension.
 func isAudioFile(filename string) bool {
 	ext := strings.ToLower(filepath.Ext(filename))
 	switch ext {
-	case ".mp3", ".flac", ".wav", ".m4a", ".ogg", ".aac", ".wma", ".aiff", ".aif":
+	case ".mp3", ".flac", ".wav", ".m4a", ".ogg", ".opus", ".aac", ".wma", ".aiff", ".aif":
 		return true
 	default:
 		return false
@@ -271,43 +49,75 @@ func isAudioFile(filename string) bool {
 
 // Indexer processes audio files and inserts their metadata into the database.
 type Indexer struct {
-	dbManager   *DBManager
+	db          *library.DB
 	musicFolder string
-	// Mutex to protect processedCount during concurrent updates
-	countMu sync.Mutex
+	// Re-read every file even if its size and mtime are unchanged
+	force bool
+	// Remove rows for files that no longer exist, and orphaned artists/albums/genres
+	prune bool
+	// Size and mtime of every file already in the database, loaded before the walk
+	knownFiles map[string]library.FileState
+	// Mutex to protect the counters below during concurrent updates
+	countMu        sync.Mutex
 	processedCount int
+	unchangedCount int
+	addedCount     int
+	updatedCount   int
+	movedCount     int
 	// Channel to send file paths to worker goroutines
 	filePathChan chan string
 	// WaitGroup to wait for all goroutines to finish
 	wg sync.WaitGroup
 	// Number of worker goroutines
 	numWorkers int
+	// Changes produced by the workers, applied by the single writer goroutine
+	writeChan chan writeOp
+	// Closed when the writer goroutine has committed its last batch
+	writerDone chan struct{}
+	// A batch is committed once it holds batchSize files or is batchInterval old
+	batchSize     int
+	batchInterval time.Duration
+	// Directory where extracted cover art is cached, one file per distinct image
+	artCacheDir string
+	// Splits multi-artist tags into individual credits
+	artistParser *ArtistParser
+	genreParser  *GenreParser
 }
 
 // NewIndexer creates a new Indexer instance.
-func NewIndexer(dbMgr *DBManager, folder string, numWorkers int) *Indexer {
+func NewIndexer(db *library.DB, folder string, numWorkers, batchSize int, batchInterval time.Duration, force, prune bool, artCacheDir string, artistParser *ArtistParser, genreParser *GenreParser) *Indexer {
 	return &Indexer{
-		dbManager:   dbMgr,
-		musicFolder: folder,
-		// Buffer the channel to allow some paths to be queued
-		filePathChan: make(chan string, numWorkers*2), // Buffer size is a common heuristic
-		numWorkers: numWorkers,
+		db:            db,
+		musicFolder:   folder,
+		force:         force,
+		prune:         prune,
+		numWorkers:    numWorkers,
+		batchSize:     batchSize,
+		batchInterval: batchInterval,
+		artCacheDir:   artCacheDir,
+		artistParser:  artistParser,
+		genreParser:   genreParser,
 	}
 }
 
 // StartIndexing walks the music directory and processes each audio file.
 func (i *Indexer) StartIndexing() error {
 	log.Printf("Starting indexing of music folder: %s with %d workers", i.musicFolder, i.numWorkers)
-	i.processedCount = 0
+	i.processedCount, i.unchangedCount, i.addedCount, i.updatedCount, i.movedCount = 0, 0, 0, 0, 0
 
-	// Start worker goroutines
-	for w := 0; w < i.numWorkers; w++ {
-		i.wg.Add(1) // Add one to the WaitGroup for each worker
-		go i.worker()
+	knownFiles, err := i.db.LoadFileStates()
+	if err != nil {
+		return fmt.Errorf("failed to load indexed file states: %w", err)
 	}
+	i.knownFiles = knownFiles
+
+	i.startWorkers()
+
+	// Every audio file seen by the walk, used to find indexed files that disappeared
+	seen := make(map[string]struct{})
 
 	// Walk the file path and send paths to the channel
-	err := filepath.Walk(i.musicFolder, func(path string, info os.FileInfo, err error) error {
+	err = filepath.Walk(i.musicFolder, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			log.Printf("Preventing walk error for %q: %v", path, err)
 			return err // Return the error to stop the walk
@@ -317,6 +127,16 @@ func (i *Indexer) StartIndexing() error {
 		}
 
 		if isAudioFile(info.Name()) {
+			seen[path] = struct{}{}
+
+			// Files whose size and mtime match the database are not reopened
+			if known, ok := i.knownFiles[path]; ok && !i.force && known == fileStateOf(info) {
+				i.countMu.Lock()
+				i.unchangedCount++
+				i.countMu.Unlock()
+				return nil
+			}
+
 			// Increment count safely
 			i.countMu.Lock()
 			i.processedCount++
@@ -324,20 +144,86 @@ func (i *Indexer) StartIndexing() error {
 			i.countMu.Unlock()
 
 			fmt.Printf("\rQueueing file %d: %s", currentCount, path) // Progress indicator
-			i.filePathChan <- path // Send file path to the channel for a worker to pick up
+			i.filePathChan <- path                                   // Send file path to the channel for a worker to pick up
 		}
 		return nil
 	})
 
+	i.stopWorkers()
+
+	fmt.Println("\nIndexing complete!")
+	log.Printf("Processed %d audio files (attempts).", i.processedCount) // Note: This is count of files *attempted*
+	log.Printf("Added %d, updated %d, moved %d, skipped %d unchanged.", i.addedCount, i.updatedCount, i.movedCount, i.unchangedCount)
+	if err != nil {
+		return err // An incomplete walk cannot tell missing files apart from unvisited ones
+	}
+
+	missing := i.missingFiles(seen)
+	if !i.prune {
+		if len(missing) > 0 {
+			log.Printf("%d indexed files no longer exist; run with --prune to remove them.", len(missing))
+		}
+		return nil
+	}
+	result, err := i.db.PruneAudioFiles(missing)
+	if err != nil {
+		return fmt.Errorf("failed to prune missing files: %w", err)
+	}
+	i.removeArtworkFiles(result.ArtworkFiles)
+	log.Printf("Pruned %d tracks, %d albums, %d artists, %d genres and %d artwork images.", result.Tracks, result.Albums, result.Artists, result.Genres, result.Artwork)
+	return nil
+}
+
+// missingFiles returns the indexed paths inside the music folder that the walk did not
+// see and that no longer exist on disk. Paths indexed from other folders are left alone.
+func (i *Indexer) missingFiles(seen map[string]struct{}) []string {
+	var missing []string
+	for path := range i.knownFiles {
+		if _, ok := seen[path]; ok || !withinDir(i.musicFolder, path) {
+			continue
+		}
+		if _, err := os.Lstat(path); os.IsNotExist(err) {
+			missing = append(missing, path)
+		}
+	}
+	return missing
+}
+
+// withinDir reports whether path lies inside dir.
+func withinDir(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// fileStateOf returns the FileState recorded for a file with the given info.
+func fileStateOf(info os.FileInfo) library.FileState {
+	return library.FileState{Size: info.Size(), ModTime: info.ModTime().UnixNano()}
+}
+
+// startWorkers creates a fresh filePathChan and starts the worker goroutines reading from
+// it, along with the writer goroutine that saves their results. Call stopWorkers to stop them.
+func (i *Indexer) startWorkers() {
+	// Buffer the channel to allow some paths to be queued
+	i.filePathChan = make(chan string, i.numWorkers*2) // Buffer size is a common heuristic
+	// Parsing is slower than saving, so a small buffer keeps the writer busy
+	i.writeChan = make(chan writeOp, i.numWorkers*4)
+	i.writerDone = make(chan struct{})
+	go i.writeLoop()
+	for w := 0; w < i.numWorkers; w++ {
+		i.wg.Add(1) // Add one to the WaitGroup for each worker
+		go i.worker()
+	}
+}
+
+// stopWorkers waits for the workers to finish the queued paths and for the writer to
+// commit their results.
+func (i *Indexer) stopWorkers() {
 	// Close the channel to signal workers that no more paths will be sent
 	close(i.filePathChan)
-
 	// Wait for all worker goroutines to finish
 	i.wg.Wait()
-
-	fmt.Println("\nIndexing complete!")
-	log.Printf("Processed %d audio files (attempts).", i.processedCount) // Note: This is count of files *attempted*
-	return err
+	close(i.writeChan)
+	<-i.writerDone
 }
 
 // worker processes file paths received from the filePathChan.
@@ -345,48 +231,189 @@ func (i *Indexer) worker() {
 	defer i.wg.Done() // Signal that this worker is done when the function exits
 
 	for filePath := range i.filePathChan {
-		if err := i.processAudioFile(filePath); err != nil {
+		// Watch mode also queues paths that were deleted or renamed away
+		if _, err := os.Stat(filePath); os.IsNotExist(err) {
+			i.writeChan <- writeOp{remove: filePath}
+			continue
+		}
+		audioFile, err := i.processAudioFile(filePath)
+		if err != nil {
 			log.Printf("Error processing %q: %v", filePath, err)
 			// The error is logged, but the worker continues to the next file
+			continue
 		}
+		i.writeChan <- writeOp{file: audioFile}
 	}
 }
 
-// processAudioFile extracts metadata and inserts it into the database.
-func (i *Indexer) processAudioFile(filePath string) error {
+// writeOp is a database change produced by a worker: a file to save, or the path of a
+// file that no longer exists.
+type writeOp struct {
+	file   *library.AudioFile
+	remove string
+}
+
+// writeLoop applies the changes produced by the workers. Only this goroutine writes, so
+// files are saved in transactions of up to batchSize files instead of one at a time,
+// and a batch is committed at least every batchInterval so watch mode stays responsive.
+func (i *Indexer) writeLoop() {
+	defer close(i.writerDone)
+
+	w := i.db.NewWriter()
+	ticker := time.NewTicker(i.batchInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case op, ok := <-i.writeChan:
+			if !ok {
+				i.commitBatch(w)
+				return
+			}
+			if op.remove != "" {
+				// Pruning runs in a transaction of its own and may delete cached rows
+				i.commitBatch(w)
+				if err := i.removeAudioFile(op.remove); err != nil {
+					log.Printf("Error removing %q: %v", op.remove, err)
+				}
+				w.Reset()
+				continue
+			}
+			i.saveAudioFile(w, op.file)
+			if w.Pending() >= i.batchSize {
+				i.commitBatch(w)
+			}
+		case <-ticker.C:
+			i.commitBatch(w)
+		}
+	}
+}
+
+// commitBatch commits the files saved by w so far.
+func (i *Indexer) commitBatch(w *library.Writer) {
+	if _, err := w.Commit(); err != nil {
+		log.Printf("Error saving batch: %v", err)
+	}
+}
+
+// removeAudioFile deletes the record of a file that no longer exists, along with any
+// artist, album or genre left without tracks.
+func (i *Indexer) removeAudioFile(filePath string) error {
+	result, err := i.db.PruneAudioFiles([]string{filePath})
+	if err != nil {
+		return err
+	}
+	i.removeArtworkFiles(result.ArtworkFiles)
+	if result.Tracks > 0 {
+		log.Printf("Removed %s (and %d albums, %d artists, %d genres, %d artwork images left unused)", filePath, result.Albums, result.Artists, result.Genres, result.Artwork)
+	}
+	return nil
+}
+
+// processAudioFile extracts the metadata of a file into a record for the writer.
+func (i *Indexer) processAudioFile(filePath string) (*library.AudioFile, error) {
 	file, err := os.Open(filePath)
 	if err != nil {
-		return fmt.Errorf("failed to open file %q: %w", filePath, err)
+		return nil, fmt.Errorf("failed to open file %q: %w", filePath, err)
 	}
 	defer file.Close()
 
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat file %q: %w", filePath, err)
+	}
+
 	m, err := tag.ReadFrom(file)
 	if err != nil {
-		return fmt.Errorf("failed to read tags from %q: %w", filePath, err)
+		return nil, fmt.Errorf("failed to read tags from %q: %w", filePath, err)
 	}
 
 	// Generate human-readable unique ID
 	humanHashSource := fmt.Sprintf("%s-%s-%s-%s", m.Title(), m.Artist(), m.Album(), filePath)
 	humanHashID, err := humanhash.Humanize([]byte(humanHashSource), 4)
 	if err != nil {
-		return fmt.Errorf("failed to generate humanhash for %q: %w", filePath, err)
+		return nil, fmt.Errorf("failed to generate humanhash for %q: %w", filePath, err)
 	}
 
 	trackNum, _ := m.Track()
 	discNum, _ := m.Disc()
 
-	audioFile := AudioFile{
+	// dhowden/tag only reads tags, so decode the stream headers for the duration and
+	// technical properties; the codec, not the extension, decides whether it is lossless
+	stream, err := ReadStreamInfo(file, stat.Size(), filepath.Ext(filePath))
+	if err != nil {
+		log.Printf("Could not read stream properties of %q: %v", filePath, err)
+	}
+
+	// dhowden/tag collapses multi-valued fields, so read those ourselves
+	multiValues, err := readMultiValueTags(file, stat.Size(), filepath.Ext(filePath))
+	if err != nil {
+		log.Printf("Could not read multi-value tags of %q: %v", filePath, err)
+	}
+	tagValues := func(key, fallback string) []string {
+		if vs := multiValues[key]; len(vs) > 0 {
+			return vs
+		}
+		if fallback == "" {
+			return nil
+		}
+		return []string{fallback}
+	}
+
+	// The fingerprint lets a later run recognise this file if it is moved or renamed
+	fingerprint, err := Fingerprint(file, stat.Size(), filepath.Ext(filePath))
+	if err != nil {
+		log.Printf("Could not fingerprint %q: %v", filePath, err)
+	}
+
+	credits := i.artistParser.Parse(tagValues("artist", m.Artist()), library.RoleMain)
+	credits = append(credits, i.artistParser.Parse(tagValues("composer", m.Composer()), library.RoleComposer)...)
+
+	audioFile := library.AudioFile{
 		HumanHashID:     humanHashID,
 		FilePath:        filePath,
 		Title:           m.Title(),
-		DurationSeconds: 0, // Set to 0, as dhowden/tag does not provide duration
-		Lossless:        IsLossless(filepath.Ext(filePath)),
+		DurationSeconds: int(stream.Duration.Round(time.Second) / time.Second),
+		Lossless:        stream.Lossless(),
+		Codec:           stream.Codec,
+		Container:       stream.Container,
+		Bitrate:         stream.Bitrate,
+		SampleRate:      stream.SampleRate,
+		BitDepth:        stream.BitDepth,
+		Channels:        stream.Channels,
 		TrackNumber:     trackNum,
 		DiscNumber:      discNum,
 		Year:            m.Year(),
-		ArtistName:      m.Artist(),
+		Credits:         credits,
+		Compilation:     isCompilation(m),
 		AlbumTitle:      m.Album(),
-		GenreName:       m.Genre(),
+		Genres:          i.genreParser.Parse(tagValues("genre", m.Genre())),
+		FileSize:        stat.Size(),
+		FileModTime:     stat.ModTime().UnixNano(),
+		Fingerprint:     fingerprint,
+	}
+
+	// Embedded cover art is cached on disk and shared by every track carrying the same image
+	if pic := m.Picture(); pic != nil && len(pic.Data) > 0 {
+		audioFile.Artwork, err = i.saveArtwork(pic)
+		if err != nil {
+			log.Printf("Could not save cover art of %q: %v", filePath, err)
+		}
+	}
+
+	// The first credited artist is the primary one. The album artist names whoever the
+	// album is filed under, so it is taken as is, never split
+	for _, credit := range audioFile.Credits {
+		if credit.Role == library.RoleMain {
+			audioFile.ArtistName = credit.Name
+			break
+		}
+	}
+	for _, albumArtist := range tagValues("albumartist", m.AlbumArtist()) {
+		if albumArtist = strings.TrimSpace(albumArtist); albumArtist != "" {
+			audioFile.AlbumArtistName = albumArtist
+			break
+		}
 	}
 
 	// Ensure essential metadata is present
@@ -395,48 +422,72 @@ func (i *Indexer) processAudioFile(filePath string) error {
 	}
 	if audioFile.ArtistName == "" {
 		audioFile.ArtistName = "Unknown Artist"
+		audioFile.Credits = append([]library.ArtistCredit{{Name: audioFile.ArtistName, Role: library.RoleMain}}, audioFile.Credits...)
 	}
 	if audioFile.AlbumTitle == "" {
 		audioFile.AlbumTitle = "Unknown Album"
 	}
-
-	// Database operations are protected by the DBManager's internal mutex
-	var artistID int
-	artistID, err = i.dbManager.GetOrInsertArtist(audioFile.ArtistName)
-	if err != nil {
-		return fmt.Errorf("failed to get/insert artist %q for %q: %w", audioFile.ArtistName, filePath, err)
+	if audioFile.AlbumArtistName == "" {
+		// Without an album artist tag, compilation tracks are filed together rather than
+		// split into one album per track artist
+		if audioFile.Compilation {
+			audioFile.AlbumArtistName = "Various Artists"
+		} else {
+			audioFile.AlbumArtistName = audioFile.ArtistName
+		}
 	}
-	audioFile.ArtistID = artistID
 
-	var albumID int
-	albumID, err = i.dbManager.GetOrInsertAlbum(audioFile.AlbumTitle, audioFile.ArtistID, audioFile.Year)
+	return &audioFile, nil
+}
+
+// saveAudioFile adds a record produced by a worker to the writer's current batch.
+func (i *Indexer) saveAudioFile(w *library.Writer, audioFile *library.AudioFile) {
+	outcome, err := w.Save(audioFile)
 	if err != nil {
-		return fmt.Errorf("failed to get/insert album %q by artist ID %d for %q: %w", audioFile.AlbumTitle, audioFile.ArtistID, filePath, err)
+		log.Printf("Error saving %q: %v", audioFile.FilePath, err)
+		return
 	}
-	audioFile.AlbumID = albumID
-
-	var genreID int
-	if audioFile.GenreName != "" {
-		genreID, err = i.dbManager.GetOrInsertGenre(audioFile.GenreName)
-		if err != nil {
-			return fmt.Errorf("failed to get/insert genre %q for %q: %w", audioFile.GenreName, filePath, err)
-		}
+	if audioFile.Artwork != nil && audioFile.ArtworkID != 0 {
+		i.restoreArtworkFile(audioFile.Artwork)
 	}
-	audioFile.GenreID = genreID // Will be 0 if empty or not found
 
-	// Insert the audio file record
-	err = i.dbManager.InsertAudioFile(&audioFile)
-	if err != nil {
-		return fmt.Errorf("failed to insert audio file record %q: %w", filePath, err)
+	i.countMu.Lock()
+	switch outcome {
+	case library.SaveInserted:
+		i.addedCount++
+	case library.SaveUpdated:
+		i.updatedCount++
+	case library.SaveMoved:
+		i.movedCount++
 	}
-
-	return nil
+	i.countMu.Unlock()
 }
 
 func main() {
+	// "indexer migrate" only upgrades the database schema
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		runMigrateCommand(os.Args[2:])
+		return
+	}
+	// "indexer bench" measures indexing throughput on a synthetic library
+	if len(os.Args) > 1 && os.Args[1] == "bench" {
+		runBenchCommand(os.Args[2:])
+		return
+	}
+
 	musicFolder := flag.String("music_folder", "", "Path to the music directory to index")
 	dbPath := flag.String("db", "music_library.sqlite", "Path to the SQLite3 database file")
 	numWorkers := flag.Int("workers", 4, "Number of concurrent workers for indexing") // New flag for concurrency
+	batchSize := flag.Int("batch_size", 500, "Maximum number of files saved in one database transaction")
+	batchInterval := flag.Duration("batch_interval", time.Second, "Maximum time before saved files are committed to the database")
+	force := flag.Bool("force", false, "Re-read every file even if its size and mtime are unchanged")
+	artCache := flag.String("art_cache", "", "Directory for extracted cover art (default: \"artwork\" next to the database)")
+	artistSeparators := flag.String("artist_separators", ";", "\"|\"-separated strings that split co-credited artists in artist tags")
+	genreSeparators := flag.String("genre_separators", ";|/", "\"|\"-separated strings that split multiple genres in genre tags")
+	featuringMarkers := flag.String("featuring", "feat.|ft.|featuring", "\"|\"-separated words that introduce featured artists in artist tags")
+	prune := flag.Bool("prune", false, "Remove database rows for deleted files and orphaned artists, albums and genres")
+	watch := flag.Bool("watch", false, "Keep running after indexing and apply filesystem changes as they happen")
+	watchDebounce := flag.Duration("watch_debounce", 2*time.Second, "How long a file must be quiet before a change is indexed in --watch mode")
 
 	flag.Parse()
 
@@ -449,6 +500,15 @@ func main() {
 	if *numWorkers <= 0 {
 		log.Fatal("Error: --workers must be a positive integer.")
 	}
+	if *batchSize <= 0 {
+		log.Fatal("Error: --batch_size must be a positive integer.")
+	}
+	if *batchInterval <= 0 {
+		log.Fatal("Error: --batch_interval must be a positive duration.")
+	}
+	if *watchDebounce <= 0 {
+		log.Fatal("Error: --watch_debounce must be a positive duration.")
+	}
 
 	// Check if music folder exists
 	if _, err := os.Stat(*musicFolder); os.IsNotExist(err) {
@@ -462,19 +522,42 @@ func main() {
 	log.Printf("Music folder: %s", *musicFolder)
 	log.Printf("Number of workers: %d", *numWorkers)
 
-	dbMgr, err := NewDBManager(*dbPath)
+	if *artCache == "" {
+		*artCache = filepath.Join(filepath.Dir(*dbPath), "artwork")
+	}
+	// Paths are stored in the database for the server, so make them absolute
+	artCacheDir, err := filepath.Abs(*artCache)
+	if err != nil {
+		log.Fatalf("Error: Invalid --art_cache path %q: %v", *artCache, err)
+	}
+	if err := os.MkdirAll(artCacheDir, 0o755); err != nil {
+		log.Fatalf("Error: Could not create art cache directory %s: %v", artCacheDir, err)
+	}
+	log.Printf("Art cache: %s", artCacheDir)
+
+	db, err := library.Open(*dbPath)
 	if err != nil {
-		log.Fatalf("Failed to initialize database manager: %v", err)
+		log.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+	// Workers only parse files; their results are written from a single goroutine
+	if applied, err := db.Migrate(); err != nil {
+		log.Fatalf("Failed to initialize database schema: %v", err)
+	} else if len(applied) > 0 {
+		log.Printf("Database schema is now at version %d", library.LatestSchemaVersion())
 	}
-	defer dbMgr.Close()
 
 	// Pass numWorkers to NewIndexer
-	indexer := NewIndexer(dbMgr, *musicFolder, *numWorkers)
+	indexer := NewIndexer(db, *musicFolder, *numWorkers, *batchSize, *batchInterval, *force, *prune, artCacheDir, NewArtistParser(*artistSeparators, *featuringMarkers), NewGenreParser(*genreSeparators))
 	if err := indexer.StartIndexing(); err != nil {
 		log.Fatalf("Indexing failed: %v", err)
 	}
 
+	if *watch {
+		if err := indexer.Watch(*watchDebounce); err != nil {
+			log.Fatalf("Watch mode failed: %v", err)
+		}
+	}
+
 	log.Println("Indexing process completed successfully!")
 }
-
-
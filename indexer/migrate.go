@@ -0,0 +1,49 @@
+package main
+
+import (
+	"flag"
+	"log"
+
+	"heavymetal/library"
+)
+
+// runMigrateCommand implements "indexer migrate": it brings a database up to the latest
+// schema version without indexing anything, or only reports the version with --status.
+func runMigrateCommand(args []string) {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	dbPath := fs.String("db", "music_library.sqlite", "Path to the SQLite3 database file")
+	status := fs.Bool("status", false, "Only print the current schema version and pending migrations")
+	fs.Parse(args)
+
+	db, err := library.Open(*dbPath)
+	if err != nil {
+		log.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	current, err := db.SchemaVersion()
+	if err != nil {
+		log.Fatalf("Failed to read schema version: %v", err)
+	}
+	log.Printf("Database %s is at schema version %d (latest: %d)", *dbPath, current, library.LatestSchemaVersion())
+	if *status {
+		pending, err := db.PendingMigrations()
+		if err != nil {
+			log.Fatalf("Failed to list pending migrations: %v", err)
+		}
+		for _, mig := range pending {
+			log.Printf("Pending migration %d: %s", mig.Version, mig.Description)
+		}
+		return
+	}
+
+	applied, err := db.Migrate()
+	if err != nil {
+		log.Fatalf("Migration failed: %v", err)
+	}
+	if len(applied) == 0 {
+		log.Println("Schema is up to date.")
+		return
+	}
+	log.Printf("Migrated to schema version %d.", applied[len(applied)-1].Version)
+}
@@ -0,0 +1,773 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"time"
+)
+
+// errUnsupportedFormat is returned when no stream parser exists for a file type.
+var errUnsupportedFormat = errors.New("unsupported audio format")
+
+// Codec names stored in audio_files.codec.
+const (
+	CodecMP1    = "mp1"
+	CodecMP2    = "mp2"
+	CodecMP3    = "mp3"
+	CodecFLAC   = "flac"
+	CodecAAC    = "aac"
+	CodecALAC   = "alac"
+	CodecVorbis = "vorbis"
+	CodecOpus   = "opus"
+	CodecPCM    = "pcm"
+)
+
+// StreamInfo holds the technical properties of an audio stream. Fields a format does not
+// record are left zero; BitDepth is only set for lossless codecs.
+type StreamInfo struct {
+	Codec      string // One of the Codec constants, or the raw codec ID for codecs we do not know
+	Container  string // "mpeg", "flac", "mp4", "ogg", "wav" or "aiff"
+	Duration   time.Duration
+	Bitrate    int // Average bits per second
+	SampleRate int // Hz
+	BitDepth   int
+	Channels   int
+}
+
+// Lossless reports whether the codec preserves the original samples exactly.
+func (s StreamInfo) Lossless() bool {
+	switch s.Codec {
+	case CodecFLAC, CodecALAC, CodecPCM:
+		return true
+	default:
+		return false
+	}
+}
+
+// ReadStreamInfo decodes the container/stream headers of an audio file. ext is the file
+// extension (including the dot) and selects the parser; size is the total size of the
+// file in bytes. When the headers carry no bitrate it is averaged over the audio payload.
+func ReadStreamInfo(r io.ReaderAt, size int64, ext string) (StreamInfo, error) {
+	var info StreamInfo
+	var err error
+	switch strings.ToLower(ext) {
+	case ".mp3":
+		info, err = mp3StreamInfo(r, size)
+	case ".flac":
+		info, err = flacStreamInfo(r)
+	case ".m4a":
+		info, err = mp4StreamInfo(r, size)
+	case ".ogg", ".opus":
+		info, err = oggStreamInfo(r, size)
+	case ".wav":
+		info, err = wavStreamInfo(r, size)
+	case ".aiff", ".aif":
+		info, err = aiffStreamInfo(r, size)
+	default:
+		return info, errUnsupportedFormat
+	}
+	if err != nil {
+		return info, err
+	}
+	if info.Bitrate == 0 && info.Duration > 0 {
+		if _, n, err := audioPayload(r, size, ext); err == nil {
+			info.Bitrate = int(float64(n*8) / info.Duration.Seconds())
+		}
+	}
+	return info, nil
+}
+
+// samplesToDuration converts a sample (or frame) count at the given rate into a duration.
+func samplesToDuration(samples uint64, rate uint32) time.Duration {
+	if rate == 0 {
+		return 0
+	}
+	return time.Duration(float64(samples) / float64(rate) * float64(time.Second))
+}
+
+// id3v2Size returns the number of bytes taken by an ID3v2 tag at the start of
+// the file, or 0 if there is none. MP3 and (rarely) FLAC files can carry one.
+func id3v2Size(r io.ReaderAt) int64 {
+	var hdr [10]byte
+	if _, err := r.ReadAt(hdr[:], 0); err != nil || string(hdr[:3]) != "ID3" {
+		return 0
+	}
+	n := int64(hdr[6]&0x7f)<<21 | int64(hdr[7]&0x7f)<<14 | int64(hdr[8]&0x7f)<<7 | int64(hdr[9]&0x7f)
+	n += 10
+	if hdr[5]&0x10 != 0 { // Footer present
+		n += 10
+	}
+	return n
+}
+
+// --- MP3 ---
+
+// mpegFrame holds the fields of an MPEG audio frame header needed for timing.
+type mpegFrame struct {
+	version    int // 1, 2 or 25 (MPEG 2.5)
+	layer      int // 1, 2 or 3
+	bitrate    int // Bits per second
+	sampleRate int
+	padding    int
+	mono       bool
+}
+
+var mpegBitrates = map[[2]int][15]int{
+	{1, 1}: {0, 32, 64, 96, 128, 160, 192, 224, 256, 288, 320, 352, 384, 416, 448},
+	{1, 2}: {0, 32, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 384},
+	{1, 3}: {0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320},
+	{2, 1}: {0, 32, 48, 56, 64, 80, 96, 112, 128, 144, 160, 176, 192, 224, 256},
+	{2, 2}: {0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},
+	{2, 3}: {0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},
+}
+
+var mpegSampleRates = map[int][3]int{
+	1:  {44100, 48000, 32000},
+	2:  {22050, 24000, 16000},
+	25: {11025, 12000, 8000},
+}
+
+// parseMPEGHeader decodes a 4-byte MPEG audio frame header.
+func parseMPEGHeader(h []byte) (mpegFrame, bool) {
+	var f mpegFrame
+	if len(h) < 4 || h[0] != 0xFF || h[1]&0xE0 != 0xE0 {
+		return f, false
+	}
+	switch (h[1] >> 3) & 3 {
+	case 0:
+		f.version = 25
+	case 2:
+		f.version = 2
+	case 3:
+		f.version = 1
+	default:
+		return f, false
+	}
+	switch (h[1] >> 1) & 3 {
+	case 1:
+		f.layer = 3
+	case 2:
+		f.layer = 2
+	case 3:
+		f.layer = 1
+	default:
+		return f, false
+	}
+	brIdx, srIdx := int(h[2]>>4), int(h[2]>>2)&3
+	if brIdx == 0 || brIdx == 15 || srIdx == 3 { // Free-format and reserved values are not supported
+		return f, false
+	}
+	tableVersion := f.version
+	if tableVersion == 25 {
+		tableVersion = 2
+	}
+	f.bitrate = mpegBitrates[[2]int{tableVersion, f.layer}][brIdx] * 1000
+	f.sampleRate = mpegSampleRates[f.version][srIdx]
+	f.padding = int(h[2]>>1) & 1
+	f.mono = h[3]>>6 == 3
+	return f, true
+}
+
+// samples returns the number of PCM samples per channel encoded in one frame.
+func (f mpegFrame) samples() int {
+	switch {
+	case f.layer == 1:
+		return 384
+	case f.layer == 3 && f.version != 1:
+		return 576
+	default:
+		return 1152
+	}
+}
+
+// length returns the size of the frame in bytes, including its header.
+func (f mpegFrame) length() int {
+	if f.layer == 1 {
+		return (12*f.bitrate/f.sampleRate + f.padding) * 4
+	}
+	return f.samples()/8*f.bitrate/f.sampleRate + f.padding
+}
+
+// sideInfoSize returns the size of the Layer III side information that precedes
+// a Xing/Info header inside the first frame.
+func (f mpegFrame) sideInfoSize() int {
+	switch {
+	case f.version == 1 && f.mono:
+		return 17
+	case f.version == 1:
+		return 32
+	case f.mono:
+		return 9
+	default:
+		return 17
+	}
+}
+
+// mp3StreamInfo takes the stream properties from the first frame. The duration comes
+// from the frame count stored in a Xing/Info or VBRI header, falling back to walking
+// every frame in the stream.
+func mp3StreamInfo(r io.ReaderAt, size int64) (StreamInfo, error) {
+	info := StreamInfo{Container: "mpeg"}
+	start := id3v2Size(r)
+	probe := make([]byte, 64*1024)
+	n, err := r.ReadAt(probe, start)
+	if err != nil && err != io.EOF {
+		return info, fmt.Errorf("failed to read mp3 stream: %w", err)
+	}
+	probe = probe[:n]
+
+	// Find the first frame whose successor is also a valid frame, to avoid
+	// latching onto stray sync bytes in padding or junk after the tag.
+	pos := -1
+	var first mpegFrame
+	for i := 0; i+4 <= len(probe); i++ {
+		f, ok := parseMPEGHeader(probe[i:])
+		if !ok {
+			continue
+		}
+		next := i + f.length()
+		if next+4 <= len(probe) {
+			if _, ok := parseMPEGHeader(probe[next:]); !ok {
+				continue
+			}
+		}
+		pos, first = i, f
+		break
+	}
+	if pos < 0 {
+		return info, errors.New("no mpeg audio frame found")
+	}
+	info.Codec = [...]string{CodecMP1, CodecMP2, CodecMP3}[first.layer-1]
+	info.SampleRate = first.sampleRate
+	info.Channels = 2
+	if first.mono {
+		info.Channels = 1
+	}
+
+	if first.layer == 3 {
+		if frames, ok := xingFrames(probe[pos:], first); ok {
+			// VBR: the bitrate of the first frame says nothing, so it is averaged later
+			info.Duration = samplesToDuration(uint64(frames)*uint64(first.samples()), uint32(first.sampleRate))
+			return info, nil
+		}
+	}
+
+	// No VBR header: count frames one by one. This is exact for CBR and for VBR
+	// files written without a header.
+	br := bufio.NewReader(io.NewSectionReader(r, start+int64(pos), size-start-int64(pos)))
+	var samples uint64
+	var hdr [4]byte
+	constant := true
+	for {
+		if _, err := io.ReadFull(br, hdr[:]); err != nil {
+			break
+		}
+		f, ok := parseMPEGHeader(hdr[:])
+		if !ok { // Trailing ID3v1/APE tags or garbage end the stream
+			break
+		}
+		samples += uint64(f.samples())
+		constant = constant && f.bitrate == first.bitrate
+		if _, err := br.Discard(f.length() - 4); err != nil {
+			break
+		}
+	}
+	info.Duration = samplesToDuration(samples, uint32(first.sampleRate))
+	if constant {
+		info.Bitrate = first.bitrate
+	}
+	return info, nil
+}
+
+// xingFrames reads the total frame count from a Xing/Info or VBRI header in the
+// first frame, if one is present.
+func xingFrames(frame []byte, f mpegFrame) (uint32, bool) {
+	if off := 4 + f.sideInfoSize(); off+12 <= len(frame) {
+		tag := string(frame[off : off+4])
+		if tag == "Xing" || tag == "Info" {
+			flags := binary.BigEndian.Uint32(frame[off+4:])
+			if flags&1 != 0 {
+				return binary.BigEndian.Uint32(frame[off+8:]), true
+			}
+		}
+	}
+	// VBRI always sits 32 bytes after the frame header.
+	if off := 4 + 32; off+18 <= len(frame) && string(frame[off:off+4]) == "VBRI" {
+		return binary.BigEndian.Uint32(frame[off+14:]), true
+	}
+	return 0, false
+}
+
+// --- FLAC ---
+
+// flacStreamInfo reads the sample rate, channels, bit depth and total sample count
+// from STREAMINFO.
+func flacStreamInfo(r io.ReaderAt) (StreamInfo, error) {
+	info := StreamInfo{Codec: CodecFLAC, Container: "flac"}
+	var buf [4 + 4 + 34]byte // "fLaC", metadata block header, STREAMINFO body
+	if _, err := r.ReadAt(buf[:], id3v2Size(r)); err != nil {
+		return info, fmt.Errorf("failed to read flac header: %w", err)
+	}
+	if string(buf[:4]) != "fLaC" {
+		return info, errors.New("missing fLaC marker")
+	}
+	if buf[4]&0x7f != 0 {
+		return info, errors.New("first flac metadata block is not STREAMINFO")
+	}
+	si := buf[8:]
+	rate := uint32(si[10])<<12 | uint32(si[11])<<4 | uint32(si[12])>>4
+	info.SampleRate = int(rate)
+	info.Channels = int(si[12]>>1&7) + 1
+	info.BitDepth = int(si[12]&1<<4|si[13]>>4) + 1
+	total := uint64(si[13]&0x0f)<<32 | uint64(binary.BigEndian.Uint32(si[14:18]))
+	if total == 0 {
+		return info, errors.New("flac STREAMINFO does not record a sample count")
+	}
+	info.Duration = samplesToDuration(total, rate)
+	return info, nil
+}
+
+// --- MP4 / M4A ---
+
+// mp4Box describes an ISO-BMFF box located in a file.
+type mp4Box struct {
+	typ       string
+	dataStart int64 // First byte after the box header
+	end       int64
+}
+
+// readMP4Box reads the header of the box starting at off. limit bounds the
+// enclosing box and is used for boxes that extend to the end of their parent.
+func readMP4Box(r io.ReaderAt, off, limit int64) (mp4Box, error) {
+	var hdr [16]byte
+	if _, err := r.ReadAt(hdr[:8], off); err != nil {
+		return mp4Box{}, err
+	}
+	size := int64(binary.BigEndian.Uint32(hdr[:4]))
+	b := mp4Box{typ: string(hdr[4:8]), dataStart: off + 8}
+	switch size {
+	case 0:
+		size = limit - off
+	case 1:
+		if _, err := r.ReadAt(hdr[8:16], off+8); err != nil {
+			return mp4Box{}, err
+		}
+		size = int64(binary.BigEndian.Uint64(hdr[8:16]))
+		b.dataStart += 8
+	}
+	if size < b.dataStart-off || off+size > limit {
+		return mp4Box{}, fmt.Errorf("malformed %q box at offset %d", b.typ, off)
+	}
+	b.end = off + size
+	return b, nil
+}
+
+// walkMP4 calls fn for every box directly contained in [off, end).
+func walkMP4(r io.ReaderAt, off, end int64, fn func(mp4Box) error) error {
+	for off+8 <= end {
+		b, err := readMP4Box(r, off, end)
+		if err != nil {
+			return err
+		}
+		if err := fn(b); err != nil {
+			return err
+		}
+		off = b.end
+	}
+	return nil
+}
+
+// readMP4Time reads the timescale and duration of an mvhd or mdhd box, which
+// share the same layout for these fields.
+func readMP4Time(r io.ReaderAt, b mp4Box) (uint32, uint64, error) {
+	var buf [32]byte
+	n := b.end - b.dataStart
+	if n > int64(len(buf)) {
+		n = int64(len(buf))
+	}
+	if _, err := r.ReadAt(buf[:n], b.dataStart); err != nil {
+		return 0, 0, err
+	}
+	if buf[0] == 1 {
+		if n < 32 {
+			return 0, 0, fmt.Errorf("short %q box", b.typ)
+		}
+		return binary.BigEndian.Uint32(buf[20:24]), binary.BigEndian.Uint64(buf[24:32]), nil
+	}
+	if n < 20 {
+		return 0, 0, fmt.Errorf("short %q box", b.typ)
+	}
+	return binary.BigEndian.Uint32(buf[12:16]), uint64(binary.BigEndian.Uint32(buf[16:20])), nil
+}
+
+// mp4StreamInfo describes the first sound track. Its duration comes from the track's
+// media header, falling back to the movie header when no track carries one.
+func mp4StreamInfo(r io.ReaderAt, size int64) (StreamInfo, error) {
+	var info StreamInfo
+	var movie time.Duration
+	found := false
+	err := walkMP4(r, 0, size, func(moov mp4Box) error {
+		if moov.typ != "moov" {
+			return nil
+		}
+		return walkMP4(r, moov.dataStart, moov.end, func(b mp4Box) error {
+			switch b.typ {
+			case "mvhd":
+				scale, d, err := readMP4Time(r, b)
+				if err != nil {
+					return err
+				}
+				movie = samplesToDuration(d, scale)
+			case "trak":
+				if found {
+					return nil
+				}
+				track, sound, err := mp4TrackInfo(r, b)
+				if err != nil {
+					return err
+				}
+				info, found = track, sound
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return info, fmt.Errorf("failed to parse mp4 boxes: %w", err)
+	}
+	info.Container = "mp4"
+	if info.Duration == 0 {
+		info.Duration = movie
+	}
+	if !found && movie == 0 {
+		return info, errors.New("no mvhd/mdhd box found")
+	}
+	return info, nil
+}
+
+// mp4TrackInfo reads the mdhd duration and the sample description of a trak box, and
+// reports whether its handler is a sound handler.
+func mp4TrackInfo(r io.ReaderAt, trak mp4Box) (StreamInfo, bool, error) {
+	var info StreamInfo
+	var sound bool
+	err := walkMP4(r, trak.dataStart, trak.end, func(mdia mp4Box) error {
+		if mdia.typ != "mdia" {
+			return nil
+		}
+		return walkMP4(r, mdia.dataStart, mdia.end, func(b mp4Box) error {
+			switch b.typ {
+			case "hdlr":
+				var handler [4]byte
+				if _, err := r.ReadAt(handler[:], b.dataStart+8); err != nil {
+					return err
+				}
+				sound = string(handler[:]) == "soun"
+			case "mdhd":
+				scale, units, err := readMP4Time(r, b)
+				if err != nil {
+					return err
+				}
+				info.Duration = samplesToDuration(units, scale)
+			case "minf":
+				return walkMP4(r, b.dataStart, b.end, func(stbl mp4Box) error {
+					if stbl.typ != "stbl" {
+						return nil
+					}
+					return walkMP4(r, stbl.dataStart, stbl.end, func(stsd mp4Box) error {
+						if stsd.typ != "stsd" || stsd.end-stsd.dataStart < 16 {
+							return nil
+						}
+						return readMP4SampleEntry(r, stsd, &info)
+					})
+				})
+			}
+			return nil
+		})
+	})
+	if err != nil || !sound {
+		return StreamInfo{}, false, err
+	}
+	return info, true, nil
+}
+
+// readMP4SampleEntry fills in the codec, channels, sample rate and bit depth from the
+// first audio sample entry of an stsd box.
+func readMP4SampleEntry(r io.ReaderAt, stsd mp4Box, info *StreamInfo) error {
+	entry, err := readMP4Box(r, stsd.dataStart+8, stsd.end) // Skip version/flags and entry count
+	if err != nil {
+		return err
+	}
+	var buf [28]byte
+	if entry.end-entry.dataStart < int64(len(buf)) {
+		return fmt.Errorf("short %q sample entry", entry.typ)
+	}
+	if _, err := r.ReadAt(buf[:], entry.dataStart); err != nil {
+		return err
+	}
+	info.Channels = int(binary.BigEndian.Uint16(buf[16:18]))
+	sampleSize := int(binary.BigEndian.Uint16(buf[18:20]))
+	info.SampleRate = int(binary.BigEndian.Uint32(buf[24:28]) >> 16) // 16.16 fixed point
+
+	switch entry.typ {
+	case "mp4a":
+		info.Codec = CodecAAC
+	case "fLaC":
+		info.Codec = CodecFLAC
+	case "Opus":
+		info.Codec = CodecOpus
+	case "alac":
+		info.Codec = CodecALAC
+		// The ALAC magic cookie has the real bit depth, and a sample rate that does not
+		// overflow the 16-bit integer part of the entry's rate above 65535 Hz
+		children := entry.dataStart + 28
+		switch binary.BigEndian.Uint16(buf[8:10]) { // QuickTime sound description version
+		case 1:
+			children += 16
+		case 2:
+			children += 36
+		}
+		return walkMP4(r, children, entry.end, func(b mp4Box) error {
+			var cookie [4 + 24]byte // Version/flags, ALACSpecificConfig
+			if b.typ != "alac" || b.end-b.dataStart < int64(len(cookie)) {
+				return nil
+			}
+			if _, err := r.ReadAt(cookie[:], b.dataStart); err != nil {
+				return err
+			}
+			info.BitDepth = int(cookie[9])
+			info.Channels = int(cookie[13])
+			info.Bitrate = int(binary.BigEndian.Uint32(cookie[20:24]))
+			info.SampleRate = int(binary.BigEndian.Uint32(cookie[24:28]))
+			return nil
+		})
+	default:
+		info.Codec = strings.TrimSpace(entry.typ)
+	}
+	if info.Lossless() {
+		info.BitDepth = sampleSize
+	}
+	return nil
+}
+
+// --- Ogg Vorbis / Opus ---
+
+// oggStreamInfo reads the codec from the identification header on the first page and
+// the final granule position of the same logical stream from the last page.
+func oggStreamInfo(r io.ReaderAt, size int64) (StreamInfo, error) {
+	info := StreamInfo{Container: "ogg"}
+	var page [27 + 255 + 30]byte
+	if _, err := r.ReadAt(page[:27], 0); err != nil {
+		return info, fmt.Errorf("failed to read ogg page: %w", err)
+	}
+	if string(page[:4]) != "OggS" {
+		return info, errors.New("missing OggS capture pattern")
+	}
+	serial := binary.LittleEndian.Uint32(page[14:18])
+	segments := int(page[26])
+	packet := page[27+segments:]
+	if _, err := r.ReadAt(packet, int64(27+segments)); err != nil {
+		return info, fmt.Errorf("failed to read ogg identification header: %w", err)
+	}
+
+	var rate uint32
+	var preSkip uint64
+	switch {
+	case bytes.HasPrefix(packet, []byte("\x01vorbis")):
+		info.Codec = CodecVorbis
+		info.Channels = int(packet[11])
+		rate = binary.LittleEndian.Uint32(packet[12:16])
+		if nominal := int32(binary.LittleEndian.Uint32(packet[20:24])); nominal > 0 {
+			info.Bitrate = int(nominal)
+		}
+	case bytes.HasPrefix(packet, []byte("OpusHead")):
+		info.Codec = CodecOpus
+		info.Channels = int(packet[9])
+		rate = 48000 // Opus always decodes to, and counts granule positions in, 48 kHz samples
+		preSkip = uint64(binary.LittleEndian.Uint16(packet[10:12]))
+	default:
+		return info, errUnsupportedFormat
+	}
+	info.SampleRate = int(rate)
+
+	granule, err := lastOggGranule(r, size, serial)
+	if err != nil {
+		return info, err
+	}
+	if granule >= preSkip {
+		info.Duration = samplesToDuration(granule-preSkip, rate)
+	}
+	return info, nil
+}
+
+// lastOggGranule scans backwards from the end of the file for the last page
+// of the given logical stream that carries a granule position.
+func lastOggGranule(r io.ReaderAt, size int64, serial uint32) (uint64, error) {
+	const window = 128 * 1024 // Larger than the biggest possible Ogg page
+	for end := size; end > 0; {
+		start := end - window
+		if start < 0 {
+			start = 0
+		}
+		buf := make([]byte, end-start)
+		if _, err := r.ReadAt(buf, start); err != nil && err != io.EOF {
+			return 0, fmt.Errorf("failed to read ogg pages: %w", err)
+		}
+		for i := len(buf); ; {
+			i = bytes.LastIndex(buf[:i], []byte("OggS"))
+			if i < 0 {
+				break
+			}
+			if i+27 > len(buf) || binary.LittleEndian.Uint32(buf[i+14:]) != serial {
+				continue
+			}
+			if g := binary.LittleEndian.Uint64(buf[i+6:]); g != math.MaxUint64 { // -1 means no packet ends on this page
+				return g, nil
+			}
+		}
+		if start == 0 {
+			break
+		}
+		end = start + 26 // Overlap so a header straddling the boundary is still seen
+	}
+	return 0, errors.New("no ogg page with a granule position found")
+}
+
+// --- WAV / AIFF ---
+
+// findChunk locates a chunk in a RIFF (little-endian) or IFF (big-endian) file such as
+// WAV or AIFF, checking the form type first. It returns the offset and size of the
+// chunk body, clamping the size of a truncated final chunk to the end of the file.
+func findChunk(r io.ReaderAt, size int64, order binary.ByteOrder, id string, forms ...string) (int64, int64, error) {
+	var hdr [12]byte
+	if _, err := r.ReadAt(hdr[:12], 0); err != nil {
+		return 0, 0, fmt.Errorf("failed to read header: %w", err)
+	}
+	formOK := false
+	for _, form := range forms {
+		formOK = formOK || string(hdr[8:12]) == form
+	}
+	if (string(hdr[:4]) != "RIFF" && string(hdr[:4]) != "FORM") || !formOK {
+		return 0, 0, fmt.Errorf("missing %s header", strings.Join(forms, "/"))
+	}
+	for off := int64(12); off+8 <= size; {
+		if _, err := r.ReadAt(hdr[:8], off); err != nil {
+			return 0, 0, fmt.Errorf("failed to read chunk header: %w", err)
+		}
+		n := int64(order.Uint32(hdr[4:8]))
+		if string(hdr[:4]) == id {
+			if off+8+n > size { // Truncated, or written by a streaming encoder
+				n = size - off - 8
+			}
+			return off + 8, n, nil
+		}
+		off += 8 + n + n&1 // Chunks are word aligned
+	}
+	return 0, 0, fmt.Errorf("no %q chunk found", id)
+}
+
+// wavFormats names the WAVE format tags we recognise.
+var wavFormats = map[uint16]string{
+	0x0001: CodecPCM,
+	0x0003: CodecPCM, // IEEE float
+	0x0055: CodecMP3,
+}
+
+// wavStreamInfo reads the format from the fmt chunk and divides the size of the data
+// chunk by its byte rate for the duration.
+func wavStreamInfo(r io.ReaderAt, size int64) (StreamInfo, error) {
+	info := StreamInfo{Container: "wav"}
+	fmtOff, fmtSize, err := findChunk(r, size, binary.LittleEndian, "fmt ", "WAVE")
+	if err != nil {
+		return info, err
+	}
+	var format [40]byte
+	if fmtSize > int64(len(format)) {
+		fmtSize = int64(len(format))
+	}
+	if fmtSize < 16 {
+		return info, errors.New("short wav fmt chunk")
+	}
+	if _, err := r.ReadAt(format[:fmtSize], fmtOff); err != nil {
+		return info, fmt.Errorf("failed to read wav fmt chunk: %w", err)
+	}
+	tag := binary.LittleEndian.Uint16(format[0:2])
+	if tag == 0xFFFE && fmtSize >= 26 { // WAVE_FORMAT_EXTENSIBLE keeps the real tag in its sub-format GUID
+		tag = binary.LittleEndian.Uint16(format[24:26])
+	}
+	info.Codec = wavFormats[tag]
+	if info.Codec == "" {
+		info.Codec = fmt.Sprintf("wav_0x%04x", tag)
+	}
+	info.Channels = int(binary.LittleEndian.Uint16(format[2:4]))
+	info.SampleRate = int(binary.LittleEndian.Uint32(format[4:8]))
+	byteRate := binary.LittleEndian.Uint32(format[8:12])
+	info.Bitrate = int(byteRate) * 8
+	if info.Lossless() {
+		info.BitDepth = int(binary.LittleEndian.Uint16(format[14:16]))
+	}
+
+	_, dataSize, err := findChunk(r, size, binary.LittleEndian, "data", "WAVE")
+	if err != nil {
+		return info, err
+	}
+	info.Duration = samplesToDuration(uint64(dataSize), byteRate)
+	return info, nil
+}
+
+// aiffStreamInfo reads the channels, sample frame count, sample size and rate from the
+// COMM chunk. AIFF-C files also name their compression type there.
+func aiffStreamInfo(r io.ReaderAt, size int64) (StreamInfo, error) {
+	info := StreamInfo{Codec: CodecPCM, Container: "aiff"}
+	off, n, err := findChunk(r, size, binary.BigEndian, "COMM", "AIFF", "AIFC")
+	if err != nil {
+		return info, err
+	}
+	var comm [22]byte
+	if n > int64(len(comm)) {
+		n = int64(len(comm))
+	}
+	if n < 18 {
+		return info, errors.New("short aiff COMM chunk")
+	}
+	if _, err := r.ReadAt(comm[:n], off); err != nil {
+		return info, fmt.Errorf("failed to read aiff COMM chunk: %w", err)
+	}
+	if n >= 22 { // AIFF-C
+		switch compression := string(comm[18:22]); compression {
+		case "NONE", "sowt", "twos", "fl32", "FL32", "fl64", "FL64", "in24", "in32":
+		default:
+			info.Codec = strings.TrimSpace(compression)
+		}
+	}
+	info.Channels = int(binary.BigEndian.Uint16(comm[0:2]))
+	frames := binary.BigEndian.Uint32(comm[2:6])
+	if info.Lossless() {
+		info.BitDepth = int(binary.BigEndian.Uint16(comm[6:8]))
+	}
+	rate := ieeeExtended(comm[8:18])
+	if rate <= 0 {
+		return info, errors.New("invalid aiff sample rate")
+	}
+	info.SampleRate = int(math.Round(rate))
+	info.Duration = time.Duration(float64(frames) / rate * float64(time.Second))
+	return info, nil
+}
+
+// ieeeExtended decodes the 80-bit IEEE 754 extended float AIFF uses for sample rates.
+func ieeeExtended(b []byte) float64 {
+	exp := int(binary.BigEndian.Uint16(b[0:2]) & 0x7fff)
+	mant := binary.BigEndian.Uint64(b[2:10])
+	if exp == 0 && mant == 0 {
+		return 0
+	}
+	f := math.Ldexp(float64(mant), exp-16383-63)
+	if b[0]&0x80 != 0 {
+		f = -f
+	}
+	return f
+}
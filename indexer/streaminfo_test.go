@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"testing"
+	"time"
+)
+
+// The fixtures below are built byte by byte: just enough headers for each parser, with
+// zeroes where the audio would be.
+
+// mp3Header is an MPEG-1 Layer III frame header: 128 kbit/s, 44.1 kHz, stereo, no
+// padding. Its frames are 417 bytes long and hold 1152 samples.
+var mp3Header = []byte{0xFF, 0xFB, 0x90, 0x00}
+
+const mp3FrameLength = 417
+
+// mp3Frame returns a frame whose body starts at byte 36 with body, right after the
+// side information, where Xing and VBRI headers go.
+func mp3Frame(body []byte) []byte {
+	f := make([]byte, mp3FrameLength)
+	copy(f, mp3Header)
+	copy(f[36:], body)
+	return f
+}
+
+func mp3File(first []byte, frames int) []byte {
+	var b bytes.Buffer
+	b.Write(id3Tag(100))
+	b.Write(first)
+	for i := 0; i < frames; i++ {
+		b.Write(mp3Frame(nil))
+	}
+	return b.Bytes()
+}
+
+// id3Tag returns an empty ID3v2 tag of n bytes after its header.
+func id3Tag(n int) []byte {
+	tag := make([]byte, 10+n)
+	copy(tag, "ID3\x04\x00\x00")
+	tag[6], tag[7], tag[8], tag[9] = byte(n>>21&0x7f), byte(n>>14&0x7f), byte(n>>7&0x7f), byte(n&0x7f)
+	return tag
+}
+
+func xingFrame(tag string, frames uint32) []byte {
+	body := make([]byte, 12)
+	copy(body, tag)
+	binary.BigEndian.PutUint32(body[4:], 1) // Frame count present
+	binary.BigEndian.PutUint32(body[8:], frames)
+	return mp3Frame(body)
+}
+
+func vbriFrame(frames uint32) []byte {
+	body := make([]byte, 18)
+	copy(body, "VBRI")
+	binary.BigEndian.PutUint32(body[14:], frames)
+	return mp3Frame(body)
+}
+
+func flacFile(rate uint32, channels, bits int, samples uint64) []byte {
+	b := []byte("fLaC\x80\x00\x00\x22") // Last metadata block: STREAMINFO, 34 bytes
+	si := make([]byte, 34)
+	binary.BigEndian.PutUint64(si[10:], uint64(rate)<<44|uint64(channels-1)<<41|uint64(bits-1)<<36|samples)
+	return append(append(b, si...), make([]byte, 64)...)
+}
+
+// box returns an ISO-BMFF box of type typ holding children.
+func box(typ string, children ...[]byte) []byte {
+	b := make([]byte, 8, 64)
+	copy(b[4:], typ)
+	for _, c := range children {
+		b = append(b, c...)
+	}
+	binary.BigEndian.PutUint32(b, uint32(len(b)))
+	return b
+}
+
+// mp4Time returns the body of a version 0 mvhd or mdhd box.
+func mp4Time(scale, duration uint32) []byte {
+	b := make([]byte, 20)
+	binary.BigEndian.PutUint32(b[12:], scale)
+	binary.BigEndian.PutUint32(b[16:], duration)
+	return b
+}
+
+func mp4Track(handler string, scale, duration uint32) []byte {
+	hdlr := make([]byte, 12)
+	copy(hdlr[8:], handler)
+	entry := make([]byte, 28)
+	binary.BigEndian.PutUint16(entry[16:], 2)  // Channels
+	binary.BigEndian.PutUint16(entry[18:], 16) // Sample size
+	binary.BigEndian.PutUint32(entry[24:], 44100<<16)
+	stsd := box("stsd", []byte{0, 0, 0, 0, 0, 0, 0, 1}, box("mp4a", entry))
+	return box("trak", box("mdia",
+		box("hdlr", hdlr),
+		box("mdhd", mp4Time(scale, duration)),
+		box("minf", box("stbl", stsd)),
+	))
+}
+
+func mp4File(moov ...[]byte) []byte {
+	return append(append(box("ftyp", []byte("M4A \x00\x00\x00\x00")), box("moov", moov...)...),
+		box("mdat", make([]byte, 256))...)
+}
+
+func oggPage(serial uint32, granule uint64, packet []byte) []byte {
+	p := make([]byte, 27, 27+1+len(packet))
+	copy(p, "OggS")
+	binary.LittleEndian.PutUint64(p[6:], granule)
+	binary.LittleEndian.PutUint32(p[14:], serial)
+	p[26] = 1
+	p = append(p, byte(len(packet)))
+	return append(p, packet...)
+}
+
+func vorbisFile(rate uint32, granule uint64) []byte {
+	id := make([]byte, 30)
+	copy(id, "\x01vorbis")
+	id[11] = 2
+	binary.LittleEndian.PutUint32(id[12:], rate)
+	binary.LittleEndian.PutUint32(id[20:], 160000)
+	return oggFile(id, granule)
+}
+
+func opusFile(preSkip uint16, granule uint64) []byte {
+	id := make([]byte, 19)
+	copy(id, "OpusHead\x01\x02")
+	binary.LittleEndian.PutUint16(id[10:], preSkip)
+	binary.LittleEndian.PutUint32(id[12:], 44100) // Input rate, which does not matter
+	return oggFile(id, granule)
+}
+
+// oggFile has the identification header, a page of audio, the last page of the stream
+// and then a page of a second logical stream that must be ignored.
+func oggFile(id []byte, granule uint64) []byte {
+	var b bytes.Buffer
+	b.Write(oggPage(1, 0, id))
+	b.Write(oggPage(1, math.MaxUint64, make([]byte, 250)))
+	b.Write(oggPage(1, granule, make([]byte, 200)))
+	b.Write(oggPage(2, granule*10, make([]byte, 100)))
+	return b.Bytes()
+}
+
+func chunk(order binary.ByteOrder, id string, size uint32, body []byte) []byte {
+	b := make([]byte, 8, 8+len(body)+1)
+	copy(b, id)
+	order.PutUint32(b[4:], size)
+	b = append(b, body...)
+	if len(body)%2 == 1 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+// wavFile is 8-bit mono PCM at 8 kHz, whose data chunk claims dataSize bytes but has
+// only actual.
+func wavFile(dataSize uint32, actual int) []byte {
+	format := make([]byte, 16)
+	binary.LittleEndian.PutUint16(format[0:], 1)
+	binary.LittleEndian.PutUint16(format[2:], 1)
+	binary.LittleEndian.PutUint32(format[4:], 8000)
+	binary.LittleEndian.PutUint32(format[8:], 8000)
+	binary.LittleEndian.PutUint16(format[12:], 1)
+	binary.LittleEndian.PutUint16(format[14:], 8)
+	body := append([]byte("WAVE"), chunk(binary.LittleEndian, "fmt ", 16, format)...)
+	body = append(body, chunk(binary.LittleEndian, "LIST", 4, []byte("INFO"))...)
+	body = append(body, chunk(binary.LittleEndian, "data", dataSize, make([]byte, actual))...)
+	return chunk(binary.LittleEndian, "RIFF", uint32(len(body)), body)
+}
+
+func aiffFile(frames uint32) []byte {
+	comm := make([]byte, 18)
+	binary.BigEndian.PutUint16(comm[0:], 2)
+	binary.BigEndian.PutUint32(comm[2:], frames)
+	binary.BigEndian.PutUint16(comm[6:], 16)
+	binary.BigEndian.PutUint16(comm[8:], 16383+15) // 44100 as an 80-bit extended float
+	binary.BigEndian.PutUint64(comm[10:], 44100<<(63-15))
+	body := append([]byte("AIFF"), chunk(binary.BigEndian, "COMM", 18, comm)...)
+	body = append(body, chunk(binary.BigEndian, "SSND", 8+64, make([]byte, 8+64))...)
+	return chunk(binary.BigEndian, "FORM", uint32(len(body)), body)
+}
+
+type streamInfoCase struct {
+	name     string
+	ext      string
+	data     []byte
+	codec    string
+	duration time.Duration
+}
+
+func streamInfoCases() []streamInfoCase {
+	frame := 1152 * time.Second / 44100
+	return []streamInfoCase{
+		{"mp3 xing", ".mp3", mp3File(xingFrame("Xing", 1000), 3), CodecMP3, samplesToDuration(1000*1152, 44100)},
+		{"mp3 info", ".mp3", mp3File(xingFrame("Info", 250), 3), CodecMP3, samplesToDuration(250*1152, 44100)},
+		{"mp3 vbri", ".mp3", mp3File(vbriFrame(500), 3), CodecMP3, samplesToDuration(500*1152, 44100)},
+		{"mp3 cbr", ".mp3", append(mp3File(mp3Frame(nil), 9), "TAG"...), CodecMP3, 10 * frame},
+		{"flac", ".flac", flacFile(44100, 2, 16, 441000), CodecFLAC, 10 * time.Second},
+		{"flac 96k", ".flac", flacFile(96000, 6, 24, 96000*3/2), CodecFLAC, 1500 * time.Millisecond},
+		{"m4a mdhd", ".m4a", mp4File(box("mvhd", mp4Time(1000, 10005)), mp4Track("soun", 44100, 441000)), CodecAAC, 10 * time.Second},
+		{"m4a mvhd", ".m4a", mp4File(box("mvhd", mp4Time(1000, 2500)), mp4Track("vide", 25, 100)), "", 2500 * time.Millisecond},
+		{"vorbis", ".ogg", vorbisFile(44100, 44100*4), CodecVorbis, 4 * time.Second},
+		{"opus", ".opus", opusFile(312, 48000*3+312), CodecOpus, 3 * time.Second},
+		{"wav", ".wav", wavFile(16000, 16000), CodecPCM, 2 * time.Second},
+		{"wav truncated", ".wav", wavFile(16000, 8000), CodecPCM, time.Second},
+		{"aiff", ".aiff", aiffFile(88200), CodecPCM, 2 * time.Second},
+	}
+}
+
+func TestReadStreamInfo(t *testing.T) {
+	for _, tc := range streamInfoCases() {
+		t.Run(tc.name, func(t *testing.T) {
+			info, err := ReadStreamInfo(bytes.NewReader(tc.data), int64(len(tc.data)), tc.ext)
+			if err != nil {
+				t.Fatalf("ReadStreamInfo: %v", err)
+			}
+			if info.Codec != tc.codec {
+				t.Errorf("codec = %q, want %q", info.Codec, tc.codec)
+			}
+			if d := info.Duration - tc.duration; d < -time.Millisecond || d > time.Millisecond {
+				t.Errorf("duration = %v, want %v", info.Duration, tc.duration)
+			}
+		})
+	}
+}
+
+func TestReadStreamInfoDetails(t *testing.T) {
+	data := flacFile(96000, 6, 24, 96000)
+	info, err := ReadStreamInfo(bytes.NewReader(data), int64(len(data)), ".flac")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.SampleRate != 96000 || info.Channels != 6 || info.BitDepth != 24 || !info.Lossless() {
+		t.Errorf("flac info = %+v", info)
+	}
+
+	data = mp3File(mp3Frame(nil), 9)
+	info, err = ReadStreamInfo(bytes.NewReader(data), int64(len(data)), ".mp3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Bitrate != 128000 || info.SampleRate != 44100 || info.Channels != 2 || info.BitDepth != 0 {
+		t.Errorf("mp3 info = %+v", info)
+	}
+}
+
+func TestReadStreamInfoUnsupported(t *testing.T) {
+	if _, err := ReadStreamInfo(bytes.NewReader(nil), 0, ".wma"); err != errUnsupportedFormat {
+		t.Errorf("err = %v, want errUnsupportedFormat", err)
+	}
+}
+
+// TestReadStreamInfoCorrupt feeds every fixture cut short at each length, and with each
+// byte of its headers overwritten, and only checks that nothing panics.
+func TestReadStreamInfoCorrupt(t *testing.T) {
+	read := func(t *testing.T, data []byte, ext string) {
+		t.Helper()
+		defer func() {
+			if r := recover(); r != nil {
+				t.Fatalf("panic on %d bytes: %v", len(data), r)
+			}
+		}()
+		ReadStreamInfo(bytes.NewReader(data), int64(len(data)), ext)
+	}
+	for _, tc := range streamInfoCases() {
+		t.Run(tc.name, func(t *testing.T) {
+			for n := 0; n < len(tc.data); n++ {
+				read(t, tc.data[:n], tc.ext)
+			}
+			data := make([]byte, len(tc.data))
+			for i := 0; i < len(tc.data) && i < 512; i++ {
+				for _, v := range []byte{0x00, 0x01, 0x7f, 0xff} {
+					copy(data, tc.data)
+					data[i] = v
+					read(t, data, tc.ext)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf16"
+)
+
+// dhowden/tag flattens multi-valued text fields: ID3v2.4 null-separated values are
+// concatenated and only the last of several repeated Vorbis comments is kept. The readers
+// in this file return every value of the fields we need, keyed by lower-case Vorbis names.
+
+// id3TextKeys maps the ID3v2 text frames we read (v2.2 and v2.3/v2.4 IDs) to Vorbis names.
+var id3TextKeys = map[string]string{
+	"TPE1": "artist", "TP1": "artist",
+	"TPE2": "albumartist", "TP2": "albumartist",
+	"TCOM": "composer", "TCM": "composer",
+	"TCON": "genre", "TCO": "genre",
+}
+
+// readMultiValueTags returns all values of the artist, albumartist, composer and genre
+// fields of a file. A nil map means the format has no multi-value fields we understand,
+// and the caller should rely on dhowden/tag.
+func readMultiValueTags(r io.ReaderAt, size int64, ext string) (map[string][]string, error) {
+	switch strings.ToLower(ext) {
+	case ".flac":
+		return readFLACComments(r, size)
+	case ".ogg", ".opus":
+		return readOggComments(r, size)
+	default:
+		return readID3v2TextFrames(r)
+	}
+}
+
+// syncsafe decodes a 28-bit ID3v2 synchsafe integer.
+func syncsafe(b []byte) int {
+	return int(b[0]&0x7f)<<21 | int(b[1]&0x7f)<<14 | int(b[2]&0x7f)<<7 | int(b[3]&0x7f)
+}
+
+// removeUnsync reverses ID3v2 unsynchronisation (0xFF 0x00 -> 0xFF).
+func removeUnsync(b []byte) []byte {
+	return bytes.ReplaceAll(b, []byte{0xFF, 0x00}, []byte{0xFF})
+}
+
+// readID3v2TextFrames reads the frames listed in id3TextKeys from an ID3v2 tag at the
+// start of the file. Files without a tag yield a nil map.
+func readID3v2TextFrames(r io.ReaderAt) (map[string][]string, error) {
+	var hdr [10]byte
+	if _, err := r.ReadAt(hdr[:], 0); err != nil || string(hdr[:3]) != "ID3" {
+		return nil, nil
+	}
+	version, flags := hdr[3], hdr[5]
+	if version < 2 || version > 4 {
+		return nil, fmt.Errorf("unsupported ID3v2.%d tag", version)
+	}
+	tag := make([]byte, syncsafe(hdr[6:10]))
+	if _, err := r.ReadAt(tag, 10); err != nil {
+		return nil, fmt.Errorf("failed to read ID3v2 tag: %w", err)
+	}
+	if flags&0x80 != 0 && version < 4 { // Whole-tag unsynchronisation
+		tag = removeUnsync(tag)
+	}
+
+	pos := 0
+	if flags&0x40 != 0 && len(tag) >= 4 { // Extended header
+		if version == 3 {
+			pos = 4 + int(binary.BigEndian.Uint32(tag[:4]))
+		} else if version == 4 {
+			pos = syncsafe(tag[:4])
+		}
+	}
+	idLen, hdrLen := 4, 10
+	if version == 2 {
+		idLen, hdrLen = 3, 6
+	}
+
+	values := make(map[string][]string)
+	for pos+hdrLen <= len(tag) && tag[pos] != 0 { // A zero byte starts the padding
+		id := string(tag[pos : pos+idLen])
+		var n int
+		var frameFlags uint16
+		switch version {
+		case 2:
+			n = int(tag[pos+3])<<16 | int(tag[pos+4])<<8 | int(tag[pos+5])
+		case 3:
+			n = int(binary.BigEndian.Uint32(tag[pos+4:]))
+			frameFlags = binary.BigEndian.Uint16(tag[pos+8:])
+		default:
+			n = syncsafe(tag[pos+4 : pos+8])
+			frameFlags = binary.BigEndian.Uint16(tag[pos+8:])
+		}
+		pos += hdrLen
+		if n < 0 || pos+n > len(tag) {
+			break
+		}
+		body := tag[pos : pos+n]
+		pos += n
+
+		key, ok := id3TextKeys[id]
+		if !ok {
+			continue
+		}
+		switch version {
+		case 3:
+			if frameFlags&0x00C0 != 0 { // Compressed or encrypted
+				continue
+			}
+			if frameFlags&0x0020 != 0 && len(body) > 0 { // Grouping identity byte
+				body = body[1:]
+			}
+		case 4:
+			if frameFlags&0x000C != 0 { // Compressed or encrypted
+				continue
+			}
+			if frameFlags&0x0040 != 0 && len(body) > 0 { // Grouping identity byte
+				body = body[1:]
+			}
+			if frameFlags&0x0001 != 0 && len(body) >= 4 { // Data length indicator
+				body = body[4:]
+			}
+			if frameFlags&0x0002 != 0 {
+				body = removeUnsync(body)
+			}
+		}
+		values[key] = append(values[key], decodeID3Text(body)...)
+	}
+	return values, nil
+}
+
+// decodeID3Text decodes the body of an ID3v2 text frame into its null-separated values.
+func decodeID3Text(b []byte) []string {
+	if len(b) < 2 {
+		return nil
+	}
+	var text string
+	switch enc, data := b[0], b[1:]; enc {
+	case 0: // ISO-8859-1
+		runes := make([]rune, len(data))
+		for i, c := range data {
+			runes[i] = rune(c)
+		}
+		text = string(runes)
+	case 1, 2: // UTF-16 with BOM, UTF-16BE
+		units := make([]uint16, 0, len(data)/2)
+		bigEndian := true
+		for i := 0; i+1 < len(data); i += 2 {
+			switch u := binary.BigEndian.Uint16(data[i:]); {
+			case enc == 1 && u == 0xFEFF:
+				bigEndian = true
+			case enc == 1 && u == 0xFFFE:
+				bigEndian = false
+			case bigEndian:
+				units = append(units, u)
+			default:
+				units = append(units, binary.LittleEndian.Uint16(data[i:]))
+			}
+		}
+		text = string(utf16.Decode(units))
+	default: // UTF-8
+		text = string(data)
+	}
+
+	var values []string
+	for _, v := range strings.Split(text, "\x00") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// parseVorbisComment parses a Vorbis comment structure (vendor string followed by
+// KEY=value entries), keeping every value of repeated keys.
+func parseVorbisComment(b []byte) (map[string][]string, error) {
+	errShort := errors.New("truncated vorbis comment")
+	if len(b) < 4 {
+		return nil, errShort
+	}
+	pos := 4 + int(binary.LittleEndian.Uint32(b))
+	if pos+4 > len(b) || pos < 4 {
+		return nil, errShort
+	}
+	count := binary.LittleEndian.Uint32(b[pos:])
+	pos += 4
+
+	values := make(map[string][]string)
+	for c := uint32(0); c < count; c++ {
+		if pos+4 > len(b) {
+			return nil, errShort
+		}
+		n := int(binary.LittleEndian.Uint32(b[pos:]))
+		pos += 4
+		if n < 0 || pos+n > len(b) {
+			return nil, errShort
+		}
+		key, value, ok := strings.Cut(string(b[pos:pos+n]), "=")
+		pos += n
+		if value = strings.TrimSpace(value); ok && value != "" {
+			key = strings.ToLower(key)
+			if key == "album artist" || key == "album_artist" {
+				key = "albumartist"
+			}
+			values[key] = append(values[key], value)
+		}
+	}
+	return values, nil
+}
+
+// readFLACComments parses the VORBIS_COMMENT metadata block of a FLAC file.
+func readFLACComments(r io.ReaderAt, size int64) (map[string][]string, error) {
+	off := id3v2Size(r)
+	var hdr [4]byte
+	if _, err := r.ReadAt(hdr[:], off); err != nil || string(hdr[:]) != "fLaC" {
+		return nil, errors.New("missing fLaC marker")
+	}
+	off += 4
+	for {
+		if _, err := r.ReadAt(hdr[:], off); err != nil {
+			return nil, fmt.Errorf("failed to read flac metadata block: %w", err)
+		}
+		n := int64(hdr[1])<<16 | int64(hdr[2])<<8 | int64(hdr[3])
+		if off+4+n > size {
+			return nil, errors.New("flac metadata block runs past end of file")
+		}
+		if hdr[0]&0x7f == 4 { // VORBIS_COMMENT
+			block := make([]byte, n)
+			if _, err := r.ReadAt(block, off+4); err != nil {
+				return nil, fmt.Errorf("failed to read flac comments: %w", err)
+			}
+			return parseVorbisComment(block)
+		}
+		if hdr[0]&0x80 != 0 { // Last metadata block
+			return map[string][]string{}, nil
+		}
+		off += 4 + n
+	}
+}
+
+// readOggComments parses the comment header (the second packet) of an Ogg Vorbis or
+// Opus stream.
+func readOggComments(r io.ReaderAt, size int64) (map[string][]string, error) {
+	packet, err := readOggPacket(r, size, 1)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case bytes.HasPrefix(packet, []byte("\x03vorbis")):
+		return parseVorbisComment(packet[7:])
+	case bytes.HasPrefix(packet, []byte("OpusTags")):
+		return parseVorbisComment(packet[8:])
+	default:
+		return nil, errUnsupportedFormat
+	}
+}
+
+// readOggPacket reassembles the packet with the given index from the first logical
+// stream of an Ogg file, following it across page boundaries.
+func readOggPacket(r io.ReaderAt, size int64, index int) ([]byte, error) {
+	const maxPacket = 16 << 20 // Comment packets with embedded pictures can be large, but not this large
+	var page [27 + 255]byte
+	var packet []byte
+	var serial uint32
+	current := 0
+	for off := int64(0); off+27 <= size; {
+		if _, err := r.ReadAt(page[:27], off); err != nil {
+			return nil, fmt.Errorf("failed to read ogg page: %w", err)
+		}
+		if string(page[:4]) != "OggS" {
+			return nil, fmt.Errorf("lost ogg sync at offset %d", off)
+		}
+		if off == 0 {
+			serial = binary.LittleEndian.Uint32(page[14:18])
+		}
+		segments := int(page[26])
+		if _, err := r.ReadAt(page[27:27+segments], off+27); err != nil {
+			return nil, fmt.Errorf("failed to read ogg segment table: %w", err)
+		}
+		bodyOff := off + 27 + int64(segments)
+		sameStream := binary.LittleEndian.Uint32(page[14:18]) == serial
+		for _, lacing := range page[27 : 27+segments] {
+			if sameStream && current == index {
+				if len(packet)+int(lacing) > maxPacket {
+					return nil, errors.New("ogg packet too large")
+				}
+				seg := make([]byte, lacing)
+				if _, err := r.ReadAt(seg, bodyOff); err != nil {
+					return nil, fmt.Errorf("failed to read ogg packet: %w", err)
+				}
+				packet = append(packet, seg...)
+			}
+			bodyOff += int64(lacing)
+			if sameStream && lacing < 255 { // A short segment ends the packet
+				if current == index {
+					return packet, nil
+				}
+				current++
+			}
+		}
+		off = bodyOff
+	}
+	return nil, fmt.Errorf("ogg packet %d not found", index)
+}
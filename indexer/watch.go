@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Watch keeps the database in sync with the music folder until SIGINT or SIGTERM.
+// Filesystem events are debounced per path, so a file is only indexed once it has been
+// quiet for the debounce period, and are then fed through the usual worker pool.
+func (i *Indexer) Watch(debounce time.Duration) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("failed to create filesystem watcher: %w", err)
+	}
+	defer watcher.Close()
+
+	if err := i.watchTree(watcher, i.musicFolder, nil); err != nil {
+		return err
+	}
+	log.Printf("Watching %s for changes (debounce %s). Press Ctrl+C to stop.", i.musicFolder, debounce)
+
+	i.startWorkers()
+	defer i.stopWorkers()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(stop)
+
+	// Last event time per path; a path is queued once it has been quiet for the debounce period
+	pending := make(map[string]time.Time)
+	// Vanished paths already held back for one extra period (see below)
+	heldBack := make(map[string]bool)
+	ticker := time.NewTicker(debounce / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			i.handleWatchEvent(watcher, event, pending)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			log.Printf("Watch error: %v", err)
+		case now := <-ticker.C:
+			for _, path := range duePaths(now, debounce, pending, heldBack) {
+				log.Printf("Change detected: %s", path)
+				i.filePathChan <- path
+			}
+		case <-stop:
+			log.Println("Stopping watch mode...")
+			return nil
+		}
+	}
+}
+
+// duePaths removes from pending, and returns, the paths that have been quiet for the
+// debounce period at now.
+func duePaths(now time.Time, debounce time.Duration, pending map[string]time.Time, heldBack map[string]bool) []string {
+	var due []string
+	for path, last := range pending {
+		if now.Sub(last) < debounce {
+			continue
+		}
+		// A rename shows up as a removal plus a creation. Hold the removal back for one
+		// more period so the new path is indexed first and keeps the ID.
+		if _, err := os.Stat(path); os.IsNotExist(err) && !heldBack[path] {
+			heldBack[path] = true
+			pending[path] = now
+			continue
+		}
+		delete(pending, path)
+		delete(heldBack, path)
+		due = append(due, path)
+	}
+	return due
+}
+
+// handleWatchEvent records the audio files affected by a filesystem event in pending.
+func (i *Indexer) handleWatchEvent(watcher *fsnotify.Watcher, event fsnotify.Event, pending map[string]time.Time) {
+	now := time.Now()
+	switch {
+	case event.Has(fsnotify.Create):
+		if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+			// A new directory (e.g. an album being copied in) may already contain files
+			// that were written before its watch was added, so walk it.
+			if err := i.watchTree(watcher, event.Name, func(path string) { pending[path] = now }); err != nil {
+				log.Printf("Error watching new directory %q: %v", event.Name, err)
+			}
+			return
+		}
+		if isAudioFile(event.Name) {
+			pending[event.Name] = now
+		}
+	case event.Has(fsnotify.Write):
+		if isAudioFile(event.Name) {
+			pending[event.Name] = now
+		}
+	case event.Has(fsnotify.Remove), event.Has(fsnotify.Rename):
+		if isAudioFile(event.Name) {
+			pending[event.Name] = now
+			return
+		}
+		// Possibly a directory moved or deleted as a whole; its files get no events of their own
+		paths, err := i.db.FilePathsUnder(event.Name)
+		if err != nil {
+			log.Printf("Error looking up files under %q: %v", event.Name, err)
+			return
+		}
+		for _, path := range paths {
+			pending[path] = now
+		}
+	}
+}
+
+// watchTree adds a watch for root and every directory below it. If found is not nil
+// it is called with every audio file in the tree.
+func (i *Indexer) watchTree(watcher *fsnotify.Watcher, root string, found func(path string)) error {
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			log.Printf("Skipping %q while adding watches: %v", path, err)
+			return nil
+		}
+		if info.IsDir() {
+			if err := watcher.Add(path); err != nil {
+				return fmt.Errorf("failed to watch %q: %w", path, err)
+			}
+			return nil
+		}
+		if found != nil && isAudioFile(info.Name()) {
+			found(path)
+		}
+		return nil
+	})
+}
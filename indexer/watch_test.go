@@ -0,0 +1,127 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"heavymetal/library"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+func TestDuePaths(t *testing.T) {
+	dir := t.TempDir()
+	quiet, busy, gone := filepath.Join(dir, "quiet.mp3"), filepath.Join(dir, "busy.mp3"), filepath.Join(dir, "gone.mp3")
+	for _, path := range []string{quiet, busy} {
+		if err := os.WriteFile(path, nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	const debounce = time.Second
+	start := time.Now()
+	pending := map[string]time.Time{quiet: start, busy: start, gone: start}
+	heldBack := map[string]bool{}
+
+	if due := duePaths(start.Add(debounce/2), debounce, pending, heldBack); len(due) != 0 {
+		t.Errorf("before the debounce period: %v are due", due)
+	}
+	// Another event on busy starts its period again
+	pending[busy] = start.Add(debounce / 2)
+
+	due := duePaths(start.Add(debounce), debounce, pending, heldBack)
+	if len(due) != 1 || due[0] != quiet {
+		t.Errorf("after the debounce period: %v are due, want only %s", due, quiet)
+	}
+	if _, ok := pending[quiet]; ok {
+		t.Errorf("%s is still pending once due", quiet)
+	}
+	// The vanished file waits one more period, in case it was renamed
+	if !heldBack[gone] || !pending[gone].Equal(start.Add(debounce)) {
+		t.Errorf("%s was not held back: pending %v, held back %v", gone, pending[gone], heldBack[gone])
+	}
+
+	due = duePaths(start.Add(2*debounce), debounce, pending, heldBack)
+	sort.Strings(due)
+	if strings.Join(due, " ") != busy+" "+gone {
+		t.Errorf("one period later: %v are due, want %s and %s", due, busy, gone)
+	}
+	if len(pending) != 0 || len(heldBack) != 0 {
+		t.Errorf("left over: pending %v, held back %v", pending, heldBack)
+	}
+}
+
+func TestHandleWatchEvent(t *testing.T) {
+	db, err := library.OpenMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watcher.Close()
+	i := &Indexer{db: db}
+
+	dir := t.TempDir()
+	album := filepath.Join(dir, "album")
+	if err := os.MkdirAll(filepath.Join(album, "disc 2"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"01.flac", "cover.jpg", "disc 2/01.mp3"} {
+		if err := os.WriteFile(filepath.Join(album, name), nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Tracks indexed under a directory that then disappears as a whole
+	oldDir := filepath.Join(dir, "old")
+	for _, name := range []string{"a.mp3", "b.mp3"} {
+		af := library.AudioFile{HumanHashID: name, FilePath: filepath.Join(oldDir, name), Title: name}
+		if af.ArtistID, err = db.GetOrInsertArtist("Artist"); err != nil {
+			t.Fatal(err)
+		}
+		if af.AlbumID, err = db.GetOrInsertAlbum("Album", af.ArtistID, 0, false); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.UpsertAudioFile(&af); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tc := range []struct {
+		name  string
+		event fsnotify.Event
+		want  []string
+	}{
+		{"new audio file", fsnotify.Event{Name: filepath.Join(dir, "new.mp3"), Op: fsnotify.Create}, []string{filepath.Join(dir, "new.mp3")}},
+		{"written audio file", fsnotify.Event{Name: filepath.Join(dir, "new.ogg"), Op: fsnotify.Write}, []string{filepath.Join(dir, "new.ogg")}},
+		{"other file", fsnotify.Event{Name: filepath.Join(album, "cover.jpg"), Op: fsnotify.Create}, nil},
+		{"chmod", fsnotify.Event{Name: filepath.Join(album, "01.flac"), Op: fsnotify.Chmod}, nil},
+		{"removed audio file", fsnotify.Event{Name: filepath.Join(dir, "gone.wav"), Op: fsnotify.Remove}, []string{filepath.Join(dir, "gone.wav")}},
+		{"new directory", fsnotify.Event{Name: album, Op: fsnotify.Create}, []string{filepath.Join(album, "01.flac"), filepath.Join(album, "disc 2", "01.mp3")}},
+		{"renamed directory", fsnotify.Event{Name: oldDir, Op: fsnotify.Rename}, []string{filepath.Join(oldDir, "a.mp3"), filepath.Join(oldDir, "b.mp3")}},
+		{"unknown directory", fsnotify.Event{Name: filepath.Join(dir, "never"), Op: fsnotify.Remove}, nil},
+	} {
+		pending := make(map[string]time.Time)
+		i.handleWatchEvent(watcher, tc.event, pending)
+		var got []string
+		for path := range pending {
+			got = append(got, path)
+		}
+		sort.Strings(got)
+		if strings.Join(got, "\n") != strings.Join(tc.want, "\n") {
+			t.Errorf("%s: pending %v, want %v", tc.name, got, tc.want)
+		}
+	}
+
+	// Files added to the new directory later are seen through its watch
+	watched := watcher.WatchList()
+	sort.Strings(watched)
+	if strings.Join(watched, "\n") != album+"\n"+filepath.Join(album, "disc 2") {
+		t.Errorf("watching %v, want the new directory and its subdirectory", watched)
+	}
+}
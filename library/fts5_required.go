@@ -0,0 +1,9 @@
+//go:build !sqlite_fts5
+
+package library
+
+// The search index is an FTS5 table, and go-sqlite3 only compiles FTS5 in with the
+// sqlite_fts5 build tag. Without it every build would work until the first migration
+// failed with "no such module: fts5", so fail here instead: this name is undefined.
+// Build, vet and test with -tags sqlite_fts5.
+var _ = library_needs_go_build_tags_sqlite_fts5
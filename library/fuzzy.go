@@ -0,0 +1,329 @@
+package library
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+)
+
+// DefaultFuzzyThreshold is the similarity every query word must reach in a fuzzy search
+// unless the caller picks another. At 0.7 a nine-letter word tolerates two typos.
+const DefaultFuzzyThreshold = 0.7
+
+// fuzzyCandidateLimit caps how many rows sharing trigrams with a query are scored.
+const fuzzyCandidateLimit = 500
+
+// prefixPenalty scales the similarity of a query word to the start of a longer word, so
+// that typing ahead finds "Metallica" from "metal" but ranks the word "Metal" higher.
+const prefixPenalty = 0.9
+
+// FuzzyTrack is a track found by a fuzzy search.
+type FuzzyTrack struct {
+	Track
+	Score float64 `json:"score" example:"0.89"` // 1 for an exact match of every query word
+}
+
+// FuzzyAlbum is an album found by a fuzzy search.
+type FuzzyAlbum struct {
+	Album
+	Score float64 `json:"score" example:"0.89"`
+}
+
+// FuzzyArtist is an artist found by a fuzzy search.
+type FuzzyArtist struct {
+	Artist
+	Score float64 `json:"score" example:"0.89"`
+}
+
+// foldText lower-cases s and strips its diacritics, so "Motörhead" becomes "motorhead".
+func foldText(s string) string {
+	t := transform.Chain(norm.NFD, runes.Remove(runes.In(unicode.Mn)), norm.NFC)
+	folded, _, err := transform.String(t, s)
+	if err != nil {
+		folded = s
+	}
+	return strings.ToLower(folded)
+}
+
+// fuzzyQuery is a query prepared for scoring and for the trigram index.
+type fuzzyQuery struct {
+	words     [][]rune // Folded query words
+	trigrams  string   // FTS5 query matching any trigram of the words, "" if all are shorter
+	substring string   // LIKE pattern used instead when there are no trigrams
+	threshold float64
+}
+
+// newFuzzyQuery prepares text for a fuzzy search. It returns nil if text has no words.
+func newFuzzyQuery(text string, threshold float64) *fuzzyQuery {
+	q := &fuzzyQuery{threshold: threshold}
+	var trigrams []string
+	seen := make(map[string]bool)
+	for _, word := range words(foldText(text)) {
+		r := []rune(word)
+		q.words = append(q.words, r)
+		for i := 0; i+3 <= len(r); i++ {
+			tri := string(r[i : i+3])
+			if !seen[tri] {
+				seen[tri] = true
+				trigrams = append(trigrams, `"`+tri+`"`)
+			}
+		}
+	}
+	if len(q.words) == 0 {
+		return nil
+	}
+	q.trigrams = strings.Join(trigrams, " OR ")
+	q.substring = "%" + strings.TrimSpace(text) + "%"
+	return q
+}
+
+// score returns how well fields match the query, from 0 to 1: the average over query
+// words of their best similarity to any word of the fields. It returns 0 unless every
+// query word reaches the threshold.
+func (q *fuzzyQuery) score(fields ...string) float64 {
+	var candidates [][]rune
+	for _, field := range fields {
+		for _, word := range words(foldText(field)) {
+			candidates = append(candidates, []rune(word))
+		}
+	}
+
+	total := 0.0
+	for _, qw := range q.words {
+		best := 0.0
+		for _, cw := range candidates {
+			if s := wordSimilarity(qw, cw, q.threshold); s > best {
+				best = s
+			}
+		}
+		if best < q.threshold {
+			return 0
+		}
+		total += best
+	}
+	return total / float64(len(q.words))
+}
+
+// wordSimilarity is one minus the edit distance between q and w relative to the longer
+// word, or the penalised similarity of q to the start of w if that is higher. Scores
+// below threshold are reported as 0 without computing them in full.
+func wordSimilarity(q, w []rune, threshold float64) float64 {
+	similarity := func(a, b []rune, scale float64) float64 {
+		longest := max(len(a), len(b))
+		if longest == 0 {
+			return 0
+		}
+		// The largest distance that can still reach the threshold; the epsilon keeps
+		// rounding from costing a whole edit
+		bound := int((1-threshold/scale)*float64(longest) + 1e-9)
+		d := boundedLevenshtein(a, b, bound)
+		if d > bound {
+			return 0
+		}
+		return scale * (1 - float64(d)/float64(longest))
+	}
+
+	best := similarity(q, w, 1)
+	if len(w) > len(q) && best < 1 {
+		best = max(best, similarity(q, w[:len(q)], prefixPenalty))
+	}
+	return best
+}
+
+// boundedLevenshtein returns the edit distance between a and b, or bound+1 as soon as it
+// is known to exceed bound.
+func boundedLevenshtein(a, b []rune, bound int) int {
+	if diff := len(a) - len(b); diff > bound || -diff > bound {
+		return bound + 1
+	}
+
+	prev := make([]int, len(b)+1)
+	curr := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		curr[0] = i
+		rowMin := curr[0]
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			curr[j] = min(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+			rowMin = min(rowMin, curr[j])
+		}
+		if rowMin > bound {
+			return bound + 1
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(b)]
+}
+
+// candidateQuery returns the WHERE and ORDER BY clauses, and the arguments, that select
+// rows of a trigram table sharing the most trigrams with q, or, for queries without
+// trigrams, rows whose columns contain the query text.
+func (q *fuzzyQuery) candidateQuery(table string, columns ...string) (string, []any) {
+	if q.trigrams != "" {
+		return table + " MATCH ? ORDER BY rank", []any{q.trigrams}
+	}
+	conds := make([]string, len(columns))
+	args := make([]any, len(columns))
+	for i, column := range columns {
+		conds[i] = table + "." + column + " LIKE ?"
+		args[i] = q.substring
+	}
+	return strings.Join(conds, " OR "), args
+}
+
+// FuzzySearchTracks returns up to limit tracks whose title, artists and album match every
+// word of query with at least the given similarity, tolerating typos, ordered by score.
+func (db *DB) FuzzySearchTracks(query string, threshold float64, limit int) ([]FuzzyTrack, error) {
+	q := newFuzzyQuery(query, threshold)
+	if q == nil {
+		return nil, nil
+	}
+	where, args := q.candidateQuery("tracks_trigram", "title", "artists", "album")
+	rows, err := db.conn.Query(`
+		SELECT ts.track_id, ts.title, ts.artists, ts.album
+		FROM tracks_trigram JOIN track_search ts ON ts.id = tracks_trigram.rowid
+		WHERE `+where+` LIMIT ?`, append(args, fuzzyCandidateLimit)...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query fuzzy track candidates: %w", err)
+	}
+	defer rows.Close()
+
+	scores := make(map[string]float64)
+	var ids []string
+	for rows.Next() {
+		var id, title, artists, album string
+		if err := rows.Scan(&id, &title, &artists, &album); err != nil {
+			return nil, fmt.Errorf("failed to scan fuzzy track candidate: %w", err)
+		}
+		// A title match counts for more than the same match on an artist or the album
+		score := max(q.score(title), 0.95*q.score(title, artists, album))
+		if score > 0 {
+			scores[id] = score
+			ids = append(ids, id)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read fuzzy track candidates: %w", err)
+	}
+	rows.Close()
+
+	sort.SliceStable(ids, func(i, j int) bool { return scores[ids[i]] > scores[ids[j]] })
+	if len(ids) > limit {
+		ids = ids[:limit]
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(ids)), ", ")
+	args = make([]any, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	tracks, err := db.queryTracks(`SELECT `+trackColumns+` FROM audio_files WHERE human_hash_id IN (`+placeholders+`)`, args...)
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[string]Track, len(tracks))
+	for _, t := range tracks {
+		byID[t.ID] = t
+	}
+	results := make([]FuzzyTrack, 0, len(ids))
+	for _, id := range ids {
+		if t, ok := byID[id]; ok {
+			results = append(results, FuzzyTrack{Track: t, Score: scores[id]})
+		}
+	}
+	return results, nil
+}
+
+// FuzzySearchAlbums returns up to limit albums whose title and album artist match every
+// word of query with at least the given similarity, ordered by score.
+func (db *DB) FuzzySearchAlbums(query string, threshold float64, limit int) ([]FuzzyAlbum, error) {
+	q := newFuzzyQuery(query, threshold)
+	if q == nil {
+		return nil, nil
+	}
+	// Albums are scored on their artist too, so candidates also come from the artists
+	// sharing trigrams with the query
+	titleWhere, args := q.candidateQuery("albums_trigram", "title")
+	artistWhere, artistArgs := q.candidateQuery("artists_trigram", "name")
+	args = append(append(append(args, fuzzyCandidateLimit), artistArgs...), fuzzyCandidateLimit, fuzzyCandidateLimit)
+	rows, err := db.conn.Query(`
+		SELECT `+albumColumns+` FROM albums al JOIN artists ar ON ar.id = al.artist_id
+		WHERE al.id IN (SELECT rowid FROM albums_trigram WHERE `+titleWhere+` LIMIT ?)
+			OR al.artist_id IN (SELECT rowid FROM artists_trigram WHERE `+artistWhere+` LIMIT ?)
+		LIMIT ?`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query fuzzy album candidates: %w", err)
+	}
+	defer rows.Close()
+
+	var results []FuzzyAlbum
+	for rows.Next() {
+		a, err := scanAlbum(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan fuzzy album candidate: %w", err)
+		}
+		if score := max(q.score(a.Title), 0.95*q.score(a.Title, a.ArtistName)); score > 0 {
+			results = append(results, FuzzyAlbum{Album: a, Score: score})
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read fuzzy album candidates: %w", err)
+	}
+
+	sort.SliceStable(results, func(i, j int) bool { return results[i].Score > results[j].Score })
+	if len(results) > limit {
+		results = results[:limit]
+	}
+	return results, nil
+}
+
+// FuzzySearchArtists returns up to limit artists whose name matches every word of query
+// with at least the given similarity, ordered by score.
+func (db *DB) FuzzySearchArtists(query string, threshold float64, limit int) ([]FuzzyArtist, error) {
+	q := newFuzzyQuery(query, threshold)
+	if q == nil {
+		return nil, nil
+	}
+	where, args := q.candidateQuery("artists_trigram", "name")
+	rows, err := db.conn.Query(`
+		SELECT ar.id, ar.name FROM artists_trigram JOIN artists ar ON ar.id = artists_trigram.rowid
+		WHERE `+where+` LIMIT ?`, append(args, fuzzyCandidateLimit)...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query fuzzy artist candidates: %w", err)
+	}
+	defer rows.Close()
+
+	var results []FuzzyArtist
+	for rows.Next() {
+		var a Artist
+		if err := rows.Scan(&a.ID, &a.Name); err != nil {
+			return nil, fmt.Errorf("failed to scan fuzzy artist candidate: %w", err)
+		}
+		if score := q.score(a.Name); score > 0 {
+			results = append(results, FuzzyArtist{Artist: a, Score: score})
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read fuzzy artist candidates: %w", err)
+	}
+
+	sort.SliceStable(results, func(i, j int) bool { return results[i].Score > results[j].Score })
+	if len(results) > limit {
+		results = results[:limit]
+	}
+	return results, nil
+}
@@ -0,0 +1,118 @@
+package library
+
+import (
+	"sort"
+	"testing"
+)
+
+// addFuzzyLibrary adds a few tracks whose names are easy to misspell, credited to their
+// artist as the indexer does.
+func addFuzzyLibrary(t *testing.T, db *DB) {
+	t.Helper()
+	for _, af := range []AudioFile{
+		{HumanHashID: "enter", Title: "Enter Sandman", ArtistName: "Metallica", AlbumTitle: "Metallica"},
+		{HumanHashID: "master", Title: "Master of Puppets", ArtistName: "Metallica", AlbumTitle: "Master of Puppets"},
+		{HumanHashID: "ace", Title: "Ace of Spades", ArtistName: "Motörhead", AlbumTitle: "Ace of Spades"},
+		{HumanHashID: "metal", Title: "Metal Health", ArtistName: "Quiet Riot", AlbumTitle: "Metal Health"},
+		{HumanHashID: "paranoid", Title: "Paranoid", ArtistName: "Black Sabbath", AlbumTitle: "Paranoid"},
+	} {
+		af.FilePath = "/music/" + af.HumanHashID + ".flac"
+		af, _ = addTrack(t, db, af)
+		credits := []ArtistCredit{{ArtistID: af.ArtistID, Name: af.ArtistName, Role: RoleMain}}
+		if err := db.SetTrackArtists(af.HumanHashID, credits); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestFuzzySearchTracks(t *testing.T) {
+	db := openTestDB(t)
+	addFuzzyLibrary(t, db)
+
+	for _, tc := range []struct {
+		query string
+		want  []string // Every match, best first
+	}{
+		{"metalica", []string{"enter", "master"}},       // A missing letter, on the artist
+		{"motorhead", []string{"ace"}},                  // Diacritics are ignored
+		{"Enter Sandmann", []string{"enter"}},           // Typos in every word
+		{"metal", []string{"metal", "enter", "master"}}, // A whole word beats a prefix
+		{"xyzzy", nil},
+	} {
+		results, err := db.FuzzySearchTracks(tc.query, DefaultFuzzyThreshold, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, r := range results {
+			got = append(got, r.ID)
+		}
+		if len(got) != len(tc.want) {
+			t.Errorf("%q found %v, want %v", tc.query, got, tc.want)
+			continue
+		}
+		for i := range got {
+			// Tracks with equal scores may come in any order
+			if got[i] != tc.want[i] && results[i].Score != results[0].Score {
+				t.Errorf("%q found %v, want %v", tc.query, got, tc.want)
+				break
+			}
+		}
+		if !sort.SliceIsSorted(results, func(i, j int) bool { return results[i].Score > results[j].Score }) {
+			t.Errorf("%q results are not ordered by score: %+v", tc.query, results)
+		}
+	}
+}
+
+func TestFuzzySearchTracksScores(t *testing.T) {
+	db := openTestDB(t)
+	addFuzzyLibrary(t, db)
+	results, err := db.FuzzySearchTracks("paranoid", DefaultFuzzyThreshold, 10)
+	if err != nil || len(results) != 1 || results[0].Score != 1 {
+		t.Fatalf("exact title: %+v, %v; want one result scoring 1", results, err)
+	}
+	results, err = db.FuzzySearchTracks("paranod", DefaultFuzzyThreshold, 10)
+	if err != nil || len(results) != 1 || results[0].Score >= 1 || results[0].Score < DefaultFuzzyThreshold {
+		t.Errorf("misspelt title: %+v, %v; want one result scoring below 1", results, err)
+	}
+	if results, err := db.FuzzySearchTracks("paranod", 0.95, 10); err != nil || len(results) != 0 {
+		t.Errorf("misspelt title above a strict threshold: %+v, %v; want none", results, err)
+	}
+}
+
+func TestFuzzySearchAlbumsByArtist(t *testing.T) {
+	db := openTestDB(t)
+	addFuzzyLibrary(t, db)
+
+	// Neither title of the albums of Metallica shares the query's trigrams but one
+	results, err := db.FuzzySearchAlbums("metalica", DefaultFuzzyThreshold, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	titles := make(map[string]bool)
+	for _, r := range results {
+		titles[r.Title] = true
+	}
+	if len(results) != 2 || !titles["Metallica"] || !titles["Master of Puppets"] {
+		t.Errorf("albums of metalica = %+v, want Metallica and Master of Puppets", results)
+	}
+	// The album named like the query beats the one only its artist matches
+	if len(results) == 2 && (results[0].Title != "Metallica" || results[0].Score <= results[1].Score) {
+		t.Errorf("albums of metalica are not ordered by score: %+v", results)
+	}
+
+	if results, err := db.FuzzySearchAlbums("motorhead", DefaultFuzzyThreshold, 10); err != nil || len(results) != 1 || results[0].Title != "Ace of Spades" {
+		t.Errorf("albums of motorhead = %+v, %v; want Ace of Spades", results, err)
+	}
+}
+
+func TestFuzzySearchArtists(t *testing.T) {
+	db := openTestDB(t)
+	addFuzzyLibrary(t, db)
+	for query, want := range map[string]string{"metalica": "Metallica", "motorhead": "Motörhead", "blak sabath": "Black Sabbath"} {
+		results, err := db.FuzzySearchArtists(query, DefaultFuzzyThreshold, 10)
+		if err != nil || len(results) == 0 || results[0].Name != want {
+			t.Errorf("%q found %+v, %v; want %s first", query, results, err, want)
+		}
+	}
+}
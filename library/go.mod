@@ -0,0 +1,8 @@
+module heavymetal/library
+
+go 1.24.3
+
+require (
+	github.com/mattn/go-sqlite3 v1.14.28
+	golang.org/x/text v0.23.0
+)
@@ -0,0 +1,527 @@
+package library
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// The methods in this file are used by the indexer to write the library. Each exported
+// method runs on its own; Writer batches the same statements into transactions.
+
+// querier is implemented by *sql.DB and *sql.Tx, so the statements below can run in
+// either.
+type querier interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	Query(query string, args ...any) (*sql.Rows, error)
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// GetOrInsertArtist retrieves an artist's ID or inserts a new artist if not found.
+func (db *DB) GetOrInsertArtist(name string) (int, error) {
+	// Acquire mutex for database write operations
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return getOrInsertArtist(db.conn, name)
+}
+
+func getOrInsertArtist(q querier, name string) (int, error) {
+	var id int
+	// Try to get existing artist
+	err := q.QueryRow("SELECT id FROM artists WHERE name = ? COLLATE NOCASE", name).Scan(&id)
+	if err == nil {
+		return id, nil // Artist found
+	}
+	if err != sql.ErrNoRows {
+		return 0, fmt.Errorf("failed to query artist: %w", err)
+	}
+
+	// Artist not found, insert new one
+	res, err := q.Exec("INSERT INTO artists (name) VALUES (?)", name)
+	if err != nil {
+		// Handle potential race condition if another goroutine inserted it between check and insert
+		if sqliteErr, ok := err.(sqlite3.Error); ok && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique {
+			// Try to get again if it was a unique constraint error
+			err = q.QueryRow("SELECT id FROM artists WHERE name = ? COLLATE NOCASE", name).Scan(&id)
+			if err == nil {
+				return id, nil
+			}
+		}
+		return 0, fmt.Errorf("failed to insert artist: %w", err)
+	}
+	lastID, err := res.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get last inserted artist ID: %w", err)
+	}
+	return int(lastID), nil
+}
+
+// GetOrInsertAlbum retrieves an album's ID or inserts a new album if not found.
+// Albums are keyed on their title and album artist. An existing album is marked as a
+// compilation as soon as one of its tracks says so.
+func (db *DB) GetOrInsertAlbum(title string, albumArtistID int, releaseYear int, compilation bool) (int, error) {
+	// Acquire mutex for database write operations
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return getOrInsertAlbum(db.conn, title, albumArtistID, releaseYear, compilation)
+}
+
+func getOrInsertAlbum(q querier, title string, albumArtistID int, releaseYear int, compilation bool) (int, error) {
+	var id int
+	err := q.QueryRow("SELECT id FROM albums WHERE title = ? COLLATE NOCASE AND artist_id = ?", title, albumArtistID).Scan(&id)
+	if err == nil {
+		if compilation {
+			if _, err := q.Exec("UPDATE albums SET compilation = 1 WHERE id = ? AND compilation = 0", id); err != nil {
+				return 0, fmt.Errorf("failed to mark album as compilation: %w", err)
+			}
+		}
+		return id, nil
+	}
+	if err != sql.ErrNoRows {
+		return 0, fmt.Errorf("failed to query album: %w", err)
+	}
+
+	// Album not found, insert new one
+	res, err := q.Exec("INSERT INTO albums (title, artist_id, release_year, compilation) VALUES (?, ?, ?, ?)", title, albumArtistID, releaseYear, compilation)
+	if err != nil {
+		if sqliteErr, ok := err.(sqlite3.Error); ok && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique {
+			err = q.QueryRow("SELECT id FROM albums WHERE title = ? COLLATE NOCASE AND artist_id = ?", title, albumArtistID).Scan(&id)
+			if err == nil {
+				return id, nil
+			}
+		}
+		return 0, fmt.Errorf("failed to insert album: %w", err)
+	}
+	lastID, err := res.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get last inserted album ID: %w", err)
+	}
+	return int(lastID), nil
+}
+
+// GetOrInsertGenre retrieves a genre's ID or inserts a new genre if not found.
+func (db *DB) GetOrInsertGenre(name string) (int, error) {
+	if name == "" { // Handle empty genre gracefully
+		return 0, nil
+	}
+	// Acquire mutex for database write operations
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return getOrInsertGenre(db.conn, name)
+}
+
+func getOrInsertGenre(q querier, name string) (int, error) {
+	var id int
+	err := q.QueryRow("SELECT id FROM genres WHERE name = ? COLLATE NOCASE", name).Scan(&id)
+	if err == nil {
+		return id, nil
+	}
+	if err != sql.ErrNoRows {
+		return 0, fmt.Errorf("failed to query genre: %w", err)
+	}
+
+	// Genre not found, insert new one
+	res, err := q.Exec("INSERT INTO genres (name) VALUES (?)", name)
+	if err != nil {
+		if sqliteErr, ok := err.(sqlite3.Error); ok && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique {
+			err = q.QueryRow("SELECT id FROM genres WHERE name = ? COLLATE NOCASE", name).Scan(&id)
+			if err == nil {
+				return id, nil
+			}
+		}
+		return 0, fmt.Errorf("failed to insert genre: %w", err)
+	}
+	lastID, err := res.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get last inserted genre ID: %w", err)
+	}
+	return int(lastID), nil
+}
+
+// LoadFileStates returns the recorded size and modification time of every indexed file, keyed by path.
+func (db *DB) LoadFileStates() (map[string]FileState, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	rows, err := db.conn.Query("SELECT file_path, file_size, file_mtime_ns, fingerprint IS NULL OR codec IS NULL FROM audio_files")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query file states: %w", err)
+	}
+	defer rows.Close()
+
+	states := make(map[string]FileState)
+	for rows.Next() {
+		var path string
+		var size, modTime sql.NullInt64 // NULL for rows indexed before these columns existed
+		var incomplete bool
+		if err := rows.Scan(&path, &size, &modTime, &incomplete); err != nil {
+			return nil, fmt.Errorf("failed to scan file state: %w", err)
+		}
+		if incomplete {
+			// Re-read once so the record gains a fingerprint, which lets it be followed
+			// across moves, and its stream properties
+			size, modTime = sql.NullInt64{}, sql.NullInt64{}
+		}
+		states[path] = FileState{Size: size.Int64, ModTime: modTime.Int64}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read file states: %w", err)
+	}
+	return states, nil
+}
+
+// GetOrInsertArtwork retrieves the ID of the artwork with the given content hash or
+// records a new one stored at filePath.
+func (db *DB) GetOrInsertArtwork(hash, mimeType, filePath string) (int, error) {
+	// Acquire mutex for database write operations
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return getOrInsertArtwork(db.conn, hash, mimeType, filePath)
+}
+
+func getOrInsertArtwork(q querier, hash, mimeType, filePath string) (int, error) {
+	var id int
+	err := q.QueryRow("SELECT id FROM artwork WHERE hash = ?", hash).Scan(&id)
+	if err == nil {
+		return id, nil
+	}
+	if err != sql.ErrNoRows {
+		return 0, fmt.Errorf("failed to query artwork: %w", err)
+	}
+
+	res, err := q.Exec("INSERT INTO artwork (hash, mime_type, file_path) VALUES (?, ?, ?)", hash, mimeType, filePath)
+	if err != nil {
+		return 0, fmt.Errorf("failed to insert artwork: %w", err)
+	}
+	lastID, err := res.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get last inserted artwork ID: %w", err)
+	}
+	return int(lastID), nil
+}
+
+// SetAlbumArtworkIfMissing links an album to artwork unless it already has some.
+func (db *DB) SetAlbumArtworkIfMissing(albumID, artworkID int) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return setAlbumArtworkIfMissing(db.conn, albumID, artworkID)
+}
+
+func setAlbumArtworkIfMissing(q querier, albumID, artworkID int) error {
+	if _, err := q.Exec("UPDATE albums SET artwork_id = ? WHERE id = ? AND artwork_id IS NULL", artworkID, albumID); err != nil {
+		return fmt.Errorf("failed to set artwork for album %d: %w", albumID, err)
+	}
+	return nil
+}
+
+// SaveOutcome describes what UpsertAudioFile did with a record.
+type SaveOutcome int
+
+const (
+	SaveSkipped  SaveOutcome = iota // Human hash ID already belongs to another file
+	SaveInserted                    // New file with a new ID
+	SaveUpdated                     // Existing path whose tags or audio changed
+	SaveMoved                       // Known audio found at a new path; path updated, ID kept
+)
+
+// audioFileUpdate sets every mutable column of an audio_files row; callers append the WHERE clause.
+const audioFileUpdate = `
+	UPDATE audio_files
+	SET file_path = ?, title = ?, duration_seconds = ?, lossless = ?, track_number = ?, disc_number = ?, year = ?,
+		artist_id = ?, album_id = ?, genre_id = ?, file_size = ?, file_mtime_ns = ?, fingerprint = ?, artwork_id = ?,
+		codec = ?, container = ?, bitrate = ?, sample_rate = ?, bit_depth = ?, channels = ?
+`
+
+// updateArgs returns the arguments for audioFileUpdate followed by extra WHERE arguments.
+func (af *AudioFile) updateArgs(where ...any) []any {
+	args := []any{af.FilePath, af.Title, af.DurationSeconds, af.Lossless, af.TrackNumber, af.DiscNumber, af.Year,
+		af.ArtistID, af.AlbumID, sql.NullInt64{Int64: int64(af.GenreID), Valid: af.GenreID != 0},
+		af.FileSize, af.FileModTime, sql.NullString{String: af.Fingerprint, Valid: af.Fingerprint != ""},
+		sql.NullInt64{Int64: int64(af.ArtworkID), Valid: af.ArtworkID != 0},
+		af.Codec, af.Container, af.Bitrate, af.SampleRate, af.BitDepth, af.Channels}
+	return append(args, where...)
+}
+
+// UpsertAudioFile inserts an audio file record, or updates an existing one in place so
+// its human hash ID stays stable: either the record for the same path, or the record of
+// a file with the same audio fingerprint whose old path no longer exists (a move).
+// When an existing record is updated af.HumanHashID is set to the preserved ID.
+func (db *DB) UpsertAudioFile(af *AudioFile) (SaveOutcome, error) {
+	// Acquire mutex for database write operations
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	outcome, err := upsertAudioFile(db.conn, af)
+	if err != nil || outcome == SaveSkipped {
+		return outcome, err
+	}
+	return outcome, indexTrack(db.conn, af.HumanHashID)
+}
+
+func upsertAudioFile(q querier, af *AudioFile) (SaveOutcome, error) {
+	var existingID string
+	err := q.QueryRow(audioFileUpdate+"WHERE file_path = ? RETURNING human_hash_id", af.updateArgs(af.FilePath)...).Scan(&existingID)
+	if err == nil {
+		af.HumanHashID = existingID // Edited tags change the computed hash, but the ID must not
+		return SaveUpdated, nil
+	}
+	if err != sql.ErrNoRows {
+		return SaveSkipped, fmt.Errorf("failed to update audio file %s: %w", af.FilePath, err)
+	}
+
+	// New path: it may be a file we already know that was moved or renamed
+	movedID, oldPath, err := findMovedFile(q, af.Fingerprint)
+	if err != nil {
+		return SaveSkipped, err
+	}
+	if movedID != "" {
+		if _, err := q.Exec(audioFileUpdate+"WHERE human_hash_id = ?", af.updateArgs(movedID)...); err != nil {
+			return SaveSkipped, fmt.Errorf("failed to move audio file %s to %s: %w", oldPath, af.FilePath, err)
+		}
+		log.Printf("Detected move of %s to %s (keeping ID %s)", oldPath, af.FilePath, movedID)
+		af.HumanHashID = movedID
+		return SaveMoved, nil
+	}
+
+	// New file: make sure its human hash ID does not collide with another path
+	var existingPath string
+	err = q.QueryRow("SELECT file_path FROM audio_files WHERE human_hash_id = ?", af.HumanHashID).Scan(&existingPath)
+	if err == nil {
+		log.Printf("Skipping audio file %s: human hash %s already belongs to %s", af.FilePath, af.HumanHashID, existingPath)
+		return SaveSkipped, nil
+	}
+	if err != sql.ErrNoRows {
+		return SaveSkipped, fmt.Errorf("failed to check for existing audio file: %w", err)
+	}
+
+	_, err = q.Exec(`
+		INSERT INTO audio_files (human_hash_id, file_path, title, duration_seconds, lossless, track_number, disc_number, year, artist_id, album_id, genre_id, file_size, file_mtime_ns, fingerprint, artwork_id,
+			codec, container, bitrate, sample_rate, bit_depth, channels, added_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, append(append([]any{af.HumanHashID}, af.updateArgs()...), time.Now().Unix())...)
+	if err != nil {
+		return SaveSkipped, fmt.Errorf("failed to insert audio file %s: %w", af.FilePath, err)
+	}
+	return SaveInserted, nil
+}
+
+// findMovedFile returns the ID and path of an indexed file with the given fingerprint
+// whose path no longer exists on disk, or an empty ID if there is none. Copies of a file
+// that still exists are not moves and get their own record.
+func findMovedFile(q querier, fingerprint string) (string, string, error) {
+	if fingerprint == "" {
+		return "", "", nil
+	}
+	rows, err := q.Query("SELECT human_hash_id, file_path FROM audio_files WHERE fingerprint = ?", fingerprint)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to query fingerprint: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id, path string
+		if err := rows.Scan(&id, &path); err != nil {
+			return "", "", fmt.Errorf("failed to scan fingerprint match: %w", err)
+		}
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			return id, path, nil
+		}
+	}
+	return "", "", rows.Err()
+}
+
+// SetTrackArtists replaces the artist credits of a track. Credits must have their ArtistID set.
+func (db *DB) SetTrackArtists(trackID string, credits []ArtistCredit) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin track artists transaction: %w", err)
+	}
+	defer tx.Rollback() // No-op once committed
+
+	if err := setTrackArtists(tx, trackID, credits); err != nil {
+		return err
+	}
+	if err := indexTrack(tx, trackID); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit track artists: %w", err)
+	}
+	return nil
+}
+
+func setTrackArtists(q querier, trackID string, credits []ArtistCredit) error {
+	if _, err := q.Exec("DELETE FROM track_artists WHERE track_id = ?", trackID); err != nil {
+		return fmt.Errorf("failed to clear artists of track %s: %w", trackID, err)
+	}
+	for pos, credit := range credits {
+		_, err := q.Exec("INSERT OR IGNORE INTO track_artists (track_id, artist_id, role, position) VALUES (?, ?, ?, ?)",
+			trackID, credit.ArtistID, credit.Role, pos)
+		if err != nil {
+			return fmt.Errorf("failed to credit artist %q on track %s: %w", credit.Name, trackID, err)
+		}
+	}
+	return nil
+}
+
+// SetTrackGenres replaces the genres of a track, keeping their order.
+func (db *DB) SetTrackGenres(trackID string, genreIDs []int) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin track genres transaction: %w", err)
+	}
+	defer tx.Rollback() // No-op once committed
+
+	if err := setTrackGenres(tx, trackID, genreIDs); err != nil {
+		return err
+	}
+	if err := indexTrack(tx, trackID); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit track genres: %w", err)
+	}
+	return nil
+}
+
+func setTrackGenres(q querier, trackID string, genreIDs []int) error {
+	if _, err := q.Exec("DELETE FROM track_genres WHERE track_id = ?", trackID); err != nil {
+		return fmt.Errorf("failed to clear genres of track %s: %w", trackID, err)
+	}
+	for pos, genreID := range genreIDs {
+		_, err := q.Exec("INSERT OR IGNORE INTO track_genres (track_id, genre_id, position) VALUES (?, ?, ?)",
+			trackID, genreID, pos)
+		if err != nil {
+			return fmt.Errorf("failed to add genre %d to track %s: %w", genreID, trackID, err)
+		}
+	}
+	return nil
+}
+
+// FilePathsUnder returns the indexed file paths that live inside dir.
+func (db *DB) FilePathsUnder(dir string) ([]string, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	prefix := strings.TrimSuffix(dir, string(filepath.Separator)) + string(filepath.Separator)
+	rows, err := db.conn.Query("SELECT file_path FROM audio_files WHERE substr(file_path, 1, length(?)) = ?", prefix, prefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query files under %s: %w", dir, err)
+	}
+	defer rows.Close()
+
+	var paths []string
+	for rows.Next() {
+		var path string
+		if err := rows.Scan(&path); err != nil {
+			return nil, fmt.Errorf("failed to scan file path: %w", err)
+		}
+		paths = append(paths, path)
+	}
+	return paths, rows.Err()
+}
+
+// PruneResult counts the rows removed by PruneAudioFiles.
+type PruneResult struct {
+	Tracks  int64
+	Albums  int64
+	Artists int64
+	Genres  int64
+	Artwork int64
+	// Cached image files of the removed artwork, for the caller to delete from disk
+	ArtworkFiles []string
+}
+
+// PruneAudioFiles deletes the records for the given file paths and then garbage-collects
+// albums, artists, genres and artwork that are no longer referenced, all in one transaction.
+func (db *DB) PruneAudioFiles(paths []string) (PruneResult, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var result PruneResult
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return result, fmt.Errorf("failed to begin prune transaction: %w", err)
+	}
+	defer tx.Rollback() // No-op once committed
+
+	stmt, err := tx.Prepare("DELETE FROM audio_files WHERE file_path = ? RETURNING human_hash_id")
+	if err != nil {
+		return result, fmt.Errorf("failed to prepare audio file delete: %w", err)
+	}
+	defer stmt.Close()
+	for _, path := range paths {
+		var trackID string
+		err := stmt.QueryRow(path).Scan(&trackID)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return result, fmt.Errorf("failed to delete audio file %s: %w", path, err)
+		}
+		if _, err := tx.Exec("DELETE FROM track_artists WHERE track_id = ?", trackID); err != nil {
+			return result, fmt.Errorf("failed to delete artist credits of %s: %w", path, err)
+		}
+		if _, err := tx.Exec("DELETE FROM track_genres WHERE track_id = ?", trackID); err != nil {
+			return result, fmt.Errorf("failed to delete genres of %s: %w", path, err)
+		}
+		result.Tracks++
+	}
+
+	// Albums go first so that artists only referenced by an orphaned album are collected too
+	orphans := []struct {
+		count *int64
+		query string
+	}{
+		{&result.Albums, "DELETE FROM albums WHERE id NOT IN (SELECT album_id FROM audio_files)"},
+		{&result.Artists, "DELETE FROM artists WHERE id NOT IN (SELECT artist_id FROM audio_files) AND id NOT IN (SELECT artist_id FROM albums) AND id NOT IN (SELECT artist_id FROM track_artists)"},
+		{&result.Genres, "DELETE FROM genres WHERE id NOT IN (SELECT genre_id FROM audio_files WHERE genre_id IS NOT NULL) AND id NOT IN (SELECT genre_id FROM track_genres)"},
+	}
+	for _, o := range orphans {
+		res, err := tx.Exec(o.query)
+		if err != nil {
+			return result, fmt.Errorf("failed to remove orphaned rows: %w", err)
+		}
+		*o.count, _ = res.RowsAffected()
+	}
+
+	rows, err := tx.Query(`
+		DELETE FROM artwork
+		WHERE id NOT IN (SELECT artwork_id FROM audio_files WHERE artwork_id IS NOT NULL)
+			AND id NOT IN (SELECT artwork_id FROM albums WHERE artwork_id IS NOT NULL)
+		RETURNING file_path
+	`)
+	if err != nil {
+		return result, fmt.Errorf("failed to remove orphaned artwork: %w", err)
+	}
+	for rows.Next() {
+		var path string
+		if err := rows.Scan(&path); err != nil {
+			rows.Close()
+			return result, fmt.Errorf("failed to scan orphaned artwork: %w", err)
+		}
+		result.ArtworkFiles = append(result.ArtworkFiles, path)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return result, fmt.Errorf("failed to remove orphaned artwork: %w", err)
+	}
+	result.Artwork = int64(len(result.ArtworkFiles))
+
+	if err := tx.Commit(); err != nil {
+		return result, fmt.Errorf("failed to commit prune transaction: %w", err)
+	}
+	return result, nil
+}
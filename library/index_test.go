@@ -0,0 +1,124 @@
+package library
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUpsertAudioFileInsertAndUpdate(t *testing.T) {
+	db := openTestDB(t)
+	af, outcome := addTrack(t, db, AudioFile{HumanHashID: "red-fox", FilePath: "/music/a.flac", Title: "Old", Lossless: true,
+		FileSize: 100, FileModTime: 1, Fingerprint: "aaa", Codec: "flac", DurationSeconds: 200})
+	if outcome != SaveInserted {
+		t.Fatalf("first save = %v, want SaveInserted", outcome)
+	}
+
+	// Editing the tags changes the hash the indexer computes, but not the track's ID
+	af, outcome = addTrack(t, db, AudioFile{HumanHashID: "blue-cat", FilePath: "/music/a.flac", Title: "New", Lossless: true,
+		FileSize: 120, FileModTime: 2, Fingerprint: "aaa", Codec: "flac", DurationSeconds: 200})
+	if outcome != SaveUpdated || af.HumanHashID != "red-fox" {
+		t.Fatalf("second save = %v with ID %q, want SaveUpdated with red-fox", outcome, af.HumanHashID)
+	}
+	track, err := db.Track("red-fox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if track.Title != "New" || track.Codec != "flac" || !track.Lossless {
+		t.Errorf("track = %+v", track)
+	}
+	if _, err := db.Track("blue-cat"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Track(blue-cat): err = %v, want ErrNotFound", err)
+	}
+
+	states, err := db.LoadFileStates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := states["/music/a.flac"]; s.Size != 120 || s.ModTime != 2 {
+		t.Errorf("file state = %+v, want size 120 and mtime 2", s)
+	}
+}
+
+func TestUpsertAudioFileMove(t *testing.T) {
+	db := openTestDB(t)
+	dir := t.TempDir()
+	oldPath, newPath := filepath.Join(dir, "old.mp3"), filepath.Join(dir, "new.mp3")
+	addTrack(t, db, AudioFile{HumanHashID: "kept-id", FilePath: oldPath, Title: "Song", Fingerprint: "fp"})
+
+	// The old path does not exist, so a file with the same audio elsewhere is a move
+	af, outcome := addTrack(t, db, AudioFile{HumanHashID: "other-id", FilePath: newPath, Title: "Song", Fingerprint: "fp"})
+	if outcome != SaveMoved || af.HumanHashID != "kept-id" {
+		t.Fatalf("save at new path = %v with ID %q, want SaveMoved with kept-id", outcome, af.HumanHashID)
+	}
+	track, err := db.Track("kept-id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if track.FilePath != newPath {
+		t.Errorf("path = %q, want %q", track.FilePath, newPath)
+	}
+
+	// A copy of a file that still exists gets a record of its own
+	if err := os.WriteFile(newPath, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	copyPath := filepath.Join(dir, "copy.mp3")
+	af, outcome = addTrack(t, db, AudioFile{HumanHashID: "copy-id", FilePath: copyPath, Title: "Song", Fingerprint: "fp"})
+	if outcome != SaveInserted || af.HumanHashID != "copy-id" {
+		t.Errorf("save of copy = %v with ID %q, want SaveInserted with copy-id", outcome, af.HumanHashID)
+	}
+
+	// A new file whose computed ID is taken by another path is skipped
+	if _, outcome = addTrack(t, db, AudioFile{HumanHashID: "copy-id", FilePath: filepath.Join(dir, "x.mp3"), Title: "X"}); outcome != SaveSkipped {
+		t.Errorf("save with a taken ID = %v, want SaveSkipped", outcome)
+	}
+}
+
+func TestPruneAudioFiles(t *testing.T) {
+	db := openTestDB(t)
+	artID, err := db.GetOrInsertArtwork("hash", "image/jpeg", "/art/hash.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addTrack(t, db, AudioFile{HumanHashID: "a1", FilePath: "/music/a/1.mp3", Title: "A1", ArtistName: "Alpha", AlbumTitle: "A", ArtworkID: artID})
+	addTrack(t, db, AudioFile{HumanHashID: "a2", FilePath: "/music/a/2.mp3", Title: "A2", ArtistName: "Alpha", AlbumTitle: "A"})
+	b, _ := addTrack(t, db, AudioFile{HumanHashID: "b1", FilePath: "/music/b/1.mp3", Title: "B1", ArtistName: "Beta", AlbumTitle: "B"})
+	genreID, err := db.GetOrInsertGenre("Doom")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetTrackGenres("a1", []int{genreID}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Album A keeps a track, so only the track and its artwork go
+	result, err := db.PruneAudioFiles([]string{"/music/a/1.mp3", "/music/missing.mp3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := PruneResult{Tracks: 1, Genres: 1, Artwork: 1, ArtworkFiles: []string{"/art/hash.jpg"}}
+	if result.Tracks != want.Tracks || result.Albums != 0 || result.Artists != 0 || result.Genres != want.Genres ||
+		result.Artwork != want.Artwork || len(result.ArtworkFiles) != 1 || result.ArtworkFiles[0] != want.ArtworkFiles[0] {
+		t.Errorf("first prune = %+v, want %+v", result, want)
+	}
+	if _, err := db.Track("a1"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Track(a1): err = %v, want ErrNotFound", err)
+	}
+
+	// Album B and artist Beta are left without tracks
+	result, err = db.PruneAudioFiles([]string{"/music/b/1.mp3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Tracks != 1 || result.Albums != 1 || result.Artists != 1 || result.Artwork != 0 {
+		t.Errorf("second prune = %+v, want 1 track, album and artist", result)
+	}
+	if _, err := db.Album(b.AlbumID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Album(B): err = %v, want ErrNotFound", err)
+	}
+	if _, err := db.Track("a2"); err != nil {
+		t.Errorf("Track(a2): %v", err)
+	}
+}
@@ -0,0 +1,80 @@
+// Package library is the shared access layer for the HeavyMetal music database. The
+// indexer writes through it and the hosting server reads through it, so the SQLite
+// schema and its migrations are defined in one place.
+package library
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// ErrNotFound is returned when a requested track, album, artist or genre does not exist.
+var ErrNotFound = errors.New("not found")
+
+// ErrExists is returned when creating something whose name is already taken.
+var ErrExists = errors.New("already exists")
+
+// ErrInvalidSort is returned when a listing is asked for a sort key it does not have.
+var ErrInvalidSort = errors.New("invalid sort")
+
+// DB is a music library stored in SQLite. It implements Repository.
+type DB struct {
+	conn *sql.DB
+	mu   sync.Mutex // Mutex to protect database writes from concurrent access
+}
+
+// dsnParams are applied to every connection. Foreign keys are enforced. The write-ahead
+// log lets the server read while the indexer writes, and makes a commit cheap enough
+// that synchronous=NORMAL (safe in WAL mode) is all a batch needs. Writers that find
+// the database locked wait for up to five seconds instead of failing at once.
+const dsnParams = "_foreign_keys=on&_journal_mode=WAL&_synchronous=NORMAL&_busy_timeout=5000"
+
+// Open opens the library database at path without touching its schema. Call Migrate to
+// bring the schema up to date, or CheckSchema to refuse an incompatible one.
+func Open(path string) (*DB, error) {
+	// A DSN parameter, unlike a PRAGMA, applies to every connection in the pool
+	sep := "?"
+	if strings.Contains(path, "?") {
+		sep = "&"
+	}
+	conn, err := sql.Open("sqlite3", path+sep+dsnParams)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+	if err := conn.Ping(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+	return &DB{conn: conn}, nil
+}
+
+// OpenMemory creates an empty in-memory library with the latest schema. Every call
+// returns an independent database, which makes it suitable for tests.
+func OpenMemory() (*DB, error) {
+	db, err := Open(":memory:")
+	if err != nil {
+		return nil, err
+	}
+	// Each connection to ":memory:" is a separate database, so keep exactly one open
+	db.conn.SetMaxOpenConns(1)
+	db.conn.SetMaxIdleConns(1)
+	db.conn.SetConnMaxLifetime(0)
+	if _, err := db.Migrate(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// SetMaxOpenConns limits the number of open connections.
+func (db *DB) SetMaxOpenConns(n int) {
+	db.conn.SetMaxOpenConns(n)
+}
+
+// Close closes the database connection.
+func (db *DB) Close() error {
+	return db.conn.Close()
+}
@@ -0,0 +1,69 @@
+package library
+
+import (
+	"errors"
+	"testing"
+)
+
+// openTestDB returns an empty in-memory library that is closed when the test ends.
+func openTestDB(t *testing.T) *DB {
+	t.Helper()
+	db, err := OpenMemory()
+	if err != nil {
+		t.Fatalf("OpenMemory: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// addTrack saves af the way the indexer does without a Writer, creating its artist and
+// album first, and returns the outcome.
+func addTrack(t *testing.T, db *DB, af AudioFile) (AudioFile, SaveOutcome) {
+	t.Helper()
+	if af.ArtistName == "" {
+		af.ArtistName = "Artist"
+	}
+	if af.AlbumTitle == "" {
+		af.AlbumTitle = "Album"
+	}
+	var err error
+	if af.ArtistID, err = db.GetOrInsertArtist(af.ArtistName); err != nil {
+		t.Fatal(err)
+	}
+	if af.AlbumID, err = db.GetOrInsertAlbum(af.AlbumTitle, af.ArtistID, af.Year, false); err != nil {
+		t.Fatal(err)
+	}
+	outcome, err := db.UpsertAudioFile(&af)
+	if err != nil {
+		t.Fatalf("UpsertAudioFile(%s): %v", af.FilePath, err)
+	}
+	return af, outcome
+}
+
+func TestOpenMemoryMigrates(t *testing.T) {
+	db := openTestDB(t)
+	version, err := db.SchemaVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != LatestSchemaVersion() {
+		t.Errorf("schema version = %d, want %d", version, LatestSchemaVersion())
+	}
+	if err := db.CheckSchema(); err != nil {
+		t.Errorf("CheckSchema: %v", err)
+	}
+	if pending, err := db.PendingMigrations(); err != nil || len(pending) != 0 {
+		t.Errorf("PendingMigrations = %v, %v; want none", pending, err)
+	}
+	if applied, err := db.Migrate(); err != nil || len(applied) != 0 {
+		t.Errorf("Migrate again = %v, %v; want nothing applied", applied, err)
+	}
+}
+
+func TestOpenMemoryIsIndependent(t *testing.T) {
+	a, b := openTestDB(t), openTestDB(t)
+	addTrack(t, a, AudioFile{HumanHashID: "one", FilePath: "/music/one.mp3", Title: "One"})
+	if _, err := b.Track("one"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Track in another database: err = %v, want ErrNotFound", err)
+	}
+}
@@ -0,0 +1,353 @@
+package library
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Page selects part of an ordered listing.
+type Page struct {
+	Offset int
+	Limit  int
+	// Sort names the order, one of the sort keys of the listing, or "" for its default
+	// order. A leading "-" reverses it, so "-year" lists the newest first. Entries with
+	// an unknown value for the key, such as tracks without a year, always come last.
+	Sort string
+}
+
+// TrackFilter narrows a track listing. Zero fields do not filter.
+type TrackFilter struct {
+	ArtistID int // Credited in any role, as for TracksByArtist
+	AlbumID  int
+	GenreID  int // Any genre of the track, as for TracksByGenre
+	YearFrom int // Tracks without a year never match a year range
+	YearTo   int
+	Lossless *bool
+}
+
+// AlbumFilter narrows an album listing. Zero fields do not filter.
+type AlbumFilter struct {
+	ArtistID int // Album artist
+	GenreID  int // Albums with at least one track of the genre
+	YearFrom int // Albums without a release year never match a year range
+	YearTo   int
+	Played   bool // Only albums with at least one recorded play
+}
+
+// PlaylistFilter narrows a playlist listing. Zero fields do not filter.
+type PlaylistFilter struct {
+	Owner string // Playlists of this user, ignoring case
+}
+
+// sortOrder returns the ORDER BY terms for a sort key in the given direction.
+type sortOrder func(dir string) string
+
+// Sort keys of each listing. Every order ends in a unique column, so that pages never
+// overlap or skip entries.
+var (
+	trackSorts = map[string]sortOrder{
+		"title": func(dir string) string { return "title COLLATE NOCASE " + dir + ", human_hash_id" },
+		"artist": func(dir string) string {
+			return "(SELECT name FROM artists WHERE artists.id = artist_id) COLLATE NOCASE " + dir +
+				", album_id, " + trackNumberOrder
+		},
+		"album": func(dir string) string {
+			return "(SELECT albums.title FROM albums WHERE albums.id = album_id) COLLATE NOCASE " + dir +
+				", album_id, " + trackNumberOrder
+		},
+		"year": func(dir string) string {
+			return "COALESCE(year, 0) = 0, year " + dir + ", album_id, " + trackNumberOrder
+		},
+		"added": func(dir string) string { return "added_at " + dir + ", human_hash_id" },
+		"duration": func(dir string) string {
+			return "COALESCE(duration_seconds, 0) = 0, duration_seconds " + dir + ", human_hash_id"
+		},
+		"track": func(dir string) string { return "album_id " + dir + ", " + trackNumberOrder },
+	}
+	albumSorts = map[string]sortOrder{
+		"title":  func(dir string) string { return "al.title " + dir + ", ar.name, al.id" },
+		"artist": func(dir string) string { return "ar.name " + dir + ", al.title, al.id" },
+		"year": func(dir string) string {
+			return "COALESCE(al.release_year, 0) = 0, al.release_year " + dir + ", al.title, al.id"
+		},
+		"duration": func(dir string) string { return "SUM(af.duration_seconds) " + dir + ", al.id" },
+		"tracks":   func(dir string) string { return "COUNT(af.human_hash_id) " + dir + ", al.id" },
+		"added":    func(dir string) string { return "MAX(af.added_at) " + dir + ", al.id" },
+		"plays":    func(dir string) string { return "(SELECT COUNT(*) " + albumPlays + ") " + dir + ", al.id" },
+		"played": func(dir string) string {
+			return "(SELECT MAX(p.played_at) " + albumPlays + ") IS NULL, (SELECT MAX(p.played_at) " + albumPlays + ") " + dir + ", al.id"
+		},
+	}
+	artistSorts = map[string]sortOrder{
+		"name":   func(dir string) string { return "ar.name " + dir + ", ar.id" },
+		"albums": func(dir string) string { return "album_count " + dir + ", ar.name, ar.id" },
+		"tracks": func(dir string) string { return "track_count " + dir + ", ar.name, ar.id" },
+	}
+	genreSorts = map[string]sortOrder{
+		"name":   func(dir string) string { return "g.name " + dir + ", g.id" },
+		"tracks": func(dir string) string { return "track_count " + dir + ", g.name, g.id" },
+	}
+	playlistSorts = map[string]sortOrder{
+		"name":     func(dir string) string { return "pl.name COLLATE NOCASE " + dir + ", pl.id" },
+		"created":  func(dir string) string { return "pl.created_at " + dir + ", pl.id" },
+		"updated":  func(dir string) string { return "pl.updated_at " + dir + ", pl.id" },
+		"tracks":   func(dir string) string { return "COUNT(af.human_hash_id) " + dir + ", pl.id" },
+		"duration": func(dir string) string { return "SUM(af.duration_seconds) " + dir + ", pl.id" },
+	}
+)
+
+// albumPlays is the FROM and WHERE clause selecting the plays of the tracks of album al.
+const albumPlays = "FROM plays p JOIN audio_files pt ON pt.human_hash_id = p.track_id WHERE pt.album_id = al.id"
+
+// trackNumberOrder orders the tracks of an album by disc and track number. The indexer
+// stores unknown numbers as 0: such tracks count as disc 1 and come last on their disc.
+const trackNumberOrder = "COALESCE(NULLIF(disc_number, 0), 1), COALESCE(track_number, 0) = 0, track_number, title, human_hash_id"
+
+// Sort keys accepted by Page.Sort for each listing, for use in error messages and docs.
+var (
+	TrackSorts    = sortKeys(trackSorts)
+	AlbumSorts    = sortKeys(albumSorts)
+	ArtistSorts   = sortKeys(artistSorts)
+	GenreSorts    = sortKeys(genreSorts)
+	PlaylistSorts = sortKeys(playlistSorts)
+)
+
+func sortKeys(sorts map[string]sortOrder) []string {
+	keys := make([]string, 0, len(sorts))
+	for key := range sorts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// orderBy returns the ORDER BY terms for p.Sort, using def if it is empty, or an error
+// wrapping ErrInvalidSort if the key is unknown.
+func (p Page) orderBy(sorts map[string]sortOrder, def string) (string, error) {
+	key, dir := p.Sort, "ASC"
+	if strings.HasPrefix(key, "-") {
+		key, dir = key[1:], "DESC"
+	}
+	if key == "" {
+		key = def
+	}
+	order, ok := sorts[key]
+	if !ok {
+		return "", fmt.Errorf("%w %q (want one of %s)", ErrInvalidSort, p.Sort, strings.Join(sortKeys(sorts), ", "))
+	}
+	return order(dir), nil
+}
+
+// yearRange appends the conditions of a year range on column to conds.
+func yearRange(conds []string, args []any, column string, from, to int) ([]string, []any) {
+	if from == 0 && to == 0 {
+		return conds, args
+	}
+	conds = append(conds, "COALESCE("+column+", 0) > 0")
+	if from != 0 {
+		conds, args = append(conds, column+" >= ?"), append(args, from)
+	}
+	if to != 0 {
+		conds, args = append(conds, column+" <= ?"), append(args, to)
+	}
+	return conds, args
+}
+
+// where joins conditions into a WHERE clause, or returns "" if there are none.
+func where(conds []string) string {
+	if len(conds) == 0 {
+		return ""
+	}
+	return " WHERE " + strings.Join(conds, " AND ")
+}
+
+// conditions returns the WHERE conditions on audio_files selecting the tracks matching
+// f, and their arguments.
+func (f TrackFilter) conditions() (conds []string, args []any) {
+	if f.ArtistID != 0 {
+		conds = append(conds, "(artist_id = ? OR human_hash_id IN (SELECT track_id FROM track_artists WHERE artist_id = ?))")
+		args = append(args, f.ArtistID, f.ArtistID)
+	}
+	if f.AlbumID != 0 {
+		conds, args = append(conds, "album_id = ?"), append(args, f.AlbumID)
+	}
+	if f.GenreID != 0 {
+		conds = append(conds, "(genre_id = ? OR human_hash_id IN (SELECT track_id FROM track_genres WHERE genre_id = ?))")
+		args = append(args, f.GenreID, f.GenreID)
+	}
+	conds, args = yearRange(conds, args, "year", f.YearFrom, f.YearTo)
+	if f.Lossless != nil {
+		conds, args = append(conds, "lossless = ?"), append(args, *f.Lossless)
+	}
+	return conds, args
+}
+
+// conditions returns the WHERE conditions on albums al selecting the albums matching f,
+// and their arguments.
+func (f AlbumFilter) conditions() (conds []string, args []any) {
+	if f.ArtistID != 0 {
+		conds, args = append(conds, "al.artist_id = ?"), append(args, f.ArtistID)
+	}
+	if f.GenreID != 0 {
+		conds = append(conds, `al.id IN (SELECT album_id FROM audio_files WHERE genre_id = ?
+			OR human_hash_id IN (SELECT track_id FROM track_genres WHERE genre_id = ?))`)
+		args = append(args, f.GenreID, f.GenreID)
+	}
+	conds, args = yearRange(conds, args, "al.release_year", f.YearFrom, f.YearTo)
+	if f.Played {
+		conds = append(conds, "EXISTS (SELECT 1 "+albumPlays+")")
+	}
+	return conds, args
+}
+
+// Tracks returns up to p.Limit tracks matching f from p.Offset on, and the number of
+// tracks matching f in all. Tracks are sorted by one of TrackSorts, by default "track"
+// (album, then disc and track number) when filtering by album and "title" otherwise.
+func (db *DB) Tracks(f TrackFilter, p Page) ([]Track, int, error) {
+	def := "title"
+	if f.AlbumID != 0 {
+		def = "track"
+	}
+	order, err := p.orderBy(trackSorts, def)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	conds, args := f.conditions()
+	var total int
+	if err := db.conn.QueryRow("SELECT COUNT(*) FROM audio_files"+where(conds), args...).Scan(&total); err != nil {
+		return nil, 0, fmt.Errorf("failed to count tracks: %w", err)
+	}
+	tracks, err := db.queryTracks(`SELECT `+trackColumns+` FROM audio_files`+where(conds)+
+		` ORDER BY `+order+` LIMIT ? OFFSET ?`, append(args, p.Limit, p.Offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	if tracks == nil {
+		tracks = []Track{}
+	}
+	return tracks, total, nil
+}
+
+// Albums returns up to p.Limit albums matching f from p.Offset on, with their totals,
+// and the number of albums matching f in all. Albums are sorted by one of AlbumSorts,
+// by default "title".
+func (db *DB) Albums(f AlbumFilter, p Page) ([]AlbumInfo, int, error) {
+	order, err := p.orderBy(albumSorts, "title")
+	if err != nil {
+		return nil, 0, err
+	}
+
+	conds, args := f.conditions()
+	var total int
+	if err := db.conn.QueryRow("SELECT COUNT(*) FROM albums al"+where(conds), args...).Scan(&total); err != nil {
+		return nil, 0, fmt.Errorf("failed to count albums: %w", err)
+	}
+	rows, err := db.conn.Query(albumInfoSelect+where(conds)+
+		` GROUP BY al.id ORDER BY `+order+` LIMIT ? OFFSET ?`, append(args, p.Limit, p.Offset)...)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to query albums: %w", err)
+	}
+	defer rows.Close()
+	albums, err := collectAlbumInfo(rows)
+	if err != nil {
+		return nil, 0, err
+	}
+	return albums, total, nil
+}
+
+// Artists returns up to p.Limit artists from p.Offset on, with their counts, and the
+// total number of artists. Artists are sorted by one of ArtistSorts, by default "name".
+func (db *DB) Artists(p Page) ([]ArtistInfo, int, error) {
+	order, err := p.orderBy(artistSorts, "name")
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var total int
+	if err := db.conn.QueryRow("SELECT COUNT(*) FROM artists").Scan(&total); err != nil {
+		return nil, 0, fmt.Errorf("failed to count artists: %w", err)
+	}
+	rows, err := db.conn.Query(artistInfoSelect+` ORDER BY `+order+` LIMIT ? OFFSET ?`, p.Limit, p.Offset)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to query artists: %w", err)
+	}
+	defer rows.Close()
+
+	artists := []ArtistInfo{}
+	for rows.Next() {
+		a, err := scanArtistInfo(rows)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to scan artist: %w", err)
+		}
+		artists = append(artists, a)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, fmt.Errorf("failed to read artists: %w", err)
+	}
+	return artists, total, nil
+}
+
+// Genres returns up to p.Limit genres from p.Offset on, with their track counts, and
+// the total number of genres. Tracks are counted the way TracksByGenre finds them.
+// Genres are sorted by one of GenreSorts, by default "name".
+func (db *DB) Genres(p Page) ([]GenreInfo, int, error) {
+	order, err := p.orderBy(genreSorts, "name")
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var total int
+	if err := db.conn.QueryRow("SELECT COUNT(*) FROM genres").Scan(&total); err != nil {
+		return nil, 0, fmt.Errorf("failed to count genres: %w", err)
+	}
+	rows, err := db.conn.Query(`
+		SELECT g.id, g.name,
+			(SELECT COUNT(*) FROM audio_files af WHERE af.genre_id = g.id
+				OR af.human_hash_id IN (SELECT track_id FROM track_genres WHERE genre_id = g.id)) AS track_count
+		FROM genres g ORDER BY `+order+` LIMIT ? OFFSET ?`, p.Limit, p.Offset)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to query genres: %w", err)
+	}
+	defer rows.Close()
+
+	genres := []GenreInfo{}
+	for rows.Next() {
+		var g GenreInfo
+		if err := rows.Scan(&g.ID, &g.Name, &g.TrackCount); err != nil {
+			return nil, 0, fmt.Errorf("failed to scan genre: %w", err)
+		}
+		genres = append(genres, g)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, fmt.Errorf("failed to read genres: %w", err)
+	}
+	return genres, total, nil
+}
+
+// RandomTracks returns up to n tracks matching f in random order.
+func (db *DB) RandomTracks(f TrackFilter, n int) ([]Track, error) {
+	conds, args := f.conditions()
+	tracks, err := db.queryTracks(`SELECT `+trackColumns+` FROM audio_files`+where(conds)+
+		` ORDER BY RANDOM() LIMIT ?`, append(args, n)...)
+	if err != nil {
+		return nil, err
+	}
+	if tracks == nil {
+		tracks = []Track{}
+	}
+	return tracks, nil
+}
+
+// RandomAlbums returns up to n albums matching f in random order, with their totals.
+func (db *DB) RandomAlbums(f AlbumFilter, n int) ([]AlbumInfo, error) {
+	conds, args := f.conditions()
+	rows, err := db.conn.Query(albumInfoSelect+where(conds)+
+		` GROUP BY al.id ORDER BY RANDOM() LIMIT ?`, append(args, n)...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query random albums: %w", err)
+	}
+	defer rows.Close()
+	return collectAlbumInfo(rows)
+}
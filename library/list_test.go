@@ -0,0 +1,124 @@
+package library
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// trackIDs returns the IDs of tracks in order.
+func trackIDs(tracks []Track) []string {
+	ids := make([]string, len(tracks))
+	for i, t := range tracks {
+		ids[i] = t.ID
+	}
+	return ids
+}
+
+func TestTracksPagination(t *testing.T) {
+	db := openTestDB(t)
+	// Equal titles are ordered by ID, so every page is stable
+	for _, id := range []string{"e", "c", "a", "d", "b"} {
+		addTrack(t, db, AudioFile{HumanHashID: id, FilePath: "/music/" + id + ".mp3", Title: "Intro"})
+	}
+	addTrack(t, db, AudioFile{HumanHashID: "z", FilePath: "/music/z.mp3", Title: "about"}) // Sorts first ignoring case
+
+	for _, tc := range []struct {
+		sort string
+		want []string
+	}{
+		{"", []string{"z", "a", "b", "c", "d", "e"}},
+		{"title", []string{"z", "a", "b", "c", "d", "e"}},
+		{"-title", []string{"a", "b", "c", "d", "e", "z"}},
+	} {
+		var got []string
+		for offset := 0; ; offset += 4 {
+			tracks, total, err := db.Tracks(TrackFilter{}, Page{Offset: offset, Limit: 4, Sort: tc.sort})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if total != 6 {
+				t.Errorf("sort %q: total = %d, want 6", tc.sort, total)
+			}
+			if len(tracks) == 0 {
+				break
+			}
+			got = append(got, trackIDs(tracks)...)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("sort %q: pages = %v, want %v", tc.sort, got, tc.want)
+		}
+	}
+
+	if _, _, err := db.Tracks(TrackFilter{}, Page{Limit: 10, Sort: "bogus"}); !errors.Is(err, ErrInvalidSort) {
+		t.Errorf("unknown sort: err = %v, want ErrInvalidSort", err)
+	}
+}
+
+func TestTracksSortByYearAndTrackNumber(t *testing.T) {
+	db := openTestDB(t)
+	addTrack(t, db, AudioFile{HumanHashID: "old2", FilePath: "/m/old2.mp3", Title: "B", Year: 1990, AlbumTitle: "Old", TrackNumber: 2})
+	addTrack(t, db, AudioFile{HumanHashID: "old1", FilePath: "/m/old1.mp3", Title: "A", Year: 1990, AlbumTitle: "Old", TrackNumber: 1})
+	addTrack(t, db, AudioFile{HumanHashID: "new", FilePath: "/m/new.mp3", Title: "C", Year: 2020, AlbumTitle: "New", TrackNumber: 1})
+	addTrack(t, db, AudioFile{HumanHashID: "none", FilePath: "/m/none.mp3", Title: "D", AlbumTitle: "Unknown"})
+
+	// Tracks without a year come last either way
+	for sort, want := range map[string][]string{
+		"year":  {"old1", "old2", "new", "none"},
+		"-year": {"new", "old1", "old2", "none"},
+	} {
+		tracks, _, err := db.Tracks(TrackFilter{}, Page{Limit: 10, Sort: sort})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := trackIDs(tracks); !reflect.DeepEqual(got, want) {
+			t.Errorf("sort %q = %v, want %v", sort, got, want)
+		}
+	}
+}
+
+func TestAlbumsPagination(t *testing.T) {
+	db := openTestDB(t)
+	// Two albums share a title; the album artist breaks the tie
+	for i, a := range []struct{ title, artist string }{
+		{"Greatest Hits", "Queen"}, {"Greatest Hits", "ABBA"}, {"Arrival", "ABBA"}, {"Jazz", "Queen"},
+	} {
+		addTrack(t, db, AudioFile{HumanHashID: fmt.Sprint("t", i), FilePath: fmt.Sprintf("/m/%d.mp3", i), Title: "T",
+			ArtistName: a.artist, AlbumTitle: a.title})
+	}
+
+	var got []string
+	for offset := 0; offset < 4; offset += 3 {
+		albums, total, err := db.Albums(AlbumFilter{}, Page{Offset: offset, Limit: 3})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if total != 4 {
+			t.Errorf("total = %d, want 4", total)
+		}
+		for _, a := range albums {
+			got = append(got, a.Title+"/"+a.ArtistName)
+			if a.TrackCount != 1 {
+				t.Errorf("%s has %d tracks, want 1", a.Title, a.TrackCount)
+			}
+		}
+	}
+	want := []string{"Arrival/ABBA", "Greatest Hits/ABBA", "Greatest Hits/Queen", "Jazz/Queen"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("pages = %v, want %v", got, want)
+	}
+
+	albums, _, err := db.Albums(AlbumFilter{}, Page{Limit: 10, Sort: "-artist"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = got[:0]
+	for _, a := range albums {
+		got = append(got, a.Title+"/"+a.ArtistName)
+	}
+	want = []string{"Greatest Hits/Queen", "Jazz/Queen", "Arrival/ABBA", "Greatest Hits/ABBA"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("sort -artist = %v, want %v", got, want)
+	}
+}
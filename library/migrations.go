@@ -0,0 +1,512 @@
+package library
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// Migration is one numbered step of the database schema. Steps run in order, each in
+// its own transaction together with its schema_version row. They are written to be
+// idempotent so that databases created before schema_version existed, which already
+// have some of the tables and columns, can be brought up to date by running every step.
+type Migration struct {
+	Version     int
+	Description string
+	apply       func(tx *sql.Tx) error
+}
+
+// rescanAll makes the indexer read every file again on its next run, for steps that add
+// data only the tags can fill in. A NULL modification time never matches the file's.
+const rescanAll = "UPDATE audio_files SET file_mtime_ns = NULL"
+
+// migrations lists every schema step. Append new steps with the next version number;
+// never edit or reorder a step that has been released. hosting_server refuses to start
+// until the database has been migrated to exactly LatestSchemaVersion.
+var migrations = []Migration{
+	{1, "Initial schema", func(tx *sql.Tx) error {
+		return execAll(tx, `
+			CREATE TABLE IF NOT EXISTS artists (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				name TEXT UNIQUE NOT NULL COLLATE NOCASE
+			)`, `
+			CREATE TABLE IF NOT EXISTS albums (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				title TEXT NOT NULL COLLATE NOCASE,
+				artist_id INTEGER NOT NULL, -- Album artist; per-track artists are on audio_files
+				release_year INTEGER,
+				FOREIGN KEY (artist_id) REFERENCES artists(id) ON DELETE CASCADE,
+				UNIQUE(title, artist_id)
+			)`, `
+			CREATE TABLE IF NOT EXISTS genres (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				name TEXT UNIQUE NOT NULL COLLATE NOCASE
+			)`, `
+			CREATE TABLE IF NOT EXISTS audio_files (
+				human_hash_id TEXT PRIMARY KEY NOT NULL,
+				file_path TEXT UNIQUE NOT NULL,
+				title TEXT NOT NULL,
+				duration_seconds INTEGER,
+				lossless BOOLEAN NOT NULL,
+				track_number INTEGER,
+				disc_number INTEGER,
+				year INTEGER,
+				artist_id INTEGER NOT NULL,
+				album_id INTEGER NOT NULL,
+				genre_id INTEGER,
+				FOREIGN KEY (artist_id) REFERENCES artists(id) ON DELETE CASCADE,
+				FOREIGN KEY (album_id) REFERENCES albums(id) ON DELETE CASCADE,
+				FOREIGN KEY (genre_id) REFERENCES genres(id) ON DELETE SET NULL
+			)`)
+	}},
+	{2, "Record file size and modification time for incremental indexing", func(tx *sql.Tx) error {
+		if err := addColumnIfMissing(tx, "audio_files", "file_size", "INTEGER"); err != nil {
+			return err
+		}
+		return addColumnIfMissing(tx, "audio_files", "file_mtime_ns", "INTEGER")
+	}},
+	{3, "Audio fingerprints for move detection", func(tx *sql.Tx) error {
+		if err := addColumnIfMissing(tx, "audio_files", "fingerprint", "TEXT"); err != nil {
+			return err
+		}
+		return execAll(tx, "CREATE INDEX IF NOT EXISTS idx_audio_files_fingerprint ON audio_files(fingerprint)")
+	}},
+	{4, "Embedded cover art cache", func(tx *sql.Tx) error {
+		err := execAll(tx, `
+			CREATE TABLE IF NOT EXISTS artwork (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				hash TEXT UNIQUE NOT NULL,
+				mime_type TEXT NOT NULL,
+				file_path TEXT NOT NULL
+			)`)
+		if err != nil {
+			return err
+		}
+		if err := addColumnIfMissing(tx, "audio_files", "artwork_id", "INTEGER REFERENCES artwork(id) ON DELETE SET NULL"); err != nil {
+			return err
+		}
+		return addColumnIfMissing(tx, "albums", "artwork_id", "INTEGER REFERENCES artwork(id) ON DELETE SET NULL")
+	}},
+	{5, "Compilation albums", func(tx *sql.Tx) error {
+		if err := addColumnIfMissing(tx, "albums", "compilation", "BOOLEAN NOT NULL DEFAULT 0"); err != nil {
+			return err
+		}
+		// Albums were grouped by track artist until now; regroup them by album artist
+		return execAll(tx, rescanAll)
+	}},
+	{6, "Multi-artist credits", func(tx *sql.Tx) error {
+		return execAll(tx, `
+			CREATE TABLE IF NOT EXISTS track_artists (
+				track_id TEXT NOT NULL,
+				artist_id INTEGER NOT NULL,
+				role TEXT NOT NULL,
+				position INTEGER NOT NULL,
+				PRIMARY KEY (track_id, artist_id, role),
+				FOREIGN KEY (track_id) REFERENCES audio_files(human_hash_id) ON DELETE CASCADE,
+				FOREIGN KEY (artist_id) REFERENCES artists(id) ON DELETE CASCADE
+			)`,
+			"CREATE INDEX IF NOT EXISTS idx_track_artists_artist ON track_artists(artist_id)",
+			rescanAll) // Credit the artists of the tracks already indexed
+	}},
+	{7, "Multiple genres per track", func(tx *sql.Tx) error {
+		return execAll(tx, `
+			CREATE TABLE IF NOT EXISTS track_genres (
+				track_id TEXT NOT NULL,
+				genre_id INTEGER NOT NULL,
+				position INTEGER NOT NULL,
+				PRIMARY KEY (track_id, genre_id),
+				FOREIGN KEY (track_id) REFERENCES audio_files(human_hash_id) ON DELETE CASCADE,
+				FOREIGN KEY (genre_id) REFERENCES genres(id) ON DELETE CASCADE
+			)`,
+			"CREATE INDEX IF NOT EXISTS idx_track_genres_genre ON track_genres(genre_id)",
+			rescanAll) // Split the genres of the tracks already indexed
+	}},
+	{8, "Technical stream properties", func(tx *sql.Tx) error {
+		// A NULL codec makes the indexer re-read the file once to fill these in
+		for _, column := range [][2]string{
+			{"codec", "TEXT"}, {"container", "TEXT"}, {"bitrate", "INTEGER"},
+			{"sample_rate", "INTEGER"}, {"bit_depth", "INTEGER"}, {"channels", "INTEGER"},
+		} {
+			if err := addColumnIfMissing(tx, "audio_files", column[0], column[1]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}},
+	{9, "Full-text search index", func(tx *sql.Tx) error {
+		// tracks_fts indexes track_search, which holds the searchable text of every
+		// track; the library refreshes a track's row whenever it saves the track. Albums
+		// and artists are indexed by triggers, keyed on their IDs.
+		err := execAll(tx, `
+			CREATE TABLE IF NOT EXISTS track_search (
+				id INTEGER PRIMARY KEY,
+				track_id TEXT UNIQUE NOT NULL,
+				title TEXT NOT NULL,
+				artists TEXT NOT NULL, -- Every credited artist
+				album TEXT NOT NULL,
+				genres TEXT NOT NULL
+			)`, `
+			CREATE VIRTUAL TABLE IF NOT EXISTS tracks_fts USING fts5(
+				title, artists, album, genres,
+				content = 'track_search', content_rowid = 'id',
+				tokenize = 'unicode61 remove_diacritics 2', prefix = '2 3'
+			)`, `
+			CREATE TRIGGER IF NOT EXISTS track_search_insert AFTER INSERT ON track_search BEGIN
+				INSERT INTO tracks_fts (rowid, title, artists, album, genres)
+				VALUES (new.id, new.title, new.artists, new.album, new.genres);
+			END`, `
+			CREATE TRIGGER IF NOT EXISTS track_search_delete AFTER DELETE ON track_search BEGIN
+				INSERT INTO tracks_fts (tracks_fts, rowid, title, artists, album, genres)
+				VALUES ('delete', old.id, old.title, old.artists, old.album, old.genres);
+			END`, `
+			CREATE TRIGGER IF NOT EXISTS track_search_update AFTER UPDATE ON track_search BEGIN
+				INSERT INTO tracks_fts (tracks_fts, rowid, title, artists, album, genres)
+				VALUES ('delete', old.id, old.title, old.artists, old.album, old.genres);
+				INSERT INTO tracks_fts (rowid, title, artists, album, genres)
+				VALUES (new.id, new.title, new.artists, new.album, new.genres);
+			END`, `
+			CREATE TRIGGER IF NOT EXISTS audio_files_search_delete AFTER DELETE ON audio_files BEGIN
+				DELETE FROM track_search WHERE track_id = old.human_hash_id;
+			END`, `
+			CREATE VIRTUAL TABLE IF NOT EXISTS albums_fts USING fts5(
+				title, artist,
+				tokenize = 'unicode61 remove_diacritics 2', prefix = '2 3'
+			)`, `
+			CREATE TRIGGER IF NOT EXISTS albums_search_insert AFTER INSERT ON albums BEGIN
+				INSERT INTO albums_fts (rowid, title, artist)
+				SELECT new.id, new.title, name FROM artists WHERE id = new.artist_id;
+			END`, `
+			CREATE TRIGGER IF NOT EXISTS albums_search_delete AFTER DELETE ON albums BEGIN
+				DELETE FROM albums_fts WHERE rowid = old.id;
+			END`, `
+			CREATE VIRTUAL TABLE IF NOT EXISTS artists_fts USING fts5(
+				name,
+				tokenize = 'unicode61 remove_diacritics 2', prefix = '2 3'
+			)`, `
+			CREATE TRIGGER IF NOT EXISTS artists_search_insert AFTER INSERT ON artists BEGIN
+				INSERT INTO artists_fts (rowid, name) VALUES (new.id, new.name);
+			END`, `
+			CREATE TRIGGER IF NOT EXISTS artists_search_delete AFTER DELETE ON artists BEGIN
+				DELETE FROM artists_fts WHERE rowid = old.id;
+			END`)
+		if err != nil {
+			if strings.Contains(err.Error(), "no such module: fts5") {
+				return fmt.Errorf("%w (build with -tags sqlite_fts5)", err)
+			}
+			return err
+		}
+
+		// Index what is already in the library
+		return execAll(tx,
+			"DELETE FROM track_search",
+			"INSERT INTO track_search (track_id, title, artists, album, genres) "+trackSearchSelect+" WHERE true",
+			"DELETE FROM albums_fts",
+			"INSERT INTO albums_fts (rowid, title, artist) SELECT al.id, al.title, ar.name FROM albums al JOIN artists ar ON ar.id = al.artist_id",
+			"DELETE FROM artists_fts",
+			"INSERT INTO artists_fts (rowid, name) SELECT id, name FROM artists")
+	}},
+	{10, "Trigram indexes for fuzzy search", func(tx *sql.Tx) error {
+		// These only narrow fuzzy searches down to candidates sharing trigrams with the
+		// query; the library scores the candidates itself. They index the text of
+		// track_search, albums and artists in place, without storing a copy.
+		return execAll(tx, `
+			CREATE VIRTUAL TABLE IF NOT EXISTS tracks_trigram USING fts5(
+				title, artists, album,
+				content = 'track_search', content_rowid = 'id',
+				tokenize = 'trigram remove_diacritics 1'
+			)`, `
+			CREATE TRIGGER IF NOT EXISTS track_search_trigram_insert AFTER INSERT ON track_search BEGIN
+				INSERT INTO tracks_trigram (rowid, title, artists, album) VALUES (new.id, new.title, new.artists, new.album);
+			END`, `
+			CREATE TRIGGER IF NOT EXISTS track_search_trigram_delete AFTER DELETE ON track_search BEGIN
+				INSERT INTO tracks_trigram (tracks_trigram, rowid, title, artists, album)
+				VALUES ('delete', old.id, old.title, old.artists, old.album);
+			END`, `
+			CREATE TRIGGER IF NOT EXISTS track_search_trigram_update AFTER UPDATE ON track_search BEGIN
+				INSERT INTO tracks_trigram (tracks_trigram, rowid, title, artists, album)
+				VALUES ('delete', old.id, old.title, old.artists, old.album);
+				INSERT INTO tracks_trigram (rowid, title, artists, album) VALUES (new.id, new.title, new.artists, new.album);
+			END`, `
+			CREATE VIRTUAL TABLE IF NOT EXISTS albums_trigram USING fts5(
+				title,
+				content = 'albums', content_rowid = 'id',
+				tokenize = 'trigram remove_diacritics 1'
+			)`, `
+			CREATE TRIGGER IF NOT EXISTS albums_trigram_insert AFTER INSERT ON albums BEGIN
+				INSERT INTO albums_trigram (rowid, title) VALUES (new.id, new.title);
+			END`, `
+			CREATE TRIGGER IF NOT EXISTS albums_trigram_delete AFTER DELETE ON albums BEGIN
+				INSERT INTO albums_trigram (albums_trigram, rowid, title) VALUES ('delete', old.id, old.title);
+			END`, `
+			CREATE VIRTUAL TABLE IF NOT EXISTS artists_trigram USING fts5(
+				name,
+				content = 'artists', content_rowid = 'id',
+				tokenize = 'trigram remove_diacritics 1'
+			)`, `
+			CREATE TRIGGER IF NOT EXISTS artists_trigram_insert AFTER INSERT ON artists BEGIN
+				INSERT INTO artists_trigram (rowid, name) VALUES (new.id, new.name);
+			END`, `
+			CREATE TRIGGER IF NOT EXISTS artists_trigram_delete AFTER DELETE ON artists BEGIN
+				INSERT INTO artists_trigram (artists_trigram, rowid, name) VALUES ('delete', old.id, old.name);
+			END`,
+			// Index what is already in the library
+			"INSERT INTO tracks_trigram (tracks_trigram) VALUES ('rebuild')",
+			"INSERT INTO albums_trigram (albums_trigram) VALUES ('rebuild')",
+			"INSERT INTO artists_trigram (artists_trigram) VALUES ('rebuild')")
+	}},
+	{11, "Indexes for browsing by artist, album and genre", func(tx *sql.Tx) error {
+		return execAll(tx,
+			"CREATE INDEX IF NOT EXISTS idx_audio_files_artist ON audio_files(artist_id)",
+			"CREATE INDEX IF NOT EXISTS idx_audio_files_album ON audio_files(album_id)",
+			"CREATE INDEX IF NOT EXISTS idx_audio_files_genre ON audio_files(genre_id)",
+			"CREATE INDEX IF NOT EXISTS idx_albums_artist ON albums(artist_id)")
+	}},
+	{12, "Date tracks were added to the library", func(tx *sql.Tx) error {
+		if err := addColumnIfMissing(tx, "audio_files", "added_at", "INTEGER"); err != nil {
+			return err
+		}
+		// The file's modification time is the best guess for tracks indexed before now
+		return execAll(tx,
+			"UPDATE audio_files SET added_at = COALESCE(file_mtime_ns / 1000000000, CAST(strftime('%s', 'now') AS INTEGER)) WHERE added_at IS NULL",
+			"CREATE INDEX IF NOT EXISTS idx_audio_files_added ON audio_files(added_at)")
+	}},
+	{13, "Playlists and play history", func(tx *sql.Tx) error {
+		// Both belong to listeners, not to the files: the indexer never writes them, and
+		// they only lose a track when pruning deletes it
+		return execAll(tx, `
+			CREATE TABLE IF NOT EXISTS playlists (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				name TEXT NOT NULL,
+				comment TEXT NOT NULL DEFAULT '',
+				owner TEXT NOT NULL,
+				public BOOLEAN NOT NULL DEFAULT 0,
+				created_at INTEGER NOT NULL,
+				updated_at INTEGER NOT NULL
+			)`,
+			"CREATE INDEX IF NOT EXISTS idx_playlists_owner ON playlists(owner)", `
+			CREATE TABLE IF NOT EXISTS playlist_tracks (
+				playlist_id INTEGER NOT NULL,
+				position INTEGER NOT NULL,
+				track_id TEXT NOT NULL,
+				PRIMARY KEY (playlist_id, position),
+				FOREIGN KEY (playlist_id) REFERENCES playlists(id) ON DELETE CASCADE,
+				FOREIGN KEY (track_id) REFERENCES audio_files(human_hash_id) ON DELETE CASCADE
+			)`,
+			"CREATE INDEX IF NOT EXISTS idx_playlist_tracks_track ON playlist_tracks(track_id)", `
+			CREATE TABLE IF NOT EXISTS plays (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				track_id TEXT NOT NULL,
+				username TEXT NOT NULL,
+				played_at INTEGER NOT NULL,
+				FOREIGN KEY (track_id) REFERENCES audio_files(human_hash_id) ON DELETE CASCADE
+			)`,
+			"CREATE INDEX IF NOT EXISTS idx_plays_track ON plays(track_id, played_at)")
+	}},
+	{14, "User accounts", func(tx *sql.Tx) error {
+		// Playlists and plays keep referring to users by name, which never changes
+		return execAll(tx, `
+			CREATE TABLE IF NOT EXISTS users (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				name TEXT UNIQUE NOT NULL COLLATE NOCASE,
+				password_hash TEXT NOT NULL,
+				role TEXT NOT NULL DEFAULT 'regular',
+				disabled BOOLEAN NOT NULL DEFAULT 0,
+				created_at INTEGER NOT NULL,
+				updated_at INTEGER NOT NULL
+			)`)
+	}},
+	{15, "Subsonic passwords", func(tx *sql.Tx) error {
+		// Subsonic token logins need a password the server can read, so it is kept
+		// encrypted with the server's key rather than hashed; empty if the user has none
+		return addColumnIfMissing(tx, "users", "subsonic_password", "TEXT NOT NULL DEFAULT ''")
+	}},
+	{16, "Login tokens", func(tx *sql.Tx) error {
+		// Only the SHA-256 of a token is kept, so a leaked database leaks no logins
+		return execAll(tx, `
+			CREATE TABLE IF NOT EXISTS tokens (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+				kind TEXT NOT NULL,
+				name TEXT NOT NULL DEFAULT '',
+				hash TEXT UNIQUE NOT NULL,
+				created_at INTEGER NOT NULL,
+				expires_at INTEGER NOT NULL DEFAULT 0,
+				last_used_at INTEGER NOT NULL DEFAULT 0
+			)`,
+			"CREATE INDEX IF NOT EXISTS idx_tokens_user ON tokens(user_id)")
+	}},
+	{17, "Playlist owners by user ID", func(tx *sql.Tx) error {
+		// Playlists made anonymously in open mode, owned by no user, are left without one
+		if err := addColumnIfMissing(tx, "playlists", "owner_id", "INTEGER REFERENCES users(id)"); err != nil {
+			return err
+		}
+		return execAll(tx,
+			"UPDATE playlists SET owner_id = (SELECT id FROM users WHERE name = playlists.owner)",
+			"CREATE INDEX IF NOT EXISTS idx_playlists_owner_id ON playlists(owner_id)")
+	}},
+}
+
+// LatestSchemaVersion is the version a database has once every migration has run.
+func LatestSchemaVersion() int {
+	return migrations[len(migrations)-1].Version
+}
+
+// execAll runs each statement in turn.
+func execAll(tx *sql.Tx, statements ...string) error {
+	for _, stmt := range statements {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addColumnIfMissing adds a column to an existing table unless it is already present.
+func addColumnIfMissing(tx *sql.Tx, table, column, definition string) error {
+	rows, err := tx.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return fmt.Errorf("failed to inspect table %s: %w", table, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid, notNull, pk int
+			name, colType    string
+			defaultValue     sql.NullString
+		)
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultValue, &pk); err != nil {
+			return fmt.Errorf("failed to scan column info for %s: %w", table, err)
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to read column info for %s: %w", table, err)
+	}
+	rows.Close() // Release the connection before altering the table
+
+	if _, err := tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition)); err != nil {
+		return fmt.Errorf("failed to add column %s.%s: %w", table, column, err)
+	}
+	return nil
+}
+
+// SchemaVersion returns the version recorded in schema_version. Databases without the
+// table, or without any recorded version, report 0.
+func (db *DB) SchemaVersion() (int, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.schemaVersion()
+}
+
+// schemaVersion is SchemaVersion for callers that hold db.mu.
+func (db *DB) schemaVersion() (int, error) {
+	var tables int
+	if err := db.conn.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'schema_version'").Scan(&tables); err != nil {
+		return 0, fmt.Errorf("failed to inspect database: %w", err)
+	}
+	if tables == 0 {
+		return 0, nil
+	}
+	var version int
+	if err := db.conn.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_version").Scan(&version); err != nil {
+		return 0, fmt.Errorf("failed to read schema version: %w", err)
+	}
+	return version, nil
+}
+
+// CheckSchema returns an error unless the database is at exactly LatestSchemaVersion.
+// Readers call it at startup instead of failing later with missing-column errors.
+func (db *DB) CheckSchema() error {
+	version, err := db.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	switch {
+	case version < LatestSchemaVersion():
+		return fmt.Errorf("database schema version %d is older than the required %d; run \"indexer migrate --db <path>\"", version, LatestSchemaVersion())
+	case version > LatestSchemaVersion():
+		return fmt.Errorf("database schema version %d is newer than this build supports (%d); upgrade it", version, LatestSchemaVersion())
+	}
+	return nil
+}
+
+// PendingMigrations returns the migrations that Migrate would apply.
+func (db *DB) PendingMigrations() ([]Migration, error) {
+	current, err := db.SchemaVersion()
+	if err != nil {
+		return nil, err
+	}
+	var pending []Migration
+	for _, mig := range migrations {
+		if mig.Version > current {
+			pending = append(pending, mig)
+		}
+	}
+	return pending, nil
+}
+
+// Migrate applies every migration newer than the database's schema version and returns
+// the ones it applied. It refuses to touch a database written by a newer build.
+func (db *DB) Migrate() ([]Migration, error) {
+	// Acquire mutex for schema changes to ensure they are not run concurrently
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	_, err := db.conn.Exec(`
+		CREATE TABLE IF NOT EXISTS schema_version (
+			version INTEGER PRIMARY KEY,
+			description TEXT NOT NULL,
+			applied_at INTEGER NOT NULL -- Unix seconds
+		)`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create schema_version table: %w", err)
+	}
+	current, err := db.schemaVersion()
+	if err != nil {
+		return nil, err
+	}
+	if current > LatestSchemaVersion() {
+		return nil, fmt.Errorf("database schema version %d is newer than this build supports (%d); upgrade it", current, LatestSchemaVersion())
+	}
+
+	var applied []Migration
+	for _, mig := range migrations {
+		if mig.Version <= current {
+			continue
+		}
+		if err := db.applyMigration(mig); err != nil {
+			return applied, err
+		}
+		applied = append(applied, mig)
+	}
+	return applied, nil
+}
+
+// applyMigration runs one migration and records it in schema_version. The caller must
+// hold db.mu.
+func (db *DB) applyMigration(mig Migration) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin migration %d: %w", mig.Version, err)
+	}
+	defer tx.Rollback() // No-op once committed
+
+	if err := mig.apply(tx); err != nil {
+		return fmt.Errorf("migration %d (%s) failed: %w", mig.Version, mig.Description, err)
+	}
+	_, err = tx.Exec("INSERT INTO schema_version (version, description, applied_at) VALUES (?, ?, ?)",
+		mig.Version, mig.Description, time.Now().Unix())
+	if err != nil {
+		return fmt.Errorf("failed to record migration %d: %w", mig.Version, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit migration %d: %w", mig.Version, err)
+	}
+	log.Printf("Applied schema migration %d: %s", mig.Version, mig.Description)
+	return nil
+}
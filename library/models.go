@@ -0,0 +1,190 @@
+package library
+
+// Roles an artist can have on a track in the track_artists table.
+const (
+	RoleMain     = "main"
+	RoleFeatured = "featured"
+	RoleComposer = "composer"
+)
+
+// ArtistCredit is one artist credited on a track.
+type ArtistCredit struct {
+	Name     string
+	Role     string
+	ArtistID int // Foreign key after insertion
+}
+
+// AudioFile is the record the indexer writes for one audio file.
+type AudioFile struct {
+	HumanHashID     string
+	FilePath        string
+	Title           string
+	DurationSeconds int // Decoded from the stream headers; 0 if the format is unsupported
+	Lossless        bool
+	Codec           string // Codec, container and the fields below are empty/0 if the format is unsupported
+	Container       string
+	Bitrate         int // Average bits per second
+	SampleRate      int
+	BitDepth        int // Only known for lossless codecs
+	Channels        int
+	TrackNumber     int
+	DiscNumber      int
+	Year            int
+	ArtistName      string         // Primary (first) track artist
+	Credits         []ArtistCredit // Every artist credited on the track, with roles
+	AlbumArtistName string         // Artist the album is filed under; differs from ArtistName on compilations and guest tracks
+	Compilation     bool
+	AlbumTitle      string
+	Genres          []string // Every genre on the track; the first is the primary one
+	FileSize        int64    // Size in bytes when the file was indexed
+	FileModTime     int64    // Modification time in Unix nanoseconds when the file was indexed
+	Fingerprint     string   // Hash of the audio payload, ignoring tags; used to detect moves
+	Artwork         *Artwork // Embedded cover art already written to the art cache, nil if the file has none
+	ArtworkID       int      // Foreign key of Artwork after insertion, 0 if the file has none
+	ArtistID        int      // Foreign key after insertion
+	AlbumArtistID   int      // Foreign key after insertion
+	AlbumID         int      // Foreign key after insertion
+	GenreID         int      // Foreign key after insertion
+	GenreIDs        []int    // Foreign keys of Genres after insertion
+}
+
+// FileState is the size and modification time recorded for an indexed file.
+type FileState struct {
+	Size    int64
+	ModTime int64 // Unix nanoseconds
+}
+
+// Track is a track as served to clients. Numeric IDs are encoded as JSON strings in
+// every type here, which is what the API has always returned for tracks.
+type Track struct {
+	ID       string   `json:"id" example:"funky-lion-pencil-heart"`
+	Title    string   `json:"title"`
+	ArtistID int      `json:"artist_id,string"`
+	AlbumID  int      `json:"album_id,string"`
+	FilePath string   `json:"file_path"`
+	Genres   []string `json:"genres,omitempty"`
+
+	ArtistName string `json:"artist_name" example:"Metallica"` // Primary track artist
+	AlbumTitle string `json:"album_title" example:"Metallica"`
+
+	TrackNumber int   `json:"track_number,omitempty"`
+	DiscNumber  int   `json:"disc_number,omitempty"`
+	Year        int   `json:"year,omitempty"`
+	AddedAt     int64 `json:"added_at,omitempty" example:"1718000000"` // Unix seconds when the track was first indexed
+
+	// Technical properties decoded from the stream headers by the indexer
+	DurationSeconds int    `json:"duration_seconds"`
+	Lossless        bool   `json:"lossless"`
+	Codec           string `json:"codec,omitempty" example:"flac"`
+	Container       string `json:"container,omitempty" example:"flac"`
+	Bitrate         int    `json:"bitrate,omitempty" example:"2304000"`
+	SampleRate      int    `json:"sample_rate,omitempty" example:"96000"`
+	BitDepth        int    `json:"bit_depth,omitempty" example:"24"`
+	Channels        int    `json:"channels,omitempty" example:"2"`
+}
+
+// Album is an album filed under its album artist.
+type Album struct {
+	ID          int    `json:"id,string"`
+	Title       string `json:"title"`
+	ArtistID    int    `json:"artist_id,string"`
+	ArtistName  string `json:"artist_name"`
+	Year        int    `json:"year,omitempty"`
+	Compilation bool   `json:"compilation"`
+}
+
+// AlbumInfo is an album with totals over its tracks.
+type AlbumInfo struct {
+	Album
+	TrackCount      int   `json:"track_count"`
+	DurationSeconds int   `json:"duration_seconds"`
+	AddedAt         int64 `json:"added_at,omitempty" example:"1718000000"` // When its latest track was added, in Unix seconds
+}
+
+// Artist is a track or album artist.
+type Artist struct {
+	ID   int    `json:"id,string"`
+	Name string `json:"name"`
+}
+
+// ArtistInfo is an artist with counts over their albums and tracks.
+type ArtistInfo struct {
+	Artist
+	AlbumCount int `json:"album_count"` // Albums filed under the artist
+	TrackCount int `json:"track_count"` // Tracks crediting the artist in any role
+}
+
+// Genre is a genre name shared by tracks.
+type Genre struct {
+	ID   int    `json:"id,string"`
+	Name string `json:"name"`
+}
+
+// GenreInfo is a genre with the number of tracks that have it.
+type GenreInfo struct {
+	Genre
+	TrackCount int `json:"track_count"`
+}
+
+// Playlist is an ordered list of tracks kept by a listener. The same track may appear
+// more than once.
+type Playlist struct {
+	ID              int    `json:"id,string"`
+	Name            string `json:"name"`
+	Comment         string `json:"comment,omitempty"`
+	Owner           string `json:"owner"`                           // Name of the user who created it
+	OwnerID         int    `json:"owner_id,string,omitempty"`       // ID of that user; 0 if the playlist was made anonymously
+	Public          bool   `json:"public"`                          // Visible to other users, who cannot change it
+	CreatedAt       int64  `json:"created_at" example:"1718000000"` // Unix seconds
+	UpdatedAt       int64  `json:"updated_at" example:"1718000000"`
+	TrackCount      int    `json:"track_count"`
+	DurationSeconds int    `json:"duration_seconds"`
+}
+
+// Roles a user can have.
+const (
+	UserRoleAdmin   = "admin"   // Manages users as well as listening
+	UserRoleRegular = "regular" // Only listens
+)
+
+// User is an account that can log in to the server.
+type User struct {
+	ID           int    `json:"id,string"`
+	Name         string `json:"name"`
+	PasswordHash string `json:"-"` // Never served
+	// SubsonicPassword is the password for Subsonic token logins, encrypted by the
+	// server, or "" if the user has none. Never served.
+	SubsonicPassword string `json:"-"`
+	Role             string `json:"role" example:"regular"`
+	Disabled         bool   `json:"disabled"`                        // Disabled users cannot log in
+	CreatedAt        int64  `json:"created_at" example:"1718000000"` // Unix seconds
+	UpdatedAt        int64  `json:"updated_at" example:"1718000000"`
+}
+
+// Kinds of login tokens.
+const (
+	TokenKindSession = "session" // Returned by logging in; expires
+	TokenKindAPIKey  = "api_key" // Created for a device or script; lasts until revoked
+)
+
+// Token is a secret a user authenticates with instead of their password. Only its
+// hash is stored.
+type Token struct {
+	ID         int    `json:"id,string"`
+	UserID     int    `json:"user_id,string"`
+	Kind       string `json:"kind" example:"api_key"`
+	Name       string `json:"name" example:"laptop mpv"` // Chosen by the user for API keys
+	Hash       string `json:"-"`
+	CreatedAt  int64  `json:"created_at" example:"1718000000"` // Unix seconds
+	ExpiresAt  int64  `json:"expires_at,omitempty"`            // 0 if it never expires
+	LastUsedAt int64  `json:"last_used_at,omitempty"`          // Updated at most once a minute
+}
+
+// Artwork is a cover image extracted by the indexer into its art cache.
+type Artwork struct {
+	ID       int
+	Hash     string
+	MimeType string
+	FilePath string // Absolute path of the cached image
+	Data     []byte // Contents of the image, for the indexer to write the cached file
+}
@@ -0,0 +1,255 @@
+package library
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// playlistSelect selects the playlist columns and totals read by scanPlaylist from
+// playlists pl; callers append a WHERE clause, if any, and then GROUP BY pl.id.
+const playlistSelect = `
+	SELECT pl.id, pl.name, pl.comment, pl.owner, COALESCE(pl.owner_id, 0), pl.public, pl.created_at, pl.updated_at,
+		COUNT(af.human_hash_id), COALESCE(SUM(af.duration_seconds), 0)
+	FROM playlists pl
+	LEFT JOIN playlist_tracks pt ON pt.playlist_id = pl.id
+	LEFT JOIN audio_files af ON af.human_hash_id = pt.track_id`
+
+// scanPlaylist reads a Playlist from a row selected with playlistSelect.
+func scanPlaylist(row rowScanner) (Playlist, error) {
+	var p Playlist
+	err := row.Scan(&p.ID, &p.Name, &p.Comment, &p.Owner, &p.OwnerID, &p.Public, &p.CreatedAt, &p.UpdatedAt,
+		&p.TrackCount, &p.DurationSeconds)
+	return p, err
+}
+
+// Playlist returns one playlist with its totals, or ErrNotFound.
+func (db *DB) Playlist(id int) (Playlist, error) {
+	p, err := scanPlaylist(db.conn.QueryRow(playlistSelect+` WHERE pl.id = ? GROUP BY pl.id`, id))
+	if err == sql.ErrNoRows {
+		return p, ErrNotFound
+	}
+	if err != nil {
+		return p, fmt.Errorf("failed to query playlist %d: %w", id, err)
+	}
+	return p, nil
+}
+
+// Playlists returns up to p.Limit of the playlists the user with ID userID can see,
+// their own and the public ones of others, matching f, from p.Offset on, and how many
+// match in all. A userID of 0 sees only public playlists. A negative p.Limit lists
+// them all. Playlists are sorted by one of PlaylistSorts, by default "name".
+func (db *DB) Playlists(userID int, f PlaylistFilter, p Page) ([]Playlist, int, error) {
+	order, err := p.orderBy(playlistSorts, "name")
+	if err != nil {
+		return nil, 0, err
+	}
+	conds, args := []string{"(pl.owner_id = ? OR pl.public)"}, []any{userID}
+	if f.Owner != "" {
+		conds, args = append(conds, "pl.owner = ? COLLATE NOCASE"), append(args, f.Owner)
+	}
+
+	var total int
+	if err := db.conn.QueryRow("SELECT COUNT(*) FROM playlists pl"+where(conds), args...).Scan(&total); err != nil {
+		return nil, 0, fmt.Errorf("failed to count playlists: %w", err)
+	}
+	rows, err := db.conn.Query(playlistSelect+where(conds)+` GROUP BY pl.id ORDER BY `+order+` LIMIT ? OFFSET ?`,
+		append(args, p.Limit, p.Offset)...)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to query playlists: %w", err)
+	}
+	defer rows.Close()
+
+	playlists := []Playlist{}
+	for rows.Next() {
+		p, err := scanPlaylist(rows)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to scan playlist: %w", err)
+		}
+		playlists = append(playlists, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, fmt.Errorf("failed to read playlists: %w", err)
+	}
+	return playlists, total, nil
+}
+
+// PlaylistTracks returns the tracks of a playlist in order, repeats included.
+func (db *DB) PlaylistTracks(id int) ([]Track, error) {
+	tracks, err := db.queryTracks(`
+		SELECT `+trackColumns+` FROM playlist_tracks pt
+		JOIN audio_files ON audio_files.human_hash_id = pt.track_id
+		WHERE pt.playlist_id = ? ORDER BY pt.position`, id)
+	if err != nil {
+		return nil, err
+	}
+	if tracks == nil {
+		tracks = []Track{}
+	}
+	return tracks, nil
+}
+
+// CreatePlaylist stores a new playlist with the given name, comment, owner and
+// visibility, holding trackIDs in order, and returns it. The owner is the user with ID
+// p.OwnerID, whose name is recorded as Owner. It returns an error wrapping ErrNotFound
+// if a track or the owner does not exist.
+func (db *DB) CreatePlaylist(p Playlist, trackIDs []string) (Playlist, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return p, fmt.Errorf("failed to begin playlist transaction: %w", err)
+	}
+	defer tx.Rollback() // No-op once committed
+
+	err = tx.QueryRow("SELECT name FROM users WHERE id = ?", p.OwnerID).Scan(&p.Owner)
+	if err == sql.ErrNoRows {
+		return p, fmt.Errorf("owner %d of playlist %q: %w", p.OwnerID, p.Name, ErrNotFound)
+	}
+	if err != nil {
+		return p, fmt.Errorf("failed to query owner of playlist %q: %w", p.Name, err)
+	}
+	now := time.Now().Unix()
+	err = tx.QueryRow(`
+		INSERT INTO playlists (name, comment, owner, owner_id, public, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?) RETURNING id`, p.Name, p.Comment, p.Owner, p.OwnerID, p.Public, now, now).Scan(&p.ID)
+	if err != nil {
+		return p, fmt.Errorf("failed to insert playlist %q: %w", p.Name, err)
+	}
+	if err := setPlaylistTracks(tx, p.ID, trackIDs); err != nil {
+		return p, err
+	}
+	if err := tx.Commit(); err != nil {
+		return p, fmt.Errorf("failed to commit playlist %q: %w", p.Name, err)
+	}
+	return db.Playlist(p.ID)
+}
+
+// UpdatePlaylist saves the name, comment and visibility of an existing playlist, or
+// returns ErrNotFound.
+func (db *DB) UpdatePlaylist(p Playlist) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	res, err := db.conn.Exec(`UPDATE playlists SET name = ?, comment = ?, public = ?, updated_at = ? WHERE id = ?`,
+		p.Name, p.Comment, p.Public, time.Now().Unix(), p.ID)
+	if err != nil {
+		return fmt.Errorf("failed to update playlist %d: %w", p.ID, err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// SetPlaylistTracks replaces the tracks of a playlist with trackIDs, in order. It
+// returns ErrNotFound if the playlist does not exist, or an error wrapping ErrNotFound
+// if a track does not.
+func (db *DB) SetPlaylistTracks(id int, trackIDs []string) error {
+	return db.EditPlaylistTracks(id, func([]string) ([]string, error) { return trackIDs, nil })
+}
+
+// EditPlaylistTracks replaces the tracks of a playlist with what edit returns given
+// their IDs in order, in one transaction, so that concurrent edits are not lost. Errors
+// of edit are returned as is, changing nothing. It returns ErrNotFound if the playlist
+// does not exist, or an error wrapping ErrNotFound if a new track does not.
+func (db *DB) EditPlaylistTracks(id int, edit func(trackIDs []string) ([]string, error)) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin playlist transaction: %w", err)
+	}
+	defer tx.Rollback() // No-op once committed
+
+	res, err := tx.Exec("UPDATE playlists SET updated_at = ? WHERE id = ?", time.Now().Unix(), id)
+	if err != nil {
+		return fmt.Errorf("failed to update playlist %d: %w", id, err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	rows, err := tx.Query("SELECT track_id FROM playlist_tracks WHERE playlist_id = ? ORDER BY position", id)
+	if err != nil {
+		return fmt.Errorf("failed to query tracks of playlist %d: %w", id, err)
+	}
+	trackIDs := []string{}
+	for rows.Next() {
+		var trackID string
+		if err := rows.Scan(&trackID); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan track of playlist %d: %w", id, err)
+		}
+		trackIDs = append(trackIDs, trackID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to read tracks of playlist %d: %w", id, err)
+	}
+
+	if trackIDs, err = edit(trackIDs); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM playlist_tracks WHERE playlist_id = ?", id); err != nil {
+		return fmt.Errorf("failed to clear playlist %d: %w", id, err)
+	}
+	if err := setPlaylistTracks(tx, id, trackIDs); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit playlist %d: %w", id, err)
+	}
+	return nil
+}
+
+// setPlaylistTracks appends trackIDs to an empty playlist.
+func setPlaylistTracks(q querier, id int, trackIDs []string) error {
+	for i, trackID := range trackIDs {
+		// Selecting the track from audio_files inserts nothing if it does not exist
+		res, err := q.Exec(`
+			INSERT INTO playlist_tracks (playlist_id, position, track_id)
+			SELECT ?, ?, human_hash_id FROM audio_files WHERE human_hash_id = ?`, id, i, trackID)
+		if err != nil {
+			return fmt.Errorf("failed to add track %s to playlist %d: %w", trackID, id, err)
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return fmt.Errorf("%w: track %s", ErrNotFound, trackID)
+		}
+	}
+	return nil
+}
+
+// DeletePlaylist deletes a playlist, or returns ErrNotFound.
+func (db *DB) DeletePlaylist(id int) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	res, err := db.conn.Exec("DELETE FROM playlists WHERE id = ?", id)
+	if err != nil {
+		return fmt.Errorf("failed to delete playlist %d: %w", id, err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// RecordPlay adds a play of a track by a user at the given time to the play history,
+// or returns ErrNotFound if the track does not exist.
+func (db *DB) RecordPlay(trackID, user string, at time.Time) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	res, err := db.conn.Exec(`
+		INSERT INTO plays (track_id, username, played_at)
+		SELECT human_hash_id, ?, ? FROM audio_files WHERE human_hash_id = ?`, user, at.Unix(), trackID)
+	if err != nil {
+		return fmt.Errorf("failed to record play of track %s: %w", trackID, err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
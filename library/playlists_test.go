@@ -0,0 +1,120 @@
+package library
+
+import (
+	"errors"
+	"testing"
+)
+
+// addUser creates a user with a placeholder password hash.
+func addUser(t *testing.T, db *DB, name string) User {
+	t.Helper()
+	u, err := db.CreateUser(User{Name: name, PasswordHash: "hash", Role: UserRoleRegular})
+	if err != nil {
+		t.Fatalf("CreateUser(%s): %v", name, err)
+	}
+	return u
+}
+
+func TestCreatePlaylistOwner(t *testing.T) {
+	db := openTestDB(t)
+	alice := addUser(t, db, "Alice")
+
+	p, err := db.CreatePlaylist(Playlist{Name: "Mine", OwnerID: alice.ID, Owner: "someone else"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.OwnerID != alice.ID || p.Owner != "Alice" {
+		t.Errorf("owner = %d %q, want %d Alice", p.OwnerID, p.Owner, alice.ID)
+	}
+	if _, err := db.CreatePlaylist(Playlist{Name: "Nobody's"}, nil); !errors.Is(err, ErrNotFound) {
+		t.Errorf("playlist without an owner: %v, want ErrNotFound", err)
+	}
+}
+
+func TestPlaylistsVisibleByOwnerID(t *testing.T) {
+	db := openTestDB(t)
+	alice, bob := addUser(t, db, "alice"), addUser(t, db, "bob")
+	for _, p := range []Playlist{
+		{Name: "alice private", OwnerID: alice.ID},
+		{Name: "alice public", OwnerID: alice.ID, Public: true},
+		{Name: "bob private", OwnerID: bob.ID},
+	} {
+		if _, err := db.CreatePlaylist(p, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A playlist made anonymously before playlists needed an owner
+	if _, err := db.conn.Exec(`INSERT INTO playlists (name, owner, created_at, updated_at) VALUES ('guest private', 'guest', 0, 0)`); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		userID int
+		want   []string
+	}{
+		{alice.ID, []string{"alice private", "alice public"}},
+		{bob.ID, []string{"alice public", "bob private"}},
+		{0, []string{"alice public"}}, // Anonymous requests own nothing, not even guest playlists
+	} {
+		playlists, total, err := db.Playlists(tc.userID, PlaylistFilter{}, Page{Limit: -1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, p := range playlists {
+			names = append(names, p.Name)
+		}
+		if total != len(tc.want) || len(names) != len(tc.want) {
+			t.Errorf("user %d sees %v (total %d), want %v", tc.userID, names, total, tc.want)
+			continue
+		}
+		for i := range names {
+			if names[i] != tc.want[i] {
+				t.Errorf("user %d sees %v, want %v", tc.userID, names, tc.want)
+				break
+			}
+		}
+	}
+}
+
+func TestMigratePlaylistOwnerIDs(t *testing.T) {
+	db := openTestDB(t)
+	alice := addUser(t, db, "Alice")
+	if _, err := db.conn.Exec(`
+		INSERT INTO playlists (name, owner, created_at, updated_at)
+		VALUES ('by name', 'alice', 0, 0), ('by guest', 'guest', 0, 0)`); err != nil {
+		t.Fatal(err)
+	}
+
+	// Run the owner ID migration again over the rows inserted without an owner ID
+	m := migrations[len(migrations)-1]
+	if m.Description != "Playlist owners by user ID" {
+		t.Fatalf("last migration is %q", m.Description)
+	}
+	tx, err := db.conn.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	if err := m.apply(tx); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	owners := map[string]int{}
+	playlists, _, err := db.Playlists(alice.ID, PlaylistFilter{}, Page{Limit: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range playlists {
+		owners[p.Name] = p.OwnerID
+	}
+	if owners["by name"] != alice.ID {
+		t.Errorf("playlist owned by name alice has owner ID %d, want %d", owners["by name"], alice.ID)
+	}
+	if _, seen := owners["by guest"]; seen {
+		t.Errorf("private guest playlist was given to alice")
+	}
+}
@@ -0,0 +1,406 @@
+package library
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// TrackRepository reads tracks.
+type TrackRepository interface {
+	// Track returns one track with its genres, or ErrNotFound.
+	Track(id string) (Track, error)
+	// Tracks returns a page of the tracks matching f, and how many match in all.
+	Tracks(f TrackFilter, p Page) ([]Track, int, error)
+	// TracksByArtist includes tracks where the artist is credited in any role.
+	TracksByArtist(artistID int) ([]Track, error)
+	TracksByAlbum(albumID int) ([]Track, error)
+	// TracksByGenre matches every genre of a track, not only the primary one.
+	TracksByGenre(genreID int) ([]Track, error)
+	// TrackArtwork returns the embedded cover art of a track, falling back to the art
+	// linked to its album. It returns nil if there is none, or ErrNotFound.
+	TrackArtwork(id string) (*Artwork, error)
+	// RandomTracks returns up to n tracks matching f in random order.
+	RandomTracks(f TrackFilter, n int) ([]Track, error)
+}
+
+// AlbumRepository reads albums.
+type AlbumRepository interface {
+	Album(id int) (Album, error)
+	// AlbumInfo returns one album with its track count and total duration, or ErrNotFound.
+	AlbumInfo(id int) (AlbumInfo, error)
+	// Albums returns a page of the albums matching f, and how many match in all.
+	Albums(f AlbumFilter, p Page) ([]AlbumInfo, int, error)
+	// AlbumsByArtist returns the albums filed under an artist, oldest first.
+	AlbumsByArtist(artistID int) ([]AlbumInfo, error)
+	// RandomAlbums returns up to n albums matching f in random order.
+	RandomAlbums(f AlbumFilter, n int) ([]AlbumInfo, error)
+}
+
+// ArtistRepository reads artists.
+type ArtistRepository interface {
+	Artist(id int) (Artist, error)
+	// ArtistInfo returns one artist with their album and track counts, or ErrNotFound.
+	ArtistInfo(id int) (ArtistInfo, error)
+	// Artists returns a page of artists, and the number of artists in all.
+	Artists(p Page) ([]ArtistInfo, int, error)
+}
+
+// GenreRepository reads genres.
+type GenreRepository interface {
+	Genre(id int) (Genre, error)
+	// GenreByName returns the genre with a name, ignoring case, or ErrNotFound.
+	GenreByName(name string) (Genre, error)
+	// Genres returns a page of genres, and the number of genres in all.
+	Genres(p Page) ([]GenreInfo, int, error)
+}
+
+// SearchRepository searches the whole library.
+type SearchRepository interface {
+	// Search returns up to limit ranked tracks, albums and artists matching query.
+	Search(query string, limit int) (SearchResults, error)
+	// The fuzzy searches tolerate typos: each query word must be at least threshold
+	// similar (0 to 1) to a word of the result. Results are ordered by score.
+	FuzzySearchTracks(query string, threshold float64, limit int) ([]FuzzyTrack, error)
+	FuzzySearchAlbums(query string, threshold float64, limit int) ([]FuzzyAlbum, error)
+	FuzzySearchArtists(query string, threshold float64, limit int) ([]FuzzyArtist, error)
+}
+
+// PlaylistRepository reads and writes the playlists of users.
+type PlaylistRepository interface {
+	// Playlist returns one playlist with its track count and duration, or ErrNotFound.
+	Playlist(id int) (Playlist, error)
+	// Playlists returns a page of the playlists of the user with ID userID and the
+	// public playlists of others matching f, and how many match in all.
+	Playlists(userID int, f PlaylistFilter, p Page) ([]Playlist, int, error)
+	PlaylistTracks(id int) ([]Track, error)
+	CreatePlaylist(p Playlist, trackIDs []string) (Playlist, error)
+	// UpdatePlaylist saves the name, comment and visibility of p.
+	UpdatePlaylist(p Playlist) error
+	// SetPlaylistTracks replaces the tracks of a playlist.
+	SetPlaylistTracks(id int, trackIDs []string) error
+	// EditPlaylistTracks replaces the tracks of a playlist with what edit makes of them.
+	EditPlaylistTracks(id int, edit func(trackIDs []string) ([]string, error)) error
+	DeletePlaylist(id int) error
+}
+
+// PlayRepository records what users listen to.
+type PlayRepository interface {
+	RecordPlay(trackID, user string, at time.Time) error
+}
+
+// UserRepository reads and writes the accounts that can log in.
+type UserRepository interface {
+	// User and UserByName return one user, or ErrNotFound. Names ignore case.
+	User(id int) (User, error)
+	UserByName(name string) (User, error)
+	Users() ([]User, error)
+	CountUsers() (int, error)
+	// CreateUser returns ErrExists if the name is taken.
+	CreateUser(u User) (User, error)
+	// UpdateUser saves the password hash, Subsonic password, role and disabled flag of u.
+	UpdateUser(u User) error
+}
+
+// TokenRepository reads and writes the tokens users log in with. Expired tokens are
+// never returned.
+type TokenRepository interface {
+	CreateToken(t Token) (Token, error)
+	// TokenByHash returns the token with a hash and its user, or ErrNotFound.
+	TokenByHash(hash string) (Token, User, error)
+	Token(id int) (Token, error)
+	// Tokens returns the tokens of a user, newest first.
+	Tokens(userID int) ([]Token, error)
+	TouchToken(id int, at time.Time) error
+	DeleteToken(id int) error
+	// DeleteUserTokens deletes the tokens of one kind of a user.
+	DeleteUserTokens(userID int, kind string) error
+}
+
+// Repository gives typed read access to the whole library, and read-write access to
+// what users keep in it and to the users themselves.
+type Repository interface {
+	TrackRepository
+	AlbumRepository
+	ArtistRepository
+	GenreRepository
+	SearchRepository
+	PlaylistRepository
+	PlayRepository
+	UserRepository
+	TokenRepository
+}
+
+var _ Repository = (*DB)(nil)
+
+// trackColumns selects the audio_files columns read by scanTrack, with the names of the
+// track's primary artist and album looked up so that callers need no joins.
+const trackColumns = `human_hash_id, title, artist_id, album_id, file_path,
+	COALESCE((SELECT artists.name FROM artists WHERE artists.id = artist_id), ''),
+	COALESCE((SELECT albums.title FROM albums WHERE albums.id = album_id), ''),
+	COALESCE(track_number, 0), COALESCE(disc_number, 0), COALESCE(year, 0), COALESCE(added_at, 0),
+	COALESCE(duration_seconds, 0), lossless, COALESCE(codec, ''), COALESCE(container, ''),
+	COALESCE(bitrate, 0), COALESCE(sample_rate, 0), COALESCE(bit_depth, 0), COALESCE(channels, 0)`
+
+// rowScanner is implemented by *sql.Row and *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+// scanTrack reads a Track from a row selected with trackColumns.
+func scanTrack(row rowScanner) (Track, error) {
+	var t Track
+	err := row.Scan(&t.ID, &t.Title, &t.ArtistID, &t.AlbumID, &t.FilePath,
+		&t.ArtistName, &t.AlbumTitle, &t.TrackNumber, &t.DiscNumber, &t.Year, &t.AddedAt,
+		&t.DurationSeconds, &t.Lossless, &t.Codec, &t.Container,
+		&t.Bitrate, &t.SampleRate, &t.BitDepth, &t.Channels)
+	return t, err
+}
+
+// queryTracks runs a query selecting trackColumns and collects the tracks.
+func (db *DB) queryTracks(query string, args ...any) ([]Track, error) {
+	rows, err := db.conn.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query tracks: %w", err)
+	}
+	defer rows.Close()
+
+	var tracks []Track
+	for rows.Next() {
+		t, err := scanTrack(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan track: %w", err)
+		}
+		tracks = append(tracks, t)
+	}
+	return tracks, rows.Err()
+}
+
+// Track returns one track with its genres, or ErrNotFound.
+func (db *DB) Track(id string) (Track, error) {
+	t, err := scanTrack(db.conn.QueryRow(`SELECT `+trackColumns+` FROM audio_files WHERE human_hash_id = ?`, id))
+	if err == sql.ErrNoRows {
+		return t, ErrNotFound
+	}
+	if err != nil {
+		return t, fmt.Errorf("failed to query track %s: %w", id, err)
+	}
+	if t.Genres, err = db.trackGenres(id); err != nil {
+		return t, err
+	}
+	return t, nil
+}
+
+// trackGenres returns the genre names of a track in tag order.
+func (db *DB) trackGenres(trackID string) ([]string, error) {
+	rows, err := db.conn.Query(`
+		SELECT g.name FROM track_genres tg JOIN genres g ON g.id = tg.genre_id
+		WHERE tg.track_id = ? ORDER BY tg.position`, trackID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query genres of track %s: %w", trackID, err)
+	}
+	defer rows.Close()
+
+	var genres []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, fmt.Errorf("failed to scan genre: %w", err)
+		}
+		genres = append(genres, name)
+	}
+	return genres, rows.Err()
+}
+
+// TracksByArtist returns the tracks where the artist is credited in any role (main,
+// featured or composer).
+func (db *DB) TracksByArtist(artistID int) ([]Track, error) {
+	return db.queryTracks(`
+		SELECT `+trackColumns+` FROM audio_files
+		WHERE artist_id = ? OR human_hash_id IN (SELECT track_id FROM track_artists WHERE artist_id = ?)`, artistID, artistID)
+}
+
+// TracksByAlbum returns the tracks of an album in disc and track number order.
+func (db *DB) TracksByAlbum(albumID int) ([]Track, error) {
+	return db.queryTracks(`SELECT `+trackColumns+` FROM audio_files WHERE album_id = ? ORDER BY `+trackNumberOrder, albumID)
+}
+
+// TracksByGenre returns the tracks that have the genre, as primary genre or otherwise.
+func (db *DB) TracksByGenre(genreID int) ([]Track, error) {
+	return db.queryTracks(`
+		SELECT `+trackColumns+` FROM audio_files
+		WHERE genre_id = ? OR human_hash_id IN (SELECT track_id FROM track_genres WHERE genre_id = ?)`, genreID, genreID)
+}
+
+// TrackArtwork prefers the track's own embedded picture, then the one linked to its album.
+func (db *DB) TrackArtwork(id string) (*Artwork, error) {
+	var (
+		artID            sql.NullInt64
+		hash, mime, path sql.NullString
+	)
+	err := db.conn.QueryRow(`
+		SELECT aw.id, aw.hash, aw.mime_type, aw.file_path
+		FROM audio_files af
+		LEFT JOIN albums al ON al.id = af.album_id
+		LEFT JOIN artwork aw ON aw.id = COALESCE(af.artwork_id, al.artwork_id)
+		WHERE af.human_hash_id = ?`, id).Scan(&artID, &hash, &mime, &path)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query artwork of track %s: %w", id, err)
+	}
+	if !artID.Valid {
+		return nil, nil
+	}
+	return &Artwork{ID: int(artID.Int64), Hash: hash.String, MimeType: mime.String, FilePath: path.String}, nil
+}
+
+// albumColumns selects the album columns read by scanAlbum from albums al joined with
+// artists ar.
+const albumColumns = `al.id, al.title, al.artist_id, ar.name, COALESCE(al.release_year, 0), al.compilation`
+
+// scanAlbum reads an Album from a row selected with albumColumns.
+func scanAlbum(row rowScanner) (Album, error) {
+	var a Album
+	err := row.Scan(&a.ID, &a.Title, &a.ArtistID, &a.ArtistName, &a.Year, &a.Compilation)
+	return a, err
+}
+
+// Album returns one album, or ErrNotFound.
+func (db *DB) Album(id int) (Album, error) {
+	a, err := scanAlbum(db.conn.QueryRow(`
+		SELECT `+albumColumns+` FROM albums al JOIN artists ar ON ar.id = al.artist_id
+		WHERE al.id = ?`, id))
+	if err == sql.ErrNoRows {
+		return a, ErrNotFound
+	}
+	if err != nil {
+		return a, fmt.Errorf("failed to query album %d: %w", id, err)
+	}
+	return a, nil
+}
+
+// albumInfoSelect selects albumColumns and the totals read by scanAlbumInfo; callers
+// append a WHERE clause, if any, and then GROUP BY al.id.
+const albumInfoSelect = `
+	SELECT ` + albumColumns + `, COUNT(af.human_hash_id), COALESCE(SUM(af.duration_seconds), 0),
+		COALESCE(MAX(af.added_at), 0)
+	FROM albums al JOIN artists ar ON ar.id = al.artist_id
+	LEFT JOIN audio_files af ON af.album_id = al.id`
+
+// scanAlbumInfo reads an AlbumInfo from a row selected with albumInfoSelect.
+func scanAlbumInfo(row rowScanner) (AlbumInfo, error) {
+	var a AlbumInfo
+	err := row.Scan(&a.ID, &a.Title, &a.ArtistID, &a.ArtistName, &a.Year, &a.Compilation,
+		&a.TrackCount, &a.DurationSeconds, &a.AddedAt)
+	return a, err
+}
+
+// AlbumInfo returns one album with its totals, or ErrNotFound.
+func (db *DB) AlbumInfo(id int) (AlbumInfo, error) {
+	a, err := scanAlbumInfo(db.conn.QueryRow(albumInfoSelect+` WHERE al.id = ? GROUP BY al.id`, id))
+	if err == sql.ErrNoRows {
+		return a, ErrNotFound
+	}
+	if err != nil {
+		return a, fmt.Errorf("failed to query album %d: %w", id, err)
+	}
+	return a, nil
+}
+
+// AlbumsByArtist returns the albums filed under an artist by release year, then title.
+func (db *DB) AlbumsByArtist(artistID int) ([]AlbumInfo, error) {
+	rows, err := db.conn.Query(albumInfoSelect+`
+		WHERE al.artist_id = ? GROUP BY al.id
+		ORDER BY COALESCE(al.release_year, 0) = 0, al.release_year, al.title`, artistID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query albums of artist %d: %w", artistID, err)
+	}
+	defer rows.Close()
+	return collectAlbumInfo(rows)
+}
+
+// collectAlbumInfo reads every row selected with albumInfoSelect.
+func collectAlbumInfo(rows *sql.Rows) ([]AlbumInfo, error) {
+	albums := []AlbumInfo{}
+	for rows.Next() {
+		a, err := scanAlbumInfo(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan album: %w", err)
+		}
+		albums = append(albums, a)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read albums: %w", err)
+	}
+	return albums, nil
+}
+
+// Artist returns one artist, or ErrNotFound.
+func (db *DB) Artist(id int) (Artist, error) {
+	a := Artist{ID: id}
+	err := db.conn.QueryRow("SELECT name FROM artists WHERE id = ?", id).Scan(&a.Name)
+	if err == sql.ErrNoRows {
+		return a, ErrNotFound
+	}
+	if err != nil {
+		return a, fmt.Errorf("failed to query artist %d: %w", id, err)
+	}
+	return a, nil
+}
+
+// artistInfoSelect selects the artist columns and counts read by scanArtistInfo from
+// artists ar; callers append a WHERE or ORDER BY clause, and may order by the counts as
+// album_count and track_count. Tracks are counted the way TracksByArtist finds them.
+const artistInfoSelect = `
+	SELECT ar.id, ar.name,
+		(SELECT COUNT(*) FROM albums al WHERE al.artist_id = ar.id) AS album_count,
+		(SELECT COUNT(*) FROM audio_files af WHERE af.artist_id = ar.id
+			OR af.human_hash_id IN (SELECT track_id FROM track_artists WHERE artist_id = ar.id)) AS track_count
+	FROM artists ar`
+
+// scanArtistInfo reads an ArtistInfo from a row selected with artistInfoSelect.
+func scanArtistInfo(row rowScanner) (ArtistInfo, error) {
+	var a ArtistInfo
+	err := row.Scan(&a.ID, &a.Name, &a.AlbumCount, &a.TrackCount)
+	return a, err
+}
+
+// ArtistInfo returns one artist with their counts, or ErrNotFound.
+func (db *DB) ArtistInfo(id int) (ArtistInfo, error) {
+	a, err := scanArtistInfo(db.conn.QueryRow(artistInfoSelect+` WHERE ar.id = ?`, id))
+	if err == sql.ErrNoRows {
+		return a, ErrNotFound
+	}
+	if err != nil {
+		return a, fmt.Errorf("failed to query artist %d: %w", id, err)
+	}
+	return a, nil
+}
+
+// Genre returns one genre, or ErrNotFound.
+func (db *DB) Genre(id int) (Genre, error) {
+	g := Genre{ID: id}
+	err := db.conn.QueryRow("SELECT name FROM genres WHERE id = ?", id).Scan(&g.Name)
+	if err == sql.ErrNoRows {
+		return g, ErrNotFound
+	}
+	if err != nil {
+		return g, fmt.Errorf("failed to query genre %d: %w", id, err)
+	}
+	return g, nil
+}
+
+// GenreByName returns the genre with a name, ignoring case, or ErrNotFound.
+func (db *DB) GenreByName(name string) (Genre, error) {
+	var g Genre
+	err := db.conn.QueryRow("SELECT id, name FROM genres WHERE name = ?", name).Scan(&g.ID, &g.Name)
+	if err == sql.ErrNoRows {
+		return g, ErrNotFound
+	}
+	if err != nil {
+		return g, fmt.Errorf("failed to query genre %q: %w", name, err)
+	}
+	return g, nil
+}
@@ -0,0 +1,121 @@
+package library
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// trackSearchSelect selects the track_search columns (track_id, title, artists, album,
+// genres) of audio_files af; callers append a WHERE clause.
+const trackSearchSelect = `
+	SELECT af.human_hash_id, af.title,
+		COALESCE((SELECT group_concat(ar.name, ' ') FROM track_artists ta JOIN artists ar ON ar.id = ta.artist_id
+			WHERE ta.track_id = af.human_hash_id), ''),
+		al.title,
+		COALESCE((SELECT group_concat(g.name, ' ') FROM track_genres tg JOIN genres g ON g.id = tg.genre_id
+			WHERE tg.track_id = af.human_hash_id), '')
+	FROM audio_files af JOIN albums al ON al.id = af.album_id`
+
+// indexTrack refreshes the full-text search row of a track from its current title,
+// artist credits, album and genres.
+func indexTrack(q querier, trackID string) error {
+	_, err := q.Exec(`
+		INSERT INTO track_search (track_id, title, artists, album, genres)
+		`+trackSearchSelect+` WHERE af.human_hash_id = ?
+		ON CONFLICT (track_id) DO UPDATE SET
+			title = excluded.title, artists = excluded.artists, album = excluded.album, genres = excluded.genres`, trackID)
+	if err != nil {
+		return fmt.Errorf("failed to index track %s for search: %w", trackID, err)
+	}
+	return nil
+}
+
+// SearchResults holds the best matches of each kind for a search query.
+type SearchResults struct {
+	Tracks  []Track  `json:"tracks"`
+	Albums  []Album  `json:"albums"`
+	Artists []Artist `json:"artists"`
+}
+
+// ftsQuery turns free text into an FTS5 query that matches every word as a prefix, so
+// "beat rev" finds "Beatles - Revolver". Words are quoted, which makes FTS5 syntax in
+// the input match literally. It returns "" if the text has no words.
+func ftsQuery(text string) string {
+	terms := words(text)
+	for i, word := range terms {
+		terms[i] = `"` + word + `"*`
+	}
+	return strings.Join(terms, " ")
+}
+
+// words splits text into words of letters and digits.
+func words(text string) []string {
+	return strings.FieldsFunc(text, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// Search returns up to limit tracks, albums and artists matching every word of query,
+// each list ordered by relevance. Matching ignores case and diacritics, and a track
+// matches on its title, credited artists, album and genres, in falling order of weight.
+func (db *DB) Search(query string, limit int) (SearchResults, error) {
+	results := SearchResults{Tracks: []Track{}, Albums: []Album{}, Artists: []Artist{}}
+	match := ftsQuery(query)
+	if match == "" {
+		return results, nil
+	}
+
+	tracks, err := db.queryTracks(`
+		SELECT `+trackColumns+` FROM audio_files af
+		JOIN (
+			SELECT ts.track_id, bm25(tracks_fts, 10.0, 5.0, 3.0, 1.0) AS score
+			FROM tracks_fts JOIN track_search ts ON ts.id = tracks_fts.rowid
+			WHERE tracks_fts MATCH ? ORDER BY score LIMIT ?
+		) m ON m.track_id = af.human_hash_id
+		ORDER BY m.score`, match, limit)
+	if err != nil {
+		return results, fmt.Errorf("failed to search tracks: %w", err)
+	}
+	if tracks != nil {
+		results.Tracks = tracks
+	}
+
+	rows, err := db.conn.Query(`
+		SELECT `+albumColumns+` FROM albums_fts
+		JOIN albums al ON al.id = albums_fts.rowid JOIN artists ar ON ar.id = al.artist_id
+		WHERE albums_fts MATCH ? ORDER BY bm25(albums_fts, 5.0, 1.0) LIMIT ?`, match, limit)
+	if err != nil {
+		return results, fmt.Errorf("failed to search albums: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		a, err := scanAlbum(rows)
+		if err != nil {
+			return results, fmt.Errorf("failed to scan album: %w", err)
+		}
+		results.Albums = append(results.Albums, a)
+	}
+	if err := rows.Err(); err != nil {
+		return results, fmt.Errorf("failed to search albums: %w", err)
+	}
+
+	rows, err = db.conn.Query(`
+		SELECT ar.id, ar.name FROM artists_fts JOIN artists ar ON ar.id = artists_fts.rowid
+		WHERE artists_fts MATCH ? ORDER BY rank LIMIT ?`, match, limit)
+	if err != nil {
+		return results, fmt.Errorf("failed to search artists: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var a Artist
+		if err := rows.Scan(&a.ID, &a.Name); err != nil {
+			return results, fmt.Errorf("failed to scan artist: %w", err)
+		}
+		results.Artists = append(results.Artists, a)
+	}
+	if err := rows.Err(); err != nil {
+		return results, fmt.Errorf("failed to search artists: %w", err)
+	}
+	return results, nil
+}
@@ -0,0 +1,131 @@
+package library
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// tokenColumns selects the tokens columns read by scanToken.
+const tokenColumns = `t.id, t.user_id, t.kind, t.name, t.hash, t.created_at, t.expires_at, t.last_used_at`
+
+// tokenLive matches tokens that have not expired; it takes the current Unix time.
+const tokenLive = `(t.expires_at = 0 OR t.expires_at > ?)`
+
+// scanToken reads a Token from a row selected with tokenColumns, followed by dest.
+func scanToken(row rowScanner, dest ...any) (Token, error) {
+	var t Token
+	err := row.Scan(append([]any{&t.ID, &t.UserID, &t.Kind, &t.Name, &t.Hash, &t.CreatedAt, &t.ExpiresAt, &t.LastUsedAt}, dest...)...)
+	return t, err
+}
+
+// CreateToken stores a new token with the user, kind, name, hash and expiry of t, and
+// returns it. Expired tokens of the user are deleted on the way.
+func (db *DB) CreateToken(t Token) (Token, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	now := time.Now().Unix()
+	if _, err := db.conn.Exec(`DELETE FROM tokens WHERE user_id = ? AND expires_at != 0 AND expires_at <= ?`, t.UserID, now); err != nil {
+		return t, fmt.Errorf("failed to delete expired tokens of user %d: %w", t.UserID, err)
+	}
+	err := db.conn.QueryRow(`
+		INSERT INTO tokens (user_id, kind, name, hash, created_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?) RETURNING id`, t.UserID, t.Kind, t.Name, t.Hash, now, t.ExpiresAt).Scan(&t.ID)
+	if err != nil {
+		return t, fmt.Errorf("failed to insert token for user %d: %w", t.UserID, err)
+	}
+	t.CreatedAt = now
+	return t, nil
+}
+
+// TokenByHash returns the unexpired token with a hash and the user it belongs to, or
+// ErrNotFound.
+func (db *DB) TokenByHash(hash string) (Token, User, error) {
+	var u User
+	t, err := scanToken(db.conn.QueryRow(`
+		SELECT `+tokenColumns+`, u.id, u.name, u.password_hash, u.role, u.disabled, u.created_at, u.updated_at
+		FROM tokens t JOIN users u ON u.id = t.user_id
+		WHERE t.hash = ? AND `+tokenLive, hash, time.Now().Unix()),
+		&u.ID, &u.Name, &u.PasswordHash, &u.Role, &u.Disabled, &u.CreatedAt, &u.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return t, u, ErrNotFound
+	}
+	if err != nil {
+		return t, u, fmt.Errorf("failed to query token: %w", err)
+	}
+	return t, u, nil
+}
+
+// Token returns one unexpired token, or ErrNotFound.
+func (db *DB) Token(id int) (Token, error) {
+	t, err := scanToken(db.conn.QueryRow(`SELECT `+tokenColumns+` FROM tokens t WHERE t.id = ? AND `+tokenLive,
+		id, time.Now().Unix()))
+	if err == sql.ErrNoRows {
+		return t, ErrNotFound
+	}
+	if err != nil {
+		return t, fmt.Errorf("failed to query token %d: %w", id, err)
+	}
+	return t, nil
+}
+
+// Tokens returns the unexpired tokens of a user, newest first.
+func (db *DB) Tokens(userID int) ([]Token, error) {
+	rows, err := db.conn.Query(`SELECT `+tokenColumns+` FROM tokens t WHERE t.user_id = ? AND `+tokenLive+`
+		ORDER BY t.created_at DESC, t.id DESC`, userID, time.Now().Unix())
+	if err != nil {
+		return nil, fmt.Errorf("failed to query tokens of user %d: %w", userID, err)
+	}
+	defer rows.Close()
+
+	tokens := []Token{}
+	for rows.Next() {
+		t, err := scanToken(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan token: %w", err)
+		}
+		tokens = append(tokens, t)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read tokens: %w", err)
+	}
+	return tokens, nil
+}
+
+// TouchToken records that a token was used at a time.
+func (db *DB) TouchToken(id int, at time.Time) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, err := db.conn.Exec("UPDATE tokens SET last_used_at = ? WHERE id = ?", at.Unix(), id); err != nil {
+		return fmt.Errorf("failed to update token %d: %w", id, err)
+	}
+	return nil
+}
+
+// DeleteToken revokes a token, or returns ErrNotFound.
+func (db *DB) DeleteToken(id int) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	res, err := db.conn.Exec("DELETE FROM tokens WHERE id = ?", id)
+	if err != nil {
+		return fmt.Errorf("failed to delete token %d: %w", id, err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// DeleteUserTokens revokes every token of one kind of a user.
+func (db *DB) DeleteUserTokens(userID int, kind string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, err := db.conn.Exec("DELETE FROM tokens WHERE user_id = ? AND kind = ?", userID, kind); err != nil {
+		return fmt.Errorf("failed to delete %s tokens of user %d: %w", kind, userID, err)
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package library
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// userColumns selects the users columns read by scanUser.
+const userColumns = `id, name, password_hash, subsonic_password, role, disabled, created_at, updated_at`
+
+// scanUser reads a User from a row selected with userColumns.
+func scanUser(row rowScanner) (User, error) {
+	var u User
+	err := row.Scan(&u.ID, &u.Name, &u.PasswordHash, &u.SubsonicPassword, &u.Role, &u.Disabled, &u.CreatedAt, &u.UpdatedAt)
+	return u, err
+}
+
+// User returns one user, or ErrNotFound.
+func (db *DB) User(id int) (User, error) {
+	u, err := scanUser(db.conn.QueryRow(`SELECT `+userColumns+` FROM users WHERE id = ?`, id))
+	if err == sql.ErrNoRows {
+		return u, ErrNotFound
+	}
+	if err != nil {
+		return u, fmt.Errorf("failed to query user %d: %w", id, err)
+	}
+	return u, nil
+}
+
+// UserByName returns the user with a name, ignoring case, or ErrNotFound.
+func (db *DB) UserByName(name string) (User, error) {
+	u, err := scanUser(db.conn.QueryRow(`SELECT `+userColumns+` FROM users WHERE name = ?`, name))
+	if err == sql.ErrNoRows {
+		return u, ErrNotFound
+	}
+	if err != nil {
+		return u, fmt.Errorf("failed to query user %q: %w", name, err)
+	}
+	return u, nil
+}
+
+// Users returns every user by name.
+func (db *DB) Users() ([]User, error) {
+	rows, err := db.conn.Query(`SELECT ` + userColumns + ` FROM users ORDER BY name, id`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query users: %w", err)
+	}
+	defer rows.Close()
+
+	users := []User{}
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan user: %w", err)
+		}
+		users = append(users, u)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read users: %w", err)
+	}
+	return users, nil
+}
+
+// CountUsers returns the number of users, disabled ones included.
+func (db *DB) CountUsers() (int, error) {
+	var n int
+	if err := db.conn.QueryRow("SELECT COUNT(*) FROM users").Scan(&n); err != nil {
+		return 0, fmt.Errorf("failed to count users: %w", err)
+	}
+	return n, nil
+}
+
+// CreateUser stores a new user with the name, password hash, role and disabled flag of
+// u, without a Subsonic password, and returns it. It returns ErrExists if the name is
+// taken, ignoring case.
+func (db *DB) CreateUser(u User) (User, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	now := time.Now().Unix()
+	err := db.conn.QueryRow(`
+		INSERT INTO users (name, password_hash, role, disabled, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?) RETURNING id`, u.Name, u.PasswordHash, u.Role, u.Disabled, now, now).Scan(&u.ID)
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE constraint failed") {
+			return u, ErrExists
+		}
+		return u, fmt.Errorf("failed to insert user %q: %w", u.Name, err)
+	}
+	u.CreatedAt, u.UpdatedAt = now, now
+	return u, nil
+}
+
+// UpdateUser saves the password hash, Subsonic password, role and disabled flag of an
+// existing user, or returns ErrNotFound. Names cannot change, since playlists and plays refer to them.
+func (db *DB) UpdateUser(u User) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	res, err := db.conn.Exec(`
+		UPDATE users SET password_hash = ?, subsonic_password = ?, role = ?, disabled = ?, updated_at = ?
+		WHERE id = ?`, u.PasswordHash, u.SubsonicPassword, u.Role, u.Disabled, time.Now().Unix(), u.ID)
+	if err != nil {
+		return fmt.Errorf("failed to update user %d: %w", u.ID, err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
@@ -0,0 +1,282 @@
+package library
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Writer saves audio files in batched transactions. Committing once per batch instead of
+// once per statement is what makes indexing a large library fast, since every commit
+// waits for the disk. A Writer also caches the IDs of the artists, albums, genres and
+// artwork it has seen, so the next track by a known artist costs no lookup.
+//
+// A Writer is not safe for concurrent use; the indexer feeds it from a single goroutine.
+// Saved files become visible to other connections when their batch is committed, and
+// the batch must be committed before any other write method of DB is called.
+type Writer struct {
+	db      *DB
+	tx      *sql.Tx
+	pending int // Files saved in tx
+
+	artists map[string]int // Keyed by foldCase(name)
+	albums  map[albumKey]*albumEntry
+	genres  map[string]int // Keyed by foldCase(name)
+	artwork map[string]int // Keyed by content hash
+}
+
+// albumKey identifies an album the way GetOrInsertAlbum does.
+type albumKey struct {
+	title    string // foldCase(title)
+	artistID int
+}
+
+// albumEntry remembers what the Writer has written for an album, to skip redundant updates.
+type albumEntry struct {
+	id          int
+	compilation bool // Known to be marked as a compilation
+	hasArtwork  bool // Known to have artwork linked
+}
+
+// NewWriter creates a Writer with empty caches.
+func (db *DB) NewWriter() *Writer {
+	w := &Writer{db: db}
+	w.Reset()
+	return w
+}
+
+// Reset forgets every cached ID. Call it after rows may have been deleted behind the
+// Writer's back, e.g. by PruneAudioFiles.
+func (w *Writer) Reset() {
+	w.artists = make(map[string]int)
+	w.albums = make(map[albumKey]*albumEntry)
+	w.genres = make(map[string]int)
+	w.artwork = make(map[string]int)
+}
+
+// Pending returns the number of files saved since the last commit.
+func (w *Writer) Pending() int {
+	return w.pending
+}
+
+// Save adds af to the current batch, beginning one if needed. The names of its artists,
+// album and genres are resolved to IDs, inserting the ones that are new, and af is
+// updated as by UpsertAudioFile. If saving fails, none of af's changes are kept but the
+// rest of the batch is unaffected.
+func (w *Writer) Save(af *AudioFile) (SaveOutcome, error) {
+	// Acquire mutex for database write operations
+	w.db.mu.Lock()
+	defer w.db.mu.Unlock()
+
+	if w.tx == nil {
+		tx, err := w.db.conn.Begin()
+		if err != nil {
+			return SaveSkipped, fmt.Errorf("failed to begin batch transaction: %w", err)
+		}
+		w.tx = tx
+	}
+
+	// A savepoint lets one broken file be undone without losing the whole batch
+	if _, err := w.tx.Exec("SAVEPOINT audio_file"); err != nil {
+		return SaveSkipped, fmt.Errorf("failed to begin saving %s: %w", af.FilePath, err)
+	}
+	outcome, err := w.save(af)
+	if err != nil {
+		// The rollback may drop rows whose IDs were just cached
+		w.Reset()
+		if _, rbErr := w.tx.Exec("ROLLBACK TO audio_file"); rbErr != nil {
+			w.rollback()
+			return SaveSkipped, fmt.Errorf("%w (batch lost: failed to roll back: %v)", err, rbErr)
+		}
+	}
+	if _, relErr := w.tx.Exec("RELEASE audio_file"); relErr != nil && err == nil {
+		err = fmt.Errorf("failed to finish saving %s: %w", af.FilePath, relErr)
+	}
+	if err != nil {
+		return SaveSkipped, err
+	}
+	w.pending++
+	return outcome, nil
+}
+
+// save runs the statements for one file inside the current transaction.
+func (w *Writer) save(af *AudioFile) (SaveOutcome, error) {
+	var err error
+	if af.Artwork != nil {
+		// Missing art is not worth losing the track over
+		if af.ArtworkID, err = w.artworkID(af.Artwork); err != nil {
+			log.Printf("Could not record cover art of %q: %v", af.FilePath, err)
+			af.ArtworkID = 0
+		}
+	}
+
+	if af.ArtistID, err = w.artistID(af.ArtistName); err != nil {
+		return SaveSkipped, fmt.Errorf("failed to get/insert artist %q for %q: %w", af.ArtistName, af.FilePath, err)
+	}
+	for c := range af.Credits {
+		credit := &af.Credits[c]
+		if credit.ArtistID, err = w.artistID(credit.Name); err != nil {
+			return SaveSkipped, fmt.Errorf("failed to get/insert credited artist %q for %q: %w", credit.Name, af.FilePath, err)
+		}
+	}
+	af.AlbumArtistID = af.ArtistID
+	if !strings.EqualFold(af.AlbumArtistName, af.ArtistName) {
+		if af.AlbumArtistID, err = w.artistID(af.AlbumArtistName); err != nil {
+			return SaveSkipped, fmt.Errorf("failed to get/insert album artist %q for %q: %w", af.AlbumArtistName, af.FilePath, err)
+		}
+	}
+
+	if af.AlbumID, err = w.albumID(af); err != nil {
+		return SaveSkipped, fmt.Errorf("failed to get/insert album %q by artist ID %d for %q: %w", af.AlbumTitle, af.AlbumArtistID, af.FilePath, err)
+	}
+
+	af.GenreIDs = af.GenreIDs[:0]
+	for _, genre := range af.Genres {
+		genreID, err := w.genreID(genre)
+		if err != nil {
+			return SaveSkipped, fmt.Errorf("failed to get/insert genre %q for %q: %w", genre, af.FilePath, err)
+		}
+		af.GenreIDs = append(af.GenreIDs, genreID)
+	}
+	af.GenreID = 0 // Stays 0 if the track has no genre
+	if len(af.GenreIDs) > 0 {
+		af.GenreID = af.GenreIDs[0]
+	}
+
+	// Insert the audio file record, or refresh it if the file changed since the last run
+	outcome, err := upsertAudioFile(w.tx, af)
+	if err != nil {
+		return SaveSkipped, fmt.Errorf("failed to save audio file record %q: %w", af.FilePath, err)
+	}
+	if outcome != SaveSkipped {
+		if err := setTrackArtists(w.tx, af.HumanHashID, af.Credits); err != nil {
+			return SaveSkipped, fmt.Errorf("failed to save artist credits for %q: %w", af.FilePath, err)
+		}
+		if err := setTrackGenres(w.tx, af.HumanHashID, af.GenreIDs); err != nil {
+			return SaveSkipped, fmt.Errorf("failed to save genres for %q: %w", af.FilePath, err)
+		}
+		if err := indexTrack(w.tx, af.HumanHashID); err != nil {
+			return SaveSkipped, err
+		}
+	}
+	return outcome, nil
+}
+
+// artistID returns the ID of the named artist, inserting it if needed.
+func (w *Writer) artistID(name string) (int, error) {
+	key := foldCase(name)
+	if id, ok := w.artists[key]; ok {
+		return id, nil
+	}
+	id, err := getOrInsertArtist(w.tx, name)
+	if err != nil {
+		return 0, err
+	}
+	w.artists[key] = id
+	return id, nil
+}
+
+// albumID returns the ID of the album of af, inserting it if needed, and marks it as a
+// compilation or links af's artwork to it as GetOrInsertAlbum and
+// SetAlbumArtworkIfMissing would.
+func (w *Writer) albumID(af *AudioFile) (int, error) {
+	key := albumKey{foldCase(af.AlbumTitle), af.AlbumArtistID}
+	album, ok := w.albums[key]
+	if !ok {
+		id, err := getOrInsertAlbum(w.tx, af.AlbumTitle, af.AlbumArtistID, af.Year, af.Compilation)
+		if err != nil {
+			return 0, err
+		}
+		album = &albumEntry{id: id, compilation: af.Compilation}
+		w.albums[key] = album
+	} else if af.Compilation && !album.compilation {
+		if _, err := w.tx.Exec("UPDATE albums SET compilation = 1 WHERE id = ? AND compilation = 0", album.id); err != nil {
+			return 0, fmt.Errorf("failed to mark album as compilation: %w", err)
+		}
+		album.compilation = true
+	}
+
+	if af.ArtworkID != 0 && !album.hasArtwork {
+		if err := setAlbumArtworkIfMissing(w.tx, album.id, af.ArtworkID); err != nil {
+			log.Printf("Could not link cover art to album %q: %v", af.AlbumTitle, err)
+		} else {
+			album.hasArtwork = true
+		}
+	}
+	return album.id, nil
+}
+
+// genreID returns the ID of the named genre, inserting it if needed.
+func (w *Writer) genreID(name string) (int, error) {
+	key := foldCase(name)
+	if id, ok := w.genres[key]; ok {
+		return id, nil
+	}
+	id, err := getOrInsertGenre(w.tx, name)
+	if err != nil {
+		return 0, err
+	}
+	w.genres[key] = id
+	return id, nil
+}
+
+// artworkID returns the ID of the artwork, recording it if needed.
+func (w *Writer) artworkID(art *Artwork) (int, error) {
+	if id, ok := w.artwork[art.Hash]; ok {
+		return id, nil
+	}
+	id, err := getOrInsertArtwork(w.tx, art.Hash, art.MimeType, art.FilePath)
+	if err != nil {
+		return 0, err
+	}
+	w.artwork[art.Hash] = id
+	return id, nil
+}
+
+// Commit commits the current batch, if there is one, and returns the number of files
+// it held. If the commit fails the batch is lost.
+func (w *Writer) Commit() (int, error) {
+	w.db.mu.Lock()
+	defer w.db.mu.Unlock()
+
+	if w.tx == nil {
+		return 0, nil
+	}
+	n := w.pending
+	err := w.tx.Commit()
+	w.tx, w.pending = nil, 0
+	if err != nil {
+		w.Reset()
+		return 0, fmt.Errorf("failed to commit batch of %d files: %w", n, err)
+	}
+	return n, nil
+}
+
+// Rollback discards the current batch, if there is one.
+func (w *Writer) Rollback() {
+	w.db.mu.Lock()
+	defer w.db.mu.Unlock()
+	w.rollback()
+}
+
+// rollback discards the current batch. The caller must hold db.mu.
+func (w *Writer) rollback() {
+	if w.tx == nil {
+		return
+	}
+	w.tx.Rollback()
+	w.tx, w.pending = nil, 0
+	w.Reset()
+}
+
+// foldCase lower-cases ASCII letters only, which is how SQLite's NOCASE collation
+// compares names, so cache keys never merge names the database keeps apart.
+func foldCase(s string) string {
+	return strings.Map(func(r rune) rune {
+		if 'A' <= r && r <= 'Z' {
+			return r + 'a' - 'A'
+		}
+		return r
+	}, s)
+}
@@ -0,0 +1,127 @@
+package library
+
+import (
+	"errors"
+	"testing"
+)
+
+// countRows returns the number of rows of table matching where, as seen by q: an open
+// batch holds the only connection of an in-memory library, so it must be asked itself.
+func countRows(t *testing.T, q querier, table, where string, args ...any) int {
+	t.Helper()
+	var n int
+	if err := q.QueryRow("SELECT COUNT(*) FROM "+table+" WHERE "+where, args...).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestWriterBatches(t *testing.T) {
+	db := openTestDB(t)
+	w := db.NewWriter()
+
+	if n, err := w.Commit(); n != 0 || err != nil {
+		t.Errorf("Commit without a batch = %d, %v", n, err)
+	}
+	for _, af := range []AudioFile{
+		{HumanHashID: "battery", FilePath: "/music/battery.flac", Title: "Battery", ArtistName: "Metallica", AlbumArtistName: "Metallica", AlbumTitle: "Master of Puppets", Genres: []string{"Thrash Metal"}},
+		{HumanHashID: "orion", FilePath: "/music/orion.flac", Title: "Orion", ArtistName: "metallica", AlbumArtistName: "Metallica", AlbumTitle: "Master of Puppets", Genres: []string{"thrash metal"}},
+	} {
+		if outcome, err := w.Save(&af); err != nil || outcome != SaveInserted {
+			t.Fatalf("Save(%s) = %v, %v", af.FilePath, outcome, err)
+		}
+	}
+	if w.Pending() != 2 {
+		t.Errorf("Pending = %d, want 2", w.Pending())
+	}
+	if n, err := w.Commit(); n != 2 || err != nil {
+		t.Fatalf("Commit = %d, %v; want 2", n, err)
+	}
+	if w.Pending() != 0 {
+		t.Errorf("Pending after Commit = %d", w.Pending())
+	}
+	// Names differing in case are one artist, album and genre, as NOCASE compares them
+	for table, want := range map[string]int{"audio_files": 2, "artists": 1, "albums": 1, "genres": 1} {
+		if n := countRows(t, db.conn, table, "1"); n != want {
+			t.Errorf("%d %s, want %d", n, table, want)
+		}
+	}
+
+	// A rolled back batch leaves nothing behind, and the next one starts afresh
+	af := AudioFile{HumanHashID: "paranoid", FilePath: "/music/paranoid.flac", Title: "Paranoid", ArtistName: "Black Sabbath", AlbumArtistName: "Black Sabbath", AlbumTitle: "Paranoid"}
+	if _, err := w.Save(&af); err != nil {
+		t.Fatal(err)
+	}
+	w.Rollback()
+	if n := countRows(t, db.conn, "artists", "name = 'Black Sabbath'"); n != 0 {
+		t.Errorf("rolled back artist was saved")
+	}
+	if _, err := w.Save(&af); err != nil {
+		t.Fatalf("Save after Rollback: %v", err)
+	}
+	if n, err := w.Commit(); n != 1 || err != nil {
+		t.Fatalf("Commit after Rollback = %d, %v; want 1", n, err)
+	}
+	if _, err := db.Track("paranoid"); err != nil {
+		t.Errorf("track saved after Rollback: %v", err)
+	}
+}
+
+func TestWriterRollsBackOneBadFile(t *testing.T) {
+	db := openTestDB(t)
+	// Fail the insert of one file, after its artist and album have been written
+	if _, err := db.conn.Exec(`CREATE TEMP TRIGGER fail_bad BEFORE INSERT ON audio_files WHEN new.title = 'bad'
+		BEGIN SELECT RAISE(ABORT, 'bad file'); END`); err != nil {
+		t.Fatal(err)
+	}
+	w := db.NewWriter()
+
+	files := []AudioFile{
+		{HumanHashID: "before", FilePath: "/music/before.mp3", Title: "Before", ArtistName: "Known", AlbumArtistName: "Known", AlbumTitle: "Known Album"},
+		{HumanHashID: "bad", FilePath: "/music/bad.mp3", Title: "bad", ArtistName: "Ghost", AlbumArtistName: "Ghost", AlbumTitle: "Ghost Album", Genres: []string{"Ghost Genre"}},
+		// New rows for the same names must be written again, not taken from the cache
+		{HumanHashID: "after", FilePath: "/music/after.mp3", Title: "After", ArtistName: "Ghost", AlbumArtistName: "Ghost", AlbumTitle: "Ghost Album", Genres: []string{"Ghost Genre"}},
+	}
+	for i := range files {
+		_, err := w.Save(&files[i])
+		if files[i].Title == "bad" {
+			if err == nil {
+				t.Fatalf("Save of the bad file succeeded")
+			}
+			if w.Pending() != 1 {
+				t.Errorf("Pending after the bad file = %d, want 1", w.Pending())
+			}
+			// Only the bad file's own rows are gone
+			if n := countRows(t, w.tx, "artists", "name = 'Ghost'"); n != 0 {
+				t.Errorf("artist of the bad file was kept")
+			}
+			if n := countRows(t, w.tx, "audio_files", "human_hash_id = 'before'"); n != 1 {
+				t.Errorf("file saved before the bad one was lost")
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Save(%s): %v", files[i].FilePath, err)
+		}
+	}
+
+	if n, err := w.Commit(); n != 2 || err != nil {
+		t.Fatalf("Commit = %d, %v; want 2", n, err)
+	}
+	for _, id := range []string{"before", "after"} {
+		track, err := db.Track(id)
+		if err != nil {
+			t.Errorf("Track(%s): %v", id, err)
+			continue
+		}
+		if id == "after" && (track.ArtistName != "Ghost" || track.AlbumTitle != "Ghost Album" || len(track.Genres) != 1 || track.Genres[0] != "Ghost Genre") {
+			t.Errorf("track after the bad file: %+v", track)
+		}
+	}
+	if _, err := db.Track("bad"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Track(bad): %v, want ErrNotFound", err)
+	}
+	if n := countRows(t, db.conn, "artists", "name = 'Ghost'"); n != 1 {
+		t.Errorf("%d artists named Ghost, want 1", n)
+	}
+}
@@ -8,16 +8,31 @@ check_dependency() {
 
 check_dependency
 
+# Set MUSIC_API_KEY to a key from POST /auth/keys when the server requires a login
+curl_auth=() mpv_auth=()
+if [ -n "$MUSIC_API_KEY" ]; then
+    curl_auth=(-H "Authorization: Bearer $MUSIC_API_KEY")
+    mpv_auth=(--http-header-fields="Authorization: Bearer $MUSIC_API_KEY")
+fi
+
 playlist_file=$1
 if [[ -z "$playlist_file" ]]; then
-    echo "Usage: $0 <playlist_file>"
+    echo "Usage: $0 <playlist_file|playlist_id>"
     exit 1
 fi
 
 EXTRA_ARGS=${2:-}
 
-for track in $(cat $playlist_file); do
+# A number is the ID of a playlist on the server, anything else a file of track IDs
+if [[ "$playlist_file" =~ ^[0-9]+$ && ! -e "$playlist_file" ]]; then
+    tracks=$(curl -s "${curl_auth[@]}" "http://127.0.0.1:8080/playlists/$playlist_file" | jq -r '.tracks[]?.id')
+else
+    tracks=$(cat "$playlist_file")
+fi
+
+for track in $tracks; do
     mpv \
+      "${mpv_auth[@]}" \
       $EXTRA_ARGS \
       http://127.0.0.1:8080/stream/$track
 done
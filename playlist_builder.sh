@@ -8,8 +8,27 @@ check_dependency() {
 
 check_dependency
 
+# Set MUSIC_API_KEY to a key from POST /auth/keys when the server requires a login
+curl_auth=()
+if [ -n "$MUSIC_API_KEY" ]; then
+    curl_auth=(-H "Authorization: Bearer $MUSIC_API_KEY")
+fi
+
+# /tracks/all is paginated; print every track as id::title::path, one page at a time
+list_tracks() {
+    local offset=0 limit=500 page count
+    while true; do
+        page=$(curl -s "${curl_auth[@]}" "127.0.0.1:8080/tracks/all?limit=$limit&offset=$offset")
+        echo "$page" | jq -r '.[]? | "\(.id)::\(.title)::\(.file_path)"'
+        count=$(echo "$page" | jq 'length? // 0')
+        [ "$count" -lt "$limit" ] && break
+        offset=$((offset + limit))
+    done
+}
+
 # Run a While loop to continuously prompt for search queries and append that to $1 file as a playlist
 # If user Ctrl+C or Ctrl+D, exit the loop and save the playlist to $1 file
+# If $1 is a number, append to the playlist with that ID on the server instead
 
 echo "Press Ctrl+C or Ctrl+D to exit the loop and save the playlist."
 read -p "Press any key to continue: "
@@ -21,12 +40,17 @@ while true; do
     fi
 
     # Search for tracks and select one using fzf
-    track_id=$(curl "127.0.0.1:8080/tracks/all" |jq -r '.[] | "\(.id)::\(.title)::\(.file_path)"'| fzf | awk -F'::' '{print $1}')
+    track_id=$(list_tracks | fzf | awk -F'::' '{print $1}')
 
     if [ -z "$track_id" ]; then
         echo "No track selected."
         break
     fi
-    # Append the selected track to the playlist file
-    echo $track_id >> "$1"
+    # Append the selected track to the playlist file or server playlist
+    if [[ "$1" =~ ^[0-9]+$ && ! -e "$1" ]]; then
+        curl -s -o /dev/null "${curl_auth[@]}" -X POST "127.0.0.1:8080/playlists/$1/tracks" \
+            -H "Content-Type: application/json" -d "{\"track_ids\": [\"$track_id\"]}"
+    else
+        echo $track_id >> "$1"
+    fi
   done
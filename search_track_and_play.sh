@@ -8,13 +8,26 @@ check_dependency() {
 
 check_dependency
 
-query=$(echo "$1" | sed 's/ /%20/g')
-if [ -z "$query" ]; then
-    echo "Usage: $0 <search_query>"
+# Set MUSIC_API_KEY to a key from POST /auth/keys when the server requires a login
+curl_auth=() mpv_auth=()
+if [ -n "$MUSIC_API_KEY" ]; then
+    curl_auth=(-H "Authorization: Bearer $MUSIC_API_KEY")
+    mpv_auth=(--http-header-fields="Authorization: Bearer $MUSIC_API_KEY")
+fi
+
+if [ -z "$1" ]; then
+    echo "Usage: $0 <search_query> [mpv_args]"
+    echo "Typos are tolerated; set SEARCH_THRESHOLD (0-1, default 0.7) to be stricter or looser."
     exit 1
 fi
+query=$(jq -rn --arg q "$1" '$q|@uri')
+params=""
+if [ -n "$SEARCH_THRESHOLD" ]; then
+    params="?threshold=$SEARCH_THRESHOLD"
+fi
 
-track_id=$(curl "127.0.0.1:8080/search/track/$query" |jq -r '.[] | "\(.id)::\(.title)::\(.file_path)"'| fzf | awk -F'::' '{print $1}')
+# Results come best match first
+track_id=$(curl "${curl_auth[@]}" "127.0.0.1:8080/search/track/$query$params" |jq -r '.[]? | "\(.id)::\(.title)::\(.file_path)"'| fzf | awk -F'::' '{print $1}')
 
 if [ -z "$track_id" ]; then
     echo "No track selected."
@@ -24,6 +37,7 @@ fi
 EXTRA_ARGS="$2"
 
 mpv \
+  "${mpv_auth[@]}" \
   $EXTRA_ARGS \
   http://127.0.0.1:8080/stream/$track_id
 